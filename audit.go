@@ -0,0 +1,222 @@
+package backupstore
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+// BlockAuditReport lists the blocks of a backup which cannot be restored
+type BlockAuditReport struct {
+	BackupURL  string
+	BlockCount int
+	// MissingBlocks and CorruptedBlocks list every mapping referring to a
+	// damaged block, so a block shared by several offsets shows up once
+	// per offset
+	MissingBlocks   []BlockMapping `json:",omitempty"`
+	CorruptedBlocks []BlockMapping `json:",omitempty"`
+	// DamagedRegions are the zero-filled ranges of the best effort restore
+	DamagedRegions []DamagedRegion `json:",omitempty"`
+}
+
+type DamagedRegion struct {
+	Offset int64 `json:",string"`
+	Length int64 `json:",string"`
+}
+
+// fillDamagedRegions merges the offsets of the damaged blocks into ranges
+func (r *BlockAuditReport) fillDamagedRegions(blockSize int64) {
+	blocks := []BlockMapping{}
+	blocks = append(blocks, r.MissingBlocks...)
+	blocks = append(blocks, r.CorruptedBlocks...)
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].Offset < blocks[j].Offset })
+
+	r.DamagedRegions = nil
+	for _, blk := range blocks {
+		length := getBlockLength(blk, blockSize)
+		last := len(r.DamagedRegions) - 1
+		if last >= 0 && r.DamagedRegions[last].Offset+r.DamagedRegions[last].Length == blk.Offset {
+			r.DamagedRegions[last].Length += length
+			continue
+		}
+		r.DamagedRegions = append(r.DamagedRegions, DamagedRegion{blk.Offset, length})
+	}
+}
+
+// Healthy returns true if no damaged block was found
+func (r *BlockAuditReport) Healthy() bool {
+	return len(r.MissingBlocks) == 0 && len(r.CorruptedBlocks) == 0
+}
+
+// BlockAuditError is returned by the restore when the audit finds damaged
+// blocks
+type BlockAuditError struct {
+	Report *BlockAuditReport
+}
+
+func (e *BlockAuditError) Error() string {
+	return fmt.Sprintf("Backup %v has %v missing and %v corrupted blocks out of %v",
+		e.Report.BackupURL, len(e.Report.MissingBlocks), len(e.Report.CorruptedBlocks), e.Report.BlockCount)
+}
+
+type blockState int
+
+const (
+	blockStateHealthy = blockState(iota)
+	blockStateMissing
+	blockStateCorrupted
+)
+
+// AuditBackupBlocks checks all the blocks of a backup exist in the
+// backupstore. If verifyChecksums is set, every block is also read and
+// verified against its checksum, which costs as much as a restore.
+func AuditBackupBlocks(backupURL string, verifyChecksums bool) (*BlockAuditReport, error) {
+	bsDriver, err := GetBackupStoreDriver(backupURL)
+	if err != nil {
+		return nil, err
+	}
+	backupName, volumeName, err := decodeBackupURL(backupURL)
+	if err != nil {
+		return nil, err
+	}
+	// The blocks are decoded one at a time rather than as a whole list
+	blocks, err := loadBackupBlocks(backupName, volumeName, bsDriver)
+	if err != nil {
+		return nil, err
+	}
+	a := newBlockAuditor(backupURL, volumeName, getBackupBlockSize(blocks.backup), bsDriver, verifyChecksums)
+	if err := blocks.forEach(func(blk BlockMapping) error {
+		a.audit(blk)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return a.finish(), nil
+}
+
+func auditBlocks(backupURL, volumeName string, blocks []BlockMapping, blockSize int64, bsDriver BackupStoreDriver,
+	verifyChecksums bool) *BlockAuditReport {
+	a := newBlockAuditor(backupURL, volumeName, blockSize, bsDriver, verifyChecksums)
+	for _, blk := range blocks {
+		a.audit(blk)
+	}
+	return a.finish()
+}
+
+// blockAuditor audits the blocks of a backup one at a time
+type blockAuditor struct {
+	report          *BlockAuditReport
+	volumeName      string
+	blockSize       int64
+	bsDriver        BackupStoreDriver
+	verifyChecksums bool
+	// Each block is only checked once
+	states map[string]blockState
+}
+
+func newBlockAuditor(backupURL, volumeName string, blockSize int64, bsDriver BackupStoreDriver,
+	verifyChecksums bool) *blockAuditor {
+	return &blockAuditor{
+		report:          &BlockAuditReport{BackupURL: backupURL},
+		volumeName:      volumeName,
+		blockSize:       blockSize,
+		bsDriver:        bsDriver,
+		verifyChecksums: verifyChecksums,
+		states:          make(map[string]blockState),
+	}
+}
+
+func (a *blockAuditor) audit(blk BlockMapping) {
+	a.report.BlockCount++
+	state, checked := a.states[blk.BlockChecksum]
+	if !checked {
+		state = auditBlock(a.volumeName, blk, a.blockSize, a.bsDriver, a.verifyChecksums)
+		a.states[blk.BlockChecksum] = state
+	}
+	switch state {
+	case blockStateMissing:
+		a.report.MissingBlocks = append(a.report.MissingBlocks, blk)
+	case blockStateCorrupted:
+		a.report.CorruptedBlocks = append(a.report.CorruptedBlocks, blk)
+	}
+}
+
+func (a *blockAuditor) finish() *BlockAuditReport {
+	report := a.report
+	if !report.Healthy() {
+		log.Warnf("Found %v missing and %v corrupted blocks in backup %v",
+			len(report.MissingBlocks), len(report.CorruptedBlocks), report.BackupURL)
+	}
+	return report
+}
+
+func auditBlock(volumeName string, blk BlockMapping, blockSize int64, bsDriver BackupStoreDriver,
+	verifyChecksum bool) blockState {
+	blkFile := getBlockFilePath(volumeName, blk.BlockChecksum)
+	size := bsDriver.FileSize(blkFile)
+	if size < 0 {
+		return blockStateMissing
+	}
+	// The uncompressed blocks are stored as is, and the size of the
+	// others is recorded since it's been tracked
+	if size == 0 || (blk.Uncompressed && size != getBlockLength(blk, blockSize)) ||
+		(blk.StoredSize > 0 && size != blk.StoredSize) {
+		return blockStateCorrupted
+	}
+	if verifyChecksum {
+		buf := util.GetBuffer()
+		defer util.PutBuffer(buf)
+		if err := readBlock(volumeName, bsDriver, blk, buf); err != nil {
+			log.Debugf("Failed to verify block %v: %v", blkFile, err)
+			return blockStateCorrupted
+		}
+	}
+	return blockStateHealthy
+}
+
+// WhoReferencesBlock returns the URLs of the backups of volumeName whose
+// block lists reference the block of checksum, e.g. to find the backups
+// affected by a corrupted block, or to check a block is unused before
+// removing it by hand
+func WhoReferencesBlock(volumeName, checksum, destURL string) ([]string, error) {
+	if !util.ValidateName(volumeName) {
+		return nil, fmt.Errorf("Invalid volume name %v", volumeName)
+	}
+	if checksum == "" {
+		return nil, fmt.Errorf("Invalid empty block checksum")
+	}
+	bsDriver, err := GetBackupStoreDriver(destURL)
+	if err != nil {
+		return nil, err
+	}
+	if !volumeExists(volumeName, bsDriver) {
+		return nil, fmt.Errorf("Volume %v doesn't exist in backupstore", volumeName)
+	}
+	backupNames, err := getBackupNamesForVolume(volumeName, bsDriver)
+	if err != nil {
+		return nil, err
+	}
+
+	backupURLs := []string{}
+	for _, backupName := range backupNames {
+		blocks, err := loadBackupBlocks(backupName, volumeName, bsDriver)
+		if err != nil {
+			return nil, err
+		}
+		referenced := false
+		if err := blocks.forEach(func(blk BlockMapping) error {
+			if blk.BlockChecksum == checksum {
+				referenced = true
+				return errStopBlockIteration
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+		if referenced {
+			backupURLs = append(backupURLs, encodeBackupURL(backupName, volumeName, destURL))
+		}
+	}
+	return backupURLs, nil
+}
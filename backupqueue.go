@@ -0,0 +1,70 @@
+package backupstore
+
+import (
+	"sync"
+)
+
+// queuedBackup is a backup waiting for the other backups of its volume
+type queuedBackup struct {
+	tracker *backupStatusTracker
+	// start prepares the backup and starts it in background, it must lead
+	// to backupDone once the backup is finished
+	start func()
+}
+
+// backupQueue runs the backups of a volume one at a time, in the order they
+// were requested
+type backupQueue struct {
+	running bool
+	waiting []*queuedBackup
+}
+
+var (
+	backupQueuesLock sync.Mutex
+	backupQueues     = make(map[string]*backupQueue)
+)
+
+// enqueueBackup returns true if no backup of the volume is running or
+// waiting, in which case the caller starts b at once. Otherwise b is queued,
+// its queue position published, and it's started once the backups ahead of
+// it are done.
+func enqueueBackup(driver BackupStoreDriver, volumeName string, b *queuedBackup) bool {
+	key := getVolumeLockKey(driver, volumeName)
+
+	backupQueuesLock.Lock()
+	defer backupQueuesLock.Unlock()
+	q, exists := backupQueues[key]
+	if !exists {
+		q = &backupQueue{}
+		backupQueues[key] = q
+	}
+	if !q.running {
+		q.running = true
+		return true
+	}
+	q.waiting = append(q.waiting, b)
+	b.tracker.queued(len(q.waiting))
+	return false
+}
+
+// backupDone starts the next queued backup of the volume, if any
+func backupDone(driver BackupStoreDriver, volumeName string) {
+	key := getVolumeLockKey(driver, volumeName)
+
+	backupQueuesLock.Lock()
+	defer backupQueuesLock.Unlock()
+	q, exists := backupQueues[key]
+	if !exists {
+		return
+	}
+	if len(q.waiting) == 0 {
+		delete(backupQueues, key)
+		return
+	}
+	next := q.waiting[0]
+	q.waiting = q.waiting[1:]
+	for i, b := range q.waiting {
+		b.tracker.queued(i + 1)
+	}
+	go next.start()
+}
@@ -15,6 +15,35 @@ type Volume struct {
 	LastBackupName string
 	LastBackupAt   string
 	BlockCount     int64 `json:",string"`
+	// BlockSize is the size of the blocks of the volume, decided by its
+	// first backup. It's zero if the volume was backed up by an older
+	// version, which means DEFAULT_BLOCK_SIZE.
+	BlockSize int64 `json:",string,omitempty"`
+	// ChunkingMode is how the volume is split into blocks, decided by its
+	// first backup. It's empty for ChunkingModeFixed if the volume was
+	// backed up by an older version.
+	ChunkingMode ChunkingMode `json:",omitempty"`
+
+	Description string            `json:",omitempty"`
+	Annotations map[string]string `json:",omitempty"`
+	Labels      map[string]string `json:",omitempty"`
+
+	// StoredSize is the size of the stored blocks, the blocks stored by
+	// older versions are not accounted
+	StoredSize int64 `json:",string,omitempty"`
+	// QuotaSize and QuotaBlockCount limit the storage used by the
+	// volume, zero means no limit
+	QuotaSize       int64 `json:",string,omitempty"`
+	QuotaBlockCount int64 `json:",string,omitempty"`
+
+	// Generation is incremented each time the volume is saved, including
+	// when a backup of the volume is created or deleted, so the changes of
+	// the volume can be detected without listing its backups
+	Generation int64 `json:",string,omitempty"`
+
+	// ManifestChecksum is the checksum of the volume metadata, verified
+	// when the volume is loaded if present
+	ManifestChecksum string `json:",omitempty"`
 }
 
 type Snapshot struct {
@@ -30,9 +59,38 @@ type Backup struct {
 	CreatedTime       string
 	Size              int64 `json:",string"`
 	Labels            map[string]string
+	// BlockSize is the size of the blocks of the backup, zero means
+	// DEFAULT_BLOCK_SIZE
+	BlockSize int64 `json:",string,omitempty"`
+	// StoredSize is the size of the distinct blocks of the backup in the
+	// backupstore, which may be shared with other backups
+	StoredSize int64 `json:",string,omitempty"`
+
+	Description string            `json:",omitempty"`
+	Annotations map[string]string `json:",omitempty"`
+	// ExpiresAt is the time in RFC3339 format after which the backup
+	// would be removed by PruneExpiredBackups
+	ExpiresAt string `json:",omitempty"`
+	// Protected backups cannot be deleted until the protection is cleared
+	Protected bool `json:",omitempty"`
+	// ParentBackupName is the backup this backup was built on top of, empty
+	// for a full backup or a backup saved by an older version
+	ParentBackupName string `json:",omitempty"`
+
+	// ManifestChecksum is the checksum of the backup metadata, and
+	// BlocksChecksum the one of the ordered block list. They're verified
+	// when the backup is loaded, if present.
+	ManifestChecksum string `json:",omitempty"`
+	BlocksChecksum   string `json:",omitempty"`
+
+	Blocks []BlockMapping `json:",omitempty"`
+	// BlocksFormat is the format the block list is saved in. Blocks is
+	// only filled once the backup is loaded, if the list is saved in
+	// CompactBlocks.
+	BlocksFormat  int    `json:",omitempty"`
+	CompactBlocks []byte `json:",omitempty"`
 
-	Blocks     []BlockMapping `json:",omitempty"`
-	SingleFile BackupFile     `json:",omitempty"`
+	SingleFile BackupFile `json:",omitempty"`
 }
 
 var (
@@ -76,6 +134,7 @@ func removeVolume(volumeName string, driver BackupStoreDriver) error {
 
 	volumeDir := getVolumePath(volumeName)
 	volumeBlocksDirectory := getBlockPath(volumeName)
+	metaCache.invalidate(driver, volumeDir)
 	if err := driver.Remove(volumeBlocksDirectory); err != nil {
 		return fmt.Errorf("failed to remove all the blocks for volume %v", volumeName)
 	}
@@ -135,3 +194,167 @@ func GetVolumeFromBackupURL(backupURL string) (string, error) {
 	_, volume, err := decodeBackupURL(backupURL)
 	return volume, err
 }
+
+// UpdateBackupLabels merges labels into the labels of an existing backup. A
+// label with an empty value would be removed from the backup.
+func UpdateBackupLabels(backupURL string, labels map[string]string) error {
+	driver, err := GetBackupStoreDriver(backupURL)
+	if err != nil {
+		return err
+	}
+	backupName, volumeName, err := decodeBackupURL(backupURL)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := lockVolume(driver, volumeName, "backup update")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	backup, err := loadBackup(backupName, volumeName, driver)
+	if err != nil {
+		return err
+	}
+
+	backup.Labels, err = mergeStringMap(backup.Labels, labels)
+	if err != nil {
+		return fmt.Errorf("Invalid labels for backup %v: %v", backupName, err)
+	}
+
+	if err := saveBackup(backup, driver); err != nil {
+		return err
+	}
+	log.Debugf("Updated labels of backup %v", backupName)
+	return nil
+}
+
+// UpdateBackupAnnotations replaces the description of a backup if description
+// is not empty, and merges annotations the same way as UpdateBackupLabels.
+func UpdateBackupAnnotations(backupURL, description string, annotations map[string]string) error {
+	driver, err := GetBackupStoreDriver(backupURL)
+	if err != nil {
+		return err
+	}
+	backupName, volumeName, err := decodeBackupURL(backupURL)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := lockVolume(driver, volumeName, "backup update")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	backup, err := loadBackup(backupName, volumeName, driver)
+	if err != nil {
+		return err
+	}
+
+	if description != "" {
+		backup.Description = description
+	}
+	backup.Annotations, err = mergeStringMap(backup.Annotations, annotations)
+	if err != nil {
+		return fmt.Errorf("Invalid annotations for backup %v: %v", backupName, err)
+	}
+
+	if err := saveBackup(backup, driver); err != nil {
+		return err
+	}
+	log.Debugf("Updated annotations of backup %v", backupName)
+	return nil
+}
+
+// UpdateBackupVolumeAnnotations replaces the description of a backup volume
+// if description is not empty, and merges annotations the same way as
+// UpdateBackupLabels.
+func UpdateBackupVolumeAnnotations(volumeName, destURL, description string, annotations map[string]string) error {
+	driver, err := GetBackupStoreDriver(destURL)
+	if err != nil {
+		return err
+	}
+	if !util.ValidateName(volumeName) {
+		return fmt.Errorf("Invalid volume name %v", volumeName)
+	}
+
+	unlock, err := lockVolume(driver, volumeName, "volume update")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	volume, err := loadVolume(volumeName, driver)
+	if err != nil {
+		return err
+	}
+
+	if description != "" {
+		volume.Description = description
+	}
+	volume.Annotations, err = mergeStringMap(volume.Annotations, annotations)
+	if err != nil {
+		return fmt.Errorf("Invalid annotations for volume %v: %v", volumeName, err)
+	}
+
+	if err := saveVolume(volume, driver); err != nil {
+		return err
+	}
+	log.Debugf("Updated annotations of backup volume %v", volumeName)
+	return nil
+}
+
+// UpdateBackupVolumeLabels merges labels into the labels of a backup volume
+// the same way as UpdateBackupLabels
+func UpdateBackupVolumeLabels(volumeName, destURL string, labels map[string]string) error {
+	driver, err := GetBackupStoreDriver(destURL)
+	if err != nil {
+		return err
+	}
+	if !util.ValidateName(volumeName) {
+		return fmt.Errorf("Invalid volume name %v", volumeName)
+	}
+
+	unlock, err := lockVolume(driver, volumeName, "volume update")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	volume, err := loadVolume(volumeName, driver)
+	if err != nil {
+		return err
+	}
+
+	volume.Labels, err = mergeStringMap(volume.Labels, labels)
+	if err != nil {
+		return fmt.Errorf("Invalid labels for volume %v: %v", volumeName, err)
+	}
+
+	if err := saveVolume(volume, driver); err != nil {
+		return err
+	}
+	log.Debugf("Updated labels of backup volume %v", volumeName)
+	return nil
+}
+
+// mergeStringMap merges src into dst and returns the result. Keys with empty
+// values in src are removed from dst.
+func mergeStringMap(dst, src map[string]string) (map[string]string, error) {
+	if dst == nil {
+		dst = make(map[string]string)
+	}
+	for key, value := range src {
+		if key == "" {
+			return nil, fmt.Errorf("empty key")
+		}
+		if value == "" {
+			delete(dst, key)
+			continue
+		}
+		dst[key] = value
+	}
+	return dst, nil
+}
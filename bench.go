@@ -0,0 +1,253 @@
+package backupstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+const (
+	BENCH_DIRECTORY = "bench"
+
+	DEFAULT_BENCH_OBJECTS = 100
+)
+
+type BenchPhase string
+
+const (
+	BenchPhaseWrite  = BenchPhase("write")
+	BenchPhaseRead   = BenchPhase("read")
+	BenchPhaseDelete = BenchPhase("delete")
+)
+
+type BenchConfig struct {
+	DestURL string
+	// Objects is the number of objects written, read and deleted,
+	// DEFAULT_BENCH_OBJECTS if not set
+	Objects int
+	// ObjectSize is the size of the objects, DEFAULT_BLOCK_SIZE if not set
+	ObjectSize int64
+	// Concurrency is the number of operations run in parallel, 1 if not
+	// set
+	Concurrency int
+}
+
+// BenchPhaseResult is the result of the operations of a phase of a
+// benchmark
+type BenchPhaseResult struct {
+	Phase      BenchPhase
+	Operations int
+	Errors     int
+	// ErrorRate is the ratio of the failed operations
+	ErrorRate float64
+	// FirstError is the error of the first failed operation
+	FirstError string `json:",omitempty"`
+
+	Duration time.Duration
+	// Bytes is the size of the objects written or read successfully, and
+	// Throughput the rate in bytes per second
+	Bytes               int64 `json:",string"`
+	Throughput          int64 `json:",string"`
+	OperationsPerSecond float64
+
+	// The latency percentiles of the successful operations
+	LatencyP50 time.Duration
+	LatencyP90 time.Duration
+	LatencyP99 time.Duration
+	LatencyMax time.Duration
+}
+
+// BenchReport is the result of a benchmark of a backupstore
+type BenchReport struct {
+	URL         string
+	Objects     int
+	ObjectSize  int64 `json:",string"`
+	Concurrency int
+	Phases      []*BenchPhaseResult
+}
+
+// BenchmarkBackupStore writes, reads back and deletes synthetic objects of
+// the size of the blocks to the backupstore of config, and reports the
+// performance of each phase. The objects are written under a directory of
+// their own, which is removed once done, so the backups are not affected.
+func BenchmarkBackupStore(ctx context.Context, config *BenchConfig) (*BenchReport, error) {
+	if config == nil {
+		return nil, fmt.Errorf("Invalid empty config for benchmark")
+	}
+	c := *config
+	if c.Objects == 0 {
+		c.Objects = DEFAULT_BENCH_OBJECTS
+	}
+	if c.ObjectSize == 0 {
+		c.ObjectSize = DEFAULT_BLOCK_SIZE
+	}
+	if c.Concurrency == 0 {
+		c.Concurrency = 1
+	}
+	if c.Objects < 0 || c.ObjectSize < 0 || c.Concurrency < 0 {
+		return nil, fmt.Errorf("Invalid benchmark of %v objects of %v bytes with concurrency %v",
+			c.Objects, c.ObjectSize, c.Concurrency)
+	}
+
+	driver, err := GetBackupStoreDriver(c.DestURL)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(backupstoreBase, BENCH_DIRECTORY, util.GenerateName("bench"))
+	defer func() {
+		if err := driver.Remove(dir); err != nil {
+			log.WithError(err).Warnf("Failed to remove benchmark objects %v", dir)
+		}
+	}()
+
+	// The content is random, so it cannot be compressed or deduplicated
+	// by the target
+	data := make([]byte, c.ObjectSize)
+	rand.Read(data)
+	getObjectPath := func(i int) string {
+		return filepath.Join(dir, "object-"+strconv.Itoa(i)+BLK_SUFFIX)
+	}
+
+	report := &BenchReport{
+		URL:         driver.GetURL(),
+		Objects:     c.Objects,
+		ObjectSize:  c.ObjectSize,
+		Concurrency: c.Concurrency,
+	}
+	phases := []struct {
+		phase BenchPhase
+		fn    func(i int) (int64, error)
+	}{
+		{BenchPhaseWrite, func(i int) (int64, error) {
+			if err := driver.Write(getObjectPath(i), bytes.NewReader(data)); err != nil {
+				return 0, err
+			}
+			return c.ObjectSize, nil
+		}},
+		{BenchPhaseRead, func(i int) (int64, error) {
+			return readBenchObject(driver, getObjectPath(i), c.ObjectSize)
+		}},
+		{BenchPhaseDelete, func(i int) (int64, error) {
+			return 0, driver.Remove(getObjectPath(i))
+		}},
+	}
+	for _, p := range phases {
+		result, err := runBenchPhase(ctx, p.phase, c.Objects, c.Concurrency, p.fn)
+		if err != nil {
+			return nil, err
+		}
+		log.Debugf("Benchmark phase %v of %v completed in %v with %v errors",
+			p.phase, report.URL, result.Duration, result.Errors)
+		report.Phases = append(report.Phases, result)
+	}
+	return report, nil
+}
+
+func readBenchObject(driver BackupStoreDriver, path string, size int64) (int64, error) {
+	rc, err := driver.Read(path)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	n, err := io.Copy(ioutil.Discard, rc)
+	if err != nil {
+		return 0, err
+	}
+	if n != size {
+		return 0, fmt.Errorf("Read %v bytes of %v, expected %v", n, path, size)
+	}
+	return n, nil
+}
+
+// runBenchPhase calls fn for each of the objects with concurrency workers,
+// fn returning the number of bytes transferred
+func runBenchPhase(ctx context.Context, phase BenchPhase, objects, concurrency int,
+	fn func(i int) (int64, error)) (*BenchPhaseResult, error) {
+	result := &BenchPhaseResult{
+		Phase:      phase,
+		Operations: objects,
+	}
+	var lock sync.Mutex
+	latencies := []time.Duration{}
+
+	indexes := make(chan int)
+	wg := sync.WaitGroup{}
+	start := time.Now()
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				opStart := time.Now()
+				n, err := fn(i)
+				latency := time.Since(opStart)
+
+				lock.Lock()
+				if err != nil {
+					if result.Errors == 0 {
+						result.FirstError = err.Error()
+					}
+					result.Errors++
+				} else {
+					result.Bytes += n
+					latencies = append(latencies, latency)
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+	var err error
+queue:
+	for i := 0; i < objects; i++ {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+			err = ctx.Err()
+			break queue
+		}
+	}
+	close(indexes)
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+
+	result.Duration = time.Since(start)
+	if objects != 0 {
+		result.ErrorRate = float64(result.Errors) / float64(objects)
+	}
+	if seconds := result.Duration.Seconds(); seconds > 0 {
+		result.Throughput = int64(float64(result.Bytes) / seconds)
+		result.OperationsPerSecond = float64(objects-result.Errors) / seconds
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	result.LatencyP50 = getLatencyPercentile(latencies, 50)
+	result.LatencyP90 = getLatencyPercentile(latencies, 90)
+	result.LatencyP99 = getLatencyPercentile(latencies, 99)
+	result.LatencyMax = getLatencyPercentile(latencies, 100)
+	return result, nil
+}
+
+// getLatencyPercentile returns the percentile p of the sorted latencies, by
+// the nearest rank
+func getLatencyPercentile(latencies []time.Duration, p float64) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(latencies))))
+	if rank < 1 {
+		rank = 1
+	}
+	return latencies[rank-1]
+}
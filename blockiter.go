@@ -0,0 +1,194 @@
+package backupstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// errStopBlockIteration stops backupBlocks.forEach without error
+var errStopBlockIteration = fmt.Errorf("stop block iteration")
+
+// skippedJSON skips a JSON value without decoding it
+type skippedJSON struct{}
+
+func (*skippedJSON) UnmarshalJSON([]byte) error {
+	return nil
+}
+
+// backupBlocks iterates over the blocks of a backup, decoding them one at a
+// time instead of decoding the whole block list at once
+type backupBlocks struct {
+	// backup is the backup loaded without its block list
+	backup   *Backup
+	filePath string
+	driver   BackupStoreDriver
+	// data is the whole content of the backup config, which the manifest
+	// checksum is verified against
+	data []byte
+}
+
+// loadBackupBlocks loads the backup config for iterating over its blocks.
+// The manifest checksum is verified at once, the blocks checksum once the
+// blocks are iterated.
+func loadBackupBlocks(backupName, volumeName string, driver BackupStoreDriver) (*backupBlocks, error) {
+	filePath := getBackupConfigPath(backupName, volumeName)
+	data, err := loadConfigDataInBackupStore(filePath, driver)
+	if err != nil {
+		return nil, err
+	}
+	header := struct {
+		*Backup
+		Blocks skippedJSON
+	}{Backup: &Backup{}}
+	if err := unmarshalConfig(filePath, driver, data, &header); err != nil {
+		return nil, err
+	}
+	backup := header.Backup
+	if !isBlocksFormatSupported(backup) {
+		return nil, fmt.Errorf("Unsupported block list format %v of backup %v, it may be saved by a newer version",
+			backup.BlocksFormat, backupName)
+	}
+	if backup.ManifestChecksum != "" {
+		if err := verifyManifestChecksum(data); err != nil {
+			return nil, newMetadataCorruptedError(filePath, driver, err)
+		}
+	}
+	return &backupBlocks{
+		backup:   backup,
+		filePath: filePath,
+		driver:   driver,
+		data:     data,
+	}, nil
+}
+
+// forEach calls fn with every block in order. If fn returns
+// errStopBlockIteration, the iteration stops without error, and the blocks
+// checksum is not verified. Otherwise the blocks checksum is verified once
+// all the blocks are iterated, so fn shouldn't act on the blocks until
+// forEach succeeds.
+func (b *backupBlocks) forEach(fn func(blk BlockMapping) error) error {
+	c := newBlocksChecksum()
+	visit := func(blk BlockMapping) error {
+		c.add(blk)
+		return fn(blk)
+	}
+
+	var err error
+	if b.backup.BlocksFormat == BLOCKS_FORMAT_COMPACT {
+		err = forEachCompactBlock(b.backup.CompactBlocks, visit)
+	} else {
+		err = forEachListedBlock(b.data, visit)
+	}
+	if err == errStopBlockIteration {
+		return nil
+	}
+	if err != nil {
+		if _, ok := err.(*blockDecodeError); ok {
+			return newMetadataCorruptedError(b.filePath, b.driver, err)
+		}
+		return err
+	}
+
+	if b.backup.BlocksChecksum != "" && c.sum() != b.backup.BlocksChecksum {
+		return newMetadataCorruptedError(b.filePath, b.driver,
+			fmt.Errorf("blocks checksum %v doesn't match %v", c.sum(), b.backup.BlocksChecksum))
+	}
+	return nil
+}
+
+// blockDecodeError tells the errors of decoding the block list from the
+// ones of the iteration function
+type blockDecodeError struct {
+	err error
+}
+
+func (e *blockDecodeError) Error() string {
+	return e.err.Error()
+}
+
+func forEachCompactBlock(data []byte, fn func(blk BlockMapping) error) error {
+	d, err := newBlockDecoder(data)
+	if err != nil {
+		return &blockDecodeError{err}
+	}
+	for {
+		blk, ok, err := d.next()
+		if err != nil {
+			return &blockDecodeError{err}
+		}
+		if !ok {
+			return nil
+		}
+		if err := fn(blk); err != nil {
+			return err
+		}
+	}
+}
+
+// forEachListedBlock decodes the blocks listed in the Blocks field of the
+// backup config data one at a time
+func forEachListedBlock(data []byte, fn func(blk BlockMapping) error) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := d.Token(); err != nil || tok != json.Delim('{') {
+		return &blockDecodeError{fmt.Errorf("invalid backup config")}
+	}
+	for d.More() {
+		tok, err := d.Token()
+		if err != nil {
+			return &blockDecodeError{err}
+		}
+		if key, _ := tok.(string); key != "Blocks" {
+			var value skippedJSON
+			if err := d.Decode(&value); err != nil {
+				return &blockDecodeError{err}
+			}
+			continue
+		}
+
+		tok, err = d.Token()
+		if err != nil {
+			return &blockDecodeError{err}
+		}
+		if tok == nil {
+			continue
+		}
+		if tok != json.Delim('[') {
+			return &blockDecodeError{fmt.Errorf("invalid block list")}
+		}
+		for d.More() {
+			var blk BlockMapping
+			if err := d.Decode(&blk); err != nil {
+				return &blockDecodeError{err}
+			}
+			if err := fn(blk); err != nil {
+				return err
+			}
+		}
+		if _, err := d.Token(); err != nil {
+			return &blockDecodeError{err}
+		}
+	}
+	return nil
+}
+
+// ForEachBackupBlock calls fn with every block of a backup in order,
+// decoding the block list as it goes rather than at once. The backup config
+// is still read in memory as a whole. The blocks checksum of the backup is
+// only verified once all the blocks are iterated, so the error returned
+// should be checked before acting on the blocks seen.
+func ForEachBackupBlock(backupURL string, fn func(blk BlockMapping) error) error {
+	driver, err := GetBackupStoreDriver(backupURL)
+	if err != nil {
+		return err
+	}
+	backupName, volumeName, err := decodeBackupURL(backupURL)
+	if err != nil {
+		return err
+	}
+	blocks, err := loadBackupBlocks(backupName, volumeName, driver)
+	if err != nil {
+		return err
+	}
+	return blocks.forEach(fn)
+}
@@ -0,0 +1,243 @@
+package backupstore
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+const (
+	// BLOCKS_FORMAT_LIST is the block list stored as a JSON list in Blocks
+	BLOCKS_FORMAT_LIST = 0
+	// BLOCKS_FORMAT_COMPACT is the block list stored in CompactBlocks.
+	// The blocks are encoded one after another, each as its offset delta
+	// from the previous block, its flags, length and stored size as
+	// varints, then its checksum as binary.
+	BLOCKS_FORMAT_COMPACT = 1
+
+	blockFlagUncompressed = 1 << 0
+
+	blockChecksumSize = util.PreservedChecksumLength / 2
+
+	// compactBlocksMarker is saved in place of Blocks once the block list
+	// is in CompactBlocks
+	compactBlocksMarker = "compact"
+)
+
+var (
+	compactBlocksLock sync.RWMutex
+	compactBlocks     = false
+)
+
+// SetCompactBlockList sets whether the block lists of the backups are
+// saved in the compact format, which is disabled by default. Only the
+// versions supporting the format can read such backups, the older ones fail
+// to decode them, so it should only be enabled once no older version
+// accesses the backupstore.
+func SetCompactBlockList(enabled bool) {
+	compactBlocksLock.Lock()
+	defer compactBlocksLock.Unlock()
+	compactBlocks = enabled
+}
+
+func isCompactBlockListEnabled() bool {
+	compactBlocksLock.RLock()
+	defer compactBlocksLock.RUnlock()
+	return compactBlocks
+}
+
+// encodeBlocks encodes blocks in BLOCKS_FORMAT_COMPACT
+func encodeBlocks(blocks []BlockMapping) ([]byte, error) {
+	// Most blocks take the checksum and a few bytes
+	data := make([]byte, 0, len(blocks)*(blockChecksumSize+8)+binary.MaxVarintLen64)
+	var tmp [binary.MaxVarintLen64]byte
+	putUvarint := func(v uint64) {
+		data = append(data, tmp[:binary.PutUvarint(tmp[:], v)]...)
+	}
+
+	putUvarint(uint64(len(blocks)))
+	prevOffset := int64(0)
+	for _, blk := range blocks {
+		checksum, err := hex.DecodeString(blk.BlockChecksum)
+		if err != nil || len(checksum) != blockChecksumSize {
+			return nil, fmt.Errorf("Invalid checksum %v of block at offset %v", blk.BlockChecksum, blk.Offset)
+		}
+		if blk.Length < 0 || blk.StoredSize < 0 {
+			return nil, fmt.Errorf("Invalid length of block at offset %v", blk.Offset)
+		}
+
+		data = append(data, tmp[:binary.PutVarint(tmp[:], blk.Offset-prevOffset)]...)
+		prevOffset = blk.Offset
+		flags := byte(0)
+		if blk.Uncompressed {
+			flags |= blockFlagUncompressed
+		}
+		data = append(data, flags)
+		putUvarint(uint64(blk.Length))
+		putUvarint(uint64(blk.StoredSize))
+		data = append(data, checksum...)
+	}
+	return data, nil
+}
+
+// blockDecoder decodes the blocks encoded by encodeBlocks one at a time
+type blockDecoder struct {
+	data      []byte
+	pos       int
+	remaining uint64
+	offset    int64
+}
+
+func newBlockDecoder(data []byte) (*blockDecoder, error) {
+	d := &blockDecoder{data: data}
+	count, err := d.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	// Every block takes at least its checksum, so don't trust a count
+	// the data cannot hold
+	if count > uint64(len(data)/blockChecksumSize) {
+		return nil, fmt.Errorf("invalid block count %v", count)
+	}
+	d.remaining = count
+	return d, nil
+}
+
+func (d *blockDecoder) readUvarint() (uint64, error) {
+	v, n := binary.Uvarint(d.data[d.pos:])
+	if n <= 0 {
+		return 0, fmt.Errorf("truncated block list at %v", d.pos)
+	}
+	d.pos += n
+	return v, nil
+}
+
+// count returns the number of blocks left
+func (d *blockDecoder) count() uint64 {
+	return d.remaining
+}
+
+// next decodes the next block. It returns false once all the blocks are
+// decoded.
+func (d *blockDecoder) next() (BlockMapping, bool, error) {
+	if d.remaining == 0 {
+		if d.pos != len(d.data) {
+			return BlockMapping{}, false, fmt.Errorf("unexpected data after the blocks at %v", d.pos)
+		}
+		return BlockMapping{}, false, nil
+	}
+
+	delta, n := binary.Varint(d.data[d.pos:])
+	if n <= 0 || d.pos+n >= len(d.data) {
+		return BlockMapping{}, false, fmt.Errorf("truncated block list at %v", d.pos)
+	}
+	d.pos += n
+	d.offset += delta
+	flags := d.data[d.pos]
+	d.pos++
+	length, err := d.readUvarint()
+	if err != nil {
+		return BlockMapping{}, false, err
+	}
+	storedSize, err := d.readUvarint()
+	if err != nil {
+		return BlockMapping{}, false, err
+	}
+	if len(d.data)-d.pos < blockChecksumSize {
+		return BlockMapping{}, false, fmt.Errorf("truncated block list at %v", d.pos)
+	}
+	blk := BlockMapping{
+		Offset:        d.offset,
+		BlockChecksum: hex.EncodeToString(d.data[d.pos : d.pos+blockChecksumSize]),
+		Uncompressed:  flags&blockFlagUncompressed != 0,
+		Length:        int64(length),
+		StoredSize:    int64(storedSize),
+	}
+	d.pos += blockChecksumSize
+	d.remaining--
+	return blk, true, nil
+}
+
+// decodeBlocks decodes the blocks encoded by encodeBlocks
+func decodeBlocks(data []byte) ([]BlockMapping, error) {
+	d, err := newBlockDecoder(data)
+	if err != nil {
+		return nil, err
+	}
+	blocks := make([]BlockMapping, 0, d.count())
+	for {
+		blk, ok, err := d.next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return blocks, nil
+		}
+		blocks = append(blocks, blk)
+	}
+}
+
+// storedBackup is a backup as it's saved. Blocks is either the block list,
+// or compactBlocksMarker if the list is in CompactBlocks, so the versions
+// not supporting the compact format fail to decode the backup instead of
+// finding no block in it.
+type storedBackup struct {
+	*Backup
+	Blocks interface{} `json:",omitempty"`
+}
+
+// getStoredBackup returns backup as it should be saved, with its block list
+// in the compact format if enabled. The blocks whose checksums cannot be
+// encoded, if any, are kept in a list.
+func getStoredBackup(backup *Backup) *storedBackup {
+	b := *backup
+	b.Blocks = nil
+	b.BlocksFormat = BLOCKS_FORMAT_LIST
+	b.CompactBlocks = nil
+	stored := &storedBackup{Backup: &b}
+	if len(backup.Blocks) == 0 {
+		return stored
+	}
+	stored.Blocks = backup.Blocks
+	if !isCompactBlockListEnabled() {
+		return stored
+	}
+	data, err := encodeBlocks(backup.Blocks)
+	if err != nil {
+		log.WithError(err).Warnf("Saving the block list of backup %v as a list", backup.Name)
+		return stored
+	}
+	stored.Blocks = compactBlocksMarker
+	b.BlocksFormat = BLOCKS_FORMAT_COMPACT
+	b.CompactBlocks = data
+	return stored
+}
+
+// isBlocksFormatSupported returns true if the block list of a loaded
+// backup can be decoded by this version
+func isBlocksFormatSupported(backup *Backup) bool {
+	return backup.BlocksFormat == BLOCKS_FORMAT_LIST || backup.BlocksFormat == BLOCKS_FORMAT_COMPACT
+}
+
+// decodeBackupBlocks fills the block list of a loaded backup from its
+// stored format, listed being the value of Blocks in the config
+func decodeBackupBlocks(backup *Backup, listed json.RawMessage) error {
+	if backup.BlocksFormat != BLOCKS_FORMAT_COMPACT {
+		if len(listed) == 0 {
+			return nil
+		}
+		return json.Unmarshal(listed, &backup.Blocks)
+	}
+	blocks, err := decodeBlocks(backup.CompactBlocks)
+	if err != nil {
+		return err
+	}
+	backup.Blocks = blocks
+	backup.BlocksFormat = BLOCKS_FORMAT_LIST
+	backup.CompactBlocks = nil
+	return nil
+}
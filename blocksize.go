@@ -0,0 +1,81 @@
+package backupstore
+
+import (
+	"fmt"
+)
+
+const (
+	// BLOCK_SIZE_ALIGNMENT is the alignment required for block sizes
+	BLOCK_SIZE_ALIGNMENT = 4096
+)
+
+// BlockSizeMismatchError is returned when the block size used to back up or
+// restore a volume doesn't match the one recorded for it. Mixing block sizes
+// within a volume would merge blocks of different ranges.
+type BlockSizeMismatchError struct {
+	VolumeName string
+	Expected   int64
+	Actual     int64
+}
+
+func (e *BlockSizeMismatchError) Error() string {
+	return fmt.Sprintf("Block size %v doesn't match block size %v of volume %v",
+		e.Actual, e.Expected, e.VolumeName)
+}
+
+func validateBlockSize(blockSize int64) error {
+	if blockSize <= 0 || blockSize%BLOCK_SIZE_ALIGNMENT != 0 {
+		return fmt.Errorf("Invalid block size %v, it must be a positive multiple of %v",
+			blockSize, BLOCK_SIZE_ALIGNMENT)
+	}
+	return nil
+}
+
+// getVolumeBlockSize returns the block size of the volume. It's not recorded
+// for the volumes backed up by older versions, which used DEFAULT_BLOCK_SIZE.
+func getVolumeBlockSize(volume *Volume) int64 {
+	if volume.BlockSize != 0 {
+		return volume.BlockSize
+	}
+	return DEFAULT_BLOCK_SIZE
+}
+
+// getBackupBlockSize returns the block size of the backup the same way as
+// getVolumeBlockSize
+func getBackupBlockSize(backup *Backup) int64 {
+	if backup.BlockSize != 0 {
+		return backup.BlockSize
+	}
+	return DEFAULT_BLOCK_SIZE
+}
+
+// checkVolumeBlockSize verifies blockSize can be used to back up volume. The
+// first backup of a volume decides its block size.
+func checkVolumeBlockSize(volume *Volume, blockSize int64) error {
+	if err := validateBlockSize(blockSize); err != nil {
+		return err
+	}
+	if volume.BlockSize == 0 && volume.LastBackupName == "" {
+		return nil
+	}
+	if expected := getVolumeBlockSize(volume); blockSize != expected {
+		return &BlockSizeMismatchError{
+			VolumeName: volume.Name,
+			Expected:   expected,
+			Actual:     blockSize,
+		}
+	}
+	return nil
+}
+
+// checkBackupBlockSize verifies backup was made with the block size of volume
+func checkBackupBlockSize(volume *Volume, backup *Backup) error {
+	if expected, actual := getVolumeBlockSize(volume), getBackupBlockSize(backup); actual != expected {
+		return &BlockSizeMismatchError{
+			VolumeName: volume.Name,
+			Expected:   expected,
+			Actual:     actual,
+		}
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package backupstore
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type CatalogFormat string
+
+const (
+	CatalogFormatJSON = CatalogFormat("json")
+	CatalogFormatCSV  = CatalogFormat("csv")
+)
+
+// Catalog is the inventory of all the volumes and backups of a backupstore
+type Catalog struct {
+	URL string
+	// ExportedAt is the time the catalog was exported in RFC3339 format
+	ExportedAt string
+	// Volumes are sorted by name. The volumes which cannot be loaded are
+	// listed with an error message.
+	Volumes []*VolumeInfo
+	// Errors maps the URLs of the backups which cannot be loaded to the
+	// error
+	Errors map[string]string `json:",omitempty"`
+}
+
+// catalogCSVHeader lists the columns of the CSV export, which has a row per
+// backup, and a row for each volume without backup
+var catalogCSVHeader = []string{
+	"Volume", "VolumeSize", "VolumeCreated", "VolumeLabels", "VolumeStoredSize",
+	"Backup", "URL", "ParentBackup", "SnapshotName", "SnapshotCreated", "Created",
+	"Size", "StoredSize", "Labels", "ExpiresAt", "Protected", "Error",
+}
+
+// ExportCatalog returns the inventory of every volume and backup of destURL.
+// The block lists of the backups are not decoded. The volumes and backups
+// which cannot be loaded are reported in the catalog rather than failing
+// the export.
+func ExportCatalog(destURL string) (*Catalog, error) {
+	driver, err := GetBackupStoreDriver(destURL)
+	if err != nil {
+		return nil, err
+	}
+	volumeNames, err := getVolumeNames(driver)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(volumeNames)
+
+	catalog := &Catalog{
+		URL:        driver.GetURL(),
+		ExportedAt: time.Now().UTC().Format(time.RFC3339),
+		Volumes:    []*VolumeInfo{},
+		Errors:     make(map[string]string),
+	}
+	for _, volumeName := range volumeNames {
+		volumeInfo, err := addCatalogVolume(catalog, volumeName, driver)
+		if err != nil {
+			return nil, err
+		}
+		catalog.Volumes = append(catalog.Volumes, volumeInfo)
+	}
+	return catalog, nil
+}
+
+func addCatalogVolume(catalog *Catalog, volumeName string, driver BackupStoreDriver) (*VolumeInfo, error) {
+	backupNames, err := getBackupNamesForVolume(volumeName, driver)
+	if err != nil {
+		return nil, err
+	}
+	volume, err := loadVolume(volumeName, driver)
+	if err != nil {
+		return &VolumeInfo{
+			Name:     volumeName,
+			Messages: map[MessageType]string{MessageTypeError: err.Error()},
+			Backups:  make(map[string]*BackupInfo),
+		}, nil
+	}
+
+	volumeInfo := fillVolumeInfo(volume)
+	for _, backupName := range backupNames {
+		// Only the header of the backup is decoded
+		blocks, err := loadBackupBlocks(backupName, volumeName, driver)
+		if err != nil {
+			catalog.Errors[encodeBackupURL(backupName, volumeName, catalog.URL)] = err.Error()
+			continue
+		}
+		info := fillBackupInfo(blocks.backup, catalog.URL)
+		volumeInfo.Backups[info.URL] = info
+	}
+	return volumeInfo, nil
+}
+
+// Write writes the catalog to w in format
+func (c *Catalog) Write(w io.Writer, format CatalogFormat) error {
+	switch format {
+	case CatalogFormatJSON:
+		data, err := json.MarshalIndent(c, "", "\t")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(data, '\n'))
+		return err
+	case CatalogFormatCSV:
+		return c.writeCSV(w)
+	}
+	return fmt.Errorf("Unsupported catalog format %v", format)
+}
+
+func (c *Catalog) writeCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(catalogCSVHeader); err != nil {
+		return err
+	}
+	for _, v := range c.Volumes {
+		volumeColumns := []string{
+			v.Name, strconv.FormatInt(v.Size, 10), v.Created, formatCatalogLabels(v.Labels),
+			strconv.FormatInt(v.StoredSize, 10),
+		}
+		backups := getSortedBackupInfos(v.Backups)
+		if len(backups) == 0 {
+			row := append(volumeColumns, make([]string, len(catalogCSVHeader)-len(volumeColumns))...)
+			row[len(row)-1] = v.Messages[MessageTypeError]
+			if err := cw.Write(row); err != nil {
+				return err
+			}
+		}
+		for _, b := range backups {
+			row := append(volumeColumns[:len(volumeColumns):len(volumeColumns)],
+				b.Name, b.URL, b.ParentBackupName, b.SnapshotName, b.SnapshotCreated, b.Created,
+				strconv.FormatInt(b.Size, 10), strconv.FormatInt(b.StoredSize, 10), formatCatalogLabels(b.Labels),
+				b.ExpiresAt, strconv.FormatBool(b.Protected), "")
+			if err := cw.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The backups which cannot be loaded only have their URL
+	urls := []string{}
+	for url := range c.Errors {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+	for _, url := range urls {
+		row := make([]string, len(catalogCSVHeader))
+		if backupName, volumeName, err := decodeBackupURL(url); err == nil {
+			row[0] = volumeName
+			row[5] = backupName
+		}
+		row[6] = url
+		row[len(row)-1] = c.Errors[url]
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// getSortedBackupInfos returns the backups of a volume sorted by creation
+// time, with the parents before the backups built on top of them
+func getSortedBackupInfos(backups map[string]*BackupInfo) []*BackupInfo {
+	infos := []*BackupInfo{}
+	byName := make(map[string]*BackupInfo)
+	for _, info := range backups {
+		infos = append(infos, info)
+		byName[info.Name] = info
+	}
+	// The creation time has a resolution of a second, so the backups
+	// created within the same second are ordered by their depth in the
+	// chain
+	depths := make(map[string]int)
+	for _, info := range infos {
+		depth := 0
+		parent := byName[info.ParentBackupName]
+		// Bounded in case the chain of corrupted metadata loops
+		for parent != nil && depth < len(infos) {
+			depth++
+			parent = byName[parent.ParentBackupName]
+		}
+		depths[info.Name] = depth
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Created != infos[j].Created {
+			return infos[i].Created < infos[j].Created
+		}
+		if depths[infos[i].Name] != depths[infos[j].Name] {
+			return depths[infos[i].Name] < depths[infos[j].Name]
+		}
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+// formatCatalogLabels formats labels as key=value pairs separated by
+// semicolons, sorted by key
+func formatCatalogLabels(labels map[string]string) string {
+	pairs := []string{}
+	for key, value := range labels {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ";")
+}
@@ -0,0 +1,137 @@
+package backupstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+// ChunkingMode is how a volume is split into blocks
+type ChunkingMode string
+
+const (
+	// ChunkingModeFixed splits the volume into blocks of the block size at
+	// fixed offsets, it's the default
+	ChunkingModeFixed = ChunkingMode("fixed")
+	// ChunkingModeCDC splits the changed ranges of the volume into blocks
+	// of variable sizes, around the block size on average, at boundaries
+	// decided by their content. The blocks are still deduplicated after
+	// the data is shifted within the volume, at the cost of more reading
+	// and hashing on each backup.
+	ChunkingModeCDC = ChunkingMode("cdc")
+)
+
+// getVolumeChunkingMode returns the chunking mode to back up volume with,
+// mode being the one requested if any. The first backup of a volume decides
+// its mode.
+func getVolumeChunkingMode(volume *Volume, mode ChunkingMode) (ChunkingMode, error) {
+	switch mode {
+	case "", ChunkingModeFixed, ChunkingModeCDC:
+	default:
+		return "", fmt.Errorf("Invalid chunking mode %v", mode)
+	}
+
+	current := volume.ChunkingMode
+	if current == "" {
+		if volume.LastBackupName == "" {
+			if mode == "" {
+				return ChunkingModeFixed, nil
+			}
+			return mode, nil
+		}
+		// The mode isn't recorded for the volumes backed up by older
+		// versions
+		current = ChunkingModeFixed
+	}
+	if mode != "" && mode != current {
+		return "", fmt.Errorf("Volume %v uses chunking mode %v, cannot back it up with chunking mode %v",
+			volume.Name, current, mode)
+	}
+	return current, nil
+}
+
+// getChunkRanges returns the ranges of the snapshot to chunk for the changes
+// in delta. The changed ranges are extended to the boundaries of the blocks
+// of lastBackup they overlap, so every block of lastBackup is either fully
+// replaced or kept, then the adjacent ranges are merged.
+func getChunkRanges(delta *Mappings, lastBackup *Backup) *Mappings {
+	ranges := &Mappings{
+		Mappings:  []Mapping{},
+		BlockSize: delta.BlockSize,
+	}
+	var blocks []BlockMapping
+	if lastBackup != nil {
+		blocks = lastBackup.Blocks
+	}
+
+	l := 0
+	for _, d := range delta.Mappings {
+		start, end := d.Offset, d.Offset+d.Size
+		for l < len(blocks) && blocks[l].Offset+getBlockLength(blocks[l], delta.BlockSize) <= start {
+			l++
+		}
+		if l < len(blocks) && blocks[l].Offset < start {
+			start = blocks[l].Offset
+		}
+		for k := l; k < len(blocks) && blocks[k].Offset < end; k++ {
+			if blkEnd := blocks[k].Offset + getBlockLength(blocks[k], delta.BlockSize); blkEnd > end {
+				end = blkEnd
+			}
+		}
+
+		if last := len(ranges.Mappings) - 1; last >= 0 && ranges.Mappings[last].Offset+ranges.Mappings[last].Size >= start {
+			if end > ranges.Mappings[last].Offset+ranges.Mappings[last].Size {
+				ranges.Mappings[last].Size = end - ranges.Mappings[last].Offset
+			}
+			continue
+		}
+		ranges.Mappings = append(ranges.Mappings, Mapping{
+			Offset: start,
+			Size:   end - start,
+		})
+	}
+	return ranges
+}
+
+// forEachChunk splits the ranges of the snapshot into content-defined chunks
+// and calls fn on each of them in order, along with the index of its range.
+// The chunk data is only valid during the call.
+func forEachChunk(ctx context.Context, reader io.ReaderAt, ranges *Mappings,
+	fn func(m int, offset int64, data []byte, lastOfRange bool) error) error {
+
+	chunker := util.NewChunker(int(ranges.BlockSize))
+	window := util.GetBytes(chunker.MaxSize())
+	defer util.PutBytes(window)
+
+	for m, r := range ranges.Mappings {
+		offset, end := r.Offset, r.Offset+r.Size
+		filled := 0
+		for offset < end {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			// The window starts at offset, the data already read is kept
+			want := len(window)
+			if end-offset < int64(want) {
+				want = int(end - offset)
+			}
+			if filled < want {
+				if err := readSnapshotBlock(reader, window[filled:want], offset+int64(filled)); err != nil {
+					return newBackupError(BackupErrorTypeSnapshot, err)
+				}
+				filled = want
+			}
+
+			n := chunker.Cut(window[:filled])
+			if err := fn(m, offset, window[:n], offset+int64(n) == end); err != nil {
+				return err
+			}
+			copy(window, window[n:filled])
+			filled -= n
+			offset += int64(n)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package backupstore
+
+import (
+	"context"
+	"fmt"
+)
+
+// BackupStoreClient accesses one backupstore. Unlike the package functions,
+// which initialize the driver on every call, it initializes the driver once
+// and reuses it. The backup URLs passed to the client are only used for the
+// backup and volume names they contain, the backupstore is always the one of
+// the client.
+type BackupStoreClient struct {
+	destURL string
+	driver  BackupStoreDriver
+}
+
+// NewBackupStoreClient initializes the driver of destURL
+func NewBackupStoreClient(destURL string) (*BackupStoreClient, error) {
+	return NewBackupStoreClientWithCredentials(destURL, nil)
+}
+
+// NewBackupStoreClientWithCredentials initializes the driver of destURL with
+// credentials, see GetBackupStoreDriverWithCredentials
+func NewBackupStoreClientWithCredentials(destURL string, credentials *Credentials) (*BackupStoreClient, error) {
+	driver, err := GetBackupStoreDriverWithCredentials(destURL, credentials)
+	if err != nil {
+		return nil, err
+	}
+	return &BackupStoreClient{
+		destURL: destURL,
+		driver:  driver,
+	}, nil
+}
+
+// URL returns the URL of the backupstore
+func (c *BackupStoreClient) URL() string {
+	return c.destURL
+}
+
+// BackupURL returns the URL of a backup in the backupstore
+func (c *BackupStoreClient) BackupURL(backupName, volumeName string) string {
+	return encodeBackupURL(backupName, volumeName, c.destURL)
+}
+
+// Backup starts a delta block backup the same way as StartDeltaBlockBackup.
+// The DestURL of config is ignored.
+func (c *BackupStoreClient) Backup(ctx context.Context, config *DeltaBackupConfig) (*BackupHandle, error) {
+	if config == nil {
+		return nil, fmt.Errorf("Invalid empty config for backup")
+	}
+	cfg := *config
+	cfg.DestURL = c.destURL
+	return queueDeltaBlockBackup(ctx, &cfg, c.driver)
+}
+
+// Restore restores a delta block backup the same way as
+// RestoreDeltaBlockBackupWithContext
+func (c *BackupStoreClient) Restore(ctx context.Context, config *DeltaRestoreConfig) error {
+	if config == nil {
+		return fmt.Errorf("Invalid empty config for restore")
+	}
+	return restoreDeltaBlockBackup(ctx, config, c.driver)
+}
+
+// List lists the volumes the same way as List
+func (c *BackupStoreClient) List(volumeName string, volumeOnly bool) (map[string]*VolumeInfo, error) {
+	return listVolumes(volumeName, c.driver, volumeOnly)
+}
+
+// InspectBackup returns the details of a backup the same way as
+// InspectBackup
+func (c *BackupStoreClient) InspectBackup(backupURL string) (*BackupInfo, error) {
+	return inspectBackup(backupURL, c.driver)
+}
+
+// DeleteBackup deletes a delta block backup the same way as
+// DeleteDeltaBlockBackup
+func (c *BackupStoreClient) DeleteBackup(backupURL string) error {
+	return deleteDeltaBlockBackup(backupURL, "", c.driver)
+}
+
+// DeleteVolume deletes a backup volume the same way as DeleteBackupVolume
+func (c *BackupStoreClient) DeleteVolume(volumeName string) error {
+	return deleteBackupVolume(volumeName, c.driver)
+}
@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/urfave/cli"
+
+	"github.com/longhorn/backupstore"
+	"github.com/longhorn/backupstore/util"
+)
+
+var annotateFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "description",
+		Usage: "free-form description, e.g. why the backup was taken",
+	},
+	cli.StringSliceFlag{
+		Name:  "annotation",
+		Usage: "annotation in key=value format, can be specified multiple times. Empty value removes the key",
+	},
+}
+
+func BackupAnnotateCmd() cli.Command {
+	return cli.Command{
+		Name:   "annotate",
+		Usage:  "set description or annotations of a backup: annotate <backup>",
+		Flags:  annotateFlags,
+		Action: cmdBackupAnnotate,
+	}
+}
+
+func cmdBackupAnnotate(c *cli.Context) {
+	if err := doBackupAnnotate(c); err != nil {
+		panic(err)
+	}
+}
+
+func doBackupAnnotate(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return RequiredMissingError("backup URL")
+	}
+	backupURL := c.Args()[0]
+	if backupURL == "" {
+		return RequiredMissingError("backup URL")
+	}
+	backupURL = util.UnescapeURL(backupURL)
+
+	annotations, err := parseKeyValues(c.StringSlice("annotation"))
+	if err != nil {
+		return err
+	}
+
+	return backupstore.UpdateBackupAnnotations(backupURL, c.String("description"), annotations)
+}
+
+func BackupVolumeAnnotateCmd() cli.Command {
+	return cli.Command{
+		Name:    "annotatebackupvolume",
+		Aliases: []string{"annotatebv"},
+		Usage:   "set description or annotations of a backup volume: annotatebv <dest> --volume <volume>",
+		Flags: append([]cli.Flag{
+			cli.StringFlag{
+				Name:  "volume",
+				Usage: "volume name",
+			},
+		}, annotateFlags...),
+		Action: cmdBackupVolumeAnnotate,
+	}
+}
+
+func cmdBackupVolumeAnnotate(c *cli.Context) {
+	if err := doBackupVolumeAnnotate(c); err != nil {
+		panic(err)
+	}
+}
+
+func doBackupVolumeAnnotate(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return RequiredMissingError("dest URL")
+	}
+	destURL := c.Args()[0]
+	if destURL == "" {
+		return RequiredMissingError("dest URL")
+	}
+	volumeName := c.String("volume")
+	if volumeName == "" {
+		return RequiredMissingError("volume")
+	}
+	if !util.ValidateName(volumeName) {
+		return fmt.Errorf("Invalid volume name %v for backup", volumeName)
+	}
+
+	annotations, err := parseKeyValues(c.StringSlice("annotation"))
+	if err != nil {
+		return err
+	}
+
+	return backupstore.UpdateBackupVolumeAnnotations(volumeName, destURL, c.String("description"), annotations)
+}
+
+func parseKeyValues(pairs []string) (map[string]string, error) {
+	result := make(map[string]string)
+	for _, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("Invalid key value pair %v, must be key=value", pair)
+		}
+		result[kv[0]] = kv[1]
+	}
+	return result, nil
+}
@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/urfave/cli"
+
+	"github.com/longhorn/backupstore"
+)
+
+func BackupBenchCmd() cli.Command {
+	return cli.Command{
+		Name:  "bench",
+		Usage: "measure the performance of a backupstore with synthetic blocks: bench <dest>",
+		Flags: []cli.Flag{
+			cli.IntFlag{
+				Name:  "objects",
+				Usage: "number of objects written, read and deleted",
+				Value: backupstore.DEFAULT_BENCH_OBJECTS,
+			},
+			cli.IntFlag{
+				Name:  "size",
+				Usage: "size of the objects in bytes",
+				Value: backupstore.DEFAULT_BLOCK_SIZE,
+			},
+			cli.IntFlag{
+				Name:  "concurrency",
+				Usage: "number of operations run in parallel",
+				Value: 1,
+			},
+			cli.BoolFlag{
+				Name:  "json",
+				Usage: "print the report as JSON instead of a table",
+			},
+		},
+		Action: cmdBackupBench,
+	}
+}
+
+func cmdBackupBench(c *cli.Context) {
+	if err := doBackupBench(c); err != nil {
+		panic(err)
+	}
+}
+
+func doBackupBench(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return RequiredMissingError("dest URL")
+	}
+	destURL := c.Args()[0]
+	if destURL == "" {
+		return RequiredMissingError("dest URL")
+	}
+	objects := c.Int("objects")
+	if objects < 1 {
+		return fmt.Errorf("Invalid number of objects %v", objects)
+	}
+	size := int64(c.Int("size"))
+	if size < 1 {
+		return fmt.Errorf("Invalid object size %v", size)
+	}
+	concurrency := c.Int("concurrency")
+	if concurrency < 1 {
+		return fmt.Errorf("Invalid concurrency %v", concurrency)
+	}
+
+	report, err := backupstore.BenchmarkBackupStore(context.Background(), &backupstore.BenchConfig{
+		DestURL:     destURL,
+		Objects:     objects,
+		ObjectSize:  size,
+		Concurrency: concurrency,
+	})
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("json") {
+		return json.NewEncoder(os.Stdout).Encode(report)
+	}
+	fmt.Printf("%v objects of %v with concurrency %v on %v\n",
+		report.Objects, formatBytes(report.ObjectSize), report.Concurrency, report.URL)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PHASE\tDURATION\tTHROUGHPUT\tOPS/S\tP50\tP90\tP99\tMAX\tERRORS")
+	for _, p := range report.Phases {
+		fmt.Fprintf(w, "%v\t%v\t%v/s\t%.1f\t%v\t%v\t%v\t%v\t%v (%.1f%%)\n",
+			p.Phase, p.Duration, formatBytes(p.Throughput), p.OperationsPerSecond,
+			p.LatencyP50, p.LatencyP90, p.LatencyP99, p.LatencyMax, p.Errors, p.ErrorRate*100)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	for _, p := range report.Phases {
+		if p.FirstError != "" {
+			fmt.Printf("First %v error: %v\n", p.Phase, p.FirstError)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/urfave/cli"
+
+	"github.com/longhorn/backupstore"
+)
+
+func BackupCatalogCmd() cli.Command {
+	return cli.Command{
+		Name:  "catalog",
+		Usage: "export the inventory of all the volumes and backups in backupstore: catalog <dest>",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "format",
+				Usage: "output format, json or csv",
+				Value: string(backupstore.CatalogFormatJSON),
+			},
+			cli.StringFlag{
+				Name:  "output",
+				Usage: "file to write the catalog to, the standard output if not specified",
+			},
+		},
+		Action: cmdBackupCatalog,
+	}
+}
+
+func cmdBackupCatalog(c *cli.Context) {
+	if err := doBackupCatalog(c); err != nil {
+		panic(err)
+	}
+}
+
+func doBackupCatalog(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return RequiredMissingError("dest URL")
+	}
+	destURL := c.Args()[0]
+	if destURL == "" {
+		return RequiredMissingError("dest URL")
+	}
+
+	format := backupstore.CatalogFormat(c.String("format"))
+	if format != backupstore.CatalogFormatJSON && format != backupstore.CatalogFormatCSV {
+		return fmt.Errorf("Invalid catalog format %v", format)
+	}
+
+	catalog, err := backupstore.ExportCatalog(destURL)
+	if err != nil {
+		return err
+	}
+
+	output := c.String("output")
+	if output == "" {
+		return catalog.Write(os.Stdout, format)
+	}
+	file, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	if err := catalog.Write(file, format); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"github.com/urfave/cli"
+
+	"github.com/longhorn/backupstore"
+	"github.com/longhorn/backupstore/util"
+)
+
+func BackupProtectCmd() cli.Command {
+	return cli.Command{
+		Name:  "protect",
+		Usage: "prevent a backup from being deleted: protect <backup>",
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "clear",
+				Usage: "clear the protection so the backup can be deleted",
+			},
+		},
+		Action: cmdBackupProtect,
+	}
+}
+
+func cmdBackupProtect(c *cli.Context) {
+	if err := doBackupProtect(c); err != nil {
+		panic(err)
+	}
+}
+
+func doBackupProtect(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return RequiredMissingError("backup URL")
+	}
+	backupURL := c.Args()[0]
+	if backupURL == "" {
+		return RequiredMissingError("backup URL")
+	}
+	backupURL = util.UnescapeURL(backupURL)
+
+	return backupstore.SetBackupProtection(backupURL, !c.Bool("clear"))
+}
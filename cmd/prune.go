@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/urfave/cli"
+
+	"github.com/longhorn/backupstore"
+	"github.com/longhorn/backupstore/util"
+)
+
+func BackupExpireCmd() cli.Command {
+	return cli.Command{
+		Name:  "expire",
+		Usage: "set expiration time of a backup: expire <backup> --at <time> or --in <duration>",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "at",
+				Usage: "expiration time in RFC3339 format",
+			},
+			cli.DurationFlag{
+				Name:  "in",
+				Usage: "expire the backup after the duration from now, e.g. 720h",
+			},
+			cli.BoolFlag{
+				Name:  "never",
+				Usage: "clear the expiration time",
+			},
+		},
+		Action: cmdBackupExpire,
+	}
+}
+
+func cmdBackupExpire(c *cli.Context) {
+	if err := doBackupExpire(c); err != nil {
+		panic(err)
+	}
+}
+
+func doBackupExpire(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return RequiredMissingError("backup URL")
+	}
+	backupURL := c.Args()[0]
+	if backupURL == "" {
+		return RequiredMissingError("backup URL")
+	}
+	backupURL = util.UnescapeURL(backupURL)
+
+	var expiresAt string
+	switch {
+	case c.Bool("never"):
+		expiresAt = ""
+	case c.String("at") != "":
+		expiresAt = c.String("at")
+	case c.Duration("in") > 0:
+		expiresAt = time.Now().Add(c.Duration("in")).UTC().Format(time.RFC3339)
+	default:
+		return RequiredMissingError("at, in or never")
+	}
+
+	return backupstore.SetBackupExpiration(backupURL, expiresAt)
+}
+
+func BackupPruneCmd() cli.Command {
+	return cli.Command{
+		Name:  "prune",
+		Usage: "remove expired backups in backupstore: prune <dest>",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "volume",
+				Usage: "volume name, all the volumes if not specified",
+			},
+		},
+		Action: cmdBackupPrune,
+	}
+}
+
+func cmdBackupPrune(c *cli.Context) {
+	if err := doBackupPrune(c); err != nil {
+		panic(err)
+	}
+}
+
+func doBackupPrune(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return RequiredMissingError("dest URL")
+	}
+	destURL := c.Args()[0]
+	if destURL == "" {
+		return RequiredMissingError("dest URL")
+	}
+	volumeName := c.String("volume")
+	if volumeName != "" && !util.ValidateName(volumeName) {
+		return fmt.Errorf("Invalid volume name %v for backup", volumeName)
+	}
+
+	pruned, err := backupstore.PruneExpiredBackups(volumeName, destURL)
+	data, outputErr := ResponseOutput(pruned)
+	if outputErr != nil {
+		return outputErr
+	}
+	// Show what was removed even if failed in the middle
+	fmt.Println(string(data))
+	return err
+}
@@ -49,6 +49,10 @@ func BackupVolumeRemoveCmd() cli.Command {
 				Name:  "volume",
 				Usage: "volume name",
 			},
+			cli.BoolFlag{
+				Name:  "force",
+				Usage: "remove everything of the volume even if its metadata is corrupted",
+			},
 		},
 		Action: cmdBackupVolumeRemove,
 	}
@@ -73,6 +77,9 @@ func doBackupVolumeRemove(c *cli.Context) error {
 		return fmt.Errorf("Invalid volume name %v for backup", volumeName)
 	}
 
+	if c.Bool("force") {
+		return backupstore.ForceDeleteBackupVolume(volumeName, destURL)
+	}
 	if err := backupstore.DeleteBackupVolume(volumeName, destURL); err != nil {
 		return err
 	}
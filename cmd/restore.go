@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+
+	"github.com/longhorn/backupstore"
+	"github.com/longhorn/backupstore/util"
+)
+
+const (
+	progressBarWidth = 40
+)
+
+func BackupRestoreCmd() cli.Command {
+	return cli.Command{
+		Name:  "restore",
+		Usage: "restore a backup to a file or block device: restore <backup> --to <file>",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "to",
+				Usage: "file or block device to restore to",
+			},
+			cli.StringFlag{
+				Name:  "last-backup",
+				Usage: "backup already restored to the target, only the changed blocks would be written",
+			},
+			cli.BoolFlag{
+				Name:  "detect-last-backup",
+				Usage: "restore incrementally on top of the backup recorded by the last restore to the target",
+			},
+			cli.StringFlag{
+				Name:  "restore-state-file",
+				Usage: "file recording the backup restored to the target, required to detect it on a block device",
+			},
+			cli.IntFlag{
+				Name:  "size",
+				Usage: "size of the target in bytes, to expand it past the size of the volume",
+			},
+			cli.IntFlag{
+				Name:  "concurrency",
+				Usage: "number of blocks read from the backupstore in parallel",
+				Value: 1,
+			},
+			cli.BoolFlag{
+				Name:  "json",
+				Usage: "print the progress as a stream of JSON objects instead of a progress bar",
+			},
+		},
+		Action: cmdBackupRestore,
+	}
+}
+
+func cmdBackupRestore(c *cli.Context) {
+	if err := doBackupRestore(c); err != nil {
+		panic(err)
+	}
+}
+
+func doBackupRestore(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return RequiredMissingError("backup URL")
+	}
+	backupURL := c.Args()[0]
+	if backupURL == "" {
+		return RequiredMissingError("backup URL")
+	}
+	backupURL = util.UnescapeURL(backupURL)
+	target := c.String("to")
+	if target == "" {
+		return RequiredMissingError("to")
+	}
+	lastBackupName := c.String("last-backup")
+	if lastBackupName != "" && !util.ValidateName(lastBackupName) {
+		return fmt.Errorf("Invalid backup name %v", lastBackupName)
+	}
+	concurrency := c.Int("concurrency")
+	if concurrency < 1 {
+		return fmt.Errorf("Invalid concurrency %v", concurrency)
+	}
+	size := int64(c.Int("size"))
+	if size < 0 {
+		return fmt.Errorf("Invalid target size %v", size)
+	}
+
+	config := &backupstore.DeltaRestoreConfig{
+		BackupURL:        backupURL,
+		Filename:         target,
+		LastBackupName:   lastBackupName,
+		DetectLastBackup: c.Bool("detect-last-backup"),
+		RestoreStateFile: c.String("restore-state-file"),
+		Concurrency:      concurrency,
+		TargetSize:       size,
+	}
+	if c.Bool("json") {
+		encoder := json.NewEncoder(os.Stdout)
+		config.ProgressFunc = func(progress *backupstore.RestoreProgress) {
+			encoder.Encode(progress)
+		}
+		config.ProgressUpdateInterval = time.Second
+	} else {
+		config.ProgressFunc = printProgressBar
+		config.ProgressUpdateInterval = 200 * time.Millisecond
+		defer fmt.Fprintln(os.Stderr)
+	}
+	return backupstore.RestoreDeltaBlockBackupWithConfig(config)
+}
+
+func printProgressBar(progress *backupstore.RestoreProgress) {
+	done := progress.Progress * progressBarWidth / 100
+	fmt.Fprintf(os.Stderr, "\r[%v%v] %3d%% %v/%v blocks, %v written, %v/s",
+		strings.Repeat("#", done), strings.Repeat(" ", progressBarWidth-done), progress.Progress,
+		progress.BlocksDone, progress.BlocksTotal, formatBytes(progress.BytesWritten), formatBytes(progress.Throughput))
+}
+
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
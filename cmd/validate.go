@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+
+	"github.com/longhorn/backupstore"
+)
+
+func BackupTargetTestCmd() cli.Command {
+	return cli.Command{
+		Name:  "test-target",
+		Usage: "check a backupstore can be used as a backup target: test-target <dest>",
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "json",
+				Usage: "print the report in JSON format",
+			},
+		},
+		Action: cmdBackupTargetTest,
+	}
+}
+
+func cmdBackupTargetTest(c *cli.Context) {
+	if err := doBackupTargetTest(c); err != nil {
+		panic(err)
+	}
+}
+
+func doBackupTargetTest(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return RequiredMissingError("dest URL")
+	}
+	destURL := c.Args()[0]
+	if destURL == "" {
+		return RequiredMissingError("dest URL")
+	}
+
+	v := backupstore.ValidateBackupTarget(destURL)
+	if c.Bool("json") {
+		data, err := ResponseOutput(v)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+	} else {
+		printValidation(v)
+	}
+	if !v.Passed() {
+		return fmt.Errorf("Backup target %v failed the validation", destURL)
+	}
+	return nil
+}
+
+func printValidation(v *backupstore.BackupTargetValidation) {
+	for _, r := range v.Results {
+		result := "PASS"
+		if r.Skipped {
+			result = "SKIP"
+		} else if !r.Passed {
+			result = "FAIL"
+		}
+		line := fmt.Sprintf("%v  %-8v  %v", result, r.Check, r.Message)
+		if r.Latency != 0 {
+			line += fmt.Sprintf(" (%v)", r.Latency.Round(time.Microsecond))
+		}
+		fmt.Println(strings.TrimSpace(line))
+	}
+	if v.Passed() {
+		fmt.Printf("Backup target %v passed the validation\n", v.URL)
+	}
+}
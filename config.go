@@ -4,7 +4,11 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"path/filepath"
+	"sort"
+	"sync"
 
 	"github.com/longhorn/backupstore/util"
 	"github.com/sirupsen/logrus"
@@ -21,21 +25,72 @@ const (
 	BACKUP_DIRECTORY     = "backups"
 	BACKUP_CONFIG_PREFIX = "backup_"
 
+	BACKUP_STATUS_DIRECTORY = "status"
+
 	CFG_SUFFIX = ".cfg"
 )
 
+var (
+	metadataCompressionLock sync.RWMutex
+	metadataCompression     = false
+)
+
+// SetMetadataCompression sets whether the backup configs are compressed when
+// they're written, which is disabled by default. The compressed and
+// uncompressed configs are both read, but the compressed ones only by the
+// versions supporting the compression, so it should only be enabled once
+// no older version accesses the backupstore.
+func SetMetadataCompression(enabled bool) {
+	metadataCompressionLock.Lock()
+	defer metadataCompressionLock.Unlock()
+	metadataCompression = enabled
+}
+
+func isMetadataCompressionEnabled() bool {
+	metadataCompressionLock.RLock()
+	defer metadataCompressionLock.RUnlock()
+	return metadataCompression
+}
+
 func getBackupConfigName(id string) string {
 	return BACKUP_CONFIG_PREFIX + id + CFG_SUFFIX
 }
 
 func loadConfigInBackupStore(filePath string, driver BackupStoreDriver, v interface{}) error {
+	data, err := loadConfigDataInBackupStore(filePath, driver)
+	if err != nil {
+		return err
+	}
+	return unmarshalConfig(filePath, driver, data, v)
+}
+
+// unmarshalConfig decodes data, the content of the config file, into v
+func unmarshalConfig(filePath string, driver BackupStoreDriver, data []byte, v interface{}) error {
+	if err := json.Unmarshal(data, v); err != nil {
+		return newMetadataCorruptedError(filePath, driver, err)
+	}
+	return nil
+}
+
+// newMetadataCorruptedError returns the error for the corrupted config file
+func newMetadataCorruptedError(filePath string, driver BackupStoreDriver, err error) error {
+	// Don't keep serving a broken config from the cache
+	metaCache.invalidate(driver, filePath)
+	return &MetadataCorruptedError{Path: filePath, Reason: err.Error()}
+}
+
+// loadConfigDataInBackupStore returns the raw content of the config file
+func loadConfigDataInBackupStore(filePath string, driver BackupStoreDriver) ([]byte, error) {
+	if data, ok := metaCache.get(driver, filePath); ok {
+		return data, nil
+	}
 	size := driver.FileSize(filePath)
 	if size < 0 {
-		return fmt.Errorf("cannot find %v in backupstore", filePath)
+		return nil, fmt.Errorf("cannot find %v in backupstore", filePath)
 	}
 	rc, err := driver.Read(filePath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer rc.Close()
 
@@ -45,8 +100,15 @@ func loadConfigInBackupStore(filePath string, driver BackupStoreDriver, v interf
 		LogFieldKind:     driver.Kind(),
 		LogFieldFilepath: filePath,
 	}).Debug()
-	if err := json.NewDecoder(rc).Decode(v); err != nil {
-		return err
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	// The config may have been compressed when written
+	if util.IsGzipData(data) {
+		if data, err = util.DecompressData(data); err != nil {
+			return nil, &MetadataCorruptedError{Path: filePath, Reason: err.Error()}
+		}
 	}
 	log.WithFields(logrus.Fields{
 		LogFieldReason:   LogReasonComplete,
@@ -54,7 +116,8 @@ func loadConfigInBackupStore(filePath string, driver BackupStoreDriver, v interf
 		LogFieldKind:     driver.Kind(),
 		LogFieldFilepath: filePath,
 	}).Debug()
-	return nil
+	metaCache.put(driver, filePath, data)
+	return data, nil
 }
 
 func saveConfigInBackupStore(filePath string, driver BackupStoreDriver, v interface{}) error {
@@ -62,13 +125,38 @@ func saveConfigInBackupStore(filePath string, driver BackupStoreDriver, v interf
 	if err != nil {
 		return err
 	}
+	return saveConfigDataInBackupStore(filePath, driver, bytes.NewReader(j))
+}
+
+// saveCompressedConfigInBackupStore is saveConfigInBackupStore compressing
+// the config if the metadata compression is enabled
+func saveCompressedConfigInBackupStore(filePath string, driver BackupStoreDriver, v interface{}) error {
+	if !isMetadataCompressionEnabled() {
+		return saveConfigInBackupStore(filePath, driver, v)
+	}
+	j, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	rs, err := util.CompressData(j)
+	if err != nil {
+		return err
+	}
+	return saveConfigDataInBackupStore(filePath, driver, rs)
+}
+
+// saveConfigDataInBackupStore writes the content of the config file
+func saveConfigDataInBackupStore(filePath string, driver BackupStoreDriver, rs io.ReadSeeker) error {
 	log.WithFields(logrus.Fields{
 		LogFieldReason:   LogReasonStart,
 		LogFieldObject:   LogObjectConfig,
 		LogFieldKind:     driver.Kind(),
 		LogFieldFilepath: filePath,
 	}).Debug()
-	if err := driver.Write(filePath, bytes.NewReader(j)); err != nil {
+	err := driver.Write(filePath, rs)
+	// The object may have been partially written on failure
+	metaCache.invalidate(driver, filePath)
+	if err != nil {
 		return err
 	}
 	log.WithFields(logrus.Fields{
@@ -130,17 +218,89 @@ func getVolumeNames(driver BackupStoreDriver) ([]string, error) {
 	return names, nil
 }
 
+// getVolumeNamesPage returns up to limit volume names following the volume
+// named after, in the order of the volume paths. more is set if there are
+// volumes left. Zero limit means no limit.
+func getVolumeNamesPage(driver BackupStoreDriver, after string, limit int) ([]string, bool, error) {
+	names := []string{}
+
+	var afterLv1, afterLv2 string
+	if after != "" {
+		checksum := util.GetChecksum([]byte(after))
+		afterLv1 = checksum[0:VOLUME_SEPARATE_LAYER1]
+		afterLv2 = checksum[VOLUME_SEPARATE_LAYER1:VOLUME_SEPARATE_LAYER2]
+	}
+
+	volumePathBase := filepath.Join(backupstoreBase, VOLUME_DIRECTORY)
+	lv1Dirs, err := driver.List(volumePathBase)
+	// Directory doesn't exist
+	if err != nil {
+		return names, false, nil
+	}
+	sort.Strings(lv1Dirs)
+	for _, lv1 := range lv1Dirs {
+		// Skip the directories listed in the previous pages
+		if lv1 < afterLv1 {
+			continue
+		}
+		lv1Path := filepath.Join(volumePathBase, lv1)
+		lv2Dirs, err := driver.List(lv1Path)
+		if err != nil {
+			return nil, false, err
+		}
+		sort.Strings(lv2Dirs)
+		for _, lv2 := range lv2Dirs {
+			if lv1 == afterLv1 && lv2 < afterLv2 {
+				continue
+			}
+			lv2Path := filepath.Join(lv1Path, lv2)
+			volumeNames, err := driver.List(lv2Path)
+			if err != nil {
+				return nil, false, err
+			}
+			sort.Strings(volumeNames)
+			for _, name := range volumeNames {
+				if lv1 == afterLv1 && lv2 == afterLv2 && name <= after {
+					continue
+				}
+				if limit > 0 && len(names) == limit {
+					return names, true, nil
+				}
+				names = append(names, name)
+			}
+		}
+	}
+	return names, false, nil
+}
+
 func loadVolume(volumeName string, driver BackupStoreDriver) (*Volume, error) {
+	v, _, err := loadVolumeWithMarker(volumeName, driver)
+	return v, err
+}
+
+// loadVolumeWithMarker loads a volume along with the checksum of its config
+func loadVolumeWithMarker(volumeName string, driver BackupStoreDriver) (*Volume, string, error) {
 	v := &Volume{}
 	file := getVolumeFilePath(volumeName)
-	if err := loadConfigInBackupStore(file, driver, v); err != nil {
-		return nil, err
+	data, err := loadConfigDataInBackupStore(file, driver)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := unmarshalConfig(file, driver, data, v); err != nil {
+		return nil, "", err
 	}
-	return v, nil
+	if err := verifyVolumeManifest(v, data); err != nil {
+		return nil, "", newMetadataCorruptedError(file, driver, err)
+	}
+	return v, util.GetChecksum(data), nil
 }
 
 func saveVolume(v *Volume, driver BackupStoreDriver) error {
 	file := getVolumeFilePath(v.Name)
+	v.Generation++
+	if err := setVolumeManifest(v); err != nil {
+		return err
+	}
 	if err := saveConfigInBackupStore(file, driver, v); err != nil {
 		return err
 	}
@@ -172,10 +332,30 @@ func backupExists(backupName, volumeName string, bsDriver BackupStoreDriver) boo
 }
 
 func loadBackup(backupName, volumeName string, bsDriver BackupStoreDriver) (*Backup, error) {
-	backup := &Backup{}
-	if err := loadConfigInBackupStore(getBackupConfigPath(backupName, volumeName), bsDriver, backup); err != nil {
+	filePath := getBackupConfigPath(backupName, volumeName)
+	data, err := loadConfigDataInBackupStore(filePath, bsDriver)
+	if err != nil {
 		return nil, err
 	}
+	// Blocks is decoded according to the block list format
+	stored := struct {
+		*Backup
+		Blocks json.RawMessage
+	}{Backup: &Backup{}}
+	if err := unmarshalConfig(filePath, bsDriver, data, &stored); err != nil {
+		return nil, err
+	}
+	backup := stored.Backup
+	if !isBlocksFormatSupported(backup) {
+		return nil, fmt.Errorf("Unsupported block list format %v of backup %v, it may be saved by a newer version",
+			backup.BlocksFormat, backupName)
+	}
+	if err := decodeBackupBlocks(backup, stored.Blocks); err != nil {
+		return nil, newMetadataCorruptedError(filePath, bsDriver, err)
+	}
+	if err := verifyBackupManifest(backup, data); err != nil {
+		return nil, newMetadataCorruptedError(filePath, bsDriver, err)
+	}
 	return backup, nil
 }
 
@@ -183,11 +363,16 @@ func saveBackup(backup *Backup, bsDriver BackupStoreDriver) error {
 	filePath := getBackupConfigPath(backup.Name, backup.VolumeName)
 	if bsDriver.FileExists(filePath) {
 		log.Warnf("Snapshot configuration file %v already exists, would remove it\n", filePath)
+		metaCache.invalidate(bsDriver, filePath)
 		if err := bsDriver.Remove(filePath); err != nil {
 			return err
 		}
 	}
-	if err := saveConfigInBackupStore(filePath, bsDriver, backup); err != nil {
+	stored, err := setBackupManifest(backup)
+	if err != nil {
+		return err
+	}
+	if err := saveCompressedConfigInBackupStore(filePath, bsDriver, stored); err != nil {
 		return err
 	}
 	return nil
@@ -195,6 +380,7 @@ func saveBackup(backup *Backup, bsDriver BackupStoreDriver) error {
 
 func removeBackup(backup *Backup, bsDriver BackupStoreDriver) error {
 	filePath := getBackupConfigPath(backup.Name, backup.VolumeName)
+	metaCache.invalidate(bsDriver, filePath)
 	if err := bsDriver.Remove(filePath); err != nil {
 		return err
 	}
@@ -1,10 +1,14 @@
 package backupstore
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 
@@ -18,11 +22,143 @@ type DeltaBackupConfig struct {
 	DestURL  string
 	DeltaOps DeltaBlockBackupOperations
 	Labels   map[string]string
+
+	// DeltaOpsV2 would be used instead of DeltaOps if specified
+	DeltaOpsV2 DeltaBlockBackupOperationsV2
+
+	Description string
+	Annotations map[string]string
+	// ExpiresAt is the optional expiration time of the backup in RFC3339
+	// format, see PruneExpiredBackups
+	ExpiresAt string
+
+	// ProgressUpdateInterval and ProgressUpdateMinDelta throttle the
+	// intermediate UpdateBackupStatus calls: an update is only delivered
+	// once the interval has passed and the progress has grown by at least
+	// the delta (in percent) since the last one. Zero disables the limit.
+	ProgressUpdateInterval time.Duration
+	ProgressUpdateMinDelta int
+
+	// SnapshotReadBlocks is the maximum number of contiguous blocks read
+	// from the snapshot in one call, DEFAULT_SNAPSHOT_READ_BLOCKS if not set
+	SnapshotReadBlocks int
+
+	// ChunkingMode is only used by the first backup of the volume, which
+	// decides the mode of all its backups. The later backups fail if it's
+	// set to another mode. ChunkingModeFixed if not set.
+	ChunkingMode ChunkingMode
+
+	// BackupName is the name of the backup, generated if not set. If a
+	// backup of the same snapshot already exists under this name, it's
+	// reported as completed instead of creating another one, so the
+	// requests can be safely retried.
+	BackupName string
+
+	// BaseBackupName pins the backup of the volume the new backup is based
+	// on, instead of its last backup, e.g. to branch off an older backup.
+	// Only the blocks changed since BaseSnapshotName, or the snapshot of
+	// the base backup if not set, are read. BaseSnapshotName must have the
+	// same content as the base backup, and the backup fails if it doesn't
+	// exist. The backup is full if the snapshot of the base backup doesn't
+	// exist anymore.
+	BaseBackupName   string
+	BaseSnapshotName string
+
+	// OperationID identifies the backup in the logs and its status,
+	// generated if not set
+	OperationID string
+
+	// PreBackup is called before the snapshot is opened, once the backup
+	// got a job slot, and PostBackup as soon as all its blocks are read,
+	// while the last ones may still be uploaded. PostBackup is called if
+	// and only if PreBackup succeeded, even if the backup failed or
+	// panicked in between. The backup fails if either of them fails. See
+	// ExecBackupHook to run commands.
+	PreBackup  BackupHook
+	PostBackup BackupHook
+}
+
+type DeltaRestoreConfig struct {
+	BackupURL string
+	// Filename is the file or block device to restore to. The ranges of a
+	// block device not covered by the backup are zeroed out with
+	// BLKZEROOUT, or written with zeroes if not supported, so no content
+	// of its previous use is left.
+	Filename string
+	// LastBackupName is the backup of the same volume already restored to
+	// Filename, only the blocks which changed since then are written.
+	// The whole backup is restored if it's empty.
+	LastBackupName string
+
+	// AuditBlocks checks all the blocks of the backup exist before
+	// writing anything, the restore fails with a *BlockAuditError
+	// listing all the damaged blocks otherwise. VerifyBlockChecksums
+	// makes the audit read and verify every block, instead of only
+	// checking the existence and size.
+	AuditBlocks          bool
+	VerifyBlockChecksums bool
+
+	// BestEffort continues the restore past the missing or corrupted
+	// blocks by zero-filling them. The restore then fails with a
+	// *BlockAuditError reporting the damaged regions once all the other
+	// blocks have been written.
+	BestEffort bool
+
+	// DetectLastBackup restores incrementally on top of the backup
+	// recorded in the restore state marker of Filename if LastBackupName
+	// is empty, as long as the marker is still valid. The whole backup is
+	// restored otherwise. It requires RestoreStateFile if Filename isn't
+	// a regular file.
+	DetectLastBackup bool
+	// RestoreStateFile is the path of the restore state marker of
+	// Filename, Filename with RESTORE_STATE_SUFFIX appended if empty. The
+	// marker is only kept if DetectLastBackup or RestoreStateFile is set.
+	RestoreStateFile string
+
+	// ProgressFunc is called with the progress of the restore, from the
+	// goroutine of the restore. ProgressUpdateInterval and
+	// ProgressUpdateMinDelta throttle the intermediate updates the same
+	// way as for DeltaBackupConfig.
+	ProgressFunc           func(progress *RestoreProgress)
+	ProgressUpdateInterval time.Duration
+	ProgressUpdateMinDelta int
+
+	// Concurrency is the number of blocks read from the backupstore in
+	// parallel, one at a time if not set
+	Concurrency int
+
+	// OperationID identifies the restore in the logs and its progress,
+	// generated if not set
+	OperationID string
+
+	// TargetSize is the size of the target after the restore, which can be
+	// larger than the volume to expand it. The tail past the volume reads
+	// as zeroes, and is left sparse in a regular file. The size is
+	// recorded in the restore state marker, so the later incremental
+	// restores keep the expansion if it's not set. The size of the volume,
+	// or of the previous restore, if not set.
+	TargetSize int64
+
+	// DiscardUnmapped discards the ranges of a block device not covered
+	// by the backup with BLKDISCARD instead of zeroing them out, so
+	// thin-provisioned devices and SSDs release them. The discarded ranges
+	// only read back as zeroes if the device guarantees it.
+	DiscardUnmapped bool
 }
 
 type BlockMapping struct {
 	Offset        int64
 	BlockChecksum string
+	// Uncompressed is set when the block was stored as is because it
+	// didn't compress
+	Uncompressed bool `json:",omitempty"`
+	// Length is the length of the block data if it's shorter than the
+	// block size, which is only the case for the last block of a volume
+	// whose size is not a multiple of it. Zero means a full block.
+	Length int64 `json:",omitempty"`
+	// StoredSize is the size of the block object in the backupstore,
+	// zero if it was backed up before the size was recorded
+	StoredSize int64 `json:",omitempty"`
 }
 
 type DeltaBlockBackupOperations interface {
@@ -31,7 +167,7 @@ type DeltaBlockBackupOperations interface {
 	OpenSnapshot(id, volumeID string) error
 	ReadSnapshot(id, volumeID string, start int64, data []byte) error
 	CloseSnapshot(id, volumeID string) error
-	UpdateBackupStatus(id, volumeID string, backupProgress int, backupURL string, err string) error
+	UpdateBackupStatus(id, volumeID string, status *BackupStatus) error
 }
 
 const (
@@ -41,59 +177,309 @@ const (
 	BLOCK_SEPARATE_LAYER1 = 2
 	BLOCK_SEPARATE_LAYER2 = 4
 
+	// DEFAULT_SNAPSHOT_READ_BLOCKS is the number of contiguous blocks read
+	// from the snapshot at once
+	DEFAULT_SNAPSHOT_READ_BLOCKS = 8
+
+	// RESTORE_WRITE_BLOCKS is the maximum number of contiguous blocks
+	// written to the restore target at once
+	RESTORE_WRITE_BLOCKS = 8
+
+	// FORCE_DELETE_MAX_ROUNDS bounds the listing and removal rounds of
+	// ForceDeleteBackupVolume
+	FORCE_DELETE_MAX_ROUNDS = 1000
+
 	PROGRESS_PERCENTAGE_BACKUP_SNAPSHOT = 95
 	PROGRESS_PERCENTAGE_BACKUP_TOTAL    = 100
 )
 
 func CreateDeltaBlockBackup(config *DeltaBackupConfig) (string, error) {
+	return CreateDeltaBlockBackupWithContext(context.Background(), config)
+}
+
+// CreateDeltaBlockBackupWithContext starts a backup which can be canceled
+// using ctx, including the part processed in background. The canceled backup
+// would end in BackupStateCanceled.
+func CreateDeltaBlockBackupWithContext(ctx context.Context, config *DeltaBackupConfig) (string, error) {
+	h, err := StartDeltaBlockBackup(ctx, config)
+	if err != nil {
+		return "", err
+	}
+	return h.Name(), nil
+}
+
+// StartDeltaBlockBackup starts a backup the same way as
+// CreateDeltaBlockBackupWithContext, and returns a handle to wait for it. If
+// another backup of the volume is running or queued in this process, the
+// backup is queued and started once they're done. The queued backups are
+// reported as BackupStatePending with their QueuePosition.
+func StartDeltaBlockBackup(ctx context.Context, config *DeltaBackupConfig) (*BackupHandle, error) {
 	if config == nil {
-		return "", fmt.Errorf("Invalid empty config for backup")
+		return nil, fmt.Errorf("Invalid empty config for backup")
+	}
+	bsDriver, err := GetBackupStoreDriver(config.DestURL)
+	if err != nil {
+		return nil, err
+	}
+	return queueDeltaBlockBackup(ctx, config, bsDriver)
+}
+
+// queueDeltaBlockBackup starts or queues the backup of config to the
+// backupstore of bsDriver
+func queueDeltaBlockBackup(ctx context.Context, config *DeltaBackupConfig, bsDriver BackupStoreDriver) (*BackupHandle, error) {
+	if err := validateExpiresAt(config.ExpiresAt); err != nil {
+		return nil, err
+	}
+	if !util.ValidateName(config.Volume.Name) {
+		return nil, fmt.Errorf("Invalid volume name %v", config.Volume.Name)
+	}
+	if config.BackupName != "" && !util.ValidateName(config.BackupName) {
+		return nil, fmt.Errorf("Invalid backup name %v", config.BackupName)
+	}
+	if err := validateBaseBackup(config); err != nil {
+		return nil, err
+	}
+	// The config of the caller may be reused for other backups
+	c := *config
+	config = &c
+	config.OperationID = getOperationID(config.OperationID, "backup")
+
+	deltaOps, err := getDeltaOps(config)
+	if err != nil {
+		return nil, err
+	}
+
+	backupName := config.BackupName
+	if backupName == "" {
+		backupName = util.GenerateName("backup")
+	}
+	h := newBackupHandle(backupName, config.OperationID)
+	tracker := newBackupStatusTracker(ctx, config, deltaOps, backupName, bsDriver)
+	done := func() {
+		backupDone(bsDriver, config.Volume.Name)
 	}
 
+	// startAsync waits for a job slot, then starts the backup, reporting
+	// its failure through the handle
+	startAsync := func() {
+		err := ctx.Err()
+		var release func()
+		if err == nil {
+			release, err = acquireJobSlot(ctx, backupLimiter, bsDriver)
+		}
+		if err != nil {
+			tracker.cancel(err)
+			h.finish(nil, err)
+			done()
+			return
+		}
+		if err := startDeltaBlockBackup(ctx, config, deltaOps, bsDriver, tracker, h, release, done); err != nil {
+			tracker.fail(err)
+			h.finish(nil, err)
+		}
+	}
+	queued := &queuedBackup{
+		tracker: tracker,
+		start:   startAsync,
+	}
+	if !enqueueBackup(bsDriver, config.Volume.Name, queued) {
+		tracker.log.Debugf("Queued backup %v of volume %v", backupName, config.Volume.Name)
+		return h, nil
+	}
+	// The volume is only locked and its snapshot opened once the backup
+	// can transfer data, so a backup waiting for a slot holds nothing
+	release := tryAcquireJobSlot(backupLimiter, bsDriver)
+	if release == nil {
+		tracker.log.Debugf("Backup %v of volume %v is waiting for a job slot", backupName, config.Volume.Name)
+		tracker.pending()
+		go startAsync()
+		return h, nil
+	}
+	if err := startDeltaBlockBackup(ctx, config, deltaOps, bsDriver, tracker, h, release, done); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// startDeltaBlockBackup prepares the backup tracked by tracker and h, and
+// processes it in background. release frees the job slot taken for the
+// backup. It and done are called once the backup is finished, or right away
+// if it cannot be started.
+func startDeltaBlockBackup(ctx context.Context, config *DeltaBackupConfig, deltaOps DeltaBlockBackupOperationsV2,
+	bsDriver BackupStoreDriver, tracker *backupStatusTracker, h *BackupHandle, release, done func()) error {
 	volume := config.Volume
 	snapshot := config.Snapshot
-	destURL := config.DestURL
-	deltaOps := config.DeltaOps
-	if deltaOps == nil {
-		return "", fmt.Errorf("Missing DeltaBlockBackupOperations")
-	}
+	backupName := h.Name()
+
+	// Once started, the backup in background unlocks the volume and calls
+	// done. The completion is only reported after, so another backup can
+	// be started at once.
+	started := false
+	var existing *BackupResult
+	defer func() {
+		if !started {
+			release()
+			done()
+		}
+		if existing != nil {
+			tracker.complete(existing.BackupURL)
+			h.finish(existing, nil)
+		}
+	}()
 
-	bsDriver, err := GetBackupStoreDriver(destURL)
+	unlock, err := lockVolume(bsDriver, volume.Name, "backup")
 	if err != nil {
-		return "", err
+		return err
 	}
+	defer func() {
+		if !started {
+			unlock()
+		}
+	}()
 
 	if err := addVolume(volume, bsDriver); err != nil {
-		return "", err
+		return err
 	}
 
 	// Update volume from backupstore
 	volume, err = loadVolume(volume.Name, bsDriver)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	lastBackupName := volume.LastBackupName
+	if config.BackupName != "" && backupExists(backupName, volume.Name, bsDriver) {
+		existing, err = getExistingBackupResult(config, backupName, bsDriver)
+		return err
+	}
 
-	if err := deltaOps.OpenSnapshot(snapshot.Name, volume.Name); err != nil {
-		return "", err
+	quota := newVolumeQuota(volume)
+	if err := quota.check(); err != nil {
+		return err
+	}
+
+	mode, err := getVolumeChunkingMode(volume, config.ChunkingMode)
+	if err != nil {
+		return err
+	}
+
+	hooks := newBackupHooks(config, backupName)
+	if err := hooks.runPre(ctx); err != nil {
+		return err
+	}
+	if err := deltaOps.OpenSnapshot(ctx, snapshot.Name, volume.Name); err != nil {
+		return hooks.runPost(err)
+	}
+
+	delta, lastBackup, err := getSnapshotDelta(ctx, deltaOps, config, volume, bsDriver, tracker.log)
+	if err != nil {
+		return hooks.runPost(closeSnapshot(deltaOps, snapshot.Name, volume.Name, err))
+	}
+	if mode == ChunkingModeCDC {
+		delta = getChunkRanges(delta, lastBackup)
+	}
+
+	tracker.log.WithFields(logrus.Fields{
+		LogFieldReason:   LogReasonStart,
+		LogFieldEvent:    LogEventBackup,
+		LogFieldObject:   LogObjectSnapshot,
+		LogFieldSnapshot: snapshot.Name,
+	}).Debug("Creating backup")
+
+	deltaBackup := &Backup{
+		Name:         backupName,
+		VolumeName:   volume.Name,
+		SnapshotName: snapshot.Name,
+		Blocks:       []BlockMapping{},
+	}
+
+	tracker.pending()
+	started = true
+	go func() {
+		// PostBackup is called even if the backup panics
+		defer hooks.runPost(errBackupAborted)
+
+		tracker.start()
+		// PostBackup is called as soon as the snapshot is read, before the
+		// last blocks are uploaded, or here with the error if the backup
+		// failed before reading
+		result, err := performIncrementalBackup(ctx, config, deltaOps, delta, mode, deltaBackup, lastBackup,
+			bsDriver, tracker, quota, hooks.runPost)
+		release()
+		if err != nil {
+			err = hooks.runPost(err)
+		}
+		err = hooks.runPost(closeSnapshot(deltaOps, snapshot.Name, volume.Name, err))
+		// The volume is unlocked before the completion is reported, so
+		// another operation can be started on it at once
+		unlock()
+		done()
+		switch {
+		case err == nil:
+			tracker.complete(result.BackupURL)
+		case ctx.Err() == context.Canceled:
+			tracker.cancel(err)
+		default:
+			// The backup may have been saved if only closing failed
+			if result != nil {
+				tracker.status.URL = result.BackupURL
+			}
+			tracker.fail(err)
+		}
+		h.finish(result, err)
+	}()
+	return nil
+}
+
+// validateBaseBackup checks the base backup pinned by config if any
+func validateBaseBackup(config *DeltaBackupConfig) error {
+	if config.BaseBackupName != "" && !util.ValidateName(config.BaseBackupName) {
+		return fmt.Errorf("Invalid base backup name %v", config.BaseBackupName)
+	}
+	if config.BaseSnapshotName != "" && config.BaseBackupName == "" {
+		return fmt.Errorf("Base snapshot %v specified without base backup", config.BaseSnapshotName)
+	}
+	return nil
+}
+
+// getSnapshotDelta returns the blocks of the opened snapshot of config
+// changed since the base backup of config, or the last backup of volume,
+// along with that backup, which is nil if the whole snapshot has to be
+// backed up. It logs to log.
+func getSnapshotDelta(ctx context.Context, deltaOps DeltaBlockBackupOperationsV2, config *DeltaBackupConfig,
+	volume *Volume, bsDriver BackupStoreDriver, log *logrus.Entry) (*Mappings, *Backup, error) {
+	snapshot := config.Snapshot
+	lastBackupName := volume.LastBackupName
+	if config.BaseBackupName != "" {
+		lastBackupName = config.BaseBackupName
 	}
 
 	var lastSnapshotName string
 	var lastBackup *Backup
+	var err error
 	if lastBackupName != "" {
 		lastBackup, err = loadBackup(lastBackupName, volume.Name, bsDriver)
 		if err != nil {
-			deltaOps.CloseSnapshot(snapshot.Name, volume.Name)
-			return "", err
+			if config.BaseBackupName != "" {
+				return nil, nil, fmt.Errorf("Cannot load base backup %v of volume %v: %v",
+					config.BaseBackupName, volume.Name, err)
+			}
+			return nil, nil, err
 		}
 
 		lastSnapshotName = lastBackup.SnapshotName
-		if lastSnapshotName == snapshot.Name {
+		if config.BaseSnapshotName != "" {
+			lastSnapshotName = config.BaseSnapshotName
+			if lastSnapshotName == snapshot.Name {
+				return nil, nil, fmt.Errorf("Base snapshot %v cannot be the snapshot to back up", lastSnapshotName)
+			}
+			if !deltaOps.HasSnapshot(ctx, lastSnapshotName, volume.Name) {
+				return nil, nil, fmt.Errorf("Cannot find base snapshot %v of volume %v", lastSnapshotName, volume.Name)
+			}
+		} else if lastSnapshotName == snapshot.Name {
 			//Generate full snapshot if the snapshot has been backed up last time
 			lastSnapshotName = ""
 			log.Debug("Would create full snapshot metadata")
-		} else if !deltaOps.HasSnapshot(lastSnapshotName, volume.Name) {
+		} else if !deltaOps.HasSnapshot(ctx, lastSnapshotName, volume.Name) {
 			// It's possible that the snapshot in backupstore doesn't exist
 			// in local storage
 			lastSnapshotName = ""
@@ -114,14 +500,12 @@ func CreateDeltaBlockBackup(config *DeltaBackupConfig) (string, error) {
 		LogFieldLastSnapshot: lastSnapshotName,
 	}).Debug("Generating snapshot changed blocks metadata")
 
-	delta, err := deltaOps.CompareSnapshot(snapshot.Name, lastSnapshotName, volume.Name)
+	delta, err := deltaOps.CompareSnapshot(ctx, snapshot.Name, lastSnapshotName, volume.Name)
 	if err != nil {
-		deltaOps.CloseSnapshot(snapshot.Name, volume.Name)
-		return "", err
+		return nil, nil, err
 	}
-	if delta.BlockSize != DEFAULT_BLOCK_SIZE {
-		deltaOps.CloseSnapshot(snapshot.Name, volume.Name)
-		return "", fmt.Errorf("currently doesn't support different block sizes driver other than %v", DEFAULT_BLOCK_SIZE)
+	if err := checkVolumeBlockSize(volume, delta.BlockSize); err != nil {
+		return nil, nil, err
 	}
 	log.WithFields(logrus.Fields{
 		LogFieldReason:       LogReasonComplete,
@@ -130,125 +514,89 @@ func CreateDeltaBlockBackup(config *DeltaBackupConfig) (string, error) {
 		LogFieldSnapshot:     snapshot.Name,
 		LogFieldLastSnapshot: lastSnapshotName,
 	}).Debug("Generated snapshot changed blocks metadata")
-
-	log.WithFields(logrus.Fields{
-		LogFieldReason:   LogReasonStart,
-		LogFieldEvent:    LogEventBackup,
-		LogFieldObject:   LogObjectSnapshot,
-		LogFieldSnapshot: snapshot.Name,
-	}).Debug("Creating backup")
-
-	deltaBackup := &Backup{
-		Name:         util.GenerateName("backup"),
-		VolumeName:   volume.Name,
-		SnapshotName: snapshot.Name,
-		Blocks:       []BlockMapping{},
-	}
-
-	go func() {
-		defer deltaOps.CloseSnapshot(snapshot.Name, volume.Name)
-		if progress, backup, err := performIncrementalBackup(config, delta, deltaBackup, lastBackup, bsDriver); err != nil {
-			deltaOps.UpdateBackupStatus(snapshot.Name, volume.Name, progress, "", err.Error())
-		} else {
-			deltaOps.UpdateBackupStatus(snapshot.Name, volume.Name, progress, backup, "")
-		}
-	}()
-	return deltaBackup.Name, nil
+	return delta, lastBackup, nil
 }
 
-func performIncrementalBackup(config *DeltaBackupConfig, delta *Mappings, deltaBackup *Backup, lastBackup *Backup,
-	bsDriver BackupStoreDriver) (int, string, error) {
+func performIncrementalBackup(ctx context.Context, config *DeltaBackupConfig, deltaOps DeltaBlockBackupOperationsV2,
+	delta *Mappings, mode ChunkingMode, deltaBackup *Backup, lastBackup *Backup,
+	bsDriver BackupStoreDriver, tracker *backupStatusTracker, quota *volumeQuota,
+	readDone func(err error) error) (*BackupResult, error) {
 
 	volume := config.Volume
 	snapshot := config.Snapshot
 	destURL := config.DestURL
-	deltaOps := config.DeltaOps
-
-	var progress int
-	mCounts := len(delta.Mappings)
-	newBlocks := int64(0)
-	for m, d := range delta.Mappings {
-		if d.Size%delta.BlockSize != 0 {
-			return progress, "", fmt.Errorf("Mapping's size %v is not multiples of backup block size %v",
-				d.Size, delta.BlockSize)
-		}
-		block := make([]byte, DEFAULT_BLOCK_SIZE)
-		blkCounts := d.Size / delta.BlockSize
-		for i := int64(0); i < blkCounts; i++ {
-			offset := d.Offset + i*delta.BlockSize
-			log.Debugf("Backup for %v: segment %v/%v, blocks %v/%v", snapshot.Name, m+1, mCounts, i+1, blkCounts)
-			err := deltaOps.ReadSnapshot(snapshot.Name, volume.Name, offset, block)
-			if err != nil {
-				return progress, "", err
-			}
-			checksum := util.GetChecksum(block)
-			blkFile := getBlockFilePath(volume.Name, checksum)
-			if bsDriver.FileSize(blkFile) >= 0 {
-				blockMapping := BlockMapping{
-					Offset:        offset,
-					BlockChecksum: checksum,
-				}
-				deltaBackup.Blocks = append(deltaBackup.Blocks, blockMapping)
-				log.Debugf("Found existed block match at %v", blkFile)
-				continue
-			}
-
-			rs, err := util.CompressData(block)
-			if err != nil {
-				return progress, "", err
-			}
 
-			if err := bsDriver.Write(blkFile, rs); err != nil {
-				return progress, "", err
-			}
-			log.Debugf("Created new block file at %v", blkFile)
+	reader, err := deltaOps.ReadSnapshot(ctx, snapshot.Name, volume.Name)
+	if err != nil {
+		return nil, newBackupError(BackupErrorTypeSnapshot, err)
+	}
 
-			newBlocks++
-			blockMapping := BlockMapping{
-				Offset:        offset,
-				BlockChecksum: checksum,
-			}
-			deltaBackup.Blocks = append(deltaBackup.Blocks, blockMapping)
-		}
-		progress = int((float64(m+1) / float64(mCounts)) * PROGRESS_PERCENTAGE_BACKUP_SNAPSHOT)
-		deltaOps.UpdateBackupStatus(snapshot.Name, volume.Name, progress, "", "")
+	blocks, newBlocks, err := backupDeltaBlocks(ctx, config, reader, delta, mode, lastBackup, bsDriver, tracker,
+		quota, readDone)
+	if err != nil {
+		return nil, err
 	}
+	deltaBackup.Blocks = append(deltaBackup.Blocks, blocks...)
 
-	log.WithFields(logrus.Fields{
+	tracker.log.WithFields(logrus.Fields{
 		LogFieldReason:   LogReasonComplete,
 		LogFieldEvent:    LogEventBackup,
 		LogFieldObject:   LogObjectSnapshot,
 		LogFieldSnapshot: snapshot.Name,
 	}).Debug("Created snapshot changed blocks")
 
-	backup := mergeSnapshotMap(deltaBackup, lastBackup)
+	backup := mergeSnapshotMap(deltaBackup, lastBackup, delta.BlockSize)
+	if lastBackup != nil {
+		backup.ParentBackupName = lastBackup.Name
+	}
 	backup.SnapshotName = snapshot.Name
 	backup.SnapshotCreatedAt = snapshot.CreatedTime
 	backup.CreatedTime = util.Now()
-	backup.Size = int64(len(backup.Blocks)) * DEFAULT_BLOCK_SIZE
+	backup.BlockSize = delta.BlockSize
+	backup.Size = getBlocksLength(backup.Blocks, delta.BlockSize)
+	backup.StoredSize = getBlocksStoredSize(backup.Blocks)
 	backup.Labels = config.Labels
+	backup.Description = config.Description
+	backup.Annotations = config.Annotations
+	backup.ExpiresAt = config.ExpiresAt
 
 	if err := saveBackup(backup, bsDriver); err != nil {
-		return progress, "", err
+		return nil, newBackupError(BackupErrorTypeBackupstore, err)
 	}
 
-	volume, err := loadVolume(volume.Name, bsDriver)
+	volume, err = loadVolume(volume.Name, bsDriver)
 	if err != nil {
-		return progress, "", err
+		return nil, newBackupError(BackupErrorTypeBackupstore, err)
 	}
 
 	volume.LastBackupName = backup.Name
 	volume.LastBackupAt = backup.SnapshotCreatedAt
+	volume.BlockSize = delta.BlockSize
+	volume.ChunkingMode = mode
 	volume.BlockCount = volume.BlockCount + newBlocks
+	volume.StoredSize = volume.StoredSize + quota.newSize
 
 	if err := saveVolume(volume, bsDriver); err != nil {
-		return progress, "", err
+		return nil, newBackupError(BackupErrorTypeBackupstore, err)
 	}
 
-	return PROGRESS_PERCENTAGE_BACKUP_TOTAL, encodeBackupURL(backup.Name, volume.Name, destURL), nil
+	return &BackupResult{
+		OperationID:      config.OperationID,
+		BackupURL:        encodeBackupURL(backup.Name, volume.Name, destURL),
+		BackupName:       backup.Name,
+		VolumeName:       volume.Name,
+		SnapshotName:     backup.SnapshotName,
+		CreatedTime:      backup.CreatedTime,
+		Size:             backup.Size,
+		TotalBlocks:      int64(len(backup.Blocks)),
+		NewBlocks:        newBlocks,
+		BytesTransferred: tracker.status.BytesTransferred,
+	}, nil
 }
 
-func mergeSnapshotMap(deltaBackup, lastBackup *Backup) *Backup {
+// mergeSnapshotMap keeps the blocks of lastBackup which don't overlap any
+// block of deltaBackup
+func mergeSnapshotMap(deltaBackup, lastBackup *Backup, blockSize int64) *Backup {
 	if lastBackup == nil {
 		return deltaBackup
 	}
@@ -262,16 +610,14 @@ func mergeSnapshotMap(deltaBackup, lastBackup *Backup) *Backup {
 	for d, l = 0, 0; d < len(deltaBackup.Blocks) && l < len(lastBackup.Blocks); {
 		dB := deltaBackup.Blocks[d]
 		lB := lastBackup.Blocks[l]
-		if dB.Offset == lB.Offset {
+		if dB.Offset+getBlockLength(dB, blockSize) <= lB.Offset {
 			backup.Blocks = append(backup.Blocks, dB)
 			d++
+		} else if lB.Offset+getBlockLength(lB, blockSize) <= dB.Offset {
+			backup.Blocks = append(backup.Blocks, lB)
 			l++
-		} else if dB.Offset < lB.Offset {
-			backup.Blocks = append(backup.Blocks, dB)
-			d++
 		} else {
-			//dB.Offset > lB.offset
-			backup.Blocks = append(backup.Blocks, lB)
+			// The block of lastBackup is replaced
 			l++
 		}
 	}
@@ -286,134 +632,142 @@ func mergeSnapshotMap(deltaBackup, lastBackup *Backup) *Backup {
 }
 
 func RestoreDeltaBlockBackup(backupURL, volDevName string) error {
-	bsDriver, err := GetBackupStoreDriver(backupURL)
+	return RestoreDeltaBlockBackupWithConfig(&DeltaRestoreConfig{
+		BackupURL: backupURL,
+		Filename:  volDevName,
+	})
+}
+
+func RestoreDeltaBlockBackupIncrementally(backupURL, volDevName, lastBackupName string) error {
+	// check lastBackupName
+	if !util.ValidateName(lastBackupName) {
+		return fmt.Errorf("Invalid parameter lastBackupName %v", lastBackupName)
+	}
+	return RestoreDeltaBlockBackupWithConfig(&DeltaRestoreConfig{
+		BackupURL:      backupURL,
+		Filename:       volDevName,
+		LastBackupName: lastBackupName,
+	})
+}
+
+// RestoreDeltaBlockBackupWithConfig restores the backup to the file or block
+// device, either fully or incrementally on top of the last restored backup.
+func RestoreDeltaBlockBackupWithConfig(config *DeltaRestoreConfig) error {
+	return RestoreDeltaBlockBackupWithContext(context.Background(), config)
+}
+
+// RestoreDeltaBlockBackupWithContext restores the backup the same way as
+// RestoreDeltaBlockBackupWithConfig, until ctx is canceled, including while
+// waiting for a restore slot
+func RestoreDeltaBlockBackupWithContext(ctx context.Context, config *DeltaRestoreConfig) error {
+	if config == nil {
+		return fmt.Errorf("Invalid empty config for restore")
+	}
+	bsDriver, err := GetBackupStoreDriver(config.BackupURL)
 	if err != nil {
 		return err
 	}
+	return restoreDeltaBlockBackup(ctx, config, bsDriver)
+}
+
+// restoreDeltaBlockBackup restores the backup of config from the backupstore
+// of bsDriver, until ctx is canceled
+func restoreDeltaBlockBackup(ctx context.Context, config *DeltaRestoreConfig, bsDriver BackupStoreDriver) error {
+	// The config of the caller may be reused for other restores
+	c := *config
+	config = &c
+	config.OperationID = getOperationID(config.OperationID, "restore")
+	opLog := operationLog(config.OperationID)
+
+	backupURL := config.BackupURL
+	volDevName := config.Filename
 
 	srcBackupName, srcVolumeName, err := decodeBackupURL(backupURL)
 	if err != nil {
 		return err
 	}
 
+	release, err := acquireJobSlot(ctx, restoreLimiter, bsDriver)
+	if err != nil {
+		return err
+	}
+	defer release()
+
 	vol, err := loadVolume(srcVolumeName, bsDriver)
 	if err != nil {
 		return generateError(logrus.Fields{
+			LogFieldOperation: config.OperationID,
 			LogFieldVolume:    srcVolumeName,
 			LogEventBackupURL: backupURL,
 		}, "Volume doesn't exist in backupstore: %v", err)
 	}
 
-	if vol.Size == 0 || vol.Size%DEFAULT_BLOCK_SIZE != 0 {
+	if vol.Size <= 0 {
 		return fmt.Errorf("Read invalid volume size %v", vol.Size)
 	}
 
-	volDev, err := os.Create(volDevName)
+	lastBackup, restoredSize, err := getRestoreBaseline(config, srcVolumeName, bsDriver)
 	if err != nil {
 		return err
 	}
-	defer volDev.Close()
-
-	stat, err := volDev.Stat()
+	if restoredSize == 0 && lastBackup != nil {
+		restoredSize = vol.Size
+	}
+	targetSize, err := getRestoreTargetSize(config, vol, restoredSize)
 	if err != nil {
 		return err
 	}
-
 	backup, err := loadBackup(srcBackupName, srcVolumeName, bsDriver)
 	if err != nil {
 		return err
 	}
-
-	log.WithFields(logrus.Fields{
-		LogFieldReason:     LogReasonStart,
-		LogFieldEvent:      LogEventRestore,
-		LogFieldObject:     LogFieldSnapshot,
-		LogFieldSnapshot:   srcBackupName,
-		LogFieldOrigVolume: srcVolumeName,
-		LogFieldVolumeDev:  volDevName,
-		LogEventBackupURL:  backupURL,
-	}).Debug()
-	blkCounts := len(backup.Blocks)
-	for i, block := range backup.Blocks {
-		log.Debugf("Restore for %v: block %v, %v/%v", volDevName, block.BlockChecksum, i+1, blkCounts)
-		if err := restoreBlockToFile(srcVolumeName, volDev, bsDriver, block); err != nil {
-			return err
-		}
+	if err := checkBackupBlockSize(vol, backup); err != nil {
+		return err
 	}
-
-	// We want to truncate regular files, but not device
-	if stat.Mode()&os.ModeType == 0 {
-		log.Debugf("Truncate %v to size %v", volDevName, vol.Size)
-		if err := volDev.Truncate(vol.Size); err != nil {
+	if lastBackup != nil {
+		if err := checkBackupBlockSize(vol, lastBackup); err != nil {
 			return err
 		}
 	}
+	blockSize := getVolumeBlockSize(vol)
 
-	return nil
-}
-
-func restoreBlockToFile(volumeName string, volDev *os.File, bsDriver BackupStoreDriver, blk BlockMapping) error {
-	blkFile := getBlockFilePath(volumeName, blk.BlockChecksum)
-	rc, err := bsDriver.Read(blkFile)
-	if err != nil {
-		return err
-	}
-	defer rc.Close()
-	r, err := util.DecompressAndVerify(rc, blk.BlockChecksum)
-	if err != nil {
-		return err
-	}
-	if _, err := volDev.Seek(blk.Offset, 0); err != nil {
-		return err
-	}
-	if _, err := io.CopyN(volDev, r, DEFAULT_BLOCK_SIZE); err != nil {
-		return err
-	}
-	return nil
-}
-
-func RestoreDeltaBlockBackupIncrementally(backupURL, volDevName, lastBackupName string) error {
-	bsDriver, err := GetBackupStoreDriver(backupURL)
-	if err != nil {
-		return err
+	if config.AuditBlocks {
+		report := auditBlocks(backupURL, srcVolumeName, backup.Blocks, blockSize, bsDriver, config.VerifyBlockChecksums)
+		if !report.Healthy() && !config.BestEffort {
+			return &BlockAuditError{report}
+		}
 	}
 
-	srcBackupName, srcVolumeName, err := decodeBackupURL(backupURL)
+	// The target won't match any backup until the restore completes
+	stateFile, err := getRestoreStateFile(config)
 	if err != nil {
 		return err
 	}
-
-	vol, err := loadVolume(srcVolumeName, bsDriver)
-	if err != nil {
-		return generateError(logrus.Fields{
-			LogFieldVolume:    srcVolumeName,
-			LogEventBackupURL: backupURL,
-		}, "Volume doesn't exist in backupstore: %v", err)
-	}
-
-	if vol.Size == 0 || vol.Size%DEFAULT_BLOCK_SIZE != 0 {
-		return fmt.Errorf("Read invalid volume size %v", vol.Size)
-	}
-
-	// check lastBackupName
-	if !util.ValidateName(lastBackupName) {
-		return fmt.Errorf("Invalid parameter lastBackupName %v", lastBackupName)
+	if stateFile != "" {
+		if err := removeRestoreState(stateFile); err != nil {
+			return err
+		}
 	}
 
 	// check volDev
 	var volDev *os.File
-	if _, err := os.Stat(volDevName); os.IsNotExist(err) {
+	if lastBackup == nil {
+		volDev, err = os.Create(volDevName)
+		if err != nil {
+			return err
+		}
+	} else if _, err := os.Stat(volDevName); os.IsNotExist(err) {
 		volDev, err = os.Create(volDevName)
 		if err != nil {
 			return err
 		}
-		logrus.Debugf("Created new file %v", volDevName)
+		opLog.Debugf("Created new file %v", volDevName)
 	} else {
 		volDev, err = os.OpenFile(volDevName, os.O_RDWR, 0600)
 		if err != nil {
 			return err
 		}
-		logrus.Debugf("File %v existed\n", volDevName)
+		opLog.Debugf("File %v existed\n", volDevName)
 	}
 	defer volDev.Close()
 
@@ -422,88 +776,369 @@ func RestoreDeltaBlockBackupIncrementally(backupURL, volDevName, lastBackupName
 		return err
 	}
 
-	lastBackup, err := loadBackup(lastBackupName, srcVolumeName, bsDriver)
+	w := util.NewCoalescingWriter(volDev, int(RESTORE_WRITE_BLOCKS*blockSize))
+	defer w.Close()
+	restorer := &blockRestorer{
+		ctx:         ctx,
+		log:         opLog,
+		volumeName:  srcVolumeName,
+		volDev:      w,
+		discard:     config.DiscardUnmapped,
+		bsDriver:    bsDriver,
+		blockSize:   blockSize,
+		tracker:     newRestoreProgressTracker(config),
+		concurrency: config.Concurrency,
+	}
+	if util.IsBlockDevice(stat) {
+		devSize, err := volDev.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+		if devSize < targetSize {
+			return fmt.Errorf("Block device %v of %v bytes is smaller than the target size %v", volDevName, devSize, targetSize)
+		}
+		restorer.blockDev = volDev
+	}
+	if config.BestEffort {
+		restorer.report = &BlockAuditReport{
+			BackupURL:  backupURL,
+			BlockCount: len(backup.Blocks),
+		}
+	}
+	if lastBackup == nil {
+		opLog.WithFields(logrus.Fields{
+			LogFieldReason:     LogReasonStart,
+			LogFieldEvent:      LogEventRestore,
+			LogFieldObject:     LogFieldSnapshot,
+			LogFieldSnapshot:   srcBackupName,
+			LogFieldOrigVolume: srcVolumeName,
+			LogFieldVolumeDev:  volDevName,
+			LogEventBackupURL:  backupURL,
+		}).Debug()
+		err = restoreBlocks(restorer, volDevName, backup, targetSize)
+	} else {
+		opLog.WithFields(logrus.Fields{
+			LogFieldReason:     LogReasonStart,
+			LogFieldEvent:      LogEventRestoreIncre,
+			LogFieldObject:     LogFieldSnapshot,
+			LogFieldSnapshot:   srcBackupName,
+			LogFieldOrigVolume: srcVolumeName,
+			LogFieldVolumeDev:  volDevName,
+			LogEventBackupURL:  backupURL,
+		}).Debugf("Started incrementally restoring from %v to %v", lastBackup, backup)
+		// The part of the block device the target is expanded to may
+		// have content of its previous use
+		if restorer.blockDev != nil && targetSize > restoredSize {
+			err = restorer.clearRange(restoredSize, targetSize-restoredSize)
+		}
+		if err == nil {
+			err = restoreBlocksIncrementally(restorer, backup, lastBackup)
+		}
+	}
 	if err != nil {
 		return err
 	}
-	backup, err := loadBackup(srcBackupName, srcVolumeName, bsDriver)
-	if err != nil {
+	if err := w.Flush(); err != nil {
 		return err
 	}
 
-	log.WithFields(logrus.Fields{
-		LogFieldReason:     LogReasonStart,
-		LogFieldEvent:      LogEventRestoreIncre,
-		LogFieldObject:     LogFieldSnapshot,
-		LogFieldSnapshot:   srcBackupName,
-		LogFieldOrigVolume: srcVolumeName,
-		LogFieldVolumeDev:  volDevName,
-		LogEventBackupURL:  backupURL,
-	}).Debugf("Started incrementally restoring from %v to %v", lastBackup, backup)
-
-	emptyBlock := make([]byte, DEFAULT_BLOCK_SIZE)
-	for b, l := 0, 0; b < len(backup.Blocks) || l < len(lastBackup.Blocks); {
-		if b >= len(backup.Blocks) {
-			if err := fillBlockToFile(&emptyBlock, volDev, lastBackup.Blocks[l].Offset); err != nil {
-				return err
-			}
-			l++
-			continue
+	// We want to truncate regular files, but not device
+	if stat.Mode()&os.ModeType == 0 {
+		opLog.Debugf("Truncate %v to size %v", volDevName, targetSize)
+		if err := volDev.Truncate(targetSize); err != nil {
+			return err
+		}
+	}
+
+	if report := restorer.report; report != nil && !report.Healthy() {
+		report.fillDamagedRegions(blockSize)
+		return &BlockAuditError{report}
+	}
+
+	if stateFile != "" {
+		// The restore succeeded regardless, the next one would only be a
+		// full one without the marker
+		if err := saveRestoreTargetState(stateFile, volDevName, &RestoreState{
+			VolumeName:     srcVolumeName,
+			BackupName:     backup.Name,
+			BlocksChecksum: getBlocksChecksum(backup.Blocks),
+			Size:           targetSize,
+		}); err != nil {
+			opLog.Warnf("Failed to save the restore state of %v to %v: %v", volDevName, stateFile, err)
 		}
-		if l >= len(lastBackup.Blocks) {
-			if err := restoreBlockToFile(srcVolumeName, volDev, bsDriver, backup.Blocks[b]); err != nil {
+	}
+	restorer.tracker.complete()
+	return nil
+}
+
+func restoreBlocks(r *blockRestorer, volDevName string, backup *Backup, size int64) error {
+	r.log.Debugf("Restore for %v: %v blocks", volDevName, len(backup.Blocks))
+	// A regular file is recreated, so only a block device may have content
+	// where the backup has no block
+	if r.blockDev != nil {
+		volume := []BlockMapping{{Length: size}}
+		for _, region := range getUncoveredRanges(volume, backup.Blocks, r.blockSize) {
+			if err := r.clearRange(region.offset, region.length); err != nil {
 				return err
 			}
-			b++
-			continue
 		}
+	}
+	return r.restoreAll(backup.Blocks)
+}
 
-		bB := backup.Blocks[b]
-		lB := lastBackup.Blocks[l]
-		if bB.Offset == lB.Offset {
-			if bB.BlockChecksum != lB.BlockChecksum {
-				if err := restoreBlockToFile(srcVolumeName, volDev, bsDriver, bB); err != nil {
-					return err
-				}
+// restoreBlocksIncrementally only writes the blocks which differ between
+// lastBackup and backup, and zeroes the ranges of lastBackup which are no
+// longer covered by backup. The blocks of both may have different offsets if
+// the volume is chunked by content.
+func restoreBlocksIncrementally(r *blockRestorer, backup, lastBackup *Backup) error {
+	for _, region := range getUncoveredRanges(lastBackup.Blocks, backup.Blocks, r.blockSize) {
+		if err := r.clearRange(region.offset, region.length); err != nil {
+			return err
+		}
+	}
+
+	restored := make(map[int64]string, len(lastBackup.Blocks))
+	for _, blk := range lastBackup.Blocks {
+		restored[blk.Offset] = blk.BlockChecksum
+	}
+	changed := []BlockMapping{}
+	for _, blk := range backup.Blocks {
+		if restored[blk.Offset] != blk.BlockChecksum {
+			changed = append(changed, blk)
+		}
+	}
+	return r.restoreAll(changed)
+}
+
+type blockRange struct {
+	offset int64
+	length int64
+}
+
+// getUncoveredRanges returns the ranges of blocks which aren't covered by
+// other. Both are sorted by offset.
+func getUncoveredRanges(blocks, other []BlockMapping, blockSize int64) []blockRange {
+	ranges := []blockRange{}
+	add := func(start, end int64) {
+		if last := len(ranges) - 1; last >= 0 && ranges[last].offset+ranges[last].length == start {
+			ranges[last].length += end - start
+			return
+		}
+		ranges = append(ranges, blockRange{start, end - start})
+	}
+
+	o := 0
+	for _, blk := range blocks {
+		start, end := blk.Offset, blk.Offset+getBlockLength(blk, blockSize)
+		for o < len(other) && other[o].Offset+getBlockLength(other[o], blockSize) <= start {
+			o++
+		}
+		for k := o; k < len(other) && other[k].Offset < end; k++ {
+			if other[k].Offset > start {
+				add(start, other[k].Offset)
 			}
-			b++
-			l++
-		} else if bB.Offset < lB.Offset {
-			if err := restoreBlockToFile(srcVolumeName, volDev, bsDriver, bB); err != nil {
+			if otherEnd := other[k].Offset + getBlockLength(other[k], blockSize); otherEnd > start {
+				start = otherEnd
+			}
+		}
+		if start < end {
+			add(start, end)
+		}
+	}
+	return ranges
+}
+
+// blockRestorer writes the blocks to the restore target
+type blockRestorer struct {
+	// ctx cancels the restore between the blocks
+	ctx        context.Context
+	log        *logrus.Entry
+	volumeName string
+	volDev     io.WriterAt
+	bsDriver   BackupStoreDriver
+	blockSize  int64
+	// concurrency is the number of blocks read from the backupstore at
+	// once. They're still written in order.
+	concurrency int
+
+	tracker *restoreProgressTracker
+
+	// report collects the damaged blocks, which are zero-filled, when
+	// restoring on a best effort basis. It's nil otherwise.
+	report     *BlockAuditReport
+	emptyBlock []byte
+
+	// blockDev is the restore target if it's a block device, whose ranges
+	// not covered by the backup are cleared by ioctls. It's reset once
+	// the device doesn't support them.
+	blockDev *os.File
+	// discard discards the ranges instead of zeroing them out
+	discard bool
+}
+
+// restoreAll restores the blocks, sorted by offset
+func (r *blockRestorer) restoreAll(blocks []BlockMapping) error {
+	r.tracker.start(int64(len(blocks)))
+	if r.concurrency <= 1 {
+		for _, blk := range blocks {
+			if err := r.ctx.Err(); err != nil {
 				return err
 			}
-			b++
-		} else {
-			if err := fillBlockToFile(&emptyBlock, volDev, lB.Offset); err != nil {
+			if err := r.restore(blk); err != nil {
 				return err
 			}
-			l++
 		}
+		return nil
 	}
 
-	// We want to truncate regular files, but not device
-	if stat.Mode()&os.ModeType == 0 {
-		log.Debugf("Truncate %v to size %v", volDevName, vol.Size)
-		if err := volDev.Truncate(vol.Size); err != nil {
+	bufs := make([]*bytes.Buffer, r.concurrency)
+	errs := make([]error, r.concurrency)
+	for i := 0; i < len(blocks); i += r.concurrency {
+		if err := r.ctx.Err(); err != nil {
+			return err
+		}
+		batch := blocks[i:]
+		if len(batch) > r.concurrency {
+			batch = batch[:r.concurrency]
+		}
+		var wg sync.WaitGroup
+		for j := range batch {
+			wg.Add(1)
+			go func(j int) {
+				defer wg.Done()
+				bufs[j] = util.GetBuffer()
+				errs[j] = readBlock(r.volumeName, r.bsDriver, batch[j], bufs[j])
+			}(j)
+		}
+		wg.Wait()
+
+		var err error
+		for j, blk := range batch {
+			if err == nil {
+				err = r.write(blk, bufs[j], errs[j])
+			}
+			util.PutBuffer(bufs[j])
+		}
+		if err != nil {
 			return err
 		}
 	}
+	return nil
+}
+
+// restore writes the block at its offset of volDev
+func (r *blockRestorer) restore(blk BlockMapping) error {
+	buf := util.GetBuffer()
+	defer util.PutBuffer(buf)
+	return r.write(blk, buf, readBlock(r.volumeName, r.bsDriver, blk, buf))
+}
 
+// write writes the block read into buf at its offset of volDev, or zeroes it
+// if it couldn't be read and the restore is on a best effort basis
+func (r *blockRestorer) write(blk BlockMapping, buf *bytes.Buffer, readErr error) error {
+	if readErr != nil {
+		if r.report == nil {
+			return readErr
+		}
+		blkFile := getBlockFilePath(r.volumeName, blk.BlockChecksum)
+		if r.bsDriver.FileExists(blkFile) {
+			r.report.CorruptedBlocks = append(r.report.CorruptedBlocks, blk)
+		} else {
+			r.report.MissingBlocks = append(r.report.MissingBlocks, blk)
+		}
+		r.log.Warnf("Zero-filled damaged block %v at offset %v: %v", blkFile, blk.Offset, readErr)
+		if err := r.zero(blk); err != nil {
+			return err
+		}
+	} else {
+		if _, err := r.volDev.WriteAt(buf.Bytes(), blk.Offset); err != nil {
+			return err
+		}
+		r.tracker.written(int64(buf.Len()))
+	}
+	r.tracker.blockDone()
 	return nil
 }
 
-func fillBlockToFile(block *[]byte, volDev *os.File, offset int64) error {
-	if _, err := volDev.WriteAt(*block, offset); err != nil {
-		return err
+// clearRange clears a range not covered by the backup. The range of a
+// block device is discarded or zeroed out without writing it if the device
+// supports it, and filled with zeroes otherwise.
+func (r *blockRestorer) clearRange(offset, length int64) error {
+	if r.blockDev != nil && r.discard {
+		err := util.DiscardRange(r.blockDev, offset, length)
+		if err == nil {
+			return nil
+		}
+		r.log.WithError(err).Debugf("Cannot discard %v, zeroing out unmapped ranges instead", r.blockDev.Name())
+		r.discard = false
+	}
+	if r.blockDev != nil {
+		err := util.ZeroOutRange(r.blockDev, offset, length)
+		if err == nil {
+			return nil
+		}
+		r.log.WithError(err).Debugf("Cannot zero out %v, writing zeroes to unmapped ranges instead", r.blockDev.Name())
+		r.blockDev = nil
+	}
+	return r.zeroRange(offset, length)
+}
+
+// zero fills the range of the block with zeroes
+func (r *blockRestorer) zero(blk BlockMapping) error {
+	return r.zeroRange(blk.Offset, getBlockLength(blk, r.blockSize))
+}
+
+func (r *blockRestorer) zeroRange(offset, length int64) error {
+	if r.emptyBlock == nil {
+		r.emptyBlock = make([]byte, r.blockSize)
+	}
+	for length > 0 {
+		n := int64(len(r.emptyBlock))
+		if length < n {
+			n = length
+		}
+		if _, err := r.volDev.WriteAt(r.emptyBlock[:n], offset); err != nil {
+			return err
+		}
+		r.tracker.written(n)
+		offset += n
+		length -= n
 	}
 	return nil
 }
 
+// readBlock reads the block content into buf and verifies it
+func readBlock(volumeName string, bsDriver BackupStoreDriver, blk BlockMapping, buf *bytes.Buffer) error {
+	blkFile := getBlockFilePath(volumeName, blk.BlockChecksum)
+	rc, err := bsDriver.Read(blkFile)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if blk.Uncompressed {
+		return util.ReadAndVerifyTo(buf, rc, blk.BlockChecksum)
+	}
+	return util.DecompressAndVerifyTo(buf, rc, blk.BlockChecksum)
+}
+
 func DeleteBackupVolume(volumeName string, destURL string) error {
 	bsDriver, err := GetBackupStoreDriver(destURL)
 	if err != nil {
 		return err
 	}
+	return deleteBackupVolume(volumeName, bsDriver)
+}
+
+func deleteBackupVolume(volumeName string, bsDriver BackupStoreDriver) error {
+	unlock, err := lockVolume(bsDriver, volumeName, "volume deletion")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := checkVolumeDeletable(volumeName, bsDriver, false); err != nil {
+		return err
+	}
 
 	if err := removeVolume(volumeName, bsDriver); err != nil {
 		return err
@@ -512,17 +1147,120 @@ func DeleteBackupVolume(volumeName string, destURL string) error {
 	return nil
 }
 
+// ForceDeleteBackupVolume removes everything under the path of the volume
+// without relying on its metadata, so the volumes with corrupted or missing
+// volume.cfg or backup configurations can still be cleaned up. The protected
+// backups whose configuration can be loaded still prevent the removal.
+func ForceDeleteBackupVolume(volumeName string, destURL string) error {
+	if !util.ValidateName(volumeName) {
+		return fmt.Errorf("Invalid volume name %v", volumeName)
+	}
+	bsDriver, err := GetBackupStoreDriver(destURL)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := lockVolume(bsDriver, volumeName, "volume deletion")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := checkVolumeDeletable(volumeName, bsDriver, true); err != nil {
+		return err
+	}
+
+	// Some drivers remove a limited number of objects at once, so remove
+	// until nothing is left
+	volumePath := getVolumePath(volumeName) + "/"
+	metaCache.invalidate(bsDriver, volumePath)
+	for i := 0; i < FORCE_DELETE_MAX_ROUNDS; i++ {
+		entries, err := bsDriver.List(volumePath)
+		// Directory doesn't exist
+		if err != nil || len(entries) == 0 {
+			log.Debugf("Force removed backup volume %v", volumeName)
+			return bsDriver.Remove(volumePath)
+		}
+		paths := make([]string, len(entries))
+		for j, entry := range entries {
+			paths[j] = filepath.Join(volumePath, entry)
+		}
+		if err := bsDriver.Remove(paths...); err != nil {
+			return fmt.Errorf("Failed to force remove backup volume %v: %v", volumeName, err)
+		}
+	}
+	return fmt.Errorf("Failed to force remove backup volume %v, objects are left after %v rounds",
+		volumeName, FORCE_DELETE_MAX_ROUNDS)
+}
+
+// checkVolumeDeletable fails if any backup of the volume is protected. The
+// backups which cannot be loaded are ignored if force is set.
+func checkVolumeDeletable(volumeName string, bsDriver BackupStoreDriver, force bool) error {
+	backupNames, err := getBackupNamesForVolume(volumeName, bsDriver)
+	if err != nil {
+		if force {
+			return nil
+		}
+		return err
+	}
+	for _, backupName := range backupNames {
+		backup, err := loadBackup(backupName, volumeName, bsDriver)
+		if err != nil {
+			if force {
+				log.Warnf("Ignored backup %v of volume %v which cannot be loaded: %v", backupName, volumeName, err)
+				continue
+			}
+			return err
+		}
+		if err := checkBackupDeletable(backup); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func DeleteDeltaBlockBackup(backupURL string) error {
+	return DeleteDeltaBlockBackupWithOperationID(backupURL, "")
+}
+
+// DeleteDeltaBlockBackupWithOperationID deletes a backup like
+// DeleteDeltaBlockBackup, logging the deletion and the GC of its blocks with
+// operationID, or a generated ID if it's empty
+func DeleteDeltaBlockBackupWithOperationID(backupURL, operationID string) error {
 	bsDriver, err := GetBackupStoreDriver(backupURL)
 	if err != nil {
 		return err
 	}
+	return deleteDeltaBlockBackup(backupURL, operationID, bsDriver)
+}
+
+func deleteDeltaBlockBackup(backupURL, operationID string, bsDriver BackupStoreDriver) error {
+	operationID = getOperationID(operationID, "delete")
+	log := operationLog(operationID)
 
 	backupName, volumeName, err := decodeBackupURL(backupURL)
 	if err != nil {
 		return err
 	}
 
+	unlock, err := lockVolume(bsDriver, volumeName, "backup deletion")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// Deleting a failed backup removes its status
+	if !backupExists(backupName, volumeName, bsDriver) {
+		removed, err := removeFailedBackupStatus(backupName, volumeName, bsDriver)
+		if err != nil {
+			return err
+		}
+		if removed {
+			log.Debugf("Removed status of failed backup %v of volume %v", backupName, volumeName)
+			return nil
+		}
+	}
+
 	v, err := loadVolume(volumeName, bsDriver)
 	if err != nil {
 		return fmt.Errorf("Cannot find volume %v in backupstore", volumeName, err)
@@ -532,22 +1270,31 @@ func DeleteDeltaBlockBackup(backupURL string) error {
 	if err != nil {
 		return err
 	}
-	discardBlockSet := make(map[string]bool)
+	if err := checkBackupDeletable(backup); err != nil {
+		return err
+	}
+	// The stored size of the blocks, zero if unknown
+	discardBlockSet := make(map[string]int64)
 	for _, blk := range backup.Blocks {
-		discardBlockSet[blk.BlockChecksum] = true
+		discardBlockSet[blk.BlockChecksum] = blk.StoredSize
 	}
 	discardBlockCounts := len(discardBlockSet)
 
 	if err := removeBackup(backup, bsDriver); err != nil {
 		return err
 	}
+	if err := removeBackupStatus(backupName, volumeName, bsDriver); err != nil {
+		log.Warnf("Failed to remove status of backup %v: %v", backupName, err)
+	}
 
 	if backup.Name == v.LastBackupName {
 		v.LastBackupName = ""
 		v.LastBackupAt = ""
-		if err := saveVolume(v, bsDriver); err != nil {
-			return err
-		}
+	}
+	// The volume is saved even if it's unchanged, so the inventory syncers
+	// pick up the removal of the backup
+	if err := saveVolume(v, bsDriver); err != nil {
+		return err
 	}
 
 	backupNames, err := getBackupNamesForVolume(volumeName, bsDriver)
@@ -564,18 +1311,24 @@ func DeleteDeltaBlockBackup(backupURL string) error {
 
 	log.Errorf("GC started")
 	for _, backupName := range backupNames {
-		backup, err := loadBackup(backupName, volumeName, bsDriver)
+		// The blocks are decoded one at a time, rather than decoding
+		// the whole block lists of large backups
+		blocks, err := loadBackupBlocks(backupName, volumeName, bsDriver)
 		if err != nil {
 			return err
 		}
-		for _, blk := range backup.Blocks {
+		err = blocks.forEach(func(blk BlockMapping) error {
 			if _, exists := discardBlockSet[blk.BlockChecksum]; exists {
 				delete(discardBlockSet, blk.BlockChecksum)
 				discardBlockCounts--
 				if discardBlockCounts == 0 {
-					break
+					return errStopBlockIteration
 				}
 			}
+			return nil
+		})
+		if err != nil {
+			return err
 		}
 		if discardBlockCounts == 0 {
 			break
@@ -583,15 +1336,29 @@ func DeleteDeltaBlockBackup(backupURL string) error {
 	}
 
 	var blkFileList []string
-	for blk := range discardBlockSet {
-		blkFileList = append(blkFileList, getBlockFilePath(volumeName, blk))
+	discardSize := int64(0)
+	for blk, size := range discardBlockSet {
+		blkFile := getBlockFilePath(volumeName, blk)
+		blkFileList = append(blkFileList, blkFile)
+		if size == 0 {
+			size = bsDriver.FileSize(blkFile)
+		}
+		if size > 0 {
+			discardSize += size
+		}
 		log.Errorf("Found unused blocks %v for volume %v", blk, volumeName)
 	}
-	if err := bsDriver.Remove(blkFileList...); err != nil {
+	if err := removeBlockFiles(volumeName, operationID, blkFileList, bsDriver); err != nil {
 		return err
 	}
 	log.Errorf("Removed unused blocks for volume ", volumeName)
 
+	if GetGCOptions().PurgeStaleBlocks {
+		if _, err := findStaleBlocks(volumeName, bsDriver, true); err != nil {
+			log.WithError(err).Warnf("Failed to purge stale blocks of volume %v", volumeName)
+		}
+	}
+
 	log.Errorf("GC completed")
 	log.Errorf("Removed backupstore backup ", backupName)
 
@@ -601,6 +1368,11 @@ func DeleteDeltaBlockBackup(backupURL string) error {
 	}
 
 	v.BlockCount -= int64(len(discardBlockSet))
+	// The blocks stored before the size was tracked are not accounted
+	v.StoredSize -= discardSize
+	if v.StoredSize < 0 {
+		v.StoredSize = 0
+	}
 
 	if err := saveVolume(v, bsDriver); err != nil {
 		return err
@@ -609,6 +1381,32 @@ func DeleteDeltaBlockBackup(backupURL string) error {
 	return nil
 }
 
+// getMappingBlockCount returns the number of blocks in the mapping. Only the
+// mapping ending the volume may have a last block shorter than blockSize.
+func getMappingBlockCount(d Mapping, blockSize, volumeSize int64) (int64, error) {
+	if d.Size%blockSize != 0 && d.Offset+d.Size != volumeSize {
+		return 0, fmt.Errorf("Mapping's size %v is not multiples of backup block size %v",
+			d.Size, blockSize)
+	}
+	return (d.Size + blockSize - 1) / blockSize, nil
+}
+
+func getBlockLength(blk BlockMapping, blockSize int64) int64 {
+	if blk.Length != 0 {
+		return blk.Length
+	}
+	return blockSize
+}
+
+// getBlocksLength returns the length of the data covered by the blocks
+func getBlocksLength(blocks []BlockMapping, blockSize int64) int64 {
+	length := int64(0)
+	for _, blk := range blocks {
+		length += getBlockLength(blk, blockSize)
+	}
+	return length
+}
+
 func getBlockPath(volumeName string) string {
 	return filepath.Join(getVolumePath(volumeName), BLOCKS_DIRECTORY) + "/"
 }
@@ -617,7 +1415,7 @@ func getBlockFilePath(volumeName, checksum string) string {
 	blockSubDirLayer1 := checksum[0:BLOCK_SEPARATE_LAYER1]
 	blockSubDirLayer2 := checksum[BLOCK_SEPARATE_LAYER1:BLOCK_SEPARATE_LAYER2]
 	path := filepath.Join(getBlockPath(volumeName), blockSubDirLayer1, blockSubDirLayer2)
-	fileName := checksum + ".blk"
+	fileName := checksum + BLK_SUFFIX
 
 	return filepath.Join(path, fileName)
 }
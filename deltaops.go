@@ -0,0 +1,160 @@
+package backupstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// DeltaBlockBackupOperationsV2 is the context aware version of
+// DeltaBlockBackupOperations. The context passed to the methods is the one
+// the backup was created with, except for CloseSnapshot and the final
+// UpdateBackupStatus, which are always called even if the backup has been
+// canceled.
+type DeltaBlockBackupOperationsV2 interface {
+	HasSnapshot(ctx context.Context, id, volumeID string) bool
+	CompareSnapshot(ctx context.Context, id, compareID, volumeID string) (*Mappings, error)
+	OpenSnapshot(ctx context.Context, id, volumeID string) error
+	// ReadSnapshot returns a reader of the opened snapshot, it stays valid
+	// until CloseSnapshot is called
+	ReadSnapshot(ctx context.Context, id, volumeID string) (io.ReaderAt, error)
+	CloseSnapshot(ctx context.Context, id, volumeID string) error
+	UpdateBackupStatus(ctx context.Context, id, volumeID string, status *BackupStatus) error
+}
+
+// NewDeltaBlockBackupOperationsV2 adapts a DeltaBlockBackupOperations to the
+// DeltaBlockBackupOperationsV2 interface. The contexts are ignored.
+func NewDeltaBlockBackupOperationsV2(ops DeltaBlockBackupOperations) DeltaBlockBackupOperationsV2 {
+	return &deltaOpsAdapter{
+		ops:        ops,
+		blockSizes: make(map[string]int64),
+	}
+}
+
+type deltaOpsAdapter struct {
+	ops DeltaBlockBackupOperations
+
+	lock sync.Mutex
+	// blockSizes maps the snapshots compared to the block size of their
+	// changes, by which their reads are split
+	blockSizes map[string]int64
+}
+
+func getSnapshotKey(id, volumeID string) string {
+	return volumeID + "/" + id
+}
+
+func (a *deltaOpsAdapter) HasSnapshot(ctx context.Context, id, volumeID string) bool {
+	return a.ops.HasSnapshot(id, volumeID)
+}
+
+func (a *deltaOpsAdapter) CompareSnapshot(ctx context.Context, id, compareID, volumeID string) (*Mappings, error) {
+	delta, err := a.ops.CompareSnapshot(id, compareID, volumeID)
+	if err != nil {
+		return nil, err
+	}
+	a.lock.Lock()
+	a.blockSizes[getSnapshotKey(id, volumeID)] = delta.BlockSize
+	a.lock.Unlock()
+	return delta, nil
+}
+
+func (a *deltaOpsAdapter) OpenSnapshot(ctx context.Context, id, volumeID string) error {
+	return a.ops.OpenSnapshot(id, volumeID)
+}
+
+func (a *deltaOpsAdapter) ReadSnapshot(ctx context.Context, id, volumeID string) (io.ReaderAt, error) {
+	a.lock.Lock()
+	blockSize := a.blockSizes[getSnapshotKey(id, volumeID)]
+	a.lock.Unlock()
+	if blockSize <= 0 {
+		blockSize = DEFAULT_BLOCK_SIZE
+	}
+	return &snapshotReader{a.ops, id, volumeID, int(blockSize)}, nil
+}
+
+func (a *deltaOpsAdapter) CloseSnapshot(ctx context.Context, id, volumeID string) error {
+	a.lock.Lock()
+	delete(a.blockSizes, getSnapshotKey(id, volumeID))
+	a.lock.Unlock()
+	return a.ops.CloseSnapshot(id, volumeID)
+}
+
+func (a *deltaOpsAdapter) UpdateBackupStatus(ctx context.Context, id, volumeID string, status *BackupStatus) error {
+	return a.ops.UpdateBackupStatus(id, volumeID, status)
+}
+
+// SnapshotBlocksReader can optionally be implemented along with
+// DeltaBlockBackupOperations to read several contiguous blocks in one call.
+// Otherwise ReadSnapshot is called once per block.
+type SnapshotBlocksReader interface {
+	// ReadSnapshotBlocks fills data, which covers one or more contiguous
+	// blocks, with the snapshot content starting at start
+	ReadSnapshotBlocks(id, volumeID string, start int64, data []byte) error
+}
+
+// snapshotReader implements io.ReaderAt on top of
+// DeltaBlockBackupOperations.ReadSnapshot, called once per block of
+// blockSize
+type snapshotReader struct {
+	ops       DeltaBlockBackupOperations
+	id        string
+	volumeID  string
+	blockSize int
+}
+
+func (r *snapshotReader) ReadAt(p []byte, off int64) (int, error) {
+	if br, ok := r.ops.(SnapshotBlocksReader); ok {
+		if err := br.ReadSnapshotBlocks(r.id, r.volumeID, off, p); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+
+	for n := 0; n < len(p); n += r.blockSize {
+		end := n + r.blockSize
+		if end > len(p) {
+			end = len(p)
+		}
+		if err := r.ops.ReadSnapshot(r.id, r.volumeID, off+int64(n), p[n:end]); err != nil {
+			return n, err
+		}
+	}
+	return len(p), nil
+}
+
+func getDeltaOps(config *DeltaBackupConfig) (DeltaBlockBackupOperationsV2, error) {
+	if config.DeltaOpsV2 != nil {
+		return config.DeltaOpsV2, nil
+	}
+	if config.DeltaOps != nil {
+		return NewDeltaBlockBackupOperationsV2(config.DeltaOps), nil
+	}
+	return nil, fmt.Errorf("Missing DeltaBlockBackupOperations")
+}
+
+// readSnapshotBlock fills block with the snapshot content at offset
+func readSnapshotBlock(r io.ReaderAt, block []byte, offset int64) error {
+	n, err := r.ReadAt(block, offset)
+	if err == io.EOF && n == len(block) {
+		return nil
+	}
+	return err
+}
+
+// closeSnapshot closes the snapshot and returns err, or the close error if
+// err is nil
+func closeSnapshot(deltaOps DeltaBlockBackupOperationsV2, snapshotName, volumeName string, err error) error {
+	closeErr := deltaOps.CloseSnapshot(context.Background(), snapshotName, volumeName)
+	if closeErr == nil {
+		return err
+	}
+	closeErr = newBackupError(BackupErrorTypeSnapshot,
+		fmt.Errorf("Failed to close snapshot %v of volume %v: %v", snapshotName, volumeName, closeErr))
+	if err != nil {
+		log.Warn(closeErr)
+		return err
+	}
+	return closeErr
+}
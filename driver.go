@@ -12,6 +12,22 @@ import (
 
 type InitFunc func(destURL string) (BackupStoreDriver, error)
 
+// InitFuncWithCredentials initializes a driver using credentials, or its
+// defaults, e.g. the environment of the process, if credentials is nil
+type InitFuncWithCredentials func(destURL string, credentials *Credentials) (BackupStoreDriver, error)
+
+// Credentials are the credentials of a backupstore, passed to the driver
+// instead of being read from the environment of the process. The drivers
+// ignore the fields not applying to them.
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string `json:",omitempty"`
+	// Endpoint is the endpoint of the service, e.g. the one of an S3
+	// compatible store
+	Endpoint string `json:",omitempty"`
+}
+
 type BackupStoreDriver interface {
 	Kind() string
 	GetURL() string
@@ -26,7 +42,7 @@ type BackupStoreDriver interface {
 }
 
 var (
-	initializers map[string]InitFunc
+	initializers map[string]InitFuncWithCredentials
 )
 
 var (
@@ -38,10 +54,21 @@ func generateError(fields logrus.Fields, format string, v ...interface{}) error
 }
 
 func init() {
-	initializers = make(map[string]InitFunc)
+	initializers = make(map[string]InitFuncWithCredentials)
 }
 
 func RegisterDriver(kind string, initFunc InitFunc) error {
+	return RegisterDriverWithCredentials(kind, func(destURL string, credentials *Credentials) (BackupStoreDriver, error) {
+		if credentials != nil {
+			return nil, fmt.Errorf("Driver %v doesn't support credentials", kind)
+		}
+		return initFunc(destURL)
+	})
+}
+
+// RegisterDriverWithCredentials registers a driver accepting the credentials
+// passed to GetBackupStoreDriverWithCredentials
+func RegisterDriverWithCredentials(kind string, initFunc InitFuncWithCredentials) error {
 	if _, exists := initializers[kind]; exists {
 		return fmt.Errorf("%s has already been registered", kind)
 	}
@@ -50,6 +77,12 @@ func RegisterDriver(kind string, initFunc InitFunc) error {
 }
 
 func GetBackupStoreDriver(destURL string) (BackupStoreDriver, error) {
+	return GetBackupStoreDriverWithCredentials(destURL, nil)
+}
+
+// GetBackupStoreDriverWithCredentials initializes the driver of destURL with
+// credentials, instead of the ones of the environment if not nil
+func GetBackupStoreDriverWithCredentials(destURL string, credentials *Credentials) (BackupStoreDriver, error) {
 	if destURL == "" {
 		return nil, fmt.Errorf("Destination URL hasn't been specified")
 	}
@@ -60,5 +93,15 @@ func GetBackupStoreDriver(destURL string) (BackupStoreDriver, error) {
 	if _, exists := initializers[u.Scheme]; !exists {
 		return nil, fmt.Errorf("Driver %v is not supported!", u.Scheme)
 	}
-	return initializers[u.Scheme](destURL)
+	timeouts := GetDriverTimeouts()
+	var driver BackupStoreDriver
+	err = callWithTimeout(timeouts.Connect, "connection", destURL, func() error {
+		d, err := initializers[u.Scheme](destURL, credentials)
+		driver = d
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newTimeoutDriver(driver, timeouts), nil
 }
@@ -0,0 +1,282 @@
+package backupstore
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// DriverTimeouts bounds the time the driver operations may take, so a dead
+// server or a black-holed endpoint fails the operation instead of hanging
+// it. Zero means no timeout. The operations timed out keep running in
+// background, but their results are discarded.
+type DriverTimeouts struct {
+	// Connect bounds the initialization of the driver, e.g. mounting
+	Connect time.Duration
+	// Read bounds opening an object, and every read from it
+	Read time.Duration
+	// Write bounds writing an object, the uploads of files are not bounded
+	Write time.Duration
+	// List bounds listing a directory
+	List time.Duration
+}
+
+var (
+	DefaultDriverTimeouts = DriverTimeouts{
+		Connect: time.Minute,
+		Read:    2 * time.Minute,
+		Write:   5 * time.Minute,
+		List:    2 * time.Minute,
+	}
+
+	driverTimeoutsLock sync.RWMutex
+	driverTimeouts     = DefaultDriverTimeouts
+)
+
+// SetDriverTimeouts sets the timeouts of the drivers returned by
+// GetBackupStoreDriver from now on
+func SetDriverTimeouts(timeouts DriverTimeouts) {
+	driverTimeoutsLock.Lock()
+	defer driverTimeoutsLock.Unlock()
+	driverTimeouts = timeouts
+}
+
+// GetDriverTimeouts returns the timeouts set by SetDriverTimeouts
+func GetDriverTimeouts() DriverTimeouts {
+	driverTimeoutsLock.RLock()
+	defer driverTimeoutsLock.RUnlock()
+	return driverTimeouts
+}
+
+// DriverTimeoutError is returned when a driver operation times out
+type DriverTimeoutError struct {
+	Operation string
+	Path      string
+	Timeout   time.Duration
+}
+
+func (e *DriverTimeoutError) Error() string {
+	return fmt.Sprintf("Timed out after %v waiting for %v of %v in backupstore", e.Timeout, e.Operation, e.Path)
+}
+
+// callWithTimeout runs fn, and returns a DriverTimeoutError if it doesn't
+// return within timeout
+func callWithTimeout(timeout time.Duration, operation, path string, fn func() error) error {
+	if timeout <= 0 {
+		return fn()
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- fn()
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-errCh:
+		return err
+	case <-timer.C:
+		log.Warnf("Timed out after %v waiting for %v of %v", timeout, operation, path)
+		return &DriverTimeoutError{
+			Operation: operation,
+			Path:      path,
+			Timeout:   timeout,
+		}
+	}
+}
+
+// timeoutDriver applies DriverTimeouts to the operations of a driver
+type timeoutDriver struct {
+	BackupStoreDriver
+	timeouts DriverTimeouts
+}
+
+func newTimeoutDriver(driver BackupStoreDriver, timeouts DriverTimeouts) BackupStoreDriver {
+	if timeouts.Read <= 0 && timeouts.Write <= 0 && timeouts.List <= 0 {
+		return driver
+	}
+	return &timeoutDriver{
+		BackupStoreDriver: driver,
+		timeouts:          timeouts,
+	}
+}
+
+func (d *timeoutDriver) unwrap() BackupStoreDriver {
+	return d.BackupStoreDriver
+}
+
+func (d *timeoutDriver) Read(src string) (io.ReadCloser, error) {
+	var (
+		lock     sync.Mutex
+		rc       io.ReadCloser
+		timedOut bool
+	)
+	err := callWithTimeout(d.timeouts.Read, "open", src, func() error {
+		r, err := d.BackupStoreDriver.Read(src)
+		lock.Lock()
+		defer lock.Unlock()
+		if err == nil && timedOut {
+			r.Close()
+			return nil
+		}
+		rc = r
+		return err
+	})
+	if err != nil {
+		lock.Lock()
+		defer lock.Unlock()
+		timedOut = true
+		// The object may have been opened right after the timeout
+		if rc != nil {
+			rc.Close()
+		}
+		return nil, err
+	}
+	if d.timeouts.Read <= 0 {
+		return rc, nil
+	}
+	return &timeoutReader{
+		rc:      rc,
+		path:    src,
+		timeout: d.timeouts.Read,
+	}, nil
+}
+
+func (d *timeoutDriver) Write(dst string, rs io.ReadSeeker) error {
+	guarded := &guardedReadSeeker{rs: rs}
+	err := callWithTimeout(d.timeouts.Write, "write", dst, func() error {
+		return d.BackupStoreDriver.Write(dst, guarded)
+	})
+	if _, ok := err.(*DriverTimeoutError); ok {
+		// The caller may reuse the content once returned, so the write
+		// in background must fail rather than store something else
+		guarded.abandon()
+	}
+	return err
+}
+
+func (d *timeoutDriver) List(path string) ([]string, error) {
+	var result []string
+	err := callWithTimeout(d.timeouts.List, "list", path, func() error {
+		var err error
+		result, err = d.BackupStoreDriver.List(path)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// timeoutReaderMinRead is the minimum size read at once by timeoutReader,
+// to limit the reads with the small buffers of decompressors
+const timeoutReaderMinRead = 64 * 1024
+
+// timeoutReader applies the read timeout to every read. The reads are done
+// in a private buffer, so a read timed out cannot write to the buffer of the
+// caller later.
+type timeoutReader struct {
+	rc      io.ReadCloser
+	path    string
+	timeout time.Duration
+
+	buf []byte
+	// data is the part of buf not returned yet, readErr the error of the
+	// read which filled it
+	data    []byte
+	readErr error
+	// err is set once a read timed out, the reader cannot be used anymore
+	err error
+}
+
+func (r *timeoutReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if len(r.data) == 0 {
+		if r.readErr != nil {
+			return 0, r.readErr
+		}
+		if err := r.fill(len(p)); err != nil {
+			r.err = err
+			return 0, err
+		}
+		if len(r.data) == 0 {
+			return 0, r.readErr
+		}
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func (r *timeoutReader) fill(size int) error {
+	if size < timeoutReaderMinRead {
+		size = timeoutReaderMinRead
+	}
+	if cap(r.buf) < size {
+		r.buf = make([]byte, size)
+	}
+	buf := r.buf[:size]
+	var n int
+	var readErr error
+	err := callWithTimeout(r.timeout, "read", r.path, func() error {
+		n, readErr = r.rc.Read(buf)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	r.data = buf[:n]
+	r.readErr = readErr
+	return nil
+}
+
+func (r *timeoutReader) Close() error {
+	if r.err != nil {
+		// A read may still be blocked, don't wait for it
+		go r.rc.Close()
+		return nil
+	}
+	return r.rc.Close()
+}
+
+// guardedReadSeeker fails all the accesses once abandoned
+type guardedReadSeeker struct {
+	lock      sync.Mutex
+	rs        io.ReadSeeker
+	abandoned bool
+}
+
+func (g *guardedReadSeeker) Read(p []byte) (int, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.abandoned {
+		return 0, fmt.Errorf("Write was abandoned after timing out")
+	}
+	return g.rs.Read(p)
+}
+
+func (g *guardedReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.abandoned {
+		return 0, fmt.Errorf("Write was abandoned after timing out")
+	}
+	return g.rs.Seek(offset, whence)
+}
+
+func (g *guardedReadSeeker) abandon() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.abandoned = true
+}
+
+// unwrapDriver returns the driver wrapped by the timeouts, if any, e.g. to
+// check the optional interfaces it implements
+func unwrapDriver(driver BackupStoreDriver) BackupStoreDriver {
+	if d, ok := driver.(*timeoutDriver); ok {
+		return d.unwrap()
+	}
+	return driver
+}
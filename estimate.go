@@ -0,0 +1,171 @@
+package backupstore
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+// BackupEstimate is the result of a dry-run backup
+type BackupEstimate struct {
+	VolumeName     string
+	SnapshotName   string
+	LastBackupName string `json:",omitempty"`
+
+	// ChangedBlocks is the number of blocks changed since the last backup
+	ChangedBlocks int64 `json:",string"`
+	// NewBlocks is the number of blocks which would be uploaded, the
+	// others already exist in the backupstore
+	NewBlocks int64 `json:",string"`
+	// NewBytes is the size of the new blocks as they would be uploaded,
+	// after compression
+	NewBytes int64 `json:",string"`
+}
+
+// EstimateDeltaBlockBackup walks the blocks a backup of config would
+// process, and computes which ones need to be uploaded, without writing
+// anything to the backupstore. Unlike CreateDeltaBlockBackup it returns once
+// done.
+func EstimateDeltaBlockBackup(ctx context.Context, config *DeltaBackupConfig) (*BackupEstimate, error) {
+	if config == nil {
+		return nil, fmt.Errorf("Invalid empty config for backup")
+	}
+	if err := validateBaseBackup(config); err != nil {
+		return nil, err
+	}
+
+	volume := config.Volume
+	snapshot := config.Snapshot
+	deltaOps, err := getDeltaOps(config)
+	if err != nil {
+		return nil, err
+	}
+
+	bsDriver, err := GetBackupStoreDriver(config.DestURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// The volume may not have been backed up yet
+	if volumeExists(volume.Name, bsDriver) {
+		if volume, err = loadVolume(volume.Name, bsDriver); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := deltaOps.OpenSnapshot(ctx, snapshot.Name, volume.Name); err != nil {
+		return nil, err
+	}
+	estimate, err := estimateDeltaBlocks(ctx, config, deltaOps, volume, bsDriver)
+	if err = closeSnapshot(deltaOps, snapshot.Name, volume.Name, err); err != nil {
+		return nil, err
+	}
+	return estimate, nil
+}
+
+func estimateDeltaBlocks(ctx context.Context, config *DeltaBackupConfig, deltaOps DeltaBlockBackupOperationsV2,
+	volume *Volume, bsDriver BackupStoreDriver) (*BackupEstimate, error) {
+
+	snapshot := config.Snapshot
+	mode, err := getVolumeChunkingMode(volume, config.ChunkingMode)
+	if err != nil {
+		return nil, err
+	}
+	delta, lastBackup, err := getSnapshotDelta(ctx, deltaOps, config, volume, bsDriver, log)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := deltaOps.ReadSnapshot(ctx, snapshot.Name, volume.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	estimate := &BackupEstimate{
+		VolumeName:   volume.Name,
+		SnapshotName: snapshot.Name,
+	}
+	if lastBackup != nil {
+		estimate.LastBackupName = lastBackup.Name
+	}
+
+	compressed := util.GetBuffer()
+	defer util.PutBuffer(compressed)
+	// The blocks counted already, they would only be uploaded once
+	counted := make(map[string]bool)
+	estimateBlock := func(block []byte) error {
+		estimate.ChangedBlocks++
+
+		checksum := util.GetChecksum(block)
+		if counted[checksum] {
+			return nil
+		}
+		counted[checksum] = true
+		if bsDriver.FileExists(getBlockFilePath(volume.Name, checksum)) {
+			return nil
+		}
+
+		compressed.Reset()
+		isCompressed, err := util.CompressBlockTo(compressed, block)
+		if err != nil {
+			return err
+		}
+		estimate.NewBlocks++
+		if isCompressed {
+			estimate.NewBytes += int64(compressed.Len())
+		} else {
+			estimate.NewBytes += int64(len(block))
+		}
+		return nil
+	}
+
+	if mode == ChunkingModeCDC {
+		err := forEachChunk(ctx, reader, getChunkRanges(delta, lastBackup),
+			func(m int, offset int64, data []byte, lastOfRange bool) error {
+				return estimateBlock(data)
+			})
+		if err != nil {
+			return nil, err
+		}
+		return estimate, nil
+	}
+
+	readBlocks := int64(config.SnapshotReadBlocks)
+	if readBlocks <= 0 {
+		readBlocks = DEFAULT_SNAPSHOT_READ_BLOCKS
+	}
+	buf := util.GetBytes(int(readBlocks * delta.BlockSize))
+	defer util.PutBytes(buf)
+
+	for _, d := range delta.Mappings {
+		blkCounts, err := getMappingBlockCount(d, delta.BlockSize, config.Volume.Size)
+		if err != nil {
+			return nil, err
+		}
+		for i := int64(0); i < blkCounts; i += readBlocks {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			n := readBlocks
+			if blkCounts-i < n {
+				n = blkCounts - i
+			}
+			start := i * delta.BlockSize
+			length := n * delta.BlockSize
+			if d.Size-start < length {
+				length = d.Size - start
+			}
+			data := buf[:length]
+			if err := readSnapshotBlock(reader, data, d.Offset+start); err != nil {
+				return nil, err
+			}
+
+			for j := int64(0); j < n; j++ {
+				if err := estimateBlock(getBatchBlock(data, j, delta.BlockSize)); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return estimate, nil
+}
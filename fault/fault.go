@@ -0,0 +1,320 @@
+package fault
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/longhorn/backupstore"
+	"github.com/longhorn/backupstore/util"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	log = logrus.WithFields(logrus.Fields{"pkg": "fault"})
+
+	driversLock sync.RWMutex
+	drivers     = make(map[string]*BackupStoreDriver)
+)
+
+const (
+	KIND = "fault"
+)
+
+// Faults are the failures injected by the driver. The reads and writes are
+// counted from 1 in the order they're started, only the ones of the objects
+// matching PathPattern if set, so the same faults are injected on each run.
+type Faults struct {
+	// PathPattern restricts the faults to the objects whose path matches
+	// it, e.g. `\.blk$` for the blocks
+	PathPattern *regexp.Regexp
+
+	// FailWriteAt fails the FailWriteAt-th write or upload, and the
+	// FailWriteCount-1 following ones. Zero disables it, FailWriteCount is
+	// 1 if not set, negative to fail all the following ones.
+	FailWriteAt    int
+	FailWriteCount int
+	// FailReadAt and FailReadCount fail the opening of the objects to
+	// read or download the same way
+	FailReadAt    int
+	FailReadCount int
+
+	// ReadDelay delays the opening of the objects to read or download
+	ReadDelay time.Duration
+	// MaxReadSize limits the bytes returned by each call of Read of the
+	// objects read, so the callers get partial reads
+	MaxReadSize int
+	// TruncateReadsAt ends the objects read after TruncateReadsAt bytes
+	// if positive, as if they had been partially written
+	TruncateReadsAt int64
+	// CorruptReads flips the bits of the byte in the middle of the objects
+	// read, so their checksum or decompression fails
+	CorruptReads bool
+}
+
+// Stats counts the operations of the driver matching the faults
+type Stats struct {
+	Writes         int
+	Reads          int
+	FailedWrites   int
+	FailedReads    int
+	CorruptedReads int
+}
+
+// InjectedError is the error of an operation failed by the driver
+type InjectedError struct {
+	Operation string
+	Path      string
+}
+
+func (e *InjectedError) Error() string {
+	return fmt.Sprintf("Injected failure of %v of %v", e.Operation, e.Path)
+}
+
+// IsInjected returns true if err has been injected by the driver
+func IsInjected(err error) bool {
+	_, ok := err.(*InjectedError)
+	return ok
+}
+
+// BackupStoreDriver wraps another driver, and injects faults into its
+// operations, to test how the failures of a backupstore are handled
+type BackupStoreDriver struct {
+	backupstore.BackupStoreDriver
+	destURL string
+
+	lock   sync.Mutex
+	faults Faults
+	stats  Stats
+}
+
+func init() {
+	if err := backupstore.RegisterDriver(KIND, initFunc); err != nil {
+		panic(err)
+	}
+}
+
+func initFunc(destURL string) (backupstore.BackupStoreDriver, error) {
+	u, err := url.Parse(destURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != KIND {
+		return nil, fmt.Errorf("BUG: Why dispatch %v to %v?", u.Scheme, KIND)
+	}
+
+	driversLock.RLock()
+	defer driversLock.RUnlock()
+	d, exists := drivers[u.Host]
+	if !exists {
+		return nil, fmt.Errorf("Cannot find fault driver %v, it must be registered first", u.Host)
+	}
+	return d, nil
+}
+
+// Register wraps the driver of destURL into a driver injecting faults, which
+// is used for the URL fault://name returned. The backups created through
+// it are encoded with that URL as well.
+func Register(name, destURL string, faults Faults) (*BackupStoreDriver, error) {
+	if !util.ValidateName(name) {
+		return nil, fmt.Errorf("Invalid fault driver name %v", name)
+	}
+	driver, err := backupstore.GetBackupStoreDriver(destURL)
+	if err != nil {
+		return nil, err
+	}
+
+	driversLock.Lock()
+	defer driversLock.Unlock()
+	if _, exists := drivers[name]; exists {
+		return nil, fmt.Errorf("Fault driver %v has already been registered", name)
+	}
+	d := &BackupStoreDriver{
+		BackupStoreDriver: driver,
+		destURL:           KIND + "://" + name,
+		faults:            faults,
+	}
+	drivers[name] = d
+	log.Debugf("Registered fault driver %v for %v", d.destURL, driver.GetURL())
+	return d, nil
+}
+
+// Unregister removes the driver registered as name
+func Unregister(name string) {
+	driversLock.Lock()
+	defer driversLock.Unlock()
+	delete(drivers, name)
+}
+
+// SetFaults replaces the faults injected by the driver, and resets the
+// counts of its operations
+func (d *BackupStoreDriver) SetFaults(faults Faults) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.faults = faults
+	d.stats = Stats{}
+}
+
+// GetStats returns the counts of the operations since the faults were set
+func (d *BackupStoreDriver) GetStats() Stats {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.stats
+}
+
+func (d *BackupStoreDriver) Kind() string {
+	return KIND
+}
+
+func (d *BackupStoreDriver) GetURL() string {
+	return d.destURL
+}
+
+// shouldFail returns true if the n-th operation falls in the range of the
+// failures starting at at
+func shouldFail(n, at, count int) bool {
+	if at <= 0 || n < at {
+		return false
+	}
+	if count == 0 {
+		count = 1
+	}
+	return count < 0 || n < at+count
+}
+
+// beginWrite counts a write of path, and returns the error to inject if any
+func (d *BackupStoreDriver) beginWrite(operation, path string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.faults.PathPattern != nil && !d.faults.PathPattern.MatchString(path) {
+		return nil
+	}
+	d.stats.Writes++
+	if shouldFail(d.stats.Writes, d.faults.FailWriteAt, d.faults.FailWriteCount) {
+		d.stats.FailedWrites++
+		return &InjectedError{Operation: operation, Path: path}
+	}
+	return nil
+}
+
+// beginRead counts a read of path, and returns the faults to inject into it,
+// nil if none, or the error to inject
+func (d *BackupStoreDriver) beginRead(operation, path string) (*Faults, error) {
+	d.lock.Lock()
+	if d.faults.PathPattern != nil && !d.faults.PathPattern.MatchString(path) {
+		d.lock.Unlock()
+		return nil, nil
+	}
+	d.stats.Reads++
+	faults := d.faults
+	fail := shouldFail(d.stats.Reads, faults.FailReadAt, faults.FailReadCount)
+	if fail {
+		d.stats.FailedReads++
+	}
+	d.lock.Unlock()
+
+	if faults.ReadDelay > 0 {
+		time.Sleep(faults.ReadDelay)
+	}
+	if fail {
+		return nil, &InjectedError{Operation: operation, Path: path}
+	}
+	return &faults, nil
+}
+
+func (d *BackupStoreDriver) Write(dst string, rs io.ReadSeeker) error {
+	if err := d.beginWrite("write", dst); err != nil {
+		return err
+	}
+	return d.BackupStoreDriver.Write(dst, rs)
+}
+
+func (d *BackupStoreDriver) Upload(src, dst string) error {
+	if err := d.beginWrite("upload", dst); err != nil {
+		return err
+	}
+	return d.BackupStoreDriver.Upload(src, dst)
+}
+
+func (d *BackupStoreDriver) Download(src, dst string) error {
+	if _, err := d.beginRead("download", src); err != nil {
+		return err
+	}
+	return d.BackupStoreDriver.Download(src, dst)
+}
+
+func (d *BackupStoreDriver) Read(src string) (io.ReadCloser, error) {
+	faults, err := d.beginRead("read", src)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := d.BackupStoreDriver.Read(src)
+	if err != nil || faults == nil {
+		return rc, err
+	}
+	if faults.MaxReadSize <= 0 && faults.TruncateReadsAt <= 0 && !faults.CorruptReads {
+		return rc, nil
+	}
+
+	r := &faultReader{
+		rc:          rc,
+		maxReadSize: faults.MaxReadSize,
+		limit:       -1,
+		corruptAt:   -1,
+	}
+	if faults.TruncateReadsAt > 0 {
+		r.limit = faults.TruncateReadsAt
+	}
+	if faults.CorruptReads {
+		size := d.FileSize(src)
+		if r.limit >= 0 && r.limit < size {
+			size = r.limit
+		}
+		if size > 0 {
+			r.corruptAt = size / 2
+			d.lock.Lock()
+			d.stats.CorruptedReads++
+			d.lock.Unlock()
+		}
+	}
+	return r, nil
+}
+
+// faultReader injects the faults into the content of an object read
+type faultReader struct {
+	rc          io.ReadCloser
+	offset      int64
+	maxReadSize int
+	// limit is where the content is truncated, and corruptAt the offset
+	// of the corrupted byte, negative if none
+	limit     int64
+	corruptAt int64
+}
+
+func (r *faultReader) Read(p []byte) (int, error) {
+	if r.maxReadSize > 0 && len(p) > r.maxReadSize {
+		p = p[:r.maxReadSize]
+	}
+	if r.limit >= 0 {
+		if r.offset >= r.limit {
+			return 0, io.EOF
+		}
+		if int64(len(p)) > r.limit-r.offset {
+			p = p[:r.limit-r.offset]
+		}
+	}
+	n, err := r.rc.Read(p)
+	if r.corruptAt >= r.offset && r.corruptAt < r.offset+int64(n) {
+		p[r.corruptAt-r.offset] ^= 0xff
+	}
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *faultReader) Close() error {
+	return r.rc.Close()
+}
@@ -0,0 +1,84 @@
+package fsops
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// DurabilityOptions controls how the files written by the filesystem backed
+// drivers are flushed to stable storage. Without them, a crash of the node
+// right after a backup completed may lose the blocks and metadata still in
+// the page cache.
+type DurabilityOptions struct {
+	// SyncFiles fsyncs the files after they're written, before they're
+	// renamed into place
+	SyncFiles bool
+	// SyncDirs fsyncs the directories after a file is renamed into them or
+	// a directory is created in them
+	SyncDirs bool
+}
+
+var (
+	durabilityLock sync.RWMutex
+	durability     DurabilityOptions
+)
+
+// SetDurabilityOptions sets the durability options of the vfs and nfs
+// drivers
+func SetDurabilityOptions(opts DurabilityOptions) {
+	durabilityLock.Lock()
+	defer durabilityLock.Unlock()
+	durability = opts
+}
+
+// GetDurabilityOptions returns the options set by SetDurabilityOptions
+func GetDurabilityOptions() DurabilityOptions {
+	durabilityLock.RLock()
+	defer durabilityLock.RUnlock()
+	return durability
+}
+
+// syncFile fsyncs the file at path
+func syncFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// syncDir fsyncs dir, so the entries created or renamed in it persist
+func syncDir(dir string) error {
+	return syncFile(dir)
+}
+
+// mkdirAll creates dir and its missing parents like os.MkdirAll. With
+// SyncDirs, the parents of the directories created are fsynced as well.
+func mkdirAll(dir string, syncDirs bool) error {
+	if !syncDirs {
+		return os.MkdirAll(dir, os.ModeDir|0700)
+	}
+
+	// Find the directories missing, from the deepest one
+	missing := []string{}
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(d); err == nil {
+			break
+		}
+		missing = append(missing, d)
+		if filepath.Dir(d) == d {
+			break
+		}
+	}
+	if err := os.MkdirAll(dir, os.ModeDir|0700); err != nil {
+		return err
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := syncDir(filepath.Dir(missing[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 
 	"github.com/longhorn/backupstore"
 	"github.com/longhorn/backupstore/util"
@@ -26,13 +27,28 @@ func NewFileSystemOperator(ops FileSystemOps) *FileSystemOperator {
 	return &FileSystemOperator{ops}
 }
 
-func (f *FileSystemOperator) preparePath(file string) error {
-	if err := os.MkdirAll(filepath.Dir(f.LocalPath(file)), os.ModeDir|0700); err != nil {
+func (f *FileSystemOperator) preparePath(file string, opts DurabilityOptions) error {
+	if err := mkdirAll(filepath.Dir(f.LocalPath(file)), opts.SyncDirs); err != nil {
 		return err
 	}
 	return nil
 }
 
+// commit renames the temporary file tmpFile to dst, and syncs the directory
+// of dst if opts require
+func (f *FileSystemOperator) commit(tmpFile, dst string, opts DurabilityOptions) error {
+	if f.FileExists(dst) {
+		f.Remove(dst)
+	}
+	if err := os.Rename(f.LocalPath(tmpFile), f.LocalPath(dst)); err != nil {
+		return err
+	}
+	if opts.SyncDirs {
+		return syncDir(filepath.Dir(f.LocalPath(dst)))
+	}
+	return nil
+}
+
 func (f *FileSystemOperator) FileSize(filePath string) int64 {
 	file := f.LocalPath(filePath)
 	st, err := os.Stat(file)
@@ -76,28 +92,41 @@ func (f *FileSystemOperator) Read(src string) (io.ReadCloser, error) {
 	return file, nil
 }
 
-func (f *FileSystemOperator) Write(dst string, rs io.ReadSeeker) error {
-	tmpFile := dst + ".tmp"
+// Write writes the content of rs to a temporary file renamed to dst once
+// complete, so an interrupted write never leaves a truncated dst
+func (f *FileSystemOperator) Write(dst string, rs io.ReadSeeker) (err error) {
+	tmpFile := dst + backupstore.TMP_SUFFIX
 	if f.FileExists(tmpFile) {
 		f.Remove(tmpFile)
 	}
-	if err := f.preparePath(dst); err != nil {
+	opts := GetDurabilityOptions()
+	if err := f.preparePath(dst, opts); err != nil {
 		return err
 	}
 	file, err := os.Create(f.LocalPath(tmpFile))
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	defer func() {
+		file.Close()
+		if err != nil {
+			f.Remove(tmpFile)
+		}
+	}()
 	_, err = io.Copy(file, rs)
 	if err != nil {
 		return err
 	}
-
-	if f.FileExists(dst) {
-		f.Remove(dst)
+	if opts.SyncFiles {
+		if err := file.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := file.Close(); err != nil {
+		return err
 	}
-	return os.Rename(f.LocalPath(tmpFile), f.LocalPath(dst))
+
+	return f.commit(tmpFile, dst, opts)
 }
 
 func (f *FileSystemOperator) List(path string) ([]string, error) {
@@ -113,22 +142,36 @@ func (f *FileSystemOperator) List(path string) ([]string, error) {
 	return result, nil
 }
 
-func (f *FileSystemOperator) Upload(src, dst string) error {
-	tmpDst := dst + ".tmp"
+func (f *FileSystemOperator) Upload(src, dst string) (err error) {
+	tmpDst := dst + backupstore.TMP_SUFFIX
 	if f.FileExists(tmpDst) {
 		f.Remove(tmpDst)
 	}
-	if err := f.preparePath(dst); err != nil {
+	opts := GetDurabilityOptions()
+	if err := f.preparePath(dst, opts); err != nil {
 		return err
 	}
-	_, err := util.Execute("cp", []string{src, f.LocalPath(tmpDst)})
+	defer func() {
+		if err != nil {
+			f.Remove(tmpDst)
+		}
+	}()
+	_, err = util.Execute("cp", []string{src, f.LocalPath(tmpDst)})
 	if err != nil {
 		return err
 	}
+	if opts.SyncFiles {
+		if err := syncFile(f.LocalPath(tmpDst)); err != nil {
+			return err
+		}
+	}
 	_, err = util.Execute("mv", []string{f.LocalPath(tmpDst), f.LocalPath(dst)})
 	if err != nil {
 		return err
 	}
+	if opts.SyncDirs {
+		return syncDir(filepath.Dir(f.LocalPath(dst)))
+	}
 	return nil
 }
 
@@ -139,3 +182,12 @@ func (f *FileSystemOperator) Download(src, dst string) error {
 	}
 	return nil
 }
+
+// AvailableCapacity returns the space available to the backupstore in bytes
+func (f *FileSystemOperator) AvailableCapacity() (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(f.LocalPath(""), &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
@@ -0,0 +1,161 @@
+package backupstore
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// GCOptions controls how the blocks no longer referenced by any backup are
+// removed when a backup is deleted
+type GCOptions struct {
+	// BatchSize is the number of blocks removed by a single driver call,
+	// e.g. a single DeleteObjects request for S3
+	BatchSize int
+	// Concurrency is the number of batches removed in parallel
+	Concurrency int
+	// Retries is the number of times a batch is retried after it failed
+	Retries int
+	// RetryInterval is the time waited before the first retry of a batch,
+	// doubled for every retry after
+	RetryInterval time.Duration
+	// ProgressFunc, if set, is called after every batch removed. It's
+	// called from the goroutines removing the batches, one at a time.
+	ProgressFunc func(progress *GCProgress)
+	// PurgeStaleBlocks also removes the files found by FindStaleBlocks once
+	// the unused blocks are removed. It lists all the block files of the
+	// volume, so it's disabled by default.
+	PurgeStaleBlocks bool
+}
+
+// GCProgress is delivered to GCOptions.ProgressFunc during the removal of
+// the unused blocks of a volume
+type GCProgress struct {
+	// OperationID identifies the backup deletion running the GC
+	OperationID   string
+	VolumeName    string
+	BlocksRemoved int64
+	BlocksTotal   int64
+}
+
+var (
+	DefaultGCOptions = GCOptions{
+		BatchSize:     1000,
+		Concurrency:   4,
+		Retries:       3,
+		RetryInterval: time.Second,
+	}
+
+	gcOptionsLock sync.RWMutex
+	gcOptions     = DefaultGCOptions
+)
+
+// SetGCOptions sets how the unused blocks are removed from now on. The batch
+// size, concurrency and retry interval not set take their default values,
+// while zero retries means a failed batch is not retried.
+func SetGCOptions(opts GCOptions) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultGCOptions.BatchSize
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = DefaultGCOptions.Concurrency
+	}
+	if opts.Retries < 0 {
+		opts.Retries = 0
+	}
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = DefaultGCOptions.RetryInterval
+	}
+	gcOptionsLock.Lock()
+	defer gcOptionsLock.Unlock()
+	gcOptions = opts
+}
+
+// GetGCOptions returns the options set by SetGCOptions
+func GetGCOptions() GCOptions {
+	gcOptionsLock.RLock()
+	defer gcOptionsLock.RUnlock()
+	return gcOptions
+}
+
+// removeBlockFiles removes the block files of volumeName in batches, with
+// the batches removed in parallel and retried on failure. Once a batch
+// failed for good no more batches are started, and its error is returned.
+func removeBlockFiles(volumeName, operationID string, blkFiles []string, bsDriver BackupStoreDriver) error {
+	opts := GetGCOptions()
+	log := operationLog(operationID)
+	if len(blkFiles) == 0 {
+		return nil
+	}
+
+	batches := make(chan []string)
+	var (
+		wg       sync.WaitGroup
+		lock     sync.Mutex
+		firstErr error
+		progress = GCProgress{
+			OperationID: operationID,
+			VolumeName:  volumeName,
+			BlocksTotal: int64(len(blkFiles)),
+		}
+	)
+	failed := func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return firstErr != nil
+	}
+
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				err := removeBlockBatch(batch, bsDriver, opts, log)
+
+				lock.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = err
+					}
+				} else {
+					progress.BlocksRemoved += int64(len(batch))
+					log.Debugf("Removed %v of %v unused blocks of volume %v",
+						progress.BlocksRemoved, progress.BlocksTotal, volumeName)
+					if opts.ProgressFunc != nil {
+						p := progress
+						opts.ProgressFunc(&p)
+					}
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+
+	for start := 0; start < len(blkFiles) && !failed(); start += opts.BatchSize {
+		end := start + opts.BatchSize
+		if end > len(blkFiles) {
+			end = len(blkFiles)
+		}
+		batches <- blkFiles[start:end]
+	}
+	close(batches)
+	wg.Wait()
+	return firstErr
+}
+
+func removeBlockBatch(batch []string, bsDriver BackupStoreDriver, opts GCOptions, log *logrus.Entry) error {
+	interval := opts.RetryInterval
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = bsDriver.Remove(batch...); err == nil {
+			return nil
+		}
+		if attempt == opts.Retries {
+			return err
+		}
+		log.WithError(err).Warnf("Failed to remove %v unused blocks, would retry in %v", len(batch), interval)
+		time.Sleep(interval)
+		interval *= 2
+	}
+}
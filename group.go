@@ -0,0 +1,346 @@
+package backupstore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path/filepath"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+const (
+	GROUP_DIRECTORY = "groups"
+)
+
+// GroupBackup is the manifest of a backup of a consistency group, recording
+// the backups of its member volumes taken from coordinated snapshots
+type GroupBackup struct {
+	Name        string
+	GroupName   string
+	CreatedTime string
+	Labels      map[string]string `json:",omitempty"`
+	Members     []GroupMember
+
+	// ManifestChecksum is the checksum of the group backup metadata,
+	// verified when it's loaded
+	ManifestChecksum string `json:",omitempty"`
+}
+
+// GroupMember is the backup of a member volume of a group backup
+type GroupMember struct {
+	VolumeName   string
+	BackupName   string
+	SnapshotName string
+	BackupURL    string `json:"-"`
+}
+
+type GroupBackupConfig struct {
+	// GroupName is the name of the consistency group
+	GroupName string
+	DestURL   string
+	// Members are the configs of the backups of the member volumes, whose
+	// snapshots should be taken at the same point in time, e.g. while
+	// the applications are quiesced. Their DestURL is the one of the
+	// group.
+	Members []*DeltaBackupConfig
+	Labels  map[string]string
+	// BackupName is the name of the group backup, generated if not set
+	BackupName string
+}
+
+type GroupBackupResult struct {
+	GroupBackupURL string
+	Name           string
+	// Members are the results of the backups of the members, in the order
+	// of GroupBackupConfig.Members
+	Members []*BackupResult
+}
+
+func getGroupPath(groupName string) string {
+	checksum := util.GetChecksum([]byte(groupName))
+	groupLayer1 := checksum[0:VOLUME_SEPARATE_LAYER1]
+	groupLayer2 := checksum[VOLUME_SEPARATE_LAYER1:VOLUME_SEPARATE_LAYER2]
+	return filepath.Join(backupstoreBase, GROUP_DIRECTORY, groupLayer1, groupLayer2, groupName)
+}
+
+func getGroupBackupConfigPath(backupName, groupName string) string {
+	return filepath.Join(getGroupPath(groupName), getBackupConfigName(backupName))
+}
+
+func encodeGroupBackupURL(backupName, groupName, destURL string) string {
+	v := url.Values{}
+	v.Add("group", groupName)
+	v.Add("group-backup", backupName)
+	return destURL + "?" + v.Encode()
+}
+
+func decodeGroupBackupURL(groupBackupURL string) (string, string, error) {
+	u, err := url.Parse(groupBackupURL)
+	if err != nil {
+		return "", "", err
+	}
+	v := u.Query()
+	groupName := v.Get("group")
+	backupName := v.Get("group-backup")
+	if !util.ValidateName(groupName) || !util.ValidateName(backupName) {
+		return "", "", fmt.Errorf("Invalid name parsed, got %v and %v", backupName, groupName)
+	}
+	return backupName, groupName, nil
+}
+
+func loadGroupBackup(backupName, groupName string, driver BackupStoreDriver) (*GroupBackup, error) {
+	filePath := getGroupBackupConfigPath(backupName, groupName)
+	data, err := loadConfigDataInBackupStore(filePath, driver)
+	if err != nil {
+		return nil, err
+	}
+	backup := &GroupBackup{}
+	if err := unmarshalConfig(filePath, driver, data, backup); err != nil {
+		return nil, err
+	}
+	if backup.ManifestChecksum != "" {
+		if err := verifyManifestChecksum(data); err != nil {
+			return nil, newMetadataCorruptedError(filePath, driver, err)
+		}
+	}
+	for i := range backup.Members {
+		m := &backup.Members[i]
+		m.BackupURL = encodeBackupURL(m.BackupName, m.VolumeName, driver.GetURL())
+	}
+	return backup, nil
+}
+
+func saveGroupBackup(backup *GroupBackup, driver BackupStoreDriver) error {
+	backup.ManifestChecksum = ""
+	data, err := json.Marshal(backup)
+	if err != nil {
+		return err
+	}
+	checksum, _, err := getManifestChecksum(data)
+	if err != nil {
+		return err
+	}
+	backup.ManifestChecksum = checksum
+	return saveConfigInBackupStore(getGroupBackupConfigPath(backup.Name, backup.GroupName), driver, backup)
+}
+
+// CreateGroupBackup backs up all the member volumes of a consistency group
+// in parallel, and saves the group backup once they all completed. If any
+// of them fails, the others are canceled and no group backup is saved,
+// though the member backups already completed are kept.
+func CreateGroupBackup(ctx context.Context, config *GroupBackupConfig) (*GroupBackupResult, error) {
+	if config == nil {
+		return nil, fmt.Errorf("Invalid empty config for group backup")
+	}
+	if !util.ValidateName(config.GroupName) {
+		return nil, fmt.Errorf("Invalid group name %v", config.GroupName)
+	}
+	if len(config.Members) == 0 {
+		return nil, fmt.Errorf("Invalid group backup of %v without member", config.GroupName)
+	}
+	members := make(map[string]bool)
+	for _, member := range config.Members {
+		if member == nil || member.Volume == nil || member.Snapshot == nil {
+			return nil, fmt.Errorf("Invalid empty member config for group backup of %v", config.GroupName)
+		}
+		if members[member.Volume.Name] {
+			return nil, fmt.Errorf("Volume %v is a member of group %v more than once", member.Volume.Name, config.GroupName)
+		}
+		members[member.Volume.Name] = true
+	}
+	backupName := config.BackupName
+	if backupName == "" {
+		backupName = util.GenerateName("group-backup")
+	} else if !util.ValidateName(backupName) {
+		return nil, fmt.Errorf("Invalid group backup name %v", backupName)
+	}
+
+	bsDriver, err := GetBackupStoreDriver(config.DestURL)
+	if err != nil {
+		return nil, err
+	}
+	if bsDriver.FileExists(getGroupBackupConfigPath(backupName, config.GroupName)) {
+		return nil, fmt.Errorf("Group backup %v of %v already exists", backupName, config.GroupName)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	handles := make([]*BackupHandle, len(config.Members))
+	var firstErr error
+	for i, member := range config.Members {
+		c := *member
+		c.DestURL = config.DestURL
+		h, err := queueDeltaBlockBackup(ctx, &c, bsDriver)
+		if err != nil {
+			firstErr = fmt.Errorf("Failed to back up volume %v of group %v: %v", member.Volume.Name, config.GroupName, err)
+			break
+		}
+		handles[i] = h
+	}
+	if firstErr != nil {
+		cancel()
+	}
+
+	result := &GroupBackupResult{
+		GroupBackupURL: encodeGroupBackupURL(backupName, config.GroupName, config.DestURL),
+		Name:           backupName,
+		Members:        make([]*BackupResult, len(config.Members)),
+	}
+	for i, h := range handles {
+		if h == nil {
+			continue
+		}
+		r, err := h.Wait()
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("Failed to back up volume %v of group %v: %v",
+				config.Members[i].Volume.Name, config.GroupName, err)
+			cancel()
+		}
+		result.Members[i] = r
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	groupBackup := &GroupBackup{
+		Name:        backupName,
+		GroupName:   config.GroupName,
+		CreatedTime: util.Now(),
+		Labels:      config.Labels,
+	}
+	for _, r := range result.Members {
+		groupBackup.Members = append(groupBackup.Members, GroupMember{
+			VolumeName:   r.VolumeName,
+			BackupName:   r.BackupName,
+			SnapshotName: r.SnapshotName,
+		})
+	}
+	if err := saveGroupBackup(groupBackup, bsDriver); err != nil {
+		return nil, err
+	}
+	log.Infof("Created group backup %v of %v with %v members", backupName, config.GroupName, len(groupBackup.Members))
+	return result, nil
+}
+
+// InspectGroupBackup returns the manifest of a group backup, with the URLs
+// of the member backups filled
+func InspectGroupBackup(groupBackupURL string) (*GroupBackup, error) {
+	driver, err := GetBackupStoreDriver(groupBackupURL)
+	if err != nil {
+		return nil, err
+	}
+	backupName, groupName, err := decodeGroupBackupURL(groupBackupURL)
+	if err != nil {
+		return nil, err
+	}
+	return loadGroupBackup(backupName, groupName, driver)
+}
+
+// ListGroupBackups returns the URLs of the backups of the group groupName
+func ListGroupBackups(groupName, destURL string) ([]string, error) {
+	if !util.ValidateName(groupName) {
+		return nil, fmt.Errorf("Invalid group name %v", groupName)
+	}
+	driver, err := GetBackupStoreDriver(destURL)
+	if err != nil {
+		return nil, err
+	}
+	urls := []string{}
+	fileList, err := driver.List(getGroupPath(groupName))
+	if err != nil {
+		// path doesn't exist
+		return urls, nil
+	}
+	backupNames, err := util.ExtractNames(fileList, BACKUP_CONFIG_PREFIX, CFG_SUFFIX)
+	if err != nil {
+		return nil, err
+	}
+	for _, backupName := range backupNames {
+		urls = append(urls, encodeGroupBackupURL(backupName, groupName, driver.GetURL()))
+	}
+	return urls, nil
+}
+
+// DeleteGroupBackup deletes a group backup along with the backups of its
+// members
+func DeleteGroupBackup(groupBackupURL string) error {
+	driver, err := GetBackupStoreDriver(groupBackupURL)
+	if err != nil {
+		return err
+	}
+	backupName, groupName, err := decodeGroupBackupURL(groupBackupURL)
+	if err != nil {
+		return err
+	}
+	backup, err := loadGroupBackup(backupName, groupName, driver)
+	if err != nil {
+		return err
+	}
+	for _, m := range backup.Members {
+		if !backupExists(m.BackupName, m.VolumeName, driver) {
+			continue
+		}
+		if err := deleteDeltaBlockBackup(m.BackupURL, "", driver); err != nil {
+			return err
+		}
+	}
+	return driver.Remove(getGroupBackupConfigPath(backupName, groupName))
+}
+
+type GroupRestoreConfig struct {
+	GroupBackupURL string
+	// Filenames maps the volume names of all the members to the files or
+	// block devices to restore them to
+	Filenames map[string]string
+	// Member is the template of the configs of the restores of the
+	// members, whose BackupURL and Filename are filled for each member
+	Member DeltaRestoreConfig
+}
+
+// RestoreGroup restores all the members of a group backup to the files or
+// block devices of config, so they're all at the point in time of the group
+// backup. All the member backups are checked to exist before anything is
+// restored. The restores are stopped once ctx is canceled.
+func RestoreGroup(ctx context.Context, config *GroupRestoreConfig) error {
+	if config == nil {
+		return fmt.Errorf("Invalid empty config for group restore")
+	}
+	driver, err := GetBackupStoreDriver(config.GroupBackupURL)
+	if err != nil {
+		return err
+	}
+	backupName, groupName, err := decodeGroupBackupURL(config.GroupBackupURL)
+	if err != nil {
+		return err
+	}
+	backup, err := loadGroupBackup(backupName, groupName, driver)
+	if err != nil {
+		return err
+	}
+
+	if len(config.Filenames) != len(backup.Members) {
+		return fmt.Errorf("Invalid %v targets for the %v members of group backup %v",
+			len(config.Filenames), len(backup.Members), backupName)
+	}
+	for _, m := range backup.Members {
+		if config.Filenames[m.VolumeName] == "" {
+			return fmt.Errorf("Cannot find the target of volume %v of group backup %v", m.VolumeName, backupName)
+		}
+		if !backupExists(m.BackupName, m.VolumeName, driver) {
+			return fmt.Errorf("Cannot find backup %v of volume %v of group backup %v",
+				m.BackupName, m.VolumeName, backupName)
+		}
+	}
+
+	for _, m := range backup.Members {
+		c := config.Member
+		c.BackupURL = m.BackupURL
+		c.Filename = config.Filenames[m.VolumeName]
+		if err := restoreDeltaBlockBackup(ctx, &c, driver); err != nil {
+			return fmt.Errorf("Failed to restore volume %v of group backup %v: %v", m.VolumeName, backupName, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package backupstore
+
+import (
+	"context"
+	"fmt"
+)
+
+// BackupResult describes a completed delta block backup
+type BackupResult struct {
+	// OperationID identifies the backup in the logs
+	OperationID  string `json:",omitempty"`
+	BackupURL    string
+	BackupName   string
+	VolumeName   string
+	SnapshotName string
+	CreatedTime  string
+	Size         int64 `json:",string"`
+
+	// TotalBlocks is the number of blocks of the backup, including the
+	// ones of the previous backups it's based on. NewBlocks is the number
+	// of blocks which were uploaded, and BytesTransferred their size as
+	// stored.
+	TotalBlocks      int64 `json:",string"`
+	NewBlocks        int64 `json:",string"`
+	BytesTransferred int64 `json:",string"`
+}
+
+// BackupHandle is a delta block backup running in background
+type BackupHandle struct {
+	name        string
+	operationID string
+	done        chan struct{}
+
+	// Set before done is closed
+	result *BackupResult
+	err    error
+}
+
+func newBackupHandle(name, operationID string) *BackupHandle {
+	return &BackupHandle{
+		name:        name,
+		operationID: operationID,
+		done:        make(chan struct{}),
+	}
+}
+
+func (h *BackupHandle) finish(result *BackupResult, err error) {
+	h.result = result
+	h.err = err
+	close(h.done)
+}
+
+// Name returns the name of the backup
+func (h *BackupHandle) Name() string {
+	return h.name
+}
+
+// OperationID returns the ID identifying the backup in the logs and its
+// status
+func (h *BackupHandle) OperationID() string {
+	return h.operationID
+}
+
+// Done returns a channel which is closed once the backup is finished
+func (h *BackupHandle) Done() <-chan struct{} {
+	return h.done
+}
+
+// Wait blocks until the backup is finished, and returns its result or the
+// error it failed with. The result is still returned if the backup was
+// saved but closing the snapshot failed.
+func (h *BackupHandle) Wait() (*BackupResult, error) {
+	<-h.done
+	return h.result, h.err
+}
+
+// getExistingBackupResult returns the result of backupName, which already
+// exists in the backupstore. The backup must be of the snapshot of config,
+// otherwise the name is taken by another backup.
+func getExistingBackupResult(config *DeltaBackupConfig, backupName string, bsDriver BackupStoreDriver) (*BackupResult, error) {
+	backup, err := loadBackup(backupName, config.Volume.Name, bsDriver)
+	if err != nil {
+		return nil, err
+	}
+	if backup.SnapshotName != config.Snapshot.Name {
+		return nil, fmt.Errorf("Backup %v of volume %v already exists for snapshot %v",
+			backupName, backup.VolumeName, backup.SnapshotName)
+	}
+	operationLog(config.OperationID).Debugf("Backup %v of snapshot %v already exists, skipped creating it",
+		backupName, backup.SnapshotName)
+
+	result := &BackupResult{
+		OperationID:  config.OperationID,
+		BackupURL:    encodeBackupURL(backup.Name, backup.VolumeName, config.DestURL),
+		BackupName:   backup.Name,
+		VolumeName:   backup.VolumeName,
+		SnapshotName: backup.SnapshotName,
+		CreatedTime:  backup.CreatedTime,
+		Size:         backup.Size,
+		TotalBlocks:  int64(len(backup.Blocks)),
+	}
+	return result, nil
+}
+
+// CreateDeltaBlockBackupAndWait creates a backup and waits for it to finish
+func CreateDeltaBlockBackupAndWait(ctx context.Context, config *DeltaBackupConfig) (*BackupResult, error) {
+	h, err := StartDeltaBlockBackup(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	return h.Wait()
+}
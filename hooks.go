@@ -0,0 +1,120 @@
+package backupstore
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+)
+
+// BackupHookInfo describes the backup a hook is called for
+type BackupHookInfo struct {
+	OperationID  string
+	BackupName   string
+	VolumeName   string
+	SnapshotName string
+	// Error is the error of the backup for PostBackup, nil if the backup
+	// succeeded so far
+	Error error
+}
+
+// BackupHook is called around the read of the snapshot of a backup, e.g. to
+// freeze and thaw a filesystem, or to quiesce a database
+type BackupHook func(ctx context.Context, info *BackupHookInfo) error
+
+// errBackupAborted is passed to PostBackup if the backup panicked
+var errBackupAborted = fmt.Errorf("Backup aborted")
+
+// backupHooks pairs the PreBackup and PostBackup hooks of a backup
+type backupHooks struct {
+	pre  BackupHook
+	post BackupHook
+	info BackupHookInfo
+
+	// preDone is set once PreBackup succeeded, postOnce runs PostBackup
+	// only once then
+	preDone  bool
+	postOnce sync.Once
+}
+
+func newBackupHooks(config *DeltaBackupConfig, backupName string) *backupHooks {
+	return &backupHooks{
+		pre:  config.PreBackup,
+		post: config.PostBackup,
+		info: BackupHookInfo{
+			OperationID:  config.OperationID,
+			BackupName:   backupName,
+			VolumeName:   config.Volume.Name,
+			SnapshotName: config.Snapshot.Name,
+		},
+	}
+}
+
+// runPre calls PreBackup. PostBackup is only called by runPost if it
+// succeeded.
+func (h *backupHooks) runPre(ctx context.Context) error {
+	if h.pre != nil {
+		info := h.info
+		if err := h.pre(ctx, &info); err != nil {
+			return newBackupError(BackupErrorTypeHook, fmt.Errorf("PreBackup hook of backup %v failed: %v", h.info.BackupName, err))
+		}
+	}
+	h.preDone = true
+	return nil
+}
+
+// runPost calls PostBackup with err, the error of the backup so far, the
+// first time it's called after PreBackup succeeded. It returns err, or the
+// error of the hook if the backup succeeded so far. The hook is called
+// without the context of the backup, since it has to run even if the
+// backup has been canceled.
+func (h *backupHooks) runPost(err error) error {
+	if !h.preDone {
+		return err
+	}
+	h.postOnce.Do(func() {
+		if h.post == nil {
+			return
+		}
+		info := h.info
+		info.Error = err
+		hookErr := h.post(context.Background(), &info)
+		if hookErr == nil {
+			return
+		}
+		hookErr = newBackupError(BackupErrorTypeHook,
+			fmt.Errorf("PostBackup hook of backup %v failed: %v", h.info.BackupName, hookErr))
+		if err != nil {
+			log.Warn(hookErr)
+			return
+		}
+		err = hookErr
+	})
+	return err
+}
+
+// ExecBackupHook returns a hook running the command name with args. The
+// backup is described to the command by the environment variables
+// BACKUP_OPERATION_ID, BACKUP_NAME, BACKUP_VOLUME and BACKUP_SNAPSHOT, and
+// BACKUP_ERROR for PostBackup if the backup failed. The hook fails if the
+// command exits with an error.
+func ExecBackupHook(name string, args ...string) BackupHook {
+	return func(ctx context.Context, info *BackupHookInfo) error {
+		cmd := exec.CommandContext(ctx, name, args...)
+		cmd.Env = append(os.Environ(),
+			"BACKUP_OPERATION_ID="+info.OperationID,
+			"BACKUP_NAME="+info.BackupName,
+			"BACKUP_VOLUME="+info.VolumeName,
+			"BACKUP_SNAPSHOT="+info.SnapshotName,
+		)
+		if info.Error != nil {
+			cmd.Env = append(cmd.Env, "BACKUP_ERROR="+info.Error.Error())
+		}
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("Failed to execute: %v %v, output %v, error %v", name, args, string(output), err)
+		}
+		return nil
+	}
+}
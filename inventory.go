@@ -0,0 +1,254 @@
+package backupstore
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// InventoryState is the inventory of a backupstore as of the last sync of an
+// InventorySyncer. It can be saved by the caller to resume syncing later.
+type InventoryState struct {
+	URL string
+	// SyncedAt is the time of the last sync in RFC3339 format
+	SyncedAt string
+	// Volumes maps the names of the volumes to their state
+	Volumes map[string]*VolumeInventoryState
+}
+
+// VolumeInventoryState is the state of a volume as of the last sync
+type VolumeInventoryState struct {
+	// Marker is the checksum of the volume config, which changes along
+	// with the Generation of the volume each time it's saved. The backups
+	// of the volume are only listed again when it changed. It's empty if
+	// the volume has to be listed again on the next sync.
+	Marker string
+	// Backups are the names of the backups reported so far, sorted
+	Backups []string
+}
+
+// InventoryDelta is the change of the inventory of a backupstore since the
+// previous sync
+type InventoryDelta struct {
+	URL      string
+	SyncedAt string
+
+	// AddedVolumes and UpdatedVolumes are sorted by name, without their
+	// backups
+	AddedVolumes   []*VolumeInfo
+	UpdatedVolumes []*VolumeInfo
+	RemovedVolumes []string
+	// AddedBackups are sorted by volume and creation time
+	AddedBackups []*BackupInfo
+	// RemovedBackups are the URLs of the removed backups, sorted
+	RemovedBackups []string
+
+	// Errors maps the volumes and backups which cannot be loaded to the
+	// error. They're retried on the next sync.
+	Errors map[string]string `json:",omitempty"`
+}
+
+// Empty returns true if nothing changed since the previous sync
+func (d *InventoryDelta) Empty() bool {
+	return len(d.AddedVolumes) == 0 && len(d.UpdatedVolumes) == 0 && len(d.RemovedVolumes) == 0 &&
+		len(d.AddedBackups) == 0 && len(d.RemovedBackups) == 0
+}
+
+// InventorySyncer detects the volumes and backups added to or removed from a
+// backupstore since its previous sync, e.g. for a standby cluster to follow
+// the backups of another one. Only the volume configs are loaded on each
+// sync, the backups are listed for the volumes which changed only.
+type InventorySyncer struct {
+	lock   sync.Mutex
+	driver BackupStoreDriver
+	state  *InventoryState
+}
+
+// NewInventorySyncer returns a syncer of the backupstore destURL, resuming
+// from state if it's not nil. Otherwise the first sync reports everything
+// as added.
+func NewInventorySyncer(destURL string, state *InventoryState) (*InventorySyncer, error) {
+	driver, err := GetBackupStoreDriver(destURL)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		state = &InventoryState{}
+	} else {
+		state = copyInventoryState(state)
+		if state.URL != "" && state.URL != driver.GetURL() {
+			return nil, fmt.Errorf("Inventory state of %v cannot be used for %v", state.URL, driver.GetURL())
+		}
+	}
+	state.URL = driver.GetURL()
+	if state.Volumes == nil {
+		state.Volumes = make(map[string]*VolumeInventoryState)
+	}
+	return &InventorySyncer{
+		driver: driver,
+		state:  state,
+	}, nil
+}
+
+// State returns a copy of the state as of the last sync
+func (s *InventorySyncer) State() *InventoryState {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return copyInventoryState(s.state)
+}
+
+func copyInventoryState(state *InventoryState) *InventoryState {
+	c := *state
+	c.Volumes = make(map[string]*VolumeInventoryState)
+	for name, v := range state.Volumes {
+		c.Volumes[name] = &VolumeInventoryState{
+			Marker:  v.Marker,
+			Backups: append([]string{}, v.Backups...),
+		}
+	}
+	return &c
+}
+
+// Sync returns the changes since the previous sync
+func (s *InventorySyncer) Sync() (*InventoryDelta, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	volumeNames, err := getVolumeNames(s.driver)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(volumeNames)
+
+	delta := &InventoryDelta{
+		URL:            s.state.URL,
+		SyncedAt:       time.Now().UTC().Format(time.RFC3339),
+		AddedVolumes:   []*VolumeInfo{},
+		UpdatedVolumes: []*VolumeInfo{},
+		RemovedVolumes: []string{},
+		AddedBackups:   []*BackupInfo{},
+		RemovedBackups: []string{},
+		Errors:         make(map[string]string),
+	}
+	listed := make(map[string]bool)
+	volumes := make(map[string]*VolumeInventoryState)
+	for _, volumeName := range volumeNames {
+		listed[volumeName] = true
+		if v := s.syncVolume(delta, volumeName); v != nil {
+			volumes[volumeName] = v
+		}
+	}
+	for volumeName, v := range s.state.Volumes {
+		if listed[volumeName] {
+			continue
+		}
+		delta.RemovedVolumes = append(delta.RemovedVolumes, volumeName)
+		for _, backupName := range v.Backups {
+			delta.RemovedBackups = append(delta.RemovedBackups, encodeBackupURL(backupName, volumeName, s.state.URL))
+		}
+	}
+	sort.Strings(delta.RemovedVolumes)
+	sort.Strings(delta.RemovedBackups)
+
+	s.state.SyncedAt = delta.SyncedAt
+	s.state.Volumes = volumes
+	return delta, nil
+}
+
+// syncVolume adds the changes of the volume to delta, and returns its new
+// state, nil if the volume was never reported and cannot be loaded
+func (s *InventorySyncer) syncVolume(delta *InventoryDelta, volumeName string) *VolumeInventoryState {
+	previous, known := s.state.Volumes[volumeName]
+	volume, marker, err := loadVolumeWithMarker(volumeName, s.driver)
+	if err != nil {
+		delta.Errors[volumeName] = err.Error()
+		if !known {
+			return nil
+		}
+		return &VolumeInventoryState{Backups: previous.Backups}
+	}
+	if known && marker == previous.Marker {
+		return previous
+	}
+
+	info := fillVolumeInfo(volume)
+	info.Backups = nil
+	if !known {
+		delta.AddedVolumes = append(delta.AddedVolumes, info)
+	} else if previous.Marker != "" {
+		delta.UpdatedVolumes = append(delta.UpdatedVolumes, info)
+	}
+
+	state := &VolumeInventoryState{Marker: marker, Backups: []string{}}
+	previousBackups := make(map[string]bool)
+	if known {
+		for _, backupName := range previous.Backups {
+			previousBackups[backupName] = true
+		}
+	}
+	backupNames, err := getBackupNamesForVolume(volumeName, s.driver)
+	if err != nil {
+		delta.Errors[volumeName] = err.Error()
+		state.Marker = ""
+		if known {
+			state.Backups = previous.Backups
+		}
+		return state
+	}
+	added := []*BackupInfo{}
+	for _, backupName := range backupNames {
+		if previousBackups[backupName] {
+			delete(previousBackups, backupName)
+			state.Backups = append(state.Backups, backupName)
+			continue
+		}
+		// Only the header of the backup is decoded
+		blocks, err := loadBackupBlocks(backupName, volumeName, s.driver)
+		if err != nil {
+			// Listed again on the next sync to retry it
+			delta.Errors[encodeBackupURL(backupName, volumeName, s.state.URL)] = err.Error()
+			state.Marker = ""
+			continue
+		}
+		added = append(added, fillFullBackupInfo(blocks.backup, volume, s.state.URL))
+		state.Backups = append(state.Backups, backupName)
+	}
+	for backupName := range previousBackups {
+		delta.RemovedBackups = append(delta.RemovedBackups, encodeBackupURL(backupName, volumeName, s.state.URL))
+	}
+	sort.Slice(added, func(i, j int) bool {
+		if added[i].Created != added[j].Created {
+			return added[i].Created < added[j].Created
+		}
+		return added[i].Name < added[j].Name
+	})
+	delta.AddedBackups = append(delta.AddedBackups, added...)
+	sort.Strings(state.Backups)
+	return state
+}
+
+// Run syncs every interval until ctx is done, and calls fn with the deltas
+// which are not empty. The first sync is done right away. The errors of the
+// syncs are logged and retried on the next interval.
+func (s *InventorySyncer) Run(ctx context.Context, interval time.Duration, fn func(*InventoryDelta)) error {
+	if interval <= 0 {
+		return fmt.Errorf("Invalid inventory sync interval %v", interval)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		delta, err := s.Sync()
+		if err != nil {
+			log.WithError(err).Warnf("Failed to sync the inventory of %v", s.driver.GetURL())
+		} else if !delta.Empty() {
+			fn(delta)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
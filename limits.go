@@ -0,0 +1,177 @@
+package backupstore
+
+import (
+	"context"
+	"sync"
+)
+
+// ConcurrencyLimits limits the number of jobs running at once in this
+// process. Zero means no limit. The jobs over the limits wait for the
+// running ones to finish.
+type ConcurrencyLimits struct {
+	// MaxBackups limits the delta block backups transferring data
+	MaxBackups int
+	// MaxRestores limits the delta block restores
+	MaxRestores int
+	// MaxJobsPerDestination limits the backups and restores using the same
+	// backupstore
+	MaxJobsPerDestination int
+}
+
+// jobLimiter is a semaphore whose limit can be changed at any time. The
+// waiters are granted a slot in order.
+type jobLimiter struct {
+	lock    sync.Mutex
+	limit   int
+	running int
+	waiters []chan struct{}
+}
+
+func (l *jobLimiter) acquire(ctx context.Context) error {
+	l.lock.Lock()
+	if l.limit <= 0 || l.running < l.limit {
+		l.running++
+		l.lock.Unlock()
+		return nil
+	}
+	ch := make(chan struct{})
+	l.waiters = append(l.waiters, ch)
+	l.lock.Unlock()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for i, waiter := range l.waiters {
+		if waiter == ch {
+			l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+			return ctx.Err()
+		}
+	}
+	// The slot was granted concurrently, give it back
+	l.running--
+	l.grant()
+	return ctx.Err()
+}
+
+// tryAcquire takes a slot if one is free without waiting, and returns false
+// otherwise
+func (l *jobLimiter) tryAcquire() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.limit <= 0 || l.running < l.limit {
+		l.running++
+		return true
+	}
+	return false
+}
+
+func (l *jobLimiter) release() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.running--
+	l.grant()
+}
+
+func (l *jobLimiter) setLimit(limit int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.limit = limit
+	l.grant()
+}
+
+// grant hands the free slots to the waiters, the caller holds the lock
+func (l *jobLimiter) grant() {
+	for len(l.waiters) != 0 && (l.limit <= 0 || l.running < l.limit) {
+		close(l.waiters[0])
+		l.waiters = l.waiters[1:]
+		l.running++
+	}
+}
+
+var (
+	limitsLock          sync.Mutex
+	concurrencyLimits   ConcurrencyLimits
+	backupLimiter       = &jobLimiter{}
+	restoreLimiter      = &jobLimiter{}
+	destinationLimiters = make(map[string]*jobLimiter)
+)
+
+// SetConcurrencyLimits sets the limits of the jobs running at once. The
+// jobs already running are not affected, even if they exceed the new
+// limits.
+func SetConcurrencyLimits(limits ConcurrencyLimits) {
+	limitsLock.Lock()
+	defer limitsLock.Unlock()
+	concurrencyLimits = limits
+	backupLimiter.setLimit(limits.MaxBackups)
+	restoreLimiter.setLimit(limits.MaxRestores)
+	for _, l := range destinationLimiters {
+		l.setLimit(limits.MaxJobsPerDestination)
+	}
+}
+
+// GetConcurrencyLimits returns the limits set by SetConcurrencyLimits
+func GetConcurrencyLimits() ConcurrencyLimits {
+	limitsLock.Lock()
+	defer limitsLock.Unlock()
+	return concurrencyLimits
+}
+
+func getDestinationLimiter(driver BackupStoreDriver) *jobLimiter {
+	limitsLock.Lock()
+	defer limitsLock.Unlock()
+	url := driver.GetURL()
+	l, exists := destinationLimiters[url]
+	if !exists {
+		l = &jobLimiter{limit: concurrencyLimits.MaxJobsPerDestination}
+		destinationLimiters[url] = l
+	}
+	return l
+}
+
+// acquireJobSlot waits until a job limited by limiter can run against the
+// backupstore of driver, and returns the function to release the slot. The
+// slot of the destination is taken first, so the jobs waiting for a busy
+// destination don't hold back the others.
+func acquireJobSlot(ctx context.Context, limiter *jobLimiter, driver BackupStoreDriver) (func(), error) {
+	destLimiter := getDestinationLimiter(driver)
+	if err := destLimiter.acquire(ctx); err != nil {
+		return nil, err
+	}
+	if err := limiter.acquire(ctx); err != nil {
+		destLimiter.release()
+		return nil, err
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			limiter.release()
+			destLimiter.release()
+		})
+	}, nil
+}
+
+// tryAcquireJobSlot takes a slot the same way as acquireJobSlot if one is
+// free, and returns nil otherwise
+func tryAcquireJobSlot(limiter *jobLimiter, driver BackupStoreDriver) func() {
+	destLimiter := getDestinationLimiter(driver)
+	if !destLimiter.tryAcquire() {
+		return nil
+	}
+	if !limiter.tryAcquire() {
+		destLimiter.release()
+		return nil
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			limiter.release()
+			destLimiter.release()
+		})
+	}
+}
@@ -2,6 +2,7 @@ package backupstore
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/longhorn/backupstore/util"
 )
@@ -12,7 +13,12 @@ type VolumeInfo struct {
 	Created        string
 	LastBackupName string
 	LastBackupAt   string
-	DataStored     int64 `json:",string"`
+	DataStored     int64             `json:",string"`
+	BlockSize      int64             `json:",string"`
+	StoredSize     int64             `json:",string,omitempty"`
+	Description    string            `json:",omitempty"`
+	Annotations    map[string]string `json:",omitempty"`
+	Labels         map[string]string `json:",omitempty"`
 
 	Messages map[MessageType]string
 
@@ -26,7 +32,15 @@ type BackupInfo struct {
 	SnapshotCreated string
 	Created         string
 	Size            int64 `json:",string"`
+	StoredSize      int64 `json:",string,omitempty"`
 	Labels          map[string]string
+	Description     string            `json:",omitempty"`
+	Annotations     map[string]string `json:",omitempty"`
+	ExpiresAt       string            `json:",omitempty"`
+	Protected       bool              `json:",omitempty"`
+	// ParentBackupName is the backup of the same volume this backup was
+	// built on top of, empty for a full backup
+	ParentBackupName string `json:",omitempty"`
 
 	VolumeName    string `json:",omitempty"`
 	VolumeSize    int64  `json:",string,omitempty"`
@@ -77,6 +91,10 @@ func List(volumeName, destURL string, volumeOnly bool) (map[string]*VolumeInfo,
 	if err != nil {
 		return nil, err
 	}
+	return listVolumes(volumeName, driver, volumeOnly)
+}
+
+func listVolumes(volumeName string, driver BackupStoreDriver, volumeOnly bool) (map[string]*VolumeInfo, error) {
 	resp := make(map[string]*VolumeInfo)
 	if volumeName != "" {
 		volumeInfo, err := addListVolume(volumeName, driver, volumeOnly)
@@ -100,6 +118,90 @@ func List(volumeName, destURL string, volumeOnly bool) (map[string]*VolumeInfo,
 	return resp, nil
 }
 
+type ListVolumesOptions struct {
+	// Limit is the maximum number of volumes returned, zero means no limit
+	Limit int
+	// ContinuationToken is the token returned with the previous page
+	ContinuationToken string
+
+	// LabelSelector only keeps the volumes having all the labels with the
+	// same values, LabelPrefixSelector the volumes having all the labels
+	// with values starting with the given prefixes
+	LabelSelector       map[string]string
+	LabelPrefixSelector map[string]string
+}
+
+func (opts *ListVolumesOptions) match(volumeInfo *VolumeInfo) bool {
+	for key, value := range opts.LabelSelector {
+		if v, exists := volumeInfo.Labels[key]; !exists || v != value {
+			return false
+		}
+	}
+	for key, prefix := range opts.LabelPrefixSelector {
+		if v, exists := volumeInfo.Labels[key]; !exists || !strings.HasPrefix(v, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+type VolumeListPage struct {
+	Volumes []*VolumeInfo
+	// ContinuationToken is set if there are volumes left, it should be
+	// passed in ListVolumesOptions to get the next page
+	ContinuationToken string `json:",omitempty"`
+}
+
+// ListAllBackupVolumes returns the summaries of the backup volumes in destURL
+// page by page. The volumes which cannot be loaded are reported with an
+// error message rather than failing the listing.
+func ListAllBackupVolumes(destURL string, opts ListVolumesOptions) (*VolumeListPage, error) {
+	driver, err := GetBackupStoreDriver(destURL)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Limit < 0 {
+		return nil, fmt.Errorf("Invalid negative limit %v", opts.Limit)
+	}
+	// The token is the name of the last volume of the previous page
+	if opts.ContinuationToken != "" && !util.ValidateName(opts.ContinuationToken) {
+		return nil, fmt.Errorf("Invalid continuation token %v", opts.ContinuationToken)
+	}
+
+	page := &VolumeListPage{
+		Volumes: []*VolumeInfo{},
+	}
+	// Keep listing until the page is full, since volumes may be filtered out
+	after := opts.ContinuationToken
+	for {
+		volumeNames, more, err := getVolumeNamesPage(driver, after, opts.Limit)
+		if err != nil {
+			return nil, err
+		}
+		for i, volumeName := range volumeNames {
+			after = volumeName
+			volumeInfo, err := addListVolume(volumeName, driver, true)
+			if err != nil {
+				return nil, err
+			}
+			if !opts.match(volumeInfo) {
+				continue
+			}
+			page.Volumes = append(page.Volumes, volumeInfo)
+			if opts.Limit > 0 && len(page.Volumes) == opts.Limit {
+				if more || i < len(volumeNames)-1 {
+					page.ContinuationToken = volumeName
+				}
+				return page, nil
+			}
+		}
+		if !more {
+			break
+		}
+	}
+	return page, nil
+}
+
 func fillVolumeInfo(volume *Volume) *VolumeInfo {
 	return &VolumeInfo{
 		Name:           volume.Name,
@@ -107,7 +209,12 @@ func fillVolumeInfo(volume *Volume) *VolumeInfo {
 		Created:        volume.CreatedTime,
 		LastBackupName: volume.LastBackupName,
 		LastBackupAt:   volume.LastBackupAt,
-		DataStored:     int64(volume.BlockCount * DEFAULT_BLOCK_SIZE),
+		DataStored:     volume.BlockCount * getVolumeBlockSize(volume),
+		BlockSize:      getVolumeBlockSize(volume),
+		StoredSize:     volume.StoredSize,
+		Description:    volume.Description,
+		Annotations:    volume.Annotations,
+		Labels:         volume.Labels,
 		Messages:       make(map[MessageType]string),
 		Backups:        make(map[string]*BackupInfo),
 	}
@@ -115,13 +222,19 @@ func fillVolumeInfo(volume *Volume) *VolumeInfo {
 
 func fillBackupInfo(backup *Backup, destURL string) *BackupInfo {
 	return &BackupInfo{
-		Name:            backup.Name,
-		URL:             encodeBackupURL(backup.Name, backup.VolumeName, destURL),
-		SnapshotName:    backup.SnapshotName,
-		SnapshotCreated: backup.SnapshotCreatedAt,
-		Created:         backup.CreatedTime,
-		Size:            backup.Size,
-		Labels:          backup.Labels,
+		Name:             backup.Name,
+		URL:              encodeBackupURL(backup.Name, backup.VolumeName, destURL),
+		SnapshotName:     backup.SnapshotName,
+		SnapshotCreated:  backup.SnapshotCreatedAt,
+		Created:          backup.CreatedTime,
+		Size:             backup.Size,
+		StoredSize:       backup.StoredSize,
+		Labels:           backup.Labels,
+		Description:      backup.Description,
+		Annotations:      backup.Annotations,
+		ExpiresAt:        backup.ExpiresAt,
+		Protected:        backup.Protected,
+		ParentBackupName: backup.ParentBackupName,
 	}
 }
 
@@ -138,6 +251,10 @@ func InspectBackup(backupURL string) (*BackupInfo, error) {
 	if err != nil {
 		return nil, err
 	}
+	return inspectBackup(backupURL, driver)
+}
+
+func inspectBackup(backupURL string, driver BackupStoreDriver) (*BackupInfo, error) {
 	backupName, volumeName, err := decodeBackupURL(backupURL)
 	if err != nil {
 		return nil, err
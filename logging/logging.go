@@ -17,6 +17,7 @@ const (
 	LogFieldDestURL      = "dest_url"
 	LogFieldKind         = "kind"
 	LogFieldFilepath     = "filepath"
+	LogFieldOperation    = "operation"
 
 	LogFieldEvent        = "event"
 	LogEventBackup       = "backup"
@@ -0,0 +1,172 @@
+package backupstore
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"strconv"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+const manifestChecksumField = "ManifestChecksum"
+
+// ErrMetadataCorrupted is returned by MetadataCorruptedError.Unwrap
+var ErrMetadataCorrupted = fmt.Errorf("Metadata in backupstore is corrupted")
+
+// MetadataCorruptedError is returned when a config object of the backupstore
+// cannot be parsed, or doesn't match its checksums
+type MetadataCorruptedError struct {
+	Path   string
+	Reason string
+}
+
+func (e *MetadataCorruptedError) Error() string {
+	return fmt.Sprintf("Metadata %v in backupstore is corrupted: %v", e.Path, e.Reason)
+}
+
+func (e *MetadataCorruptedError) Unwrap() error {
+	return ErrMetadataCorrupted
+}
+
+// IsMetadataCorrupted returns true if err is a MetadataCorruptedError
+func IsMetadataCorrupted(err error) bool {
+	_, ok := err.(*MetadataCorruptedError)
+	return ok
+}
+
+// blocksChecksum computes the checksum of an ordered block list one block
+// at a time
+type blocksChecksum struct {
+	h   hash.Hash
+	buf []byte
+}
+
+func newBlocksChecksum() *blocksChecksum {
+	return &blocksChecksum{h: sha512.New()}
+}
+
+func (c *blocksChecksum) add(blk BlockMapping) {
+	c.buf = strconv.AppendInt(c.buf[:0], blk.Offset, 10)
+	c.buf = append(c.buf, ':')
+	c.buf = append(c.buf, blk.BlockChecksum...)
+	c.buf = append(c.buf, '\n')
+	c.h.Write(c.buf)
+}
+
+// sum returns the checksum the same way as util.GetChecksum
+func (c *blocksChecksum) sum() string {
+	return hex.EncodeToString(c.h.Sum(nil))[:util.PreservedChecksumLength]
+}
+
+// getBlocksChecksum returns the checksum of the ordered block list
+func getBlocksChecksum(blocks []BlockMapping) string {
+	c := newBlocksChecksum()
+	for _, blk := range blocks {
+		c.add(blk)
+	}
+	return c.sum()
+}
+
+// getManifestChecksum returns the checksum of the serialized backup, without
+// its ManifestChecksum field. The config is decoded generically, so the
+// fields unknown to this version are covered as well.
+func getManifestChecksum(data []byte) (string, string, error) {
+	var fields map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	// Keep the numbers as they are encoded
+	d.UseNumber()
+	if err := d.Decode(&fields); err != nil {
+		return "", "", err
+	}
+	stored, _ := fields[manifestChecksumField].(string)
+	delete(fields, manifestChecksumField)
+
+	// The map keys are sorted, so the encoding is canonical
+	canonical, err := json.Marshal(fields)
+	if err != nil {
+		return "", "", err
+	}
+	return util.GetChecksum(canonical), stored, nil
+}
+
+// setBackupManifest fills the checksums of backup before it's saved, and
+// returns the backup as it should be saved
+func setBackupManifest(backup *Backup) (*storedBackup, error) {
+	backup.BlocksChecksum = ""
+	if len(backup.Blocks) != 0 {
+		backup.BlocksChecksum = getBlocksChecksum(backup.Blocks)
+	}
+	// The manifest checksum covers the block list in its stored format
+	stored := getStoredBackup(backup)
+	stored.ManifestChecksum = ""
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return nil, err
+	}
+	checksum, _, err := getManifestChecksum(data)
+	if err != nil {
+		return nil, err
+	}
+	stored.ManifestChecksum = checksum
+	backup.ManifestChecksum = checksum
+	return stored, nil
+}
+
+// setVolumeManifest fills the checksum of volume before it's saved
+func setVolumeManifest(volume *Volume) error {
+	volume.ManifestChecksum = ""
+	data, err := json.Marshal(volume)
+	if err != nil {
+		return err
+	}
+	checksum, _, err := getManifestChecksum(data)
+	if err != nil {
+		return err
+	}
+	volume.ManifestChecksum = checksum
+	return nil
+}
+
+// verifyManifestChecksum checks data, the content of a config, against the
+// manifest checksum stored in it
+func verifyManifestChecksum(data []byte) error {
+	checksum, stored, err := getManifestChecksum(data)
+	if err != nil {
+		return err
+	}
+	if checksum != stored {
+		return fmt.Errorf("manifest checksum %v doesn't match %v", checksum, stored)
+	}
+	return nil
+}
+
+// verifyVolumeManifest checks the checksum of a loaded volume, data being
+// the content of its config. The volumes saved before the checksums were
+// introduced are not verified.
+func verifyVolumeManifest(volume *Volume, data []byte) error {
+	if volume.ManifestChecksum == "" {
+		return nil
+	}
+	return verifyManifestChecksum(data)
+}
+
+// verifyBackupManifest checks the checksums of a loaded backup, data being
+// the content of its config. The backups saved before the checksums were
+// introduced are not verified.
+func verifyBackupManifest(backup *Backup, data []byte) error {
+	if backup.ManifestChecksum != "" {
+		if err := verifyManifestChecksum(data); err != nil {
+			return err
+		}
+	}
+	if backup.BlocksChecksum != "" {
+		if checksum := getBlocksChecksum(backup.Blocks); checksum != backup.BlocksChecksum {
+			return fmt.Errorf("blocks checksum %v doesn't match %v", checksum, backup.BlocksChecksum)
+		}
+	}
+	return nil
+}
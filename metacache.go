@@ -0,0 +1,117 @@
+package backupstore
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// METADATA_CACHE_MAX_ENTRIES bounds the number of config objects kept
+	// in the metadata cache
+	METADATA_CACHE_MAX_ENTRIES = 4096
+)
+
+type metadataCacheEntry struct {
+	data      []byte
+	expiresAt time.Time
+}
+
+// metadataCache keeps the content of the config objects loaded from the
+// backupstore, keyed by the URL of the backupstore and the object path. The
+// entries are invalidated when the objects are saved or removed through this
+// process, and expire after the TTL to pick up the changes of others.
+type metadataCache struct {
+	lock    sync.Mutex
+	ttl     time.Duration
+	entries map[string]*metadataCacheEntry
+}
+
+var metaCache = &metadataCache{
+	entries: make(map[string]*metadataCacheEntry),
+}
+
+// SetMetadataCacheTTL enables caching the volume and backup configs loaded
+// from the backupstore for ttl. Zero, the default, disables the cache.
+func SetMetadataCacheTTL(ttl time.Duration) {
+	metaCache.lock.Lock()
+	defer metaCache.lock.Unlock()
+	metaCache.ttl = ttl
+	if ttl <= 0 {
+		metaCache.entries = make(map[string]*metadataCacheEntry)
+	}
+}
+
+// PurgeMetadataCache drops all the cached configs
+func PurgeMetadataCache() {
+	metaCache.lock.Lock()
+	defer metaCache.lock.Unlock()
+	metaCache.entries = make(map[string]*metadataCacheEntry)
+}
+
+func getMetadataCacheKey(driver BackupStoreDriver, filePath string) string {
+	return driver.GetURL() + "|" + filePath
+}
+
+// get returns the cached content of filePath. The content is shared, so it
+// must not be modified.
+func (m *metadataCache) get(driver BackupStoreDriver, filePath string) ([]byte, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.ttl <= 0 {
+		return nil, false
+	}
+	key := getMetadataCacheKey(driver, filePath)
+	entry, ok := m.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expiresAt) {
+		delete(m.entries, key)
+		return nil, false
+	}
+	return entry.data, true
+}
+
+func (m *metadataCache) put(driver BackupStoreDriver, filePath string, data []byte) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.ttl <= 0 {
+		return
+	}
+	now := time.Now()
+	if len(m.entries) >= METADATA_CACHE_MAX_ENTRIES {
+		for key, entry := range m.entries {
+			if now.After(entry.expiresAt) {
+				delete(m.entries, key)
+			}
+		}
+		// Start over rather than tracking the usage of the entries
+		if len(m.entries) >= METADATA_CACHE_MAX_ENTRIES {
+			m.entries = make(map[string]*metadataCacheEntry)
+		}
+	}
+	m.entries[getMetadataCacheKey(driver, filePath)] = &metadataCacheEntry{
+		data:      data,
+		expiresAt: now.Add(m.ttl),
+	}
+}
+
+// invalidate drops the cached content of paths, and of the objects under
+// them since the drivers remove paths recursively
+func (m *metadataCache) invalidate(driver BackupStoreDriver, paths ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if len(m.entries) == 0 {
+		return
+	}
+	for _, path := range paths {
+		prefix := getMetadataCacheKey(driver, path)
+		dirPrefix := strings.TrimSuffix(prefix, "/") + "/"
+		for key := range m.entries {
+			if key == prefix || strings.HasPrefix(key, dirPrefix) {
+				delete(m.entries, key)
+			}
+		}
+	}
+}
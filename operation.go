@@ -0,0 +1,25 @@
+package backupstore
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/backupstore/util"
+
+	. "github.com/longhorn/backupstore/logging"
+)
+
+// getOperationID returns id, or a new unique ID for an operation of kind,
+// e.g. "backup", if it's empty. The operation ID is included in the logs
+// and the status of the operation, so the logs of concurrent operations on
+// the same volume can be told apart.
+func getOperationID(id, kind string) string {
+	if id != "" {
+		return id
+	}
+	return util.GenerateName(kind)
+}
+
+// operationLog returns the logger of the operation id
+func operationLog(id string) *logrus.Entry {
+	return log.WithField(LogFieldOperation, id)
+}
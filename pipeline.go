@@ -0,0 +1,416 @@
+package backupstore
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/longhorn/backupstore/util"
+	"github.com/sirupsen/logrus"
+)
+
+// The delta blocks are backed up by a pipeline of stages, each running in
+// its own goroutine and connected by unbuffered channels:
+//
+//	read -> checksum and dedup check -> compress -> upload
+//
+// so reading the snapshot, the CPU work and the network transfer overlap.
+// Every stage processes the blocks in order, so the resulting mappings stay
+// sorted by offset.
+
+// snapshotBatch is the buffer of contiguous blocks read from the snapshot
+// at once. It's returned to the pool once all its blocks are uploaded.
+type snapshotBatch struct {
+	buf     []byte
+	pending int32
+}
+
+func (b *snapshotBatch) release() {
+	if atomic.AddInt32(&b.pending, -1) == 0 {
+		util.PutBytes(b.buf)
+	}
+}
+
+type blockTask struct {
+	batch  *snapshotBatch
+	data   []byte
+	offset int64
+	// length is the length of data if it differs from the block size
+	length int64
+
+	// mappingIndex is the index of the delta mapping the block belongs to,
+	// lastOfMapping is set on the last block of the mapping
+	mappingIndex  int
+	lastOfMapping bool
+
+	checksum string
+	// existingSize is the size of the block already in the backupstore, or
+	// -1 if the block needs to be uploaded. existingUncompressed is set if
+	// that block is stored as is.
+	existingSize         int64
+	existingUncompressed bool
+	// duplicated is set if a previous block of this backup has the same
+	// content and would be uploaded
+	duplicated bool
+
+	compressed   *bytes.Buffer
+	isCompressed bool
+}
+
+type blockPipeline struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	log    *logrus.Entry
+
+	// storedBlocks maps the checksums of the blocks of the last backup to
+	// their mappings, which record how they're stored
+	storedBlocks map[string]BlockMapping
+
+	errLock sync.Mutex
+	err     error
+}
+
+// fail stops the pipeline with err, unless it already failed
+func (p *blockPipeline) fail(err error) {
+	p.errLock.Lock()
+	defer p.errLock.Unlock()
+	if p.err == nil {
+		p.err = err
+		p.cancel()
+	}
+}
+
+// getErr returns the error the pipeline failed with, or the error of its
+// context if it was stopped without error
+func (p *blockPipeline) getErr() error {
+	p.errLock.Lock()
+	defer p.errLock.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	return p.ctx.Err()
+}
+
+// send passes the task to the next stage, and returns false if the pipeline
+// has been stopped
+func (p *blockPipeline) send(ch chan<- *blockTask, task *blockTask) bool {
+	select {
+	case ch <- task:
+		return true
+	case <-p.ctx.Done():
+		return false
+	}
+}
+
+// backupDeltaBlocks stores the blocks of delta which don't exist in the
+// backupstore yet. It returns the mappings of all the blocks in delta and the
+// number of new blocks. The encoding of the blocks already stored is taken
+// from lastBackup if it has them. readDone is called with the error of the pipeline so
+// far, if any, once the snapshot is no longer read, while the last blocks may
+// still be uploaded. The pipeline fails if it returns an error.
+func backupDeltaBlocks(ctx context.Context, config *DeltaBackupConfig, reader io.ReaderAt, delta *Mappings,
+	mode ChunkingMode, lastBackup *Backup, bsDriver BackupStoreDriver, tracker *backupStatusTracker,
+	quota *volumeQuota, readDone func(err error) error) ([]BlockMapping, int64, error) {
+
+	p := &blockPipeline{
+		log:          tracker.log,
+		storedBlocks: make(map[string]BlockMapping),
+	}
+	if lastBackup != nil {
+		for _, blk := range lastBackup.Blocks {
+			p.storedBlocks[blk.BlockChecksum] = blk
+		}
+	}
+	p.ctx, p.cancel = context.WithCancel(ctx)
+	defer p.cancel()
+
+	checksumCh := make(chan *blockTask)
+	compressCh := make(chan *blockTask)
+	uploadCh := make(chan *blockTask)
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		defer close(checksumCh)
+		if mode == ChunkingModeCDC {
+			p.readChunks(reader, delta, checksumCh)
+		} else {
+			p.readBlocks(config, reader, delta, checksumCh)
+		}
+		if readDone != nil {
+			if err := readDone(p.getErr()); err != nil {
+				p.fail(err)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		defer close(compressCh)
+		p.checkBlocks(config.Volume.Name, bsDriver, checksumCh, compressCh)
+	}()
+	go func() {
+		defer wg.Done()
+		defer close(uploadCh)
+		p.compressBlocks(compressCh, uploadCh)
+	}()
+
+	blocks, newBlocks := p.uploadBlocks(config.Volume.Name, len(delta.Mappings), bsDriver, tracker, quota, uploadCh)
+	wg.Wait()
+
+	p.errLock.Lock()
+	err := p.err
+	p.errLock.Unlock()
+	if err != nil {
+		return nil, 0, err
+	}
+	// The pipeline may have been stopped without error by the cancellation
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	return blocks, newBlocks, nil
+}
+
+func (p *blockPipeline) readBlocks(config *DeltaBackupConfig, reader io.ReaderAt, delta *Mappings, out chan<- *blockTask) {
+	readBlocks := int64(config.SnapshotReadBlocks)
+	if readBlocks <= 0 {
+		readBlocks = DEFAULT_SNAPSHOT_READ_BLOCKS
+	}
+
+	mCounts := len(delta.Mappings)
+	for m, d := range delta.Mappings {
+		blkCounts, err := getMappingBlockCount(d, delta.BlockSize, config.Volume.Size)
+		if err != nil {
+			p.fail(newBackupError(BackupErrorTypeInvalid, err))
+			return
+		}
+		for i := int64(0); i < blkCounts; i += readBlocks {
+			if err := p.ctx.Err(); err != nil {
+				return
+			}
+			// Read as many contiguous blocks as possible at once
+			n := readBlocks
+			if blkCounts-i < n {
+				n = blkCounts - i
+			}
+			// The last block of the volume may be short
+			start := i * delta.BlockSize
+			length := n * delta.BlockSize
+			if d.Size-start < length {
+				length = d.Size - start
+			}
+			batch := &snapshotBatch{
+				buf:     util.GetBytes(int(length)),
+				pending: int32(n),
+			}
+			if err := readSnapshotBlock(reader, batch.buf, d.Offset+start); err != nil {
+				util.PutBytes(batch.buf)
+				p.fail(newBackupError(BackupErrorTypeSnapshot, err))
+				return
+			}
+
+			for j := int64(0); j < n; j++ {
+				p.log.Debugf("Backup for %v: segment %v/%v, blocks %v/%v", config.Snapshot.Name, m+1, mCounts, i+j+1, blkCounts)
+				task := &blockTask{
+					batch:         batch,
+					data:          getBatchBlock(batch.buf, j, delta.BlockSize),
+					offset:        d.Offset + (i+j)*delta.BlockSize,
+					mappingIndex:  m,
+					lastOfMapping: i+j == blkCounts-1,
+				}
+				if int64(len(task.data)) != delta.BlockSize {
+					task.length = int64(len(task.data))
+				}
+				if !p.send(out, task) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// readChunks reads the ranges of delta as content-defined chunks
+func (p *blockPipeline) readChunks(reader io.ReaderAt, delta *Mappings, out chan<- *blockTask) {
+	err := forEachChunk(p.ctx, reader, delta, func(m int, offset int64, data []byte, lastOfRange bool) error {
+		batch := &snapshotBatch{
+			buf:     util.GetBytes(len(data)),
+			pending: 1,
+		}
+		copy(batch.buf, data)
+		task := &blockTask{
+			batch:         batch,
+			data:          batch.buf,
+			offset:        offset,
+			mappingIndex:  m,
+			lastOfMapping: lastOfRange,
+		}
+		if int64(len(data)) != delta.BlockSize {
+			task.length = int64(len(data))
+		}
+		if !p.send(out, task) {
+			batch.release()
+			return p.ctx.Err()
+		}
+		return nil
+	})
+	if err != nil && p.ctx.Err() == nil {
+		p.fail(err)
+	}
+}
+
+// getBatchBlock returns the j-th block of buf, the last one may be short
+func getBatchBlock(buf []byte, j, blockSize int64) []byte {
+	end := (j + 1) * blockSize
+	if end > int64(len(buf)) {
+		end = int64(len(buf))
+	}
+	return buf[j*blockSize : end]
+}
+
+func (p *blockPipeline) checkBlocks(volumeName string, bsDriver BackupStoreDriver, in <-chan *blockTask, out chan<- *blockTask) {
+	scheduled := make(map[string]bool)
+	for task := range in {
+		task.checksum = util.GetChecksum(task.data)
+		if scheduled[task.checksum] {
+			task.duplicated = true
+		} else {
+			task.existingSize = bsDriver.FileSize(getBlockFilePath(volumeName, task.checksum))
+			// An empty block is left by an interrupted upload, and would
+			// be uploaded again instead of reused
+			if task.existingSize == 0 {
+				task.existingSize = -1
+			}
+			if task.existingSize < 0 {
+				scheduled[task.checksum] = true
+			} else {
+				uncompressed, err := p.isStoredUncompressed(volumeName, bsDriver, task)
+				if err != nil {
+					p.fail(newBackupError(BackupErrorTypeBackupstore, err))
+					return
+				}
+				task.existingUncompressed = uncompressed
+			}
+		}
+		if !p.send(out, task) {
+			return
+		}
+	}
+}
+
+// isStoredUncompressed returns true if the existing block of task is stored
+// as is. It's recorded by the last backup if the block is part of it. The
+// compressed blocks are smaller than their data, otherwise the block is read
+// to check whether it's the raw data.
+func (p *blockPipeline) isStoredUncompressed(volumeName string, bsDriver BackupStoreDriver, task *blockTask) (bool, error) {
+	if stored, exists := p.storedBlocks[task.checksum]; exists {
+		return stored.Uncompressed, nil
+	}
+	if task.existingSize != int64(len(task.data)) {
+		return false, nil
+	}
+	rc, err := bsDriver.Read(getBlockFilePath(volumeName, task.checksum))
+	if err != nil {
+		return false, err
+	}
+	defer rc.Close()
+	buf := util.GetBuffer()
+	defer util.PutBuffer(buf)
+	if _, err := buf.ReadFrom(rc); err != nil {
+		return false, err
+	}
+	return util.GetChecksum(buf.Bytes()) == task.checksum, nil
+}
+
+func (p *blockPipeline) compressBlocks(in <-chan *blockTask, out chan<- *blockTask) {
+	for task := range in {
+		if !task.duplicated && task.existingSize < 0 {
+			task.compressed = util.GetBuffer()
+			isCompressed, err := util.CompressBlockTo(task.compressed, task.data)
+			if err != nil {
+				util.PutBuffer(task.compressed)
+				p.fail(err)
+				return
+			}
+			task.isCompressed = isCompressed
+		}
+		if !p.send(out, task) {
+			return
+		}
+	}
+}
+
+// uploadBlocks consumes all the tasks, even after the pipeline is stopped, so
+// the buffers get back to the pools
+func (p *blockPipeline) uploadBlocks(volumeName string, mCounts int, bsDriver BackupStoreDriver,
+	tracker *backupStatusTracker, quota *volumeQuota, in <-chan *blockTask) ([]BlockMapping, int64) {
+
+	blocks := []BlockMapping{}
+	newBlocks := int64(0)
+	// The mappings of the blocks uploaded by this backup
+	uploaded := make(map[string]BlockMapping)
+	for task := range in {
+		if p.ctx.Err() == nil {
+			mapping, isNew, err := uploadBlock(volumeName, bsDriver, task, uploaded, tracker, quota)
+			if err != nil {
+				p.fail(err)
+			} else {
+				blocks = append(blocks, mapping)
+				if isNew {
+					newBlocks++
+				}
+				if task.lastOfMapping {
+					tracker.progress(int((float64(task.mappingIndex+1) / float64(mCounts)) * PROGRESS_PERCENTAGE_BACKUP_SNAPSHOT))
+				}
+			}
+		}
+		if task.compressed != nil {
+			util.PutBuffer(task.compressed)
+		}
+		task.batch.release()
+	}
+	return blocks, newBlocks
+}
+
+func uploadBlock(volumeName string, bsDriver BackupStoreDriver, task *blockTask, uploaded map[string]BlockMapping,
+	tracker *backupStatusTracker, quota *volumeQuota) (BlockMapping, bool, error) {
+	mapping := BlockMapping{
+		Offset:        task.offset,
+		BlockChecksum: task.checksum,
+		Length:        task.length,
+	}
+	blkFile := getBlockFilePath(volumeName, task.checksum)
+
+	if task.duplicated {
+		mapping.Uncompressed = uploaded[task.checksum].Uncompressed
+		mapping.StoredSize = uploaded[task.checksum].StoredSize
+		tracker.log.Debugf("Found block match at %v uploaded by this backup", blkFile)
+		return mapping, false, nil
+	}
+	if task.existingSize >= 0 {
+		mapping.Uncompressed = task.existingUncompressed
+		mapping.StoredSize = task.existingSize
+		tracker.log.Debugf("Found existed block match at %v", blkFile)
+		return mapping, false, nil
+	}
+
+	data := task.data
+	if task.isCompressed {
+		data = task.compressed.Bytes()
+	}
+	if err := quota.reserve(int64(len(data))); err != nil {
+		return mapping, false, err
+	}
+	if err := bsDriver.Write(blkFile, bytes.NewReader(data)); err != nil {
+		return mapping, false, newBackupError(BackupErrorTypeBackupstore, err)
+	}
+	tracker.log.Debugf("Created new block file at %v, compressed %v", blkFile, task.isCompressed)
+	tracker.transferred(int64(len(data)))
+	quota.add(int64(len(data)))
+
+	mapping.Uncompressed = !task.isCompressed
+	mapping.StoredSize = int64(len(data))
+	uploaded[task.checksum] = mapping
+	return mapping, true, nil
+}
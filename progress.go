@@ -0,0 +1,113 @@
+package backupstore
+
+import (
+	"time"
+)
+
+// progressThrottler decides whether an intermediate progress update should be
+// delivered, based on the minimum interval and minimum progress delta since
+// the last delivered update. A zero limit is not enforced, so zero for both
+// delivers every update.
+type progressThrottler struct {
+	interval time.Duration
+	minDelta int
+
+	lastProgress int
+	lastUpdate   time.Time
+}
+
+func newProgressThrottler(interval time.Duration, minDelta int) *progressThrottler {
+	return &progressThrottler{
+		interval: interval,
+		minDelta: minDelta,
+	}
+}
+
+func (p *progressThrottler) shouldUpdate(progress int) bool {
+	now := time.Now()
+	if p.interval > 0 && !p.lastUpdate.IsZero() && now.Sub(p.lastUpdate) < p.interval {
+		return false
+	}
+	if p.minDelta > 0 && progress-p.lastProgress < p.minDelta {
+		return false
+	}
+	p.lastProgress = progress
+	p.lastUpdate = now
+	return true
+}
+
+// RestoreProgress is delivered to DeltaRestoreConfig.ProgressFunc during a
+// restore
+type RestoreProgress struct {
+	// OperationID identifies the restore in the logs
+	OperationID string `json:",omitempty"`
+	BackupURL   string
+	// BlocksTotal is the number of blocks to write, which only counts the
+	// changed blocks for an incremental restore
+	BlocksDone  int64
+	BlocksTotal int64
+	// BytesWritten includes the zeroes written over the removed blocks
+	BytesWritten int64
+	// Throughput is the average number of bytes written per second since
+	// the restore started
+	Throughput int64
+	Progress   int
+	Completed  bool
+}
+
+// restoreProgressTracker maintains the progress of one restore and delivers
+// it to the callback of the restore, if any
+type restoreProgressTracker struct {
+	progress  RestoreProgress
+	fn        func(progress *RestoreProgress)
+	throttler *progressThrottler
+	startedAt time.Time
+}
+
+func newRestoreProgressTracker(config *DeltaRestoreConfig) *restoreProgressTracker {
+	return &restoreProgressTracker{
+		progress: RestoreProgress{
+			OperationID: config.OperationID,
+			BackupURL:   config.BackupURL,
+		},
+		fn:        config.ProgressFunc,
+		throttler: newProgressThrottler(config.ProgressUpdateInterval, config.ProgressUpdateMinDelta),
+		startedAt: time.Now(),
+	}
+}
+
+func (t *restoreProgressTracker) publish() {
+	if t.fn == nil {
+		return
+	}
+	if elapsed := time.Since(t.startedAt).Seconds(); elapsed > 0 {
+		t.progress.Throughput = int64(float64(t.progress.BytesWritten) / elapsed)
+	}
+	progress := t.progress
+	t.fn(&progress)
+}
+
+func (t *restoreProgressTracker) start(blocksTotal int64) {
+	t.progress.BlocksTotal = blocksTotal
+	t.publish()
+}
+
+func (t *restoreProgressTracker) written(bytes int64) {
+	t.progress.BytesWritten += bytes
+}
+
+func (t *restoreProgressTracker) blockDone() {
+	t.progress.BlocksDone++
+	if t.progress.BlocksTotal != 0 {
+		t.progress.Progress = int(t.progress.BlocksDone * 100 / t.progress.BlocksTotal)
+	}
+	if t.throttler.shouldUpdate(t.progress.Progress) {
+		t.publish()
+	}
+}
+
+func (t *restoreProgressTracker) complete() {
+	t.progress.Progress = 100
+	t.progress.Completed = true
+	t.publish()
+}
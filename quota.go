@@ -0,0 +1,141 @@
+package backupstore
+
+import (
+	"fmt"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+// BackupErrorTypeQuota means the backup would exceed the quota of the
+// backup volume
+const BackupErrorTypeQuota = BackupErrorType("quota")
+
+// VolumeUsage is the storage used by a backup volume in the backupstore
+type VolumeUsage struct {
+	VolumeName string
+	BlockCount int64 `json:",string"`
+	// StoredSize is the size of the blocks as stored, after compression
+	StoredSize int64 `json:",string"`
+	// Zero means no limit
+	QuotaSize       int64 `json:",string"`
+	QuotaBlockCount int64 `json:",string"`
+}
+
+// SetBackupVolumeQuota limits the stored size in bytes and the number of
+// blocks of a backup volume. Zero removes the limit. Backups exceeding the
+// quota fail, the existing backups are kept even if they exceed the new
+// quota.
+func SetBackupVolumeQuota(volumeName, destURL string, quotaSize, quotaBlockCount int64) error {
+	if quotaSize < 0 || quotaBlockCount < 0 {
+		return fmt.Errorf("Invalid negative quota for volume %v", volumeName)
+	}
+	driver, err := GetBackupStoreDriver(destURL)
+	if err != nil {
+		return err
+	}
+	if !util.ValidateName(volumeName) {
+		return fmt.Errorf("Invalid volume name %v", volumeName)
+	}
+
+	unlock, err := lockVolume(driver, volumeName, "volume update")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	volume, err := loadVolume(volumeName, driver)
+	if err != nil {
+		return err
+	}
+	volume.QuotaSize = quotaSize
+	volume.QuotaBlockCount = quotaBlockCount
+	if err := saveVolume(volume, driver); err != nil {
+		return err
+	}
+	log.Debugf("Updated quota of backup volume %v to %v bytes, %v blocks", volumeName, quotaSize, quotaBlockCount)
+	return nil
+}
+
+// GetBackupVolumeUsage returns the storage used by a backup volume along with
+// its quota
+func GetBackupVolumeUsage(volumeName, destURL string) (*VolumeUsage, error) {
+	driver, err := GetBackupStoreDriver(destURL)
+	if err != nil {
+		return nil, err
+	}
+	if !util.ValidateName(volumeName) {
+		return nil, fmt.Errorf("Invalid volume name %v", volumeName)
+	}
+
+	volume, err := loadVolume(volumeName, driver)
+	if err != nil {
+		return nil, err
+	}
+	return &VolumeUsage{
+		VolumeName:      volume.Name,
+		BlockCount:      volume.BlockCount,
+		StoredSize:      volume.StoredSize,
+		QuotaSize:       volume.QuotaSize,
+		QuotaBlockCount: volume.QuotaBlockCount,
+	}, nil
+}
+
+// volumeQuota accounts the blocks uploaded by a backup against the quota of
+// the volume
+type volumeQuota struct {
+	volume *Volume
+
+	newBlocks int64
+	newSize   int64
+}
+
+func newVolumeQuota(volume *Volume) *volumeQuota {
+	return &volumeQuota{volume: volume}
+}
+
+// check fails if the volume is already over its quota, so the backup can be
+// rejected before starting
+func (q *volumeQuota) check() error {
+	if limit := q.volume.QuotaBlockCount; limit > 0 && q.volume.BlockCount >= limit {
+		return newBackupError(BackupErrorTypeQuota, fmt.Errorf("Volume %v has reached its quota of %v blocks",
+			q.volume.Name, limit))
+	}
+	if limit := q.volume.QuotaSize; limit > 0 && q.volume.StoredSize >= limit {
+		return newBackupError(BackupErrorTypeQuota, fmt.Errorf("Volume %v has reached its quota of %v bytes",
+			q.volume.Name, limit))
+	}
+	return nil
+}
+
+// reserve fails if uploading one more block of size would exceed the quota
+func (q *volumeQuota) reserve(size int64) error {
+	if limit := q.volume.QuotaBlockCount; limit > 0 && q.volume.BlockCount+q.newBlocks+1 > limit {
+		return newBackupError(BackupErrorTypeQuota, fmt.Errorf("Volume %v would exceed its quota of %v blocks",
+			q.volume.Name, limit))
+	}
+	if limit := q.volume.QuotaSize; limit > 0 && q.volume.StoredSize+q.newSize+size > limit {
+		return newBackupError(BackupErrorTypeQuota, fmt.Errorf("Volume %v would exceed its quota of %v bytes",
+			q.volume.Name, limit))
+	}
+	return nil
+}
+
+func (q *volumeQuota) add(size int64) {
+	q.newBlocks++
+	q.newSize += size
+}
+
+// getBlocksStoredSize returns the stored size of the distinct blocks. The
+// blocks without recorded size are not accounted.
+func getBlocksStoredSize(blocks []BlockMapping) int64 {
+	counted := make(map[string]bool)
+	size := int64(0)
+	for _, blk := range blocks {
+		if counted[blk.BlockChecksum] {
+			continue
+		}
+		counted[blk.BlockChecksum] = true
+		size += blk.StoredSize
+	}
+	return size
+}
@@ -0,0 +1,135 @@
+package backupstore
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+// RenameBackupVolume moves the backups of volume oldName to newName. Since
+// the paths in the backupstore derive from the volume name, all the objects
+// of the volume are copied to the new location, then the old location is
+// removed. The old volume is only removed once the new one is complete, so
+// the rename can be retried after a failure.
+func RenameBackupVolume(oldName, newName, destURL string) error {
+	if !util.ValidateName(oldName) {
+		return fmt.Errorf("Invalid volume name %v", oldName)
+	}
+	if !util.ValidateName(newName) {
+		return fmt.Errorf("Invalid volume name %v", newName)
+	}
+	if oldName == newName {
+		return fmt.Errorf("Cannot rename volume %v to the same name", oldName)
+	}
+	driver, err := GetBackupStoreDriver(destURL)
+	if err != nil {
+		return err
+	}
+	unlock, err := lockVolume(driver, oldName, "volume rename")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	unlockNew, err := lockVolume(driver, newName, "volume rename")
+	if err != nil {
+		return err
+	}
+	defer unlockNew()
+	if volumeExists(newName, driver) {
+		return fmt.Errorf("Volume %v already exists in backupstore", newName)
+	}
+
+	volume, err := loadVolume(oldName, driver)
+	if err != nil {
+		return err
+	}
+	backupNames, err := getBackupNamesForVolume(oldName, driver)
+	if err != nil {
+		return err
+	}
+
+	copiedBlocks := make(map[string]bool)
+	for _, backupName := range backupNames {
+		backup, err := loadBackup(backupName, oldName, driver)
+		if err != nil {
+			return err
+		}
+		for _, blk := range backup.Blocks {
+			if copiedBlocks[blk.BlockChecksum] {
+				continue
+			}
+			if err := copyObject(driver, getBlockFilePath(oldName, blk.BlockChecksum),
+				getBlockFilePath(newName, blk.BlockChecksum)); err != nil {
+				return err
+			}
+			copiedBlocks[blk.BlockChecksum] = true
+		}
+
+		backup.VolumeName = newName
+		if backup.SingleFile.FilePath != "" {
+			dst := getSingleFileBackupFilePath(backup)
+			if err := copyFileObject(driver, backup.SingleFile.FilePath, dst); err != nil {
+				return err
+			}
+			backup.SingleFile.FilePath = dst
+		}
+		if err := saveBackup(backup, driver); err != nil {
+			return err
+		}
+		log.Debugf("Copied backup %v of volume %v to volume %v", backupName, oldName, newName)
+	}
+
+	// The new volume only exists once all its backups have been copied
+	volume.Name = newName
+	if err := saveVolume(volume, driver); err != nil {
+		return err
+	}
+	if err := removeVolume(oldName, driver); err != nil {
+		return fmt.Errorf("Renamed volume %v to %v, but failed to remove the old volume: %v", oldName, newName, err)
+	}
+	log.Debugf("Renamed backup volume %v to %v", oldName, newName)
+	return nil
+}
+
+// copyObject copies a small object, e.g. a block, through memory. The
+// object is skipped if it has been copied by an interrupted rename.
+func copyObject(driver BackupStoreDriver, src, dst string) error {
+	srcSize := driver.FileSize(src)
+	if srcSize < 0 {
+		return fmt.Errorf("Cannot find %v in backupstore", src)
+	}
+	if driver.FileSize(dst) == srcSize {
+		return nil
+	}
+
+	rc, err := driver.Read(src)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	buf := util.GetBuffer()
+	defer util.PutBuffer(buf)
+	if _, err := buf.ReadFrom(rc); err != nil {
+		return err
+	}
+	return driver.Write(dst, bytes.NewReader(buf.Bytes()))
+}
+
+// copyFileObject copies a large object through a local temporary file
+func copyFileObject(driver BackupStoreDriver, src, dst string) error {
+	tmpDir, err := ioutil.TempDir("", "backupstore-rename")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tmpFile := filepath.Join(tmpDir, filepath.Base(src))
+	if err := driver.Download(src, tmpFile); err != nil {
+		return err
+	}
+	return driver.Upload(tmpFile, dst)
+}
@@ -0,0 +1,258 @@
+package backupstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+const (
+	// RESTORE_STATE_SUFFIX is appended to the restore target to get the
+	// default path of its restore state marker
+	RESTORE_STATE_SUFFIX = ".restore-state"
+
+	// restoreStateSampledBlocks is the number of blocks of the restored
+	// backup read back from the target to verify it still holds them
+	restoreStateSampledBlocks = 8
+)
+
+// RestoreState is the marker saved along a restore target once a backup has
+// been completely restored to it, so the next restore can be incremental.
+// It's only kept by the restores with DetectLastBackup or RestoreStateFile
+// set, and removed when such a restore starts, so a failed restore leaves
+// none.
+type RestoreState struct {
+	VolumeName string
+	BackupName string
+	// BlocksChecksum is the checksum of the block list of the backup
+	BlocksChecksum string
+	// ModifiedTime is the modification time of the target after the
+	// restore. It's only recorded for regular files, to detect they've
+	// been written since.
+	ModifiedTime string `json:",omitempty"`
+	// Size is the size of the target after the restore, larger than the
+	// volume if the target was expanded. It's not recorded by the older
+	// versions.
+	Size int64 `json:",string,omitempty"`
+}
+
+// GetRestoreState returns the restore state marker at path, or nil if there
+// is none
+func GetRestoreState(path string) (*RestoreState, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	state := &RestoreState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("Invalid restore state %v: %v", path, err)
+	}
+	return state, nil
+}
+
+// getRestoreStateFile returns the path of the restore state marker of the
+// target, or an empty string if the restore doesn't keep one. The marker
+// isn't put along a target which isn't a regular file, such as a block
+// device, unless its path is given.
+func getRestoreStateFile(config *DeltaRestoreConfig) (string, error) {
+	if config.RestoreStateFile != "" {
+		return config.RestoreStateFile, nil
+	}
+	if !config.DetectLastBackup {
+		return "", nil
+	}
+	stat, err := os.Stat(config.Filename)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	if err == nil && !stat.Mode().IsRegular() {
+		return "", fmt.Errorf("Cannot detect the last backup restored to %v which is not a regular file without a restore state file",
+			config.Filename)
+	}
+	return config.Filename + RESTORE_STATE_SUFFIX, nil
+}
+
+func saveRestoreState(path string, state *RestoreState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// saveRestoreTargetState saves state along with the modification time of the
+// target
+func saveRestoreTargetState(path, target string, state *RestoreState) error {
+	modifiedTime, err := getTargetModifiedTime(target)
+	if err != nil {
+		return err
+	}
+	state.ModifiedTime = modifiedTime
+	return saveRestoreState(path, state)
+}
+
+func removeRestoreState(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// getTargetModifiedTime returns the modification time of the target if it's
+// a regular file, or an empty string otherwise
+func getTargetModifiedTime(target string) (string, error) {
+	stat, err := os.Stat(target)
+	if err != nil {
+		return "", err
+	}
+	if stat.Mode()&os.ModeType != 0 {
+		return "", nil
+	}
+	return stat.ModTime().UTC().Format(time.RFC3339Nano), nil
+}
+
+// checkRestoreState verifies the target still holds the backup recorded by
+// state, and returns the backup
+func checkRestoreState(state *RestoreState, volumeName, target string, driver BackupStoreDriver) (*Backup, error) {
+	if state.VolumeName != volumeName {
+		return nil, fmt.Errorf("Target %v was restored from volume %v", target, state.VolumeName)
+	}
+	modifiedTime, err := getTargetModifiedTime(target)
+	if err != nil {
+		return nil, err
+	}
+	if modifiedTime != state.ModifiedTime {
+		return nil, fmt.Errorf("Target %v has been modified since backup %v was restored", target, state.BackupName)
+	}
+	backup, err := loadBackup(state.BackupName, volumeName, driver)
+	if err != nil {
+		return nil, err
+	}
+	if checksum := getBlocksChecksum(backup.Blocks); checksum != state.BlocksChecksum {
+		return nil, fmt.Errorf("Backup %v has changed since it was restored to %v", state.BackupName, target)
+	}
+	if err := checkTargetBlocks(target, backup); err != nil {
+		return nil, err
+	}
+	return backup, nil
+}
+
+// checkTargetBlocks reads a few blocks of backup spread over the target, and
+// verifies they still have the checksums recorded in the backup. It catches
+// the writes to the targets without a modification time, like the block
+// devices.
+func checkTargetBlocks(target string, backup *Backup) error {
+	if len(backup.Blocks) == 0 {
+		return nil
+	}
+	f, err := os.Open(target)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	blockSize := getBackupBlockSize(backup)
+	count := restoreStateSampledBlocks
+	if len(backup.Blocks) < count {
+		count = len(backup.Blocks)
+	}
+	for i := 0; i < count; i++ {
+		// The first and last blocks, and the ones evenly spread between
+		blk := backup.Blocks[0]
+		if count > 1 {
+			blk = backup.Blocks[i*(len(backup.Blocks)-1)/(count-1)]
+		}
+		data := make([]byte, getBlockLength(blk, blockSize))
+		if _, err := f.ReadAt(data, blk.Offset); err != nil && err != io.EOF {
+			return err
+		}
+		if util.GetChecksum(data) != blk.BlockChecksum {
+			return fmt.Errorf("Target %v has been modified since backup %v was restored: block at offset %v differs",
+				target, backup.Name, blk.Offset)
+		}
+	}
+	return nil
+}
+
+// getRestoreBaseline returns the backup already restored to the target which
+// the restore can be incremental on, or nil for a full restore, along with
+// the size the target was restored to, zero if unknown. The backup named by
+// the caller must match the restore state marker if there is one.
+func getRestoreBaseline(config *DeltaRestoreConfig, volumeName string, driver BackupStoreDriver) (*Backup, int64, error) {
+	stateFile, err := getRestoreStateFile(config)
+	if err != nil {
+		return nil, 0, err
+	}
+	if config.LastBackupName == "" && stateFile == "" {
+		return nil, 0, nil
+	}
+	var state *RestoreState
+	if stateFile != "" {
+		if state, err = GetRestoreState(stateFile); err != nil {
+			operationLog(config.OperationID).Warnf("Ignored restore state of %v: %v", config.Filename, err)
+			state = nil
+		}
+	}
+
+	if config.LastBackupName != "" {
+		if state == nil {
+			// The target was restored by an older version, without
+			// saving the state, or the restore doesn't keep one
+			backup, err := loadBackup(config.LastBackupName, volumeName, driver)
+			return backup, 0, err
+		}
+		if state.BackupName != config.LastBackupName {
+			return nil, 0, fmt.Errorf("Target %v was restored from backup %v rather than %v",
+				config.Filename, state.BackupName, config.LastBackupName)
+		}
+		backup, err := checkRestoreState(state, volumeName, config.Filename, driver)
+		if err != nil {
+			return nil, 0, err
+		}
+		return backup, state.Size, nil
+	}
+
+	if state == nil {
+		return nil, 0, nil
+	}
+	backup, err := checkRestoreState(state, volumeName, config.Filename, driver)
+	if err != nil {
+		operationLog(config.OperationID).Infof("Would fully restore %v: %v", config.Filename, err)
+		return nil, 0, nil
+	}
+	operationLog(config.OperationID).Debugf("Detected backup %v restored to %v", backup.Name, config.Filename)
+	return backup, state.Size, nil
+}
+
+// getRestoreTargetSize returns the size of the target after the restore of
+// vol, restoredSize being the size the target was restored to if the
+// restore is incremental. An expanded target is never shrunk.
+func getRestoreTargetSize(config *DeltaRestoreConfig, vol *Volume, restoredSize int64) (int64, error) {
+	size := config.TargetSize
+	if size == 0 {
+		size = vol.Size
+		// Keep the expansion of the previous restore
+		if restoredSize > size {
+			size = restoredSize
+		}
+	}
+	if size < vol.Size {
+		return 0, fmt.Errorf("Invalid target size %v smaller than the size %v of volume %v", size, vol.Size, vol.Name)
+	}
+	if restoredSize > size {
+		return 0, fmt.Errorf("Target %v was expanded to %v, it cannot be shrunk to %v", config.Filename, restoredSize, size)
+	}
+	return size, nil
+}
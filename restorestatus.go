@@ -0,0 +1,198 @@
+package backupstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+type RestoreStatusState string
+
+const (
+	RestoreStatusInProgress = RestoreStatusState("in_progress")
+	RestoreStatusCompleted  = RestoreStatusState("completed")
+	RestoreStatusError      = RestoreStatusState("error")
+)
+
+// RestoreStatus describes the state of a restore started by
+// StartDeltaBlockRestore
+type RestoreStatus struct {
+	ID string
+	// OperationID identifies the restore in the logs, the ID of the
+	// restore unless set in its config
+	OperationID string `json:",omitempty"`
+	BackupURL   string
+	Filename    string
+
+	State        RestoreStatusState
+	Progress     int
+	BlocksDone   int64  `json:",string"`
+	BlocksTotal  int64  `json:",string"`
+	BytesWritten int64  `json:",string"`
+	Error        string `json:",omitempty"`
+
+	StartedAt   string
+	UpdatedAt   string
+	CompletedAt string `json:",omitempty"`
+}
+
+var (
+	restoreStatusLock sync.Mutex
+	restoreStatuses   = make(map[string]*RestoreStatus)
+	restoreStatusDir  string
+)
+
+// SetRestoreStatusDir makes the restores save their status in dir, so it
+// can still be retrieved by GetRestoreStatus after the process restarts. The
+// directory should only be used by one process at a time.
+func SetRestoreStatusDir(dir string) {
+	restoreStatusLock.Lock()
+	defer restoreStatusLock.Unlock()
+	restoreStatusDir = dir
+}
+
+func getRestoreStatusPath(dir, id string) string {
+	return filepath.Join(dir, id+".json")
+}
+
+// StartDeltaBlockRestore starts restoring the backup in background, and
+// returns the ID of the restore to pass to GetRestoreStatus
+func StartDeltaBlockRestore(config *DeltaRestoreConfig) (string, error) {
+	if config == nil {
+		return "", fmt.Errorf("Invalid empty config for restore")
+	}
+	if _, _, err := decodeBackupURL(config.BackupURL); err != nil {
+		return "", err
+	}
+
+	now := util.Now()
+	status := &RestoreStatus{
+		ID:          util.GenerateName("restore"),
+		OperationID: config.OperationID,
+		BackupURL:   config.BackupURL,
+		Filename:    config.Filename,
+		State:       RestoreStatusInProgress,
+		StartedAt:   now,
+	}
+	if status.OperationID == "" {
+		status.OperationID = status.ID
+	}
+	updateRestoreStatus(status)
+
+	// The status is only modified by the restore goroutine, which runs
+	// the progress callback as well
+	restoreConfig := *config
+	restoreConfig.OperationID = status.OperationID
+	restoreConfig.ProgressFunc = func(progress *RestoreProgress) {
+		status.Progress = progress.Progress
+		status.BlocksDone = progress.BlocksDone
+		status.BlocksTotal = progress.BlocksTotal
+		status.BytesWritten = progress.BytesWritten
+		updateRestoreStatus(status)
+		if config.ProgressFunc != nil {
+			config.ProgressFunc(progress)
+		}
+	}
+	go func() {
+		err := RestoreDeltaBlockBackupWithConfig(&restoreConfig)
+		status.CompletedAt = util.Now()
+		if err != nil {
+			status.State = RestoreStatusError
+			status.Error = err.Error()
+		} else {
+			status.State = RestoreStatusCompleted
+			status.Progress = 100
+		}
+		updateRestoreStatus(status)
+	}()
+	return status.ID, nil
+}
+
+// updateRestoreStatus publishes a copy of status
+func updateRestoreStatus(status *RestoreStatus) {
+	status.UpdatedAt = util.Now()
+	published := *status
+
+	restoreStatusLock.Lock()
+	restoreStatuses[status.ID] = &published
+	dir := restoreStatusDir
+	restoreStatusLock.Unlock()
+	if dir == "" {
+		return
+	}
+
+	data, err := json.Marshal(&published)
+	if err == nil {
+		path := getRestoreStatusPath(dir, status.ID)
+		if err = ioutil.WriteFile(path+".tmp", data, 0600); err == nil {
+			err = os.Rename(path+".tmp", path)
+		}
+	}
+	if err != nil {
+		operationLog(status.OperationID).Warnf("Failed to save status of restore %v: %v", status.ID, err)
+	}
+}
+
+// GetRestoreStatus returns the status of a restore started by
+// StartDeltaBlockRestore. A restore found in progress in the status
+// directory but not in this process was interrupted by a restart, and is
+// reported as failed.
+func GetRestoreStatus(id string) (*RestoreStatus, error) {
+	if !util.ValidateName(id) {
+		return nil, fmt.Errorf("Invalid restore ID %v", id)
+	}
+
+	restoreStatusLock.Lock()
+	status, exists := restoreStatuses[id]
+	dir := restoreStatusDir
+	restoreStatusLock.Unlock()
+	if exists {
+		s := *status
+		return &s, nil
+	}
+	if dir == "" {
+		return nil, fmt.Errorf("Cannot find restore %v", id)
+	}
+
+	data, err := ioutil.ReadFile(getRestoreStatusPath(dir, id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("Cannot find restore %v", id)
+		}
+		return nil, err
+	}
+	status = &RestoreStatus{}
+	if err := json.Unmarshal(data, status); err != nil {
+		return nil, fmt.Errorf("Invalid status of restore %v: %v", id, err)
+	}
+	if status.State == RestoreStatusInProgress {
+		status.State = RestoreStatusError
+		status.Error = "Restore was interrupted"
+	}
+	return status, nil
+}
+
+// RemoveRestoreStatus forgets the status of a restore which is done
+func RemoveRestoreStatus(id string) error {
+	if !util.ValidateName(id) {
+		return fmt.Errorf("Invalid restore ID %v", id)
+	}
+
+	restoreStatusLock.Lock()
+	defer restoreStatusLock.Unlock()
+	if status, exists := restoreStatuses[id]; exists && status.State == RestoreStatusInProgress {
+		return fmt.Errorf("Restore %v is still in progress", id)
+	}
+	delete(restoreStatuses, id)
+	if restoreStatusDir != "" {
+		if err := os.Remove(getRestoreStatusPath(restoreStatusDir, id)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
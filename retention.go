@@ -0,0 +1,168 @@
+package backupstore
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+// validateExpiresAt checks expiresAt is either empty or in RFC3339 format
+func validateExpiresAt(expiresAt string) error {
+	if expiresAt == "" {
+		return nil
+	}
+	if _, err := time.Parse(time.RFC3339, expiresAt); err != nil {
+		return fmt.Errorf("Invalid expiration time %v, must be in RFC3339 format: %v", expiresAt, err)
+	}
+	return nil
+}
+
+func isBackupExpired(backup *Backup, now time.Time) (bool, error) {
+	if backup.ExpiresAt == "" {
+		return false, nil
+	}
+	expiresAt, err := time.Parse(time.RFC3339, backup.ExpiresAt)
+	if err != nil {
+		return false, fmt.Errorf("Invalid expiration time %v of backup %v: %v", backup.ExpiresAt, backup.Name, err)
+	}
+	return !now.Before(expiresAt), nil
+}
+
+func checkBackupDeletable(backup *Backup) error {
+	if backup.Protected {
+		return fmt.Errorf("Backup %v of volume %v is protected, the protection must be cleared before deleting it",
+			backup.Name, backup.VolumeName)
+	}
+	return nil
+}
+
+// SetBackupProtection sets or clears the protection of a backup. Protected
+// backups are refused to be deleted, and skipped by PruneExpiredBackups.
+func SetBackupProtection(backupURL string, protected bool) error {
+	driver, err := GetBackupStoreDriver(backupURL)
+	if err != nil {
+		return err
+	}
+	backupName, volumeName, err := decodeBackupURL(backupURL)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := lockVolume(driver, volumeName, "backup update")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	backup, err := loadBackup(backupName, volumeName, driver)
+	if err != nil {
+		return err
+	}
+	backup.Protected = protected
+	if err := saveBackup(backup, driver); err != nil {
+		return err
+	}
+	log.Debugf("Updated protection of backup %v to %v", backupName, protected)
+	return nil
+}
+
+// SetBackupExpiration sets the time after which PruneExpiredBackups removes
+// the backup, in RFC3339 format. Empty expiresAt makes the backup never
+// expire.
+func SetBackupExpiration(backupURL, expiresAt string) error {
+	if err := validateExpiresAt(expiresAt); err != nil {
+		return err
+	}
+	driver, err := GetBackupStoreDriver(backupURL)
+	if err != nil {
+		return err
+	}
+	backupName, volumeName, err := decodeBackupURL(backupURL)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := lockVolume(driver, volumeName, "backup update")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	backup, err := loadBackup(backupName, volumeName, driver)
+	if err != nil {
+		return err
+	}
+	backup.ExpiresAt = expiresAt
+	if err := saveBackup(backup, driver); err != nil {
+		return err
+	}
+	log.Debugf("Updated expiration time of backup %v to %v", backupName, expiresAt)
+	return nil
+}
+
+// PruneExpiredBackups removes the expired backups of volumeName, or of all
+// the volumes in the backupstore if volumeName is empty. It returns the URLs
+// of the removed backups, including when failing in the middle.
+func PruneExpiredBackups(volumeName, destURL string) ([]string, error) {
+	driver, err := GetBackupStoreDriver(destURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var volumeNames []string
+	if volumeName != "" {
+		if !util.ValidateName(volumeName) {
+			return nil, fmt.Errorf("Invalid volume name %v", volumeName)
+		}
+		volumeNames = []string{volumeName}
+	} else {
+		if volumeNames, err = getVolumeNames(driver); err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	pruned := []string{}
+	for _, volumeName := range volumeNames {
+		backupNames, err := getBackupNamesForVolume(volumeName, driver)
+		if err != nil {
+			return pruned, err
+		}
+		for _, backupName := range backupNames {
+			// Only the header of the backup is decoded. A backup which
+			// cannot be loaded doesn't prevent pruning the others.
+			blocks, err := loadBackupBlocks(backupName, volumeName, driver)
+			if err != nil {
+				log.WithError(err).Warnf("Skipped pruning backup %v of volume %v which cannot be loaded",
+					backupName, volumeName)
+				continue
+			}
+			backup := blocks.backup
+			expired, err := isBackupExpired(backup, now)
+			if err != nil {
+				return pruned, err
+			}
+			if !expired {
+				continue
+			}
+			if backup.Protected {
+				log.Warnf("Skipped pruning protected backup %v expired at %v", backupName, backup.ExpiresAt)
+				continue
+			}
+
+			backupURL := encodeBackupURL(backupName, volumeName, destURL)
+			if backup.SingleFile.FilePath != "" {
+				err = DeleteSingleFileBackup(backupURL)
+			} else {
+				err = DeleteDeltaBlockBackup(backupURL)
+			}
+			if err != nil {
+				return pruned, err
+			}
+			log.Debugf("Pruned backup %v expired at %v", backupName, backup.ExpiresAt)
+			pruned = append(pruned, backupURL)
+		}
+	}
+	return pruned, nil
+}
@@ -27,13 +27,14 @@ const (
 )
 
 func init() {
-	if err := backupstore.RegisterDriver(KIND, initFunc); err != nil {
+	if err := backupstore.RegisterDriverWithCredentials(KIND, initFunc); err != nil {
 		panic(err)
 	}
 }
 
-func initFunc(destURL string) (backupstore.BackupStoreDriver, error) {
+func initFunc(destURL string, credentials *backupstore.Credentials) (backupstore.BackupStoreDriver, error) {
 	b := &BackupStoreDriver{}
+	b.service.Credentials = credentials
 
 	u, err := url.Parse(destURL)
 	if err != nil {
@@ -59,17 +60,23 @@ func initFunc(destURL string) (backupstore.BackupStoreDriver, error) {
 	//Leading '/' can cause mystery problems for s3
 	b.path = strings.TrimLeft(b.path, "/")
 
-	//Test connection
-	if _, err := b.List(""); err != nil {
-		return nil, err
-	}
-
 	b.destURL = KIND + "://" + b.service.Bucket
 	if b.service.Region != "" {
 		b.destURL += "@" + b.service.Region
 	}
 	b.destURL += "/" + b.path
 
+	if proxy := getProxyConfig(b.destURL); proxy != nil {
+		if b.service.httpClient, err = newProxyHTTPClient(proxy); err != nil {
+			return nil, err
+		}
+	}
+
+	//Test connection
+	if _, err := b.List(""); err != nil {
+		return nil, err
+	}
+
 	log.Debugf("Loaded driver for %v", b.destURL)
 	return b, nil
 }
@@ -0,0 +1,197 @@
+package s3
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProxyConfig is the proxy used to reach S3, instead of the one of the
+// process environment
+type ProxyConfig struct {
+	// HTTPProxy and HTTPSProxy are the URLs of the proxies of the HTTP and
+	// HTTPS endpoints. Empty means connecting directly.
+	HTTPProxy  string
+	HTTPSProxy string
+	// NoProxy is a comma separated list of the hosts reached directly, in
+	// the NO_PROXY format: host names matching their subdomains as well,
+	// IP addresses, CIDRs, or "*" for all
+	NoProxy string
+}
+
+var (
+	proxyConfigsLock sync.RWMutex
+	proxyConfigs     = make(map[string]*ProxyConfig)
+)
+
+// SetProxyConfig sets the proxy of an S3 destination, e.g.
+// s3://bucket@region/path, or the default one of all the S3 destinations if
+// destURL is empty. A nil config removes it. It applies to the drivers
+// initialized from now on.
+func SetProxyConfig(destURL string, config *ProxyConfig) error {
+	key := ""
+	if destURL != "" {
+		var err error
+		if key, err = getProxyConfigKey(destURL); err != nil {
+			return err
+		}
+	}
+	if config != nil {
+		if _, err := config.proxyFunc(); err != nil {
+			return err
+		}
+	}
+
+	proxyConfigsLock.Lock()
+	defer proxyConfigsLock.Unlock()
+	if config == nil {
+		delete(proxyConfigs, key)
+		return nil
+	}
+	c := *config
+	proxyConfigs[key] = &c
+	return nil
+}
+
+// getProxyConfigKey returns the normalized destination URL, the same way as
+// the URL of the driver
+func getProxyConfigKey(destURL string) (string, error) {
+	u, err := url.Parse(destURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != KIND {
+		return "", fmt.Errorf("Invalid S3 destination %v", destURL)
+	}
+	key := KIND + "://" + u.Host
+	if u.User != nil {
+		key = KIND + "://" + u.User.Username() + "@" + u.Host
+	}
+	return key + "/" + strings.Trim(u.Path, "/"), nil
+}
+
+// getProxyConfig returns the proxy of destURL, normalized as
+// getProxyConfigKey, or nil if the environment applies
+func getProxyConfig(destURL string) *ProxyConfig {
+	proxyConfigsLock.RLock()
+	defer proxyConfigsLock.RUnlock()
+	if config, exists := proxyConfigs[strings.TrimRight(destURL, "/")]; exists {
+		return config
+	}
+	return proxyConfigs[""]
+}
+
+// proxyFunc returns the function choosing the proxy of the requests
+func (c *ProxyConfig) proxyFunc() (func(*http.Request) (*url.URL, error), error) {
+	var httpProxy, httpsProxy *url.URL
+	var err error
+	if c.HTTPProxy != "" {
+		if httpProxy, err = url.Parse(c.HTTPProxy); err != nil {
+			return nil, fmt.Errorf("Invalid HTTP proxy %v: %v", c.HTTPProxy, err)
+		}
+	}
+	if c.HTTPSProxy != "" {
+		if httpsProxy, err = url.Parse(c.HTTPSProxy); err != nil {
+			return nil, fmt.Errorf("Invalid HTTPS proxy %v: %v", c.HTTPSProxy, err)
+		}
+	}
+	noProxy := parseNoProxy(c.NoProxy)
+
+	return func(req *http.Request) (*url.URL, error) {
+		proxy := httpProxy
+		if req.URL.Scheme == "https" {
+			proxy = httpsProxy
+		}
+		if proxy == nil || noProxy.matches(req.URL.Hostname()) {
+			return nil, nil
+		}
+		return proxy, nil
+	}, nil
+}
+
+type noProxyList struct {
+	all     bool
+	domains []string
+	ips     []net.IP
+	nets    []*net.IPNet
+}
+
+func parseNoProxy(noProxy string) *noProxyList {
+	l := &noProxyList{}
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			l.all = true
+			continue
+		}
+		if _, n, err := net.ParseCIDR(entry); err == nil {
+			l.nets = append(l.nets, n)
+			continue
+		}
+		if host, _, err := net.SplitHostPort(entry); err == nil {
+			entry = host
+		}
+		if ip := net.ParseIP(entry); ip != nil {
+			l.ips = append(l.ips, ip)
+			continue
+		}
+		l.domains = append(l.domains, strings.TrimPrefix(entry, "."))
+	}
+	return l
+}
+
+func (l *noProxyList) matches(host string) bool {
+	if l.all {
+		return true
+	}
+	host = strings.ToLower(host)
+	if ip := net.ParseIP(host); ip != nil {
+		for _, i := range l.ips {
+			if i.Equal(ip) {
+				return true
+			}
+		}
+		for _, n := range l.nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, domain := range l.domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// newProxyHTTPClient returns the HTTP client of the requests through the
+// proxy of config. The transport settings are the ones of
+// http.DefaultTransport.
+func newProxyHTTPClient(config *ProxyConfig) (*http.Client, error) {
+	proxy, err := config.proxyFunc()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: proxy,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+		},
+	}, nil
+}
@@ -0,0 +1,123 @@
+package s3
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/sirupsen/logrus"
+)
+
+// RequestInfo describes a single attempt of a request to S3. A request
+// retried by the SDK is reported once per attempt.
+type RequestInfo struct {
+	Operation string
+	Method    string
+	Bucket    string
+	Key       string
+	// Duration is the time spent on this attempt
+	Duration time.Duration
+	// StatusCode is the HTTP status of the response, zero if none was
+	// received
+	StatusCode int
+	// RetryCount is the number of attempts made before this one
+	RetryCount int
+	Error      error
+}
+
+var (
+	requestLock    sync.RWMutex
+	requestLogging bool
+	requestHook    func(*RequestInfo)
+)
+
+// SetRequestLogging enables logging every request sent to S3 at debug level
+func SetRequestLogging(enabled bool) {
+	requestLock.Lock()
+	defer requestLock.Unlock()
+	requestLogging = enabled
+}
+
+// SetRequestHook sets a function called after every request sent to S3,
+// e.g. to collect metrics. A nil hook removes the current one. The hook is
+// called synchronously, so it shouldn't block.
+func SetRequestHook(hook func(*RequestInfo)) {
+	requestLock.Lock()
+	defer requestLock.Unlock()
+	requestHook = hook
+}
+
+func getRequestOptions() (bool, func(*RequestInfo)) {
+	requestLock.RLock()
+	defer requestLock.RUnlock()
+	return requestLogging, requestHook
+}
+
+// addRequestHandlers instruments the requests sent by svc. A client is
+// created for every request, so the start time of the current attempt can
+// be kept here.
+func addRequestHandlers(svc *s3.S3) {
+	var start time.Time
+	svc.Handlers.Send.PushFront(func(r *request.Request) {
+		start = time.Now()
+	})
+	svc.Handlers.Send.PushBack(func(r *request.Request) {
+		logging, hook := getRequestOptions()
+		if !logging && hook == nil {
+			return
+		}
+
+		info := &RequestInfo{
+			Duration:   time.Since(start),
+			RetryCount: r.RetryCount,
+			Error:      r.Error,
+		}
+		if r.Operation != nil {
+			info.Operation = r.Operation.Name
+			info.Method = r.Operation.HTTPMethod
+		}
+		if r.HTTPResponse != nil {
+			info.StatusCode = r.HTTPResponse.StatusCode
+		}
+		info.Bucket, info.Key = getRequestObject(r.Params)
+
+		if logging {
+			fields := logrus.Fields{
+				"operation":  info.Operation,
+				"method":     info.Method,
+				"bucket":     info.Bucket,
+				"key":        info.Key,
+				"duration":   info.Duration,
+				"status":     info.StatusCode,
+				"retryCount": info.RetryCount,
+			}
+			if info.Error != nil {
+				fields["error"] = info.Error
+			}
+			log.WithFields(fields).Debug("S3 request")
+		}
+		if hook != nil {
+			hook(info)
+		}
+	})
+}
+
+// getRequestObject returns the bucket and the key, or the prefix, of the
+// parameters of a request
+func getRequestObject(params interface{}) (string, string) {
+	switch p := params.(type) {
+	case *s3.ListObjectsInput:
+		return aws.StringValue(p.Bucket), aws.StringValue(p.Prefix)
+	case *s3.HeadObjectInput:
+		return aws.StringValue(p.Bucket), aws.StringValue(p.Key)
+	case *s3.PutObjectInput:
+		return aws.StringValue(p.Bucket), aws.StringValue(p.Key)
+	case *s3.GetObjectInput:
+		return aws.StringValue(p.Bucket), aws.StringValue(p.Key)
+	case *s3.DeleteObjectsInput:
+		return aws.StringValue(p.Bucket), ""
+	}
+	return "", ""
+}
@@ -3,28 +3,56 @@ package s3
 import (
 	"fmt"
 	"io"
+	"net/http"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"os"
+
+	"github.com/longhorn/backupstore"
+)
+
+const (
+	// MaxDeleteObjects is the number of objects S3 deletes in one request
+	MaxDeleteObjects = 1000
 )
 
 type Service struct {
 	Region string
 	Bucket string
+	// Credentials are used instead of the ones of the environment if set
+	Credentials *backupstore.Credentials
+
+	// httpClient is the client of the requests if a proxy is configured
+	httpClient *http.Client
 }
 
 func (s *Service) New() (*s3.S3, error) {
 	// get custom endpoint
 	endpoints := os.Getenv("AWS_ENDPOINTS")
 	config := &aws.Config{Region: &s.Region}
+	if s.Credentials != nil {
+		if s.Credentials.Endpoint != "" {
+			endpoints = s.Credentials.Endpoint
+		}
+		if s.Credentials.AccessKeyID != "" {
+			config.Credentials = credentials.NewStaticCredentials(s.Credentials.AccessKeyID,
+				s.Credentials.SecretAccessKey, s.Credentials.SessionToken)
+		}
+	}
 	if endpoints != "" {
 		config.Endpoint = aws.String(endpoints)
 		config.S3ForcePathStyle = aws.Bool(true)
 	}
-	return s3.New(session.New(), config), nil
+	if s.httpClient != nil {
+		config.HTTPClient = s.httpClient
+	}
+	svc := s3.New(session.New(), config)
+	addRequestHandlers(svc)
+	return svc, nil
 }
 
 func (s *Service) Close() {
@@ -143,24 +171,37 @@ func (s *Service) DeleteObjects(keys []string) error {
 	}
 	defer s.Close()
 
-	identifiers := make([]*s3.ObjectIdentifier, totalSize)
-	for i, k := range keyList {
-		identifiers[i] = &s3.ObjectIdentifier{
-			Key: aws.String(k),
+	// A single request deletes up to MaxDeleteObjects objects
+	for start := 0; start < totalSize; start += MaxDeleteObjects {
+		end := start + MaxDeleteObjects
+		if end > totalSize {
+			end = totalSize
+		}
+		identifiers := make([]*s3.ObjectIdentifier, end-start)
+		for i, k := range keyList[start:end] {
+			identifiers[i] = &s3.ObjectIdentifier{
+				Key: aws.String(k),
+			}
+		}
+		quiet := true
+		params := &s3.DeleteObjectsInput{
+			Bucket: aws.String(s.Bucket),
+			Delete: &s3.Delete{
+				Objects: identifiers,
+				Quiet:   &quiet,
+			},
 		}
-	}
-	quiet := true
-	params := &s3.DeleteObjectsInput{
-		Bucket: aws.String(s.Bucket),
-		Delete: &s3.Delete{
-			Objects: identifiers,
-			Quiet:   &quiet,
-		},
-	}
 
-	resp, err := svc.DeleteObjects(params)
-	if err != nil {
-		return parseAwsError(resp.String(), err)
+		resp, err := svc.DeleteObjects(params)
+		if err != nil {
+			return parseAwsError(resp.String(), err)
+		}
+		// The objects failed to be deleted are reported even in quiet mode
+		if len(resp.Errors) != 0 {
+			e := resp.Errors[0]
+			return fmt.Errorf("Failed to delete %v objects, first %v: %v",
+				len(resp.Errors), aws.StringValue(e.Key), aws.StringValue(e.Message))
+		}
 	}
 	return nil
 }
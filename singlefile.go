@@ -29,6 +29,12 @@ func CreateSingleFileBackup(volume *Volume, snapshot *Snapshot, filePath, destUR
 		return "", err
 	}
 
+	unlock, err := lockVolume(driver, volume.Name, "backup")
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
 	if err := addVolume(volume, driver); err != nil {
 		return "", err
 	}
@@ -115,6 +121,12 @@ func DeleteSingleFileBackup(backupURL string) error {
 		return err
 	}
 
+	unlock, err := lockVolume(driver, volumeName, "backup deletion")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	_, err = loadVolume(volumeName, driver)
 	if err != nil {
 		return fmt.Errorf("Cannot find volume %v in backupstore", volumeName, err)
@@ -124,6 +136,9 @@ func DeleteSingleFileBackup(backupURL string) error {
 	if err != nil {
 		return err
 	}
+	if err := checkBackupDeletable(backup); err != nil {
+		return err
+	}
 
 	if err := driver.Remove(backup.SingleFile.FilePath); err != nil {
 		return err
@@ -0,0 +1,234 @@
+package backupstore
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+const (
+	BLK_SUFFIX = ".blk"
+	// TMP_SUFFIX is appended to the files while the filesystem drivers
+	// write them, before they're renamed into place
+	TMP_SUFFIX = ".tmp"
+)
+
+// StaleBlocksReport lists the leftovers of the block uploads interrupted in
+// the block directory of a volume
+type StaleBlocksReport struct {
+	VolumeName string
+	// TempFiles are the temporary files of the uploads interrupted before
+	// the block was renamed into place
+	TempFiles []string `json:",omitempty"`
+	// ShortBlocks are the checksums of the blocks whose size doesn't match
+	// the one recorded by the backups, or whose content doesn't match the
+	// checksum for the blocks not used by any backup
+	ShortBlocks []string `json:",omitempty"`
+	// Purged is true if the files found were removed
+	Purged bool
+}
+
+// Empty returns true if no stale file was found
+func (r *StaleBlocksReport) Empty() bool {
+	return len(r.TempFiles) == 0 && len(r.ShortBlocks) == 0
+}
+
+// FindStaleBlocks looks for the temporary files and the short blocks left
+// by the uploads interrupted in the block directory of volumeName. Every
+// block file is listed and every block not used by any backup is read, so
+// it costs much more than a backup deletion.
+func FindStaleBlocks(volumeName, destURL string) (*StaleBlocksReport, error) {
+	return checkStaleBlocks(volumeName, destURL, false)
+}
+
+// PurgeStaleBlocks removes the files found by FindStaleBlocks, so the next
+// backups upload the short blocks again instead of reusing them. The
+// backups using a short block keep referring to it, and would report it
+// missing instead of corrupted. Since a volume is only locked within this
+// process, it must not run while another process is creating a backup of
+// the volume.
+func PurgeStaleBlocks(volumeName, destURL string) (*StaleBlocksReport, error) {
+	return checkStaleBlocks(volumeName, destURL, true)
+}
+
+func checkStaleBlocks(volumeName, destURL string, purge bool) (*StaleBlocksReport, error) {
+	if !util.ValidateName(volumeName) {
+		return nil, fmt.Errorf("Invalid volume name %v", volumeName)
+	}
+	bsDriver, err := GetBackupStoreDriver(destURL)
+	if err != nil {
+		return nil, err
+	}
+	if !volumeExists(volumeName, bsDriver) {
+		return nil, fmt.Errorf("Volume %v doesn't exist in backupstore", volumeName)
+	}
+
+	unlock, err := lockVolume(bsDriver, volumeName, "stale block purge")
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return findStaleBlocks(volumeName, bsDriver, purge)
+}
+
+// findStaleBlocks requires the volume to be locked, so no block of the
+// volume is being written by this process
+func findStaleBlocks(volumeName string, bsDriver BackupStoreDriver, purge bool) (*StaleBlocksReport, error) {
+	sizes, err := getReferencedBlockSizes(volumeName, bsDriver)
+	if err != nil {
+		return nil, err
+	}
+	files, err := listBlockFiles(volumeName, bsDriver)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &StaleBlocksReport{VolumeName: volumeName}
+	staleFiles := []string{}
+	for _, file := range files {
+		name := filepath.Base(file)
+		if strings.HasSuffix(name, TMP_SUFFIX) {
+			report.TempFiles = append(report.TempFiles, file)
+			staleFiles = append(staleFiles, file)
+			continue
+		}
+		if !strings.HasSuffix(name, BLK_SUFFIX) {
+			continue
+		}
+		checksum := strings.TrimSuffix(name, BLK_SUFFIX)
+		if isShortBlock(file, checksum, sizes, bsDriver) {
+			report.ShortBlocks = append(report.ShortBlocks, checksum)
+			staleFiles = append(staleFiles, file)
+		}
+	}
+
+	if report.Empty() {
+		return report, nil
+	}
+	log.Warnf("Found %v temporary files and %v short blocks of volume %v",
+		len(report.TempFiles), len(report.ShortBlocks), volumeName)
+	if !purge {
+		return report, nil
+	}
+	if err := bsDriver.Remove(staleFiles...); err != nil {
+		return nil, err
+	}
+	report.Purged = true
+	log.Infof("Removed %v stale block files of volume %v", len(staleFiles), volumeName)
+	return report, nil
+}
+
+const blockSizeUnknown = int64(-1)
+
+// getReferencedBlockSizes maps the blocks used by the backups of volumeName
+// to the size they should have in the backupstore, blockSizeUnknown if the
+// backups didn't record it or disagree on it
+func getReferencedBlockSizes(volumeName string, bsDriver BackupStoreDriver) (map[string]int64, error) {
+	backupNames, err := getBackupNamesForVolume(volumeName, bsDriver)
+	if err != nil {
+		return nil, err
+	}
+	sizes := make(map[string]int64)
+	for _, backupName := range backupNames {
+		blocks, err := loadBackupBlocks(backupName, volumeName, bsDriver)
+		if err != nil {
+			return nil, err
+		}
+		blockSize := getBackupBlockSize(blocks.backup)
+		if err := blocks.forEach(func(blk BlockMapping) error {
+			size := blockSizeUnknown
+			if blk.StoredSize > 0 {
+				size = blk.StoredSize
+			} else if blk.Uncompressed {
+				size = getBlockLength(blk, blockSize)
+			}
+			if recorded, exists := sizes[blk.BlockChecksum]; exists && recorded != size {
+				size = blockSizeUnknown
+			}
+			sizes[blk.BlockChecksum] = size
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return sizes, nil
+}
+
+// listBlockFiles lists all the files in the block directory of volumeName
+func listBlockFiles(volumeName string, bsDriver BackupStoreDriver) ([]string, error) {
+	blockPath := getBlockPath(volumeName)
+	files := []string{}
+	layer1, err := bsDriver.List(blockPath)
+	if err != nil {
+		// path doesn't exist
+		return files, nil
+	}
+	for _, dir1 := range layer1 {
+		layer2, err := bsDriver.List(filepath.Join(blockPath, dir1))
+		if err != nil {
+			return nil, err
+		}
+		for _, dir2 := range layer2 {
+			names, err := bsDriver.List(filepath.Join(blockPath, dir1, dir2))
+			if err != nil {
+				return nil, err
+			}
+			for _, name := range names {
+				files = append(files, filepath.Join(blockPath, dir1, dir2, name))
+			}
+		}
+	}
+	return files, nil
+}
+
+// isShortBlock returns true if the block file of checksum is empty, its size
+// doesn't match the one the backups recorded, or, for the blocks not used
+// by any backup, its content doesn't match checksum
+func isShortBlock(blkFile, checksum string, sizes map[string]int64, bsDriver BackupStoreDriver) bool {
+	size := bsDriver.FileSize(blkFile)
+	if size < 0 {
+		return false
+	}
+	if size == 0 {
+		return true
+	}
+	expected, referenced := sizes[checksum]
+	if referenced {
+		return expected != blockSizeUnknown && size != expected
+	}
+	if err := verifyStoredBlock(blkFile, checksum, bsDriver); err != nil {
+		log.Debugf("Failed to verify unused block %v: %v", blkFile, err)
+		return true
+	}
+	return false
+}
+
+// verifyStoredBlock verifies the content of a block file without its
+// mapping, telling the compressed blocks by their header
+func verifyStoredBlock(blkFile, checksum string, bsDriver BackupStoreDriver) error {
+	rc, err := bsDriver.Read(blkFile)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	data := util.GetBuffer()
+	defer util.PutBuffer(data)
+	if _, err := io.Copy(data, rc); err != nil {
+		return err
+	}
+
+	if util.GetChecksum(data.Bytes()) == checksum {
+		return nil
+	}
+	if !util.IsGzipData(data.Bytes()) {
+		return fmt.Errorf("checksum verification failed for block")
+	}
+	buf := util.GetBuffer()
+	defer util.PutBuffer(buf)
+	return util.DecompressAndVerifyTo(buf, bytes.NewReader(data.Bytes()), checksum)
+}
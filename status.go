@@ -0,0 +1,277 @@
+package backupstore
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/longhorn/backupstore/util"
+	"github.com/sirupsen/logrus"
+)
+
+type BackupState string
+
+const (
+	BackupStatePending    = BackupState("pending")
+	BackupStateInProgress = BackupState("in_progress")
+	BackupStateCompleted  = BackupState("completed")
+	BackupStateError      = BackupState("error")
+	BackupStateCanceled   = BackupState("canceled")
+)
+
+const (
+	// BACKUP_STATUS_SAVE_INTERVAL is the minimum interval between the saves
+	// of the progress of a backup in the backupstore. The changes of state
+	// are saved at once.
+	BACKUP_STATUS_SAVE_INTERVAL = 10 * time.Second
+)
+
+type BackupErrorType string
+
+const (
+	// BackupErrorTypeSnapshot means the snapshot couldn't be read
+	BackupErrorTypeSnapshot = BackupErrorType("snapshot")
+	// BackupErrorTypeBackupstore means the backupstore couldn't be accessed
+	BackupErrorTypeBackupstore = BackupErrorType("backupstore")
+	// BackupErrorTypeInvalid means the input of the backup is invalid
+	BackupErrorTypeInvalid = BackupErrorType("invalid")
+	// BackupErrorTypeHook means PreBackup or PostBackup failed
+	BackupErrorTypeHook = BackupErrorType("hook")
+	// BackupErrorTypeInternal covers all the other errors
+	BackupErrorTypeInternal = BackupErrorType("internal")
+)
+
+// BackupStatus describes the state of a delta block backup. It's delivered
+// to DeltaBlockBackupOperations.UpdateBackupStatus, and saved in the
+// backupstore while the backup is not completed, along with its progress
+// every BACKUP_STATUS_SAVE_INTERVAL at most.
+type BackupStatus struct {
+	// OperationID identifies the backup in the logs
+	OperationID  string `json:",omitempty"`
+	Name         string
+	VolumeName   string
+	SnapshotName string
+
+	State            BackupState
+	Progress         int
+	URL              string          `json:",omitempty"`
+	Error            string          `json:",omitempty"`
+	ErrorType        BackupErrorType `json:",omitempty"`
+	BytesTransferred int64           `json:",string"`
+	// QueuePosition is the number of backups of the volume to be done
+	// before this pending one can start, zero once it's not queued
+	QueuePosition int `json:",omitempty"`
+
+	StartedAt   string
+	UpdatedAt   string
+	CompletedAt string `json:",omitempty"`
+}
+
+// backupError attaches a BackupErrorType to an error
+type backupError struct {
+	errType BackupErrorType
+	error
+}
+
+func newBackupError(errType BackupErrorType, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(backupError); ok {
+		return err
+	}
+	return backupError{errType, err}
+}
+
+func getBackupErrorType(err error) BackupErrorType {
+	if e, ok := err.(backupError); ok {
+		return e.errType
+	}
+	return BackupErrorTypeInternal
+}
+
+func getBackupStatusPath(backupName, volumeName string) string {
+	return filepath.Join(getVolumePath(volumeName), BACKUP_STATUS_DIRECTORY, getBackupConfigName(backupName))
+}
+
+func removeBackupStatus(backupName, volumeName string, driver BackupStoreDriver) error {
+	statusFile := getBackupStatusPath(backupName, volumeName)
+	metaCache.invalidate(driver, statusFile)
+	return driver.Remove(statusFile)
+}
+
+// removeFailedBackupStatus removes the status of a failed or canceled backup,
+// and returns false if the backup has no such status
+func removeFailedBackupStatus(backupName, volumeName string, driver BackupStoreDriver) (bool, error) {
+	statusFile := getBackupStatusPath(backupName, volumeName)
+	if !driver.FileExists(statusFile) {
+		return false, nil
+	}
+	status := &BackupStatus{}
+	if err := loadConfigInBackupStore(statusFile, driver, status); err != nil {
+		return false, err
+	}
+	if status.State != BackupStateError && status.State != BackupStateCanceled {
+		return false, nil
+	}
+	return true, removeBackupStatus(backupName, volumeName, driver)
+}
+
+// backupStatusTracker maintains the status of one backup, and publishes it to
+// the DeltaBlockBackupOperations on every change. It's saved in the
+// backupstore on the changes of state, and every BACKUP_STATUS_SAVE_INTERVAL
+// at most in between.
+type backupStatusTracker struct {
+	ctx       context.Context
+	log       *logrus.Entry
+	status    BackupStatus
+	deltaOps  DeltaBlockBackupOperationsV2
+	driver    BackupStoreDriver
+	throttler *progressThrottler
+
+	// saved is the status last saved in the backupstore, and savedAt when
+	// it was saved
+	saved   *BackupStatus
+	savedAt time.Time
+}
+
+func newBackupStatusTracker(ctx context.Context, config *DeltaBackupConfig, deltaOps DeltaBlockBackupOperationsV2,
+	backupName string, driver BackupStoreDriver) *backupStatusTracker {
+	now := util.Now()
+	return &backupStatusTracker{
+		ctx: ctx,
+		log: operationLog(config.OperationID),
+		status: BackupStatus{
+			OperationID:  config.OperationID,
+			Name:         backupName,
+			VolumeName:   config.Volume.Name,
+			SnapshotName: config.Snapshot.Name,
+			State:        BackupStatePending,
+			StartedAt:    now,
+			UpdatedAt:    now,
+		},
+		deltaOps:  deltaOps,
+		driver:    driver,
+		throttler: newProgressThrottler(config.ProgressUpdateInterval, config.ProgressUpdateMinDelta),
+	}
+}
+
+func (t *backupStatusTracker) publish() {
+	t.status.UpdatedAt = util.Now()
+	status := t.status
+	ctx := t.ctx
+	if status.State != BackupStatePending && status.State != BackupStateInProgress {
+		ctx = context.Background()
+	}
+	t.deltaOps.UpdateBackupStatus(ctx, status.SnapshotName, status.VolumeName, &status)
+
+	if status.State == BackupStateCompleted {
+		if err := removeBackupStatus(status.Name, status.VolumeName, t.driver); err != nil {
+			t.log.Warnf("Failed to remove status of backup %v: %v", status.Name, err)
+		}
+		return
+	}
+	if t.saved != nil && t.saved.State == status.State && t.saved.QueuePosition == status.QueuePosition &&
+		time.Since(t.savedAt) < BACKUP_STATUS_SAVE_INTERVAL {
+		return
+	}
+	statusFile := getBackupStatusPath(status.Name, status.VolumeName)
+	if err := saveConfigInBackupStore(statusFile, t.driver, &status); err != nil {
+		t.log.Warnf("Failed to save status of backup %v: %v", status.Name, err)
+		return
+	}
+	t.saved = &status
+	t.savedAt = time.Now()
+}
+
+func (t *backupStatusTracker) pending() {
+	t.status.QueuePosition = 0
+	t.publish()
+}
+
+func (t *backupStatusTracker) queued(position int) {
+	t.status.QueuePosition = position
+	t.publish()
+}
+
+func (t *backupStatusTracker) start() {
+	t.status.State = BackupStateInProgress
+	t.publish()
+}
+
+// transferred accounts data written to the backupstore
+func (t *backupStatusTracker) transferred(bytes int64) {
+	t.status.BytesTransferred += bytes
+}
+
+// progress publishes the progress if the throttling allows it
+func (t *backupStatusTracker) progress(progress int) {
+	t.status.Progress = progress
+	if t.throttler.shouldUpdate(progress) {
+		t.publish()
+	}
+}
+
+func (t *backupStatusTracker) complete(backupURL string) {
+	t.status.State = BackupStateCompleted
+	t.status.Progress = PROGRESS_PERCENTAGE_BACKUP_TOTAL
+	t.status.URL = backupURL
+	t.status.CompletedAt = util.Now()
+	t.publish()
+}
+
+func (t *backupStatusTracker) fail(err error) {
+	t.finish(BackupStateError, err)
+}
+
+func (t *backupStatusTracker) cancel(err error) {
+	t.finish(BackupStateCanceled, err)
+}
+
+func (t *backupStatusTracker) finish(state BackupState, err error) {
+	t.status.State = state
+	t.status.Error = err.Error()
+	t.status.ErrorType = getBackupErrorType(err)
+	t.status.CompletedAt = util.Now()
+	t.publish()
+}
+
+// GetBackupStatus returns the status of a delta block backup, including the
+// ones still in progress or failed
+func GetBackupStatus(backupName, volumeName, destURL string) (*BackupStatus, error) {
+	driver, err := GetBackupStoreDriver(destURL)
+	if err != nil {
+		return nil, err
+	}
+	if !util.ValidateName(backupName) || !util.ValidateName(volumeName) {
+		return nil, fmt.Errorf("Invalid name, got %v and %v", backupName, volumeName)
+	}
+
+	statusFile := getBackupStatusPath(backupName, volumeName)
+	if driver.FileExists(statusFile) {
+		status := &BackupStatus{}
+		if err := loadConfigInBackupStore(statusFile, driver, status); err != nil {
+			return nil, err
+		}
+		return status, nil
+	}
+
+	if !backupExists(backupName, volumeName, driver) {
+		return nil, fmt.Errorf("Cannot find backup %v of volume %v in backupstore", backupName, volumeName)
+	}
+	backup, err := loadBackup(backupName, volumeName, driver)
+	if err != nil {
+		return nil, err
+	}
+	return &BackupStatus{
+		Name:         backup.Name,
+		VolumeName:   backup.VolumeName,
+		SnapshotName: backup.SnapshotName,
+		State:        BackupStateCompleted,
+		Progress:     PROGRESS_PERCENTAGE_BACKUP_TOTAL,
+		URL:          encodeBackupURL(backup.Name, backup.VolumeName, driver.GetURL()),
+		UpdatedAt:    backup.CreatedTime,
+		CompletedAt:  backup.CreatedTime,
+	}, nil
+}
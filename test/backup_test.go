@@ -1,6 +1,11 @@
 package test
 
 import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -9,13 +14,18 @@ import (
 	"os/exec"
 	"path/filepath"
 	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	//"github.com/sirupsen/logrus"
 	"github.com/longhorn/backupstore"
+	"github.com/longhorn/backupstore/fault"
+	"github.com/longhorn/backupstore/fsops"
 	_ "github.com/longhorn/backupstore/nfs"
 	"github.com/longhorn/backupstore/util"
 	. "gopkg.in/check.v1"
@@ -31,11 +41,47 @@ const (
 	snapIncrePreifix  = "restore-snap-"
 )
 
+// Each test backs up its own volume, so it sees none of the backups of the
+// other tests
+const (
+	incompressibleVolumeName = "BackupStoreIncompressibleTestVolume"
+	canceledVolumeName       = "BackupStoreCanceledTestVolume"
+	quotaVolumeName          = "BackupStoreQuotaTestVolume"
+	pruneVolumeName          = "BackupStorePruneTestVolume"
+	renameVolumeName         = "BackupStoreRenameTestVolume"
+	corruptedVolumeName      = "BackupStoreCorruptedTestVolume"
+	damagedVolumeName        = "BackupStoreDamagedTestVolume"
+	unalignedVolumeName      = "BackupStoreUnalignedTestVolume"
+	blockSizeVolumeName      = "BackupStoreBlockSizeTestVolume"
+	chunkingVolumeName       = "BackupStoreChunkingTestVolume"
+	restoreStateVolumeName   = "BackupStoreRestoreStateTestVolume"
+	restoreStatusVolumeName  = "BackupStoreRestoreStatusTestVolume"
+	metadataCacheVolumeName  = "BackupStoreMetadataCacheTestVolume"
+	lockVolumeName           = "BackupStoreLockTestVolume"
+	limitVolumeName          = "BackupStoreLimitTestVolume"
+	clientVolumeName         = "BackupStoreClientTestVolume"
+	durabilityVolumeName     = "BackupStoreDurabilityTestVolume"
+	blockIterationVolumeName = "BackupStoreBlockIterationTestVolume"
+	gcVolumeName             = "BackupStoreGCTestVolume"
+	staleBlocksVolumeName    = "BackupStoreStaleBlocksTestVolume"
+	blockDeviceVolumeName    = "BackupStoreBlockDeviceTestVolume"
+	catalogVolumeName        = "BackupStoreCatalogTestVolume"
+	hooksVolumeName          = "BackupStoreHooksTestVolume"
+	groupVolumeName          = "BackupStoreGroupTestVolume"
+	groupMemberVolumeName    = "BackupStoreGroupMemberTestVolume"
+	inventoryVolumeName      = "BackupStoreInventoryTestVolume"
+	baseBackupVolumeName     = "BackupStoreBaseBackupTestVolume"
+	expansionVolumeName      = "BackupStoreExpansionTestVolume"
+	faultVolumeName          = "BackupStoreFaultTestVolume"
+)
+
 func Test(t *testing.T) { TestingT(t) }
 
 type TestSuite struct {
 	BasePath        string
 	BackupStorePath string
+	// snapshotDirs hold the snapshots of the volumes of the running test
+	snapshotDirs []string
 }
 
 var _ = Suite(&TestSuite{})
@@ -53,35 +99,51 @@ type DeltaBlockBackupOperations interface {
 */
 
 type RawFileVolume struct {
-	lock           sync.Mutex
-	v              backupstore.Volume
-	Snapshots      []backupstore.Snapshot
-	BackupProgress int
-	BackupError    string
-	BackupURL      string
+	lock          sync.Mutex
+	v             backupstore.Volume
+	Snapshots     []backupstore.Snapshot
+	BackupStatus  backupstore.BackupStatus
+	BackupUpdates int
+	// ContentSize is the size of the snapshots, volumeContentSize if zero
+	ContentSize int64
+	// BlockSize is the block size of the mappings, DEFAULT_BLOCK_SIZE if
+	// zero
+	BlockSize int64
+	// readGate blocks the reads of the snapshots until it's closed, if set
+	readGate chan struct{}
+	// dir is where addSnapshot saves the snapshots
+	dir string
+}
+
+func (r *RawFileVolume) getContentSize() int64 {
+	if r.ContentSize != 0 {
+		return r.ContentSize
+	}
+	return volumeContentSize
 }
 
-func (r *RawFileVolume) UpdateBackupStatus(id, volumeID string, backupProgress int, backupURL string, backupError string) error {
+func (r *RawFileVolume) UpdateBackupStatus(id, volumeID string, status *backupstore.BackupStatus) error {
 	r.lock.Lock()
-	r.BackupProgress = backupProgress
-	r.BackupURL = backupURL
-	r.BackupError = backupError
+	r.BackupStatus = *status
+	if status.State == backupstore.BackupStateInProgress {
+		r.BackupUpdates++
+	}
 	r.lock.Unlock()
 	return nil
 }
 
 func (r *RawFileVolume) GetBackupStatus() (string, string) {
 	r.lock.Lock()
-	bUrl := r.BackupURL
-	bErr := r.BackupError
+	bUrl := r.BackupStatus.URL
+	bErr := r.BackupStatus.Error
 	r.lock.Unlock()
 	return bUrl, bErr
 }
 
 func (r *RawFileVolume) ResetBackupStatus() {
 	r.lock.Lock()
-	r.BackupURL = ""
-	r.BackupError = ""
+	r.BackupStatus = backupstore.BackupStatus{}
+	r.BackupUpdates = 0
 	r.lock.Unlock()
 }
 
@@ -91,9 +153,13 @@ func (r *RawFileVolume) HasSnapshot(id, volumeID string) bool {
 }
 
 func (r *RawFileVolume) CompareSnapshot(id, compareID, volumeID string) (*backupstore.Mappings, error) {
+	blockSize := int64(backupstore.DEFAULT_BLOCK_SIZE)
+	if r.BlockSize != 0 {
+		blockSize = r.BlockSize
+	}
 	mappings := backupstore.Mappings{
 		Mappings:  []backupstore.Mapping{},
-		BlockSize: backupstore.DEFAULT_BLOCK_SIZE,
+		BlockSize: blockSize,
 	}
 
 	snap1, err := os.Open(id)
@@ -103,20 +169,22 @@ func (r *RawFileVolume) CompareSnapshot(id, compareID, volumeID string) (*backup
 		return nil, err
 	}
 
-	blockSize := int64(backupstore.DEFAULT_BLOCK_SIZE)
-
+	contentSize := r.getContentSize()
 	if compareID == "" {
 		emptyData := make([]byte, blockSize)
-		for i := int64(0); i < volumeContentSize/blockSize; i++ {
-			offset := i * blockSize
-			data := make([]byte, blockSize)
+		for offset := int64(0); offset < contentSize; offset += blockSize {
+			size := blockSize
+			if contentSize-offset < size {
+				size = contentSize - offset
+			}
+			data := make([]byte, size)
 			if _, err := snap1.ReadAt(data, offset); err != nil {
 				return nil, err
 			}
-			if !reflect.DeepEqual(data, emptyData) {
+			if !reflect.DeepEqual(data, emptyData[:size]) {
 				mappings.Mappings = append(mappings.Mappings, backupstore.Mapping{
 					Offset: offset,
-					Size:   blockSize,
+					Size:   size,
 				})
 			}
 		}
@@ -130,10 +198,13 @@ func (r *RawFileVolume) CompareSnapshot(id, compareID, volumeID string) (*backup
 		return nil, err
 	}
 
-	for i := int64(0); i < volumeContentSize/blockSize; i++ {
-		offset := i * blockSize
-		data1 := make([]byte, blockSize)
-		data2 := make([]byte, blockSize)
+	for offset := int64(0); offset < contentSize; offset += blockSize {
+		size := blockSize
+		if contentSize-offset < size {
+			size = contentSize - offset
+		}
+		data1 := make([]byte, size)
+		data2 := make([]byte, size)
 		if _, err := snap1.ReadAt(data1, offset); err != nil {
 			return nil, err
 		}
@@ -143,7 +214,7 @@ func (r *RawFileVolume) CompareSnapshot(id, compareID, volumeID string) (*backup
 		if !reflect.DeepEqual(data1, data2) {
 			mappings.Mappings = append(mappings.Mappings, backupstore.Mapping{
 				Offset: offset,
-				Size:   blockSize,
+				Size:   size,
 			})
 		}
 	}
@@ -155,10 +226,29 @@ func (r *RawFileVolume) OpenSnapshot(id, volumeID string) error {
 }
 
 func (r *RawFileVolume) ReadSnapshot(id, volumeID string, start int64, data []byte) error {
+	if r.readGate != nil {
+		<-r.readGate
+	}
+	f, err := os.Open(id)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.ReadAt(data, start); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *RawFileVolume) ReadSnapshotBlocks(id, volumeID string, start int64, data []byte) error {
+	if r.readGate != nil {
+		<-r.readGate
+	}
 	f, err := os.Open(id)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 
 	if _, err := f.ReadAt(data, start); err != nil {
 		return err
@@ -180,6 +270,71 @@ func (s *TestSuite) randomChange(data []byte, offset, length int64) {
 	}
 }
 
+// randomData returns size random letters, which compress well
+func (s *TestSuite) randomData(size int64) []byte {
+	data := make([]byte, size)
+	s.randomChange(data, 0, size)
+	return data
+}
+
+// changingData returns the content of count snapshots of random data, each
+// one changed in one more block than the previous one
+func (s *TestSuite) changingData(count int) [][]byte {
+	data := s.randomData(volumeContentSize)
+	snapshots := [][]byte{}
+	for i := 0; i < count; i++ {
+		snapshots = append(snapshots, append([]byte{}, data...))
+		s.randomChange(data, int64(i)*backupstore.DEFAULT_BLOCK_SIZE, 10)
+	}
+	return snapshots
+}
+
+// newTestVolume returns a volume named name with a snapshot for each of
+// snapshots, the volume being as large as the first one, along with a
+// function returning the config to back up its i-th snapshot. The snapshots
+// are removed once the test is done.
+func (s *TestSuite) newTestVolume(c *C, name string, snapshots [][]byte) (*RawFileVolume, func(i int) *backupstore.DeltaBackupConfig) {
+	dir, err := ioutil.TempDir(s.BasePath, "snapshots-")
+	c.Assert(err, IsNil)
+	s.snapshotDirs = append(s.snapshotDirs, dir)
+
+	size := int64(len(snapshots[0]))
+	volume := &RawFileVolume{
+		v: backupstore.Volume{
+			Name:        name,
+			Size:        size,
+			CreatedTime: util.Now(),
+		},
+		ContentSize: size,
+		dir:         dir,
+	}
+	for _, data := range snapshots {
+		volume.addSnapshot(c, data)
+	}
+	newConfig := func(i int) *backupstore.DeltaBackupConfig {
+		return &backupstore.DeltaBackupConfig{
+			Volume:   &volume.v,
+			Snapshot: &volume.Snapshots[i],
+			DestURL:  s.getDestURL(),
+			DeltaOps: volume,
+		}
+	}
+	return volume, newConfig
+}
+
+// addSnapshot saves a new snapshot of the volume with data, and returns its
+// index
+func (r *RawFileVolume) addSnapshot(c *C, data []byte) int {
+	name := filepath.Join(r.dir, "snapshot-"+strconv.Itoa(len(r.Snapshots)))
+	err := ioutil.WriteFile(name, data, 0600)
+	c.Assert(err, IsNil)
+	r.Snapshots = append(r.Snapshots, backupstore.Snapshot{
+		Name:        name,
+		CreatedTime: util.Now(),
+	})
+	return len(r.Snapshots) - 1
+}
+
 func (s *TestSuite) SetUpSuite(c *C) {
 	//logrus.SetLevel(logrus.DebugLevel)
 	rand.Seed(time.Now().UTC().UnixNano())
@@ -199,6 +354,24 @@ func (s *TestSuite) TearDownSuite(c *C) {
 	c.Assert(err, IsNil)
 }
 
+func (s *TestSuite) TearDownTest(c *C) {
+	for _, dir := range s.snapshotDirs {
+		err := os.RemoveAll(dir)
+		c.Assert(err, IsNil)
+	}
+	s.snapshotDirs = nil
+}
+
+func getVolumePath(volumeName string) string {
+	checksum := util.GetChecksum([]byte(volumeName))
+	return filepath.Join(backupstore.GetBackupstoreBase(), "volumes", checksum[0:2], checksum[2:4], volumeName)
+}
+
+func getBlockFilePath(volumeName string, data []byte) string {
+	checksum := util.GetChecksum(data)
+	return filepath.Join(getVolumePath(volumeName), "blocks", checksum[0:2], checksum[2:4], checksum+".blk")
+}
+
 func (s *TestSuite) getDestURL() string {
 	//return "vfs://" + s.BackupStorePath
 	return "nfs://127.0.0.1:/opt/backupstore"
@@ -208,6 +381,12 @@ func (s *TestSuite) createAndWaitForBackup(c *C, config *backupstore.DeltaBackup
 	_, err := backupstore.CreateDeltaBlockBackup(config)
 	c.Assert(err, IsNil)
 
+	bURL, _ := s.waitForBackup(c, deltaOps)
+	return bURL
+}
+
+// waitForBackup returns the backup URL and the number of status updates
+func (s *TestSuite) waitForBackup(c *C, deltaOps *RawFileVolume) (string, int) {
 	retryCount := 120
 	var bError, bURL string
 	for j := 0; j < retryCount; j++ {
@@ -221,9 +400,12 @@ func (s *TestSuite) createAndWaitForBackup(c *C, config *backupstore.DeltaBackup
 	}
 
 	c.Assert(bURL, Not(Equals), "")
+	deltaOps.lock.Lock()
+	updates := deltaOps.BackupUpdates
+	deltaOps.lock.Unlock()
 	deltaOps.ResetBackupStatus()
 
-	return bURL
+	return bURL, updates
 }
 
 func (s *TestSuite) TestBackupBasic(c *C) {
@@ -273,14 +455,28 @@ func (s *TestSuite) TestBackupBasic(c *C) {
 				"SnapshotName": volume.Snapshots[i].Name,
 				"RandomKey":    "RandomValue",
 			},
+			Description: "pre-upgrade",
+			Annotations: map[string]string{"ticket": strconv.Itoa(i)},
 		}
-		backup := s.createAndWaitForBackup(c, config, &volume)
+		_, err := backupstore.CreateDeltaBlockBackup(config)
+		c.Assert(err, IsNil)
+		volume.lock.Lock()
+		c.Assert(volume.BackupStatus.State, Not(Equals), backupstore.BackupStateError)
+		volume.lock.Unlock()
+		backup, _ := s.waitForBackup(c, &volume)
 		if i == 0 {
 			backup0 = backup
 		}
 
+		backupName, err := backupstore.GetBackupFromBackupURL(backup)
+		c.Assert(err, IsNil)
+		status, err := backupstore.GetBackupStatus(backupName, volume.v.Name, s.getDestURL())
+		c.Assert(err, IsNil)
+		c.Assert(status.State, Equals, backupstore.BackupStateCompleted)
+		c.Assert(status.URL, Equals, backup)
+
 		restore := filepath.Join(s.BasePath, "restore-"+strconv.Itoa(i))
-		err := backupstore.RestoreDeltaBlockBackup(backup, restore)
+		err = backupstore.RestoreDeltaBlockBackup(backup, restore)
 		c.Assert(err, IsNil)
 
 		err = exec.Command("diff", volume.Snapshots[i].Name, restore).Run()
@@ -299,6 +495,8 @@ func (s *TestSuite) TestBackupBasic(c *C) {
 		c.Assert(backupInfo.VolumeCreated, Equals, volume.v.CreatedTime)
 		c.Assert(backupInfo.Labels["SnapshotName"], Equals, volume.Snapshots[i].Name)
 		c.Assert(backupInfo.Labels["RandomKey"], Equals, "RandomValue")
+		c.Assert(backupInfo.Description, Equals, "pre-upgrade")
+		c.Assert(backupInfo.Annotations["ticket"], Equals, strconv.Itoa(i))
 	}
 
 	listInfo, err := backupstore.List(volume.v.Name, s.getDestURL(), false)
@@ -325,6 +523,29 @@ func (s *TestSuite) TestBackupBasic(c *C) {
 	c.Assert(backupInfo0.Labels["SnapshotName"], Equals, volume.Snapshots[0].Name)
 	c.Assert(backupInfo0.Labels["RandomKey"], Equals, "RandomValue")
 
+	err = backupstore.UpdateBackupLabels(backup0, map[string]string{
+		"RandomKey": "",
+		"verified":  "true",
+	})
+	c.Assert(err, IsNil)
+	backupInfo0, err = backupstore.InspectBackup(backup0)
+	c.Assert(err, IsNil)
+	c.Assert(backupInfo0.Labels, DeepEquals, map[string]string{
+		"SnapshotName": volume.Snapshots[0].Name,
+		"verified":     "true",
+	})
+
+	err = backupstore.UpdateBackupAnnotations(backup0, "migration", map[string]string{"ticket": ""})
+	c.Assert(err, IsNil)
+	backupInfo0, err = backupstore.InspectBackup(backup0)
+	c.Assert(err, IsNil)
+	c.Assert(backupInfo0.Description, Equals, "migration")
+	c.Assert(backupInfo0.Annotations, HasLen, 0)
+
+	err = backupstore.UpdateBackupVolumeAnnotations(volume.v.Name, s.getDestURL(), "test volume",
+		map[string]string{"owner": "tester"})
+	c.Assert(err, IsNil)
+
 	volumeList, err := backupstore.List(volume.v.Name, s.getDestURL(), true)
 	c.Assert(err, IsNil)
 	c.Assert(len(volumeList), Equals, 1)
@@ -333,6 +554,8 @@ func (s *TestSuite) TestBackupBasic(c *C) {
 	c.Assert(volumeInfo.Name, Equals, volume.v.Name)
 	c.Assert(volumeInfo.Size, Equals, volumeSize)
 	c.Assert(volumeInfo.Created, Equals, volume.v.CreatedTime)
+	c.Assert(volumeInfo.Description, Equals, "test volume")
+	c.Assert(volumeInfo.Annotations["owner"], Equals, "tester")
 	c.Assert(len(volumeInfo.Backups), Equals, 0)
 }
 
@@ -480,3 +703,1951 @@ func (s *TestSuite) TestBackupRestoreExtra(c *C) {
 		c.Assert(backupInfo.Labels["RandomKey"], Equals, "RandomValue")
 	}
 }
+
+func (s *TestSuite) TestBackupIncompressible(c *C) {
+	blockSize := int64(backupstore.DEFAULT_BLOCK_SIZE)
+	// First block is random thus incompressible, the rest compress well
+	data := s.randomData(volumeContentSize)
+	_, err := crand.Read(data[:blockSize])
+	c.Assert(err, IsNil)
+	original := append([]byte{}, data...)
+	// Only touch a compressible block, the random one would be reused
+	s.randomChange(data, blockSize, 10)
+
+	volume, newConfig := s.newTestVolume(c, incompressibleVolumeName, [][]byte{original, data})
+	for i := range volume.Snapshots {
+		config := newConfig(i)
+		config.ProgressUpdateMinDelta = 50
+		estimate, err := backupstore.EstimateDeltaBlockBackup(context.Background(), config)
+		c.Assert(err, IsNil)
+		if i == 0 {
+			c.Assert(estimate.ChangedBlocks, Equals, volumeContentSize/blockSize)
+			c.Assert(estimate.NewBlocks, Equals, volumeContentSize/blockSize)
+			// The incompressible block is uploaded as is
+			c.Assert(estimate.NewBytes > blockSize, Equals, true)
+			c.Assert(estimate.NewBytes <= volumeContentSize, Equals, true)
+		} else {
+			c.Assert(estimate.ChangedBlocks, Equals, int64(1))
+			c.Assert(estimate.NewBlocks, Equals, int64(1))
+			c.Assert(estimate.NewBytes <= blockSize, Equals, true)
+		}
+
+		_, err = backupstore.CreateDeltaBlockBackup(config)
+		c.Assert(err, IsNil)
+		backup, updates := s.waitForBackup(c, volume)
+		// The start and at most one intermediate progress update
+		c.Assert(updates <= 2, Equals, true)
+
+		restore := filepath.Join(s.BasePath, "restore-incompressible-"+strconv.Itoa(i))
+		err = backupstore.RestoreDeltaBlockBackup(backup, restore)
+		c.Assert(err, IsNil)
+
+		err = exec.Command("diff", volume.Snapshots[i].Name, restore).Run()
+		c.Assert(err, IsNil)
+	}
+
+	// The incompressible block of the first backup is reused as is once
+	// it's back, though the last backup doesn't have it
+	_, err = crand.Read(data[:blockSize])
+	c.Assert(err, IsNil)
+	for i, content := range [][]byte{data, original} {
+		snapshot := volume.addSnapshot(c, content)
+		result, err := backupstore.CreateDeltaBlockBackupAndWait(context.Background(), newConfig(snapshot))
+		c.Assert(err, IsNil)
+		report, err := backupstore.AuditBackupBlocks(result.BackupURL, true)
+		c.Assert(err, IsNil)
+		c.Assert(report.Healthy(), Equals, true)
+		if i == 1 {
+			c.Assert(result.NewBlocks, Equals, int64(0))
+		}
+	}
+}
+
+func (s *TestSuite) TestBackupCanceled(c *C) {
+	volume, newConfig := s.newTestVolume(c, canceledVolumeName, [][]byte{s.randomData(volumeContentSize)})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	backupName, err := backupstore.CreateDeltaBlockBackupWithContext(ctx, newConfig(0))
+	c.Assert(err, IsNil)
+
+	var status *backupstore.BackupStatus
+	for j := 0; j < 120; j++ {
+		status, err = backupstore.GetBackupStatus(backupName, volume.v.Name, s.getDestURL())
+		c.Assert(err, IsNil)
+		if status.State == backupstore.BackupStateCanceled {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	c.Assert(status.State, Equals, backupstore.BackupStateCanceled)
+	c.Assert(status.URL, Equals, "")
+
+	volume.lock.Lock()
+	c.Assert(volume.BackupStatus.State, Equals, backupstore.BackupStateCanceled)
+	volume.lock.Unlock()
+
+	// Deleting the canceled backup removes its status
+	err = backupstore.DeleteDeltaBlockBackup(s.getDestURL() + "?backup=" + backupName + "&volume=" + canceledVolumeName)
+	c.Assert(err, IsNil)
+	_, err = backupstore.GetBackupStatus(backupName, volume.v.Name, s.getDestURL())
+	c.Assert(err, ErrorMatches, "Cannot find backup .*")
+}
+
+func (s *TestSuite) TestValidateBackupTarget(c *C) {
+	v := backupstore.ValidateBackupTarget(s.getDestURL())
+	c.Assert(v.Passed(), Equals, true, Commentf("%+v", v.Results))
+	c.Assert(v.Results, HasLen, 6)
+	for _, r := range v.Results {
+		if r.Check != backupstore.ValidationCheckCapacity {
+			c.Assert(r.Passed, Equals, true)
+		}
+		if r.Check == backupstore.ValidationCheckWrite {
+			c.Assert(r.Latency > 0, Equals, true)
+		}
+	}
+
+	v = backupstore.ValidateBackupTarget("unknown:///tmp")
+	c.Assert(v.Passed(), Equals, false)
+	c.Assert(v.Results[0].Check, Equals, backupstore.ValidationCheckURL)
+	c.Assert(v.Results[0].Passed, Equals, false)
+	c.Assert(v.Results[1].Skipped, Equals, true)
+}
+
+func (s *TestSuite) TestBackupVolumeQuota(c *C) {
+	blockSize := int64(backupstore.DEFAULT_BLOCK_SIZE)
+	volume, newConfig := s.newTestVolume(c, quotaVolumeName, s.changingData(3))
+	volume.v.Labels = map[string]string{"tenant": "quota"}
+
+	_, err := backupstore.CreateDeltaBlockBackup(newConfig(0))
+	c.Assert(err, IsNil)
+	s.waitForBackup(c, volume)
+
+	usage, err := backupstore.GetBackupVolumeUsage(volume.v.Name, s.getDestURL())
+	c.Assert(err, IsNil)
+	c.Assert(usage.BlockCount, Equals, volumeContentSize/blockSize)
+	c.Assert(usage.StoredSize > 0, Equals, true)
+	volumeList, err := backupstore.List(volume.v.Name, s.getDestURL(), false)
+	c.Assert(err, IsNil)
+	c.Assert(volumeList[volume.v.Name].Labels, DeepEquals, map[string]string{"tenant": "quota"})
+	c.Assert(volumeList[volume.v.Name].StoredSize, Equals, usage.StoredSize)
+	// The first backup holds all the blocks
+	for _, info := range volumeList[volume.v.Name].Backups {
+		c.Assert(info.StoredSize, Equals, usage.StoredSize)
+	}
+
+	// Already at the quota, the backup is rejected right away
+	err = backupstore.SetBackupVolumeQuota(volume.v.Name, s.getDestURL(), 0, usage.BlockCount)
+	c.Assert(err, IsNil)
+	_, err = backupstore.CreateDeltaBlockBackup(newConfig(1))
+	c.Assert(err, ErrorMatches, ".*reached its quota.*")
+
+	// The new block doesn't fit in the remaining space
+	err = backupstore.SetBackupVolumeQuota(volume.v.Name, s.getDestURL(), usage.StoredSize+1, 0)
+	c.Assert(err, IsNil)
+	backupName, err := backupstore.CreateDeltaBlockBackup(newConfig(1))
+	c.Assert(err, IsNil)
+	var status *backupstore.BackupStatus
+	for j := 0; j < 120; j++ {
+		status, err = backupstore.GetBackupStatus(backupName, volume.v.Name, s.getDestURL())
+		c.Assert(err, IsNil)
+		if status.State == backupstore.BackupStateError {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	c.Assert(status.State, Equals, backupstore.BackupStateError)
+	c.Assert(status.ErrorType, Equals, backupstore.BackupErrorTypeQuota)
+	volume.ResetBackupStatus()
+
+	err = backupstore.SetBackupVolumeQuota(volume.v.Name, s.getDestURL(), 0, 0)
+	c.Assert(err, IsNil)
+	_, err = backupstore.CreateDeltaBlockBackup(newConfig(2))
+	c.Assert(err, IsNil)
+	s.waitForBackup(c, volume)
+
+	usage2, err := backupstore.GetBackupVolumeUsage(volume.v.Name, s.getDestURL())
+	c.Assert(err, IsNil)
+	c.Assert(usage2.BlockCount, Equals, usage.BlockCount+2)
+	c.Assert(usage2.StoredSize > usage.StoredSize, Equals, true)
+}
+
+func (s *TestSuite) TestPruneExpiredBackups(c *C) {
+	volume, newConfig := s.newTestVolume(c, pruneVolumeName, s.changingData(2))
+
+	config := newConfig(0)
+	config.ExpiresAt = "yesterday"
+	_, err := backupstore.CreateDeltaBlockBackup(config)
+	c.Assert(err, ErrorMatches, "Invalid expiration time.*")
+
+	config.ExpiresAt = "2000-01-01T00:00:00Z"
+	_, err = backupstore.CreateDeltaBlockBackup(config)
+	c.Assert(err, IsNil)
+	expired, _ := s.waitForBackup(c, volume)
+
+	_, err = backupstore.CreateDeltaBlockBackup(newConfig(1))
+	c.Assert(err, IsNil)
+	kept, _ := s.waitForBackup(c, volume)
+
+	pruned, err := backupstore.PruneExpiredBackups(volume.v.Name, s.getDestURL())
+	c.Assert(err, IsNil)
+	c.Assert(pruned, DeepEquals, []string{expired})
+
+	// The blocks shared with the pruned backup are still there
+	restore := filepath.Join(s.BasePath, "restore-prune")
+	err = backupstore.RestoreDeltaBlockBackup(kept, restore)
+	c.Assert(err, IsNil)
+	err = exec.Command("diff", volume.Snapshots[1].Name, restore).Run()
+	c.Assert(err, IsNil)
+
+	err = backupstore.SetBackupExpiration(kept, time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	c.Assert(err, IsNil)
+	pruned, err = backupstore.PruneExpiredBackups("", s.getDestURL())
+	c.Assert(err, IsNil)
+	c.Assert(pruned, HasLen, 0)
+
+	info, err := backupstore.InspectBackup(kept)
+	c.Assert(err, IsNil)
+	c.Assert(info.ExpiresAt, Not(Equals), "")
+
+	// Protected backups are neither pruned nor deleted
+	err = backupstore.SetBackupExpiration(kept, "2000-01-01T00:00:00Z")
+	c.Assert(err, IsNil)
+	err = backupstore.SetBackupProtection(kept, true)
+	c.Assert(err, IsNil)
+	// A backup which cannot be loaded is skipped as well
+	driver, err := backupstore.GetBackupStoreDriver(s.getDestURL())
+	c.Assert(err, IsNil)
+	brokenCfg := filepath.Join(getVolumePath(pruneVolumeName), "backups", "backup_broken.cfg")
+	err = driver.Write(brokenCfg, bytes.NewReader([]byte("corrupted")))
+	c.Assert(err, IsNil)
+	pruned, err = backupstore.PruneExpiredBackups(volume.v.Name, s.getDestURL())
+	c.Assert(err, IsNil)
+	c.Assert(pruned, HasLen, 0)
+	err = driver.Remove(brokenCfg)
+	c.Assert(err, IsNil)
+	err = backupstore.DeleteDeltaBlockBackup(kept)
+	c.Assert(err, ErrorMatches, ".*is protected.*")
+	err = backupstore.DeleteBackupVolume(volume.v.Name, s.getDestURL())
+	c.Assert(err, ErrorMatches, ".*is protected.*")
+	info, err = backupstore.InspectBackup(kept)
+	c.Assert(err, IsNil)
+	c.Assert(info.Protected, Equals, true)
+
+	err = backupstore.SetBackupProtection(kept, false)
+	c.Assert(err, IsNil)
+	pruned, err = backupstore.PruneExpiredBackups(volume.v.Name, s.getDestURL())
+	c.Assert(err, IsNil)
+	c.Assert(pruned, DeepEquals, []string{kept})
+}
+
+func (s *TestSuite) TestListAllBackupVolumes(c *C) {
+	all, err := backupstore.ListAllBackupVolumes(s.getDestURL(), backupstore.ListVolumesOptions{})
+	c.Assert(err, IsNil)
+	c.Assert(all.ContinuationToken, Equals, "")
+
+	names := []string{}
+	opts := backupstore.ListVolumesOptions{Limit: 2}
+	for {
+		page, err := backupstore.ListAllBackupVolumes(s.getDestURL(), opts)
+		c.Assert(err, IsNil)
+		c.Assert(len(page.Volumes) <= 2, Equals, true)
+		for _, v := range page.Volumes {
+			names = append(names, v.Name)
+		}
+		if page.ContinuationToken == "" {
+			break
+		}
+		opts.ContinuationToken = page.ContinuationToken
+	}
+
+	c.Assert(names, HasLen, len(all.Volumes))
+	for i, v := range all.Volumes {
+		c.Assert(names[i], Equals, v.Name)
+	}
+
+	if len(all.Volumes) < 3 {
+		return
+	}
+	for i, v := range all.Volumes[:3] {
+		err := backupstore.UpdateBackupVolumeLabels(v.Name, s.getDestURL(), map[string]string{
+			"cluster": "cluster-" + strconv.Itoa(i%2),
+			"listed":  "true",
+		})
+		c.Assert(err, IsNil)
+	}
+	page, err := backupstore.ListAllBackupVolumes(s.getDestURL(), backupstore.ListVolumesOptions{
+		Limit:         1,
+		LabelSelector: map[string]string{"listed": "true", "cluster": "cluster-0"},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(page.Volumes, HasLen, 1)
+	c.Assert(page.Volumes[0].Name, Equals, all.Volumes[0].Name)
+	c.Assert(page.ContinuationToken, Not(Equals), "")
+	page, err = backupstore.ListAllBackupVolumes(s.getDestURL(), backupstore.ListVolumesOptions{
+		Limit:             1,
+		ContinuationToken: page.ContinuationToken,
+		LabelSelector:     map[string]string{"listed": "true", "cluster": "cluster-0"},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(page.Volumes, HasLen, 1)
+	c.Assert(page.Volumes[0].Name, Equals, all.Volumes[2].Name)
+
+	page, err = backupstore.ListAllBackupVolumes(s.getDestURL(), backupstore.ListVolumesOptions{
+		LabelPrefixSelector: map[string]string{"cluster": "cluster-"},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(page.Volumes, HasLen, 3)
+
+	for _, v := range all.Volumes[:3] {
+		err := backupstore.UpdateBackupVolumeLabels(v.Name, s.getDestURL(), map[string]string{
+			"cluster": "",
+			"listed":  "",
+		})
+		c.Assert(err, IsNil)
+	}
+}
+
+func (s *TestSuite) TestRenameBackupVolume(c *C) {
+	volume, newConfig := s.newTestVolume(c, renameVolumeName, s.changingData(2))
+	backups := []string{}
+	for i := range volume.Snapshots {
+		_, err := backupstore.CreateDeltaBlockBackup(newConfig(i))
+		c.Assert(err, IsNil)
+		backup, _ := s.waitForBackup(c, volume)
+		backups = append(backups, backup)
+	}
+
+	newName := renameVolumeName + "Renamed"
+	err := backupstore.RenameBackupVolume(renameVolumeName, newName, s.getDestURL())
+	c.Assert(err, IsNil)
+	err = backupstore.RenameBackupVolume(renameVolumeName, newName, s.getDestURL())
+	c.Assert(err, ErrorMatches, ".*already exists.*")
+
+	_, err = backupstore.InspectBackup(backups[0])
+	c.Assert(err, NotNil)
+	volumeList, err := backupstore.List(newName, s.getDestURL(), false)
+	c.Assert(err, IsNil)
+	c.Assert(volumeList[newName].Backups, HasLen, 2)
+
+	for i, snapshot := range volume.Snapshots {
+		var backupURL string
+		for url, info := range volumeList[newName].Backups {
+			if info.SnapshotName == snapshot.Name {
+				backupURL = url
+			}
+		}
+		c.Assert(backupURL, Not(Equals), "")
+
+		restore := filepath.Join(s.BasePath, "restore-rename-"+strconv.Itoa(i))
+		err = backupstore.RestoreDeltaBlockBackup(backupURL, restore)
+		c.Assert(err, IsNil)
+		err = exec.Command("diff", snapshot.Name, restore).Run()
+		c.Assert(err, IsNil)
+	}
+}
+
+func (s *TestSuite) TestForceDeleteBackupVolume(c *C) {
+	volume, newConfig := s.newTestVolume(c, corruptedVolumeName, [][]byte{s.randomData(volumeContentSize)})
+	_, err := backupstore.CreateDeltaBlockBackup(newConfig(0))
+	c.Assert(err, IsNil)
+	backup, _ := s.waitForBackup(c, volume)
+
+	// Corrupt the volume configuration
+	driver, err := backupstore.GetBackupStoreDriver(s.getDestURL())
+	c.Assert(err, IsNil)
+	volumeCfg := filepath.Join(getVolumePath(corruptedVolumeName), "volume.cfg")
+	err = driver.Write(volumeCfg, bytes.NewReader([]byte("corrupted")))
+	c.Assert(err, IsNil)
+
+	_, err = backupstore.LoadVolume(backup)
+	c.Assert(backupstore.IsMetadataCorrupted(err), Equals, true)
+	c.Assert(err.(*backupstore.MetadataCorruptedError).Path, Equals, volumeCfg)
+	err = backupstore.DeleteDeltaBlockBackup(backup)
+	c.Assert(err, NotNil)
+
+	err = backupstore.SetBackupProtection(backup, true)
+	c.Assert(err, IsNil)
+	err = backupstore.ForceDeleteBackupVolume(corruptedVolumeName, s.getDestURL())
+	c.Assert(err, ErrorMatches, ".*is protected.*")
+	err = backupstore.SetBackupProtection(backup, false)
+	c.Assert(err, IsNil)
+
+	err = backupstore.ForceDeleteBackupVolume(corruptedVolumeName, s.getDestURL())
+	c.Assert(err, IsNil)
+	c.Assert(driver.FileExists(volumeCfg), Equals, false)
+	_, err = backupstore.InspectBackup(backup)
+	c.Assert(err, NotNil)
+	page, err := backupstore.ListAllBackupVolumes(s.getDestURL(), backupstore.ListVolumesOptions{})
+	c.Assert(err, IsNil)
+	for _, v := range page.Volumes {
+		c.Assert(v.Name, Not(Equals), corruptedVolumeName)
+	}
+}
+
+func (s *TestSuite) TestRestoreAudit(c *C) {
+	backupstore.SetMetadataCompression(true)
+	defer backupstore.SetMetadataCompression(false)
+	backupstore.SetCompactBlockList(true)
+	defer backupstore.SetCompactBlockList(false)
+
+	blockSize := int64(backupstore.DEFAULT_BLOCK_SIZE)
+	data := s.randomData(volumeContentSize)
+	volume, newConfig := s.newTestVolume(c, damagedVolumeName, [][]byte{data})
+	_, err := backupstore.CreateDeltaBlockBackup(newConfig(0))
+	c.Assert(err, IsNil)
+	backup, _ := s.waitForBackup(c, volume)
+
+	report, err := backupstore.AuditBackupBlocks(backup, true)
+	c.Assert(err, IsNil)
+	c.Assert(report.Healthy(), Equals, true)
+	c.Assert(report.BlockCount, Equals, int(volumeContentSize/blockSize))
+
+	// Remove the second block and corrupt the fourth one
+	driver, err := backupstore.GetBackupStoreDriver(s.getDestURL())
+	c.Assert(err, IsNil)
+	err = driver.Remove(getBlockFilePath(damagedVolumeName, data[blockSize:2*blockSize]))
+	c.Assert(err, IsNil)
+	err = driver.Write(getBlockFilePath(damagedVolumeName, data[3*blockSize:4*blockSize]),
+		bytes.NewReader([]byte("corrupted")))
+	c.Assert(err, IsNil)
+
+	report, err = backupstore.AuditBackupBlocks(backup, true)
+	c.Assert(err, IsNil)
+	c.Assert(report.Healthy(), Equals, false)
+	c.Assert(report.MissingBlocks, HasLen, 1)
+	c.Assert(report.MissingBlocks[0].Offset, Equals, blockSize)
+	c.Assert(report.CorruptedBlocks, HasLen, 1)
+	c.Assert(report.CorruptedBlocks[0].Offset, Equals, 3*blockSize)
+
+	// Nothing is written if the audit fails
+	restore := filepath.Join(s.BasePath, "restore-damaged")
+	err = backupstore.RestoreDeltaBlockBackupWithConfig(&backupstore.DeltaRestoreConfig{
+		BackupURL:            backup,
+		Filename:             restore,
+		AuditBlocks:          true,
+		VerifyBlockChecksums: true,
+	})
+	c.Assert(err, FitsTypeOf, &backupstore.BlockAuditError{})
+	_, err = os.Stat(restore)
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	// The damaged blocks are zero-filled and reported
+	err = backupstore.RestoreDeltaBlockBackupWithConfig(&backupstore.DeltaRestoreConfig{
+		BackupURL:   backup,
+		Filename:    restore,
+		BestEffort:  true,
+		Concurrency: 3,
+	})
+	c.Assert(err, FitsTypeOf, &backupstore.BlockAuditError{})
+	report = err.(*backupstore.BlockAuditError).Report
+	c.Assert(report.DamagedRegions, DeepEquals, []backupstore.DamagedRegion{
+		{Offset: blockSize, Length: blockSize},
+		{Offset: 3 * blockSize, Length: blockSize},
+	})
+	c.Assert(report.MissingBlocks, HasLen, 1)
+	c.Assert(report.CorruptedBlocks, HasLen, 1)
+
+	for _, offset := range []int64{blockSize, 3 * blockSize} {
+		copy(data[offset:offset+blockSize], make([]byte, blockSize))
+	}
+	restored, err := ioutil.ReadFile(restore)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(restored, data), Equals, true)
+
+	// Tampered metadata is detected
+	backupName, err := backupstore.GetBackupFromBackupURL(backup)
+	c.Assert(err, IsNil)
+	backupCfg := filepath.Join(getVolumePath(damagedVolumeName), "backups", "backup_"+backupName+".cfg")
+	rc, err := driver.Read(backupCfg)
+	c.Assert(err, IsNil)
+	cfg, err := ioutil.ReadAll(rc)
+	rc.Close()
+	c.Assert(err, IsNil)
+	// The backup configs are compressed, the uncompressed ones are read
+	// as well
+	c.Assert(util.IsGzipData(cfg), Equals, true)
+	cfg, err = util.DecompressData(cfg)
+	c.Assert(err, IsNil)
+	// The block list is saved in the compact format
+	c.Assert(bytes.Contains(cfg, []byte(`"CompactBlocks":`)), Equals, true)
+	// The versions not supporting the compact format fail to decode it,
+	// instead of finding no block
+	err = json.Unmarshal(cfg, &baselineBackup{})
+	c.Assert(err, ErrorMatches, ".*cannot unmarshal string .*Blocks.*")
+	tampered := bytes.Replace(cfg, []byte(`"SnapshotName":"`), []byte(`"SnapshotName":"x`), 1)
+	c.Assert(bytes.Equal(tampered, cfg), Equals, false)
+	err = driver.Write(backupCfg, bytes.NewReader(tampered))
+	c.Assert(err, IsNil)
+	_, err = backupstore.InspectBackup(backup)
+	c.Assert(err, ErrorMatches, ".*is corrupted.*")
+	c.Assert(backupstore.IsMetadataCorrupted(err), Equals, true)
+
+	volumeCfg := filepath.Join(getVolumePath(damagedVolumeName), "volume.cfg")
+	rc, err = driver.Read(volumeCfg)
+	c.Assert(err, IsNil)
+	cfg, err = ioutil.ReadAll(rc)
+	rc.Close()
+	c.Assert(err, IsNil)
+	tampered = bytes.Replace(cfg, []byte(`"LastBackupName":"`), []byte(`"LastBackupName":"x`), 1)
+	c.Assert(bytes.Equal(tampered, cfg), Equals, false)
+	err = driver.Write(volumeCfg, bytes.NewReader(tampered))
+	c.Assert(err, IsNil)
+	_, err = backupstore.LoadVolume(backup)
+	c.Assert(err, ErrorMatches, "Metadata "+volumeCfg+" in backupstore is corrupted: manifest checksum.*")
+}
+
+func (s *TestSuite) TestUnalignedVolume(c *C) {
+	blockSize := int64(backupstore.DEFAULT_BLOCK_SIZE)
+	// Two and a half blocks
+	contentSize := 2*blockSize + blockSize/2
+	data0 := s.randomData(contentSize)
+	// Only change the short last block
+	data := append([]byte{}, data0...)
+	s.randomChange(data, 2*blockSize, 16)
+
+	volume, newConfig := s.newTestVolume(c, unalignedVolumeName, [][]byte{data0, data})
+	_, err := backupstore.CreateDeltaBlockBackup(newConfig(0))
+	c.Assert(err, IsNil)
+	backup0, _ := s.waitForBackup(c, volume)
+
+	backupInfo, err := backupstore.InspectBackup(backup0)
+	c.Assert(err, IsNil)
+	c.Assert(backupInfo.Size, Equals, contentSize)
+	report, err := backupstore.AuditBackupBlocks(backup0, true)
+	c.Assert(err, IsNil)
+	c.Assert(report.Healthy(), Equals, true)
+	c.Assert(report.BlockCount, Equals, 3)
+
+	_, err = backupstore.CreateDeltaBlockBackup(newConfig(1))
+	c.Assert(err, IsNil)
+	backup1, _ := s.waitForBackup(c, volume)
+
+	restore := filepath.Join(s.BasePath, "restore-unaligned")
+	err = backupstore.RestoreDeltaBlockBackup(backup1, restore)
+	c.Assert(err, IsNil)
+	restored, err := ioutil.ReadFile(restore)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(restored, data), Equals, true)
+
+	// Restore the first backup, then the second one incrementally
+	err = os.Remove(restore)
+	c.Assert(err, IsNil)
+	err = backupstore.RestoreDeltaBlockBackup(backup0, restore)
+	c.Assert(err, IsNil)
+	backupName0, err := backupstore.GetBackupFromBackupURL(backup0)
+	c.Assert(err, IsNil)
+	err = backupstore.RestoreDeltaBlockBackupIncrementally(backup1, restore, backupName0)
+	c.Assert(err, IsNil)
+	restored, err = ioutil.ReadFile(restore)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(restored, data), Equals, true)
+}
+
+func (s *TestSuite) TestVolumeBlockSize(c *C) {
+	blockSize := int64(1024 * 1024)
+	data0 := s.randomData(volumeContentSize)
+	data := append([]byte{}, data0...)
+	s.randomChange(data, 0, 16)
+
+	volume, newConfig := s.newTestVolume(c, blockSizeVolumeName, [][]byte{data0, data})
+	volume.BlockSize = blockSize
+	config := newConfig(0)
+	_, err := backupstore.CreateDeltaBlockBackup(config)
+	c.Assert(err, IsNil)
+	backup0, _ := s.waitForBackup(c, volume)
+
+	volumeInfos, err := backupstore.List(blockSizeVolumeName, s.getDestURL(), true)
+	c.Assert(err, IsNil)
+	volumeInfo := volumeInfos[blockSizeVolumeName]
+	c.Assert(volumeInfo.BlockSize, Equals, blockSize)
+	c.Assert(volumeInfo.DataStored, Equals, volumeContentSize)
+	report, err := backupstore.AuditBackupBlocks(backup0, true)
+	c.Assert(err, IsNil)
+	c.Assert(report.Healthy(), Equals, true)
+	c.Assert(report.BlockCount, Equals, int(volumeContentSize/blockSize))
+
+	restore := filepath.Join(s.BasePath, "restore-block-size")
+	err = backupstore.RestoreDeltaBlockBackup(backup0, restore)
+	c.Assert(err, IsNil)
+	restored, err := ioutil.ReadFile(restore)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(restored, data0), Equals, true)
+
+	// The block size of the volume cannot change
+	volume.ResetBackupStatus()
+	volume.BlockSize = backupstore.DEFAULT_BLOCK_SIZE
+	config.Snapshot = &volume.Snapshots[1]
+	_, err = backupstore.CreateDeltaBlockBackup(config)
+	c.Assert(err, FitsTypeOf, &backupstore.BlockSizeMismatchError{})
+	mismatch := err.(*backupstore.BlockSizeMismatchError)
+	c.Assert(mismatch.Expected, Equals, blockSize)
+	c.Assert(mismatch.Actual, Equals, int64(backupstore.DEFAULT_BLOCK_SIZE))
+
+	volume.BlockSize = blockSize
+	_, err = backupstore.CreateDeltaBlockBackup(config)
+	c.Assert(err, IsNil)
+	backup1, _ := s.waitForBackup(c, volume)
+
+	backupName0, err := backupstore.GetBackupFromBackupURL(backup0)
+	c.Assert(err, IsNil)
+	err = backupstore.RestoreDeltaBlockBackupIncrementally(backup1, restore, backupName0)
+	c.Assert(err, IsNil)
+	restored, err = ioutil.ReadFile(restore)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(restored, data), Equals, true)
+
+	// The volumes reading one block at a time get reads of their block
+	// size, even if their changes cover several blocks
+	volume.ResetBackupStatus()
+	blockReads := &blockReadVolume{DeltaBlockBackupOperations: volume, blockSize: blockSize}
+	config.DeltaOps = blockReads
+	config.BackupName = "backup-block-reads"
+	_, err = backupstore.CreateDeltaBlockBackupAndWait(context.Background(), config)
+	c.Assert(err, IsNil)
+	c.Assert(blockReads.reads, Equals, int(volumeContentSize/blockSize))
+}
+
+// baselineBackup is the backup config as decoded by the versions before the
+// compact block lists
+type baselineBackup struct {
+	Name              string
+	VolumeName        string
+	SnapshotName      string
+	SnapshotCreatedAt string
+	CreatedTime       string
+	Size              int64 `json:",string"`
+	Labels            map[string]string
+
+	Blocks []struct {
+		Offset        int64
+		BlockChecksum string
+	} `json:",omitempty"`
+	SingleFile backupstore.BackupFile `json:",omitempty"`
+}
+
+// blockReadVolume reads the snapshots one block at a time, and reports the
+// whole volume as changed in one mapping
+type blockReadVolume struct {
+	backupstore.DeltaBlockBackupOperations
+	blockSize int64
+
+	lock  sync.Mutex
+	reads int
+}
+
+func (v *blockReadVolume) CompareSnapshot(id, compareID, volumeID string) (*backupstore.Mappings, error) {
+	return &backupstore.Mappings{
+		Mappings:  []backupstore.Mapping{{Offset: 0, Size: volumeContentSize}},
+		BlockSize: v.blockSize,
+	}, nil
+}
+
+func (v *blockReadVolume) ReadSnapshot(id, volumeID string, start int64, data []byte) error {
+	if int64(len(data)) != v.blockSize {
+		return fmt.Errorf("Invalid read of %v bytes of snapshot %v", len(data), id)
+	}
+	v.lock.Lock()
+	v.reads++
+	v.lock.Unlock()
+	return v.DeltaBlockBackupOperations.ReadSnapshot(id, volumeID, start, data)
+}
+
+func (s *TestSuite) TestContentDefinedChunking(c *C) {
+	data0 := s.randomData(volumeContentSize)
+	// The second snapshot has the data shifted
+	data := append([]byte{}, data0...)
+	copy(data[4096:], data[:volumeContentSize-4096])
+	s.randomChange(data, 0, 4096)
+
+	volume, newConfig := s.newTestVolume(c, chunkingVolumeName, [][]byte{data0, data})
+	config := newConfig(0)
+	config.ChunkingMode = backupstore.ChunkingModeCDC
+	_, err := backupstore.CreateDeltaBlockBackup(config)
+	c.Assert(err, IsNil)
+	backup0, _ := s.waitForBackup(c, volume)
+	usage, err := backupstore.GetBackupVolumeUsage(chunkingVolumeName, s.getDestURL())
+	c.Assert(err, IsNil)
+	blockCount := usage.BlockCount
+
+	// The blocks after the change are still deduplicated
+	config = newConfig(1)
+	_, err = backupstore.CreateDeltaBlockBackup(config)
+	c.Assert(err, IsNil)
+	backup1, _ := s.waitForBackup(c, volume)
+	usage, err = backupstore.GetBackupVolumeUsage(chunkingVolumeName, s.getDestURL())
+	c.Assert(err, IsNil)
+	c.Assert(usage.BlockCount-blockCount <= 2, Equals, true)
+
+	backupInfo, err := backupstore.InspectBackup(backup1)
+	c.Assert(err, IsNil)
+	c.Assert(backupInfo.Size, Equals, volumeContentSize)
+	report, err := backupstore.AuditBackupBlocks(backup1, true)
+	c.Assert(err, IsNil)
+	c.Assert(report.Healthy(), Equals, true)
+
+	restore := filepath.Join(s.BasePath, "restore-chunking")
+	err = backupstore.RestoreDeltaBlockBackup(backup0, restore)
+	c.Assert(err, IsNil)
+	backupName0, err := backupstore.GetBackupFromBackupURL(backup0)
+	c.Assert(err, IsNil)
+	err = backupstore.RestoreDeltaBlockBackupIncrementally(backup1, restore, backupName0)
+	c.Assert(err, IsNil)
+	restored, err := ioutil.ReadFile(restore)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(restored, data), Equals, true)
+
+	// The chunking mode of the volume cannot change
+	config.ChunkingMode = backupstore.ChunkingModeFixed
+	_, err = backupstore.CreateDeltaBlockBackup(config)
+	c.Assert(err, ErrorMatches, ".*chunking mode.*")
+}
+
+func (s *TestSuite) TestRestoreState(c *C) {
+	blockSize := int64(backupstore.DEFAULT_BLOCK_SIZE)
+	data0 := s.randomData(volumeContentSize)
+	data := append([]byte{}, data0...)
+	s.randomChange(data, blockSize, 16)
+
+	volume, newConfig := s.newTestVolume(c, restoreStateVolumeName, [][]byte{data0, data})
+	_, err := backupstore.CreateDeltaBlockBackup(newConfig(0))
+	c.Assert(err, IsNil)
+	backup0, _ := s.waitForBackup(c, volume)
+	_, err = backupstore.CreateDeltaBlockBackup(newConfig(1))
+	c.Assert(err, IsNil)
+	backup1, _ := s.waitForBackup(c, volume)
+	backupName0, err := backupstore.GetBackupFromBackupURL(backup0)
+	c.Assert(err, IsNil)
+	backupName1, err := backupstore.GetBackupFromBackupURL(backup1)
+	c.Assert(err, IsNil)
+
+	restore := filepath.Join(s.BasePath, "restore-state")
+	// A plain restore keeps no marker
+	err = backupstore.RestoreDeltaBlockBackup(backup0, restore)
+	c.Assert(err, IsNil)
+	_, err = os.Stat(restore + backupstore.RESTORE_STATE_SUFFIX)
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	updates := []backupstore.RestoreProgress{}
+	err = backupstore.RestoreDeltaBlockBackupWithConfig(&backupstore.DeltaRestoreConfig{
+		BackupURL:        backup0,
+		Filename:         restore,
+		DetectLastBackup: true,
+		ProgressFunc: func(progress *backupstore.RestoreProgress) {
+			updates = append(updates, *progress)
+		},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(len(updates) > 2, Equals, true)
+	c.Assert(updates[0].BlocksDone, Equals, int64(0))
+	progress := updates[len(updates)-1]
+	c.Assert(progress.Completed, Equals, true)
+	c.Assert(progress.Progress, Equals, 100)
+	c.Assert(progress.BlocksDone, Equals, volumeContentSize/blockSize)
+	c.Assert(progress.BlocksTotal, Equals, volumeContentSize/blockSize)
+	c.Assert(progress.BytesWritten, Equals, volumeContentSize)
+	state, err := backupstore.GetRestoreState(restore + backupstore.RESTORE_STATE_SUFFIX)
+	c.Assert(err, IsNil)
+	c.Assert(state.BackupName, Equals, backupName0)
+
+	// The baseline has to match the restored backup
+	err = backupstore.RestoreDeltaBlockBackupWithConfig(&backupstore.DeltaRestoreConfig{
+		BackupURL:        backup0,
+		Filename:         restore,
+		LastBackupName:   backupName1,
+		DetectLastBackup: true,
+	})
+	c.Assert(err, ErrorMatches, ".*was restored from backup.*")
+
+	updates = updates[:0]
+	err = backupstore.RestoreDeltaBlockBackupWithConfig(&backupstore.DeltaRestoreConfig{
+		BackupURL:        backup1,
+		Filename:         restore,
+		DetectLastBackup: true,
+		ProgressFunc: func(progress *backupstore.RestoreProgress) {
+			updates = append(updates, *progress)
+		},
+	})
+	c.Assert(err, IsNil)
+	// Only the changed block is written
+	progress = updates[len(updates)-1]
+	c.Assert(progress.BlocksTotal, Equals, int64(1))
+	c.Assert(progress.BytesWritten, Equals, blockSize)
+	restored, err := ioutil.ReadFile(restore)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(restored, data), Equals, true)
+	state, err = backupstore.GetRestoreState(restore + backupstore.RESTORE_STATE_SUFFIX)
+	c.Assert(err, IsNil)
+	c.Assert(state.BackupName, Equals, backupName1)
+
+	// A modified target is fully restored
+	err = ioutil.WriteFile(restore, make([]byte, volumeContentSize), 0600)
+	c.Assert(err, IsNil)
+	modified := time.Now().Add(time.Minute)
+	err = os.Chtimes(restore, modified, modified)
+	c.Assert(err, IsNil)
+	err = backupstore.RestoreDeltaBlockBackupWithConfig(&backupstore.DeltaRestoreConfig{
+		BackupURL:        backup0,
+		Filename:         restore,
+		LastBackupName:   backupName1,
+		DetectLastBackup: true,
+	})
+	c.Assert(err, ErrorMatches, ".*has been modified.*")
+	err = backupstore.RestoreDeltaBlockBackupWithConfig(&backupstore.DeltaRestoreConfig{
+		BackupURL:        backup0,
+		Filename:         restore,
+		DetectLastBackup: true,
+	})
+	c.Assert(err, IsNil)
+	restored, err = ioutil.ReadFile(restore)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(restored, data0), Equals, true)
+
+	// The restored blocks are checked too, the modification time may be
+	// kept or missing, like for a block device
+	stat, err := os.Stat(restore)
+	c.Assert(err, IsNil)
+	err = ioutil.WriteFile(restore, make([]byte, volumeContentSize), 0600)
+	c.Assert(err, IsNil)
+	err = os.Chtimes(restore, stat.ModTime(), stat.ModTime())
+	c.Assert(err, IsNil)
+	err = backupstore.RestoreDeltaBlockBackupWithConfig(&backupstore.DeltaRestoreConfig{
+		BackupURL:        backup1,
+		Filename:         restore,
+		LastBackupName:   backupName0,
+		DetectLastBackup: true,
+	})
+	c.Assert(err, ErrorMatches, ".*has been modified.*block at offset.*")
+	err = backupstore.RestoreDeltaBlockBackupWithConfig(&backupstore.DeltaRestoreConfig{
+		BackupURL:        backup1,
+		Filename:         restore,
+		DetectLastBackup: true,
+	})
+	c.Assert(err, IsNil)
+	restored, err = ioutil.ReadFile(restore)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(restored, data), Equals, true)
+}
+
+func (s *TestSuite) waitForRestore(c *C, id string) *backupstore.RestoreStatus {
+	for i := 0; i < 100; i++ {
+		status, err := backupstore.GetRestoreStatus(id)
+		c.Assert(err, IsNil)
+		if status.State != backupstore.RestoreStatusInProgress {
+			return status
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	c.Fatalf("Restore %v didn't finish", id)
+	return nil
+}
+
+func (s *TestSuite) TestRestoreStatus(c *C) {
+	data := s.randomData(volumeContentSize)
+	volume, newConfig := s.newTestVolume(c, restoreStatusVolumeName, [][]byte{data})
+	h, err := backupstore.StartDeltaBlockBackup(context.Background(), newConfig(0))
+	c.Assert(err, IsNil)
+	result, err := h.Wait()
+	c.Assert(err, IsNil)
+	<-h.Done()
+	backup := result.BackupURL
+	c.Assert(result.BackupName, Equals, h.Name())
+	c.Assert(result.OperationID, Not(Equals), "")
+	c.Assert(result.OperationID, Equals, h.OperationID())
+	c.Assert(result.VolumeName, Equals, restoreStatusVolumeName)
+	c.Assert(result.SnapshotName, Equals, volume.Snapshots[0].Name)
+	c.Assert(result.Size, Equals, volumeContentSize)
+	c.Assert(result.TotalBlocks, Equals, volumeContentSize/int64(backupstore.DEFAULT_BLOCK_SIZE))
+	c.Assert(result.NewBlocks, Equals, result.TotalBlocks)
+	c.Assert(result.BytesTransferred > 0, Equals, true)
+	bURL, _ := volume.GetBackupStatus()
+	c.Assert(bURL, Equals, backup)
+
+	statusDir := filepath.Join(s.BasePath, "restore-status")
+	err = os.MkdirAll(statusDir, 0700)
+	c.Assert(err, IsNil)
+	backupstore.SetRestoreStatusDir(statusDir)
+	defer backupstore.SetRestoreStatusDir("")
+
+	restore := filepath.Join(s.BasePath, "restore-status.img")
+	id, err := backupstore.StartDeltaBlockRestore(&backupstore.DeltaRestoreConfig{
+		BackupURL: backup,
+		Filename:  restore,
+	})
+	c.Assert(err, IsNil)
+	status := s.waitForRestore(c, id)
+	c.Assert(status.State, Equals, backupstore.RestoreStatusCompleted)
+	c.Assert(status.OperationID, Equals, id)
+	c.Assert(status.Progress, Equals, 100)
+	c.Assert(status.BytesWritten, Equals, volumeContentSize)
+	restored, err := ioutil.ReadFile(restore)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(restored, data), Equals, true)
+
+	_, err = os.Stat(filepath.Join(statusDir, id+".json"))
+	c.Assert(err, IsNil)
+	err = backupstore.RemoveRestoreStatus(id)
+	c.Assert(err, IsNil)
+	_, err = backupstore.GetRestoreStatus(id)
+	c.Assert(err, ErrorMatches, "Cannot find restore.*")
+
+	// A failed restore reports its error
+	id, err = backupstore.StartDeltaBlockRestore(&backupstore.DeltaRestoreConfig{
+		BackupURL:   backup,
+		Filename:    filepath.Join(s.BasePath, "nonexistent", "restore.img"),
+		OperationID: "restore-status-op",
+	})
+	c.Assert(err, IsNil)
+	status = s.waitForRestore(c, id)
+	c.Assert(status.State, Equals, backupstore.RestoreStatusError)
+	c.Assert(status.OperationID, Equals, "restore-status-op")
+	c.Assert(status.Error, Not(Equals), "")
+
+	// The restores in progress before a restart were interrupted
+	err = ioutil.WriteFile(filepath.Join(statusDir, "restore-interrupted.json"),
+		[]byte(`{"ID":"restore-interrupted","State":"in_progress"}`), 0600)
+	c.Assert(err, IsNil)
+	status, err = backupstore.GetRestoreStatus("restore-interrupted")
+	c.Assert(err, IsNil)
+	c.Assert(status.State, Equals, backupstore.RestoreStatusError)
+}
+
+func (s *TestSuite) TestMetadataCache(c *C) {
+	volume, newConfig := s.newTestVolume(c, metadataCacheVolumeName, [][]byte{s.randomData(volumeContentSize)})
+	backupURL := s.createAndWaitForBackup(c, newConfig(0), volume)
+
+	backupstore.SetMetadataCacheTTL(time.Hour)
+	defer backupstore.SetMetadataCacheTTL(0)
+
+	_, err := backupstore.InspectBackup(backupURL)
+	c.Assert(err, IsNil)
+
+	// The config changed behind the cache isn't seen until the cache is
+	// purged
+	driver, err := backupstore.GetBackupStoreDriver(s.getDestURL())
+	c.Assert(err, IsNil)
+	backupName, err := backupstore.GetBackupFromBackupURL(backupURL)
+	c.Assert(err, IsNil)
+	cfgPath := filepath.Join(getVolumePath(metadataCacheVolumeName), "backups", "backup_"+backupName+".cfg")
+	rc, err := driver.Read(cfgPath)
+	c.Assert(err, IsNil)
+	cfg, err := ioutil.ReadAll(rc)
+	rc.Close()
+	c.Assert(err, IsNil)
+	err = driver.Write(cfgPath, bytes.NewReader([]byte("corrupted")))
+	c.Assert(err, IsNil)
+
+	_, err = backupstore.InspectBackup(backupURL)
+	c.Assert(err, IsNil)
+	backupstore.PurgeMetadataCache()
+	_, err = backupstore.InspectBackup(backupURL)
+	c.Assert(err, NotNil)
+
+	// The changes made through the backupstore are seen at once
+	err = driver.Write(cfgPath, bytes.NewReader(cfg))
+	c.Assert(err, IsNil)
+	_, err = backupstore.InspectBackup(backupURL)
+	c.Assert(err, IsNil)
+	err = backupstore.UpdateBackupLabels(backupURL, map[string]string{"cached": "false"})
+	c.Assert(err, IsNil)
+	info, err := backupstore.InspectBackup(backupURL)
+	c.Assert(err, IsNil)
+	c.Assert(info.Labels["cached"], Equals, "false")
+}
+
+func (s *TestSuite) TestVolumeLock(c *C) {
+	data := s.randomData(volumeContentSize)
+	volume, newConfig := s.newTestVolume(c, lockVolumeName, [][]byte{data})
+	volume.readGate = make(chan struct{})
+	config := newConfig(0)
+	config.BackupName = "backup-lock-test"
+	h, err := backupstore.StartDeltaBlockBackup(context.Background(), config)
+	c.Assert(err, IsNil)
+	c.Assert(h.Name(), Equals, config.BackupName)
+
+	// The other backups are queued, while the other operations fail until
+	// the backups are done
+	queuedConfig := *config
+	queuedConfig.BackupName = ""
+	queued, err := backupstore.StartDeltaBlockBackup(context.Background(), &queuedConfig)
+	c.Assert(err, IsNil)
+	status, err := backupstore.GetBackupStatus(queued.Name(), lockVolumeName, s.getDestURL())
+	c.Assert(err, IsNil)
+	c.Assert(status.State, Equals, backupstore.BackupStatePending)
+	c.Assert(status.QueuePosition, Equals, 1)
+	retriedQueued, err := backupstore.StartDeltaBlockBackup(context.Background(), config)
+	c.Assert(err, IsNil)
+	err = backupstore.DeleteBackupVolume(lockVolumeName, s.getDestURL())
+	c.Assert(err, Equals, backupstore.ErrOperationInProgress)
+
+	close(volume.readGate)
+	result, err := h.Wait()
+	c.Assert(err, IsNil)
+	queuedResult, err := queued.Wait()
+	c.Assert(err, IsNil)
+	c.Assert(queuedResult.BackupName, Equals, queued.Name())
+	retriedResult, err := retriedQueued.Wait()
+	c.Assert(err, IsNil)
+	c.Assert(retriedResult.BackupURL, Equals, result.BackupURL)
+	err = backupstore.DeleteDeltaBlockBackup(queuedResult.BackupURL)
+	c.Assert(err, IsNil)
+
+	// Retrying with the same name reports the existing backup
+	volume.ResetBackupStatus()
+	retried, err := backupstore.CreateDeltaBlockBackupAndWait(context.Background(), config)
+	c.Assert(err, IsNil)
+	c.Assert(retried.BackupURL, Equals, result.BackupURL)
+	c.Assert(retried.NewBlocks, Equals, int64(0))
+	c.Assert(retried.TotalBlocks, Equals, result.TotalBlocks)
+	bURL, bErr := volume.GetBackupStatus()
+	c.Assert(bErr, Equals, "")
+	c.Assert(bURL, Equals, result.BackupURL)
+	volumeInfo, err := backupstore.List(lockVolumeName, s.getDestURL(), false)
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo[lockVolumeName].Backups, HasLen, 1)
+
+	config.Snapshot = &volume.Snapshots[volume.addSnapshot(c, data)]
+	_, err = backupstore.CreateDeltaBlockBackupAndWait(context.Background(), config)
+	c.Assert(err, ErrorMatches, ".*already exists for snapshot.*")
+
+	err = backupstore.DeleteDeltaBlockBackup(result.BackupURL)
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestConcurrencyLimits(c *C) {
+	data := s.randomData(volumeContentSize)
+
+	backupstore.SetConcurrencyLimits(backupstore.ConcurrencyLimits{MaxBackups: 1})
+	defer backupstore.SetConcurrencyLimits(backupstore.ConcurrencyLimits{})
+
+	gate := make(chan struct{})
+	closeGate := func() {
+		select {
+		case <-gate:
+		default:
+			close(gate)
+		}
+	}
+	defer closeGate()
+	handles := []*backupstore.BackupHandle{}
+	for _, name := range []string{limitVolumeName, limitVolumeName + "Other"} {
+		volume, newConfig := s.newTestVolume(c, name, [][]byte{data})
+		volume.readGate = gate
+		h, err := backupstore.StartDeltaBlockBackup(context.Background(), newConfig(0))
+		c.Assert(err, IsNil)
+		handles = append(handles, h)
+	}
+
+	// Either backup may take the slot first, the other one waits for it
+	// to be done
+	time.Sleep(100 * time.Millisecond)
+	states := map[backupstore.BackupState]int{}
+	for i, name := range []string{limitVolumeName, limitVolumeName + "Other"} {
+		status, err := backupstore.GetBackupStatus(handles[i].Name(), name, s.getDestURL())
+		c.Assert(err, IsNil)
+		states[status.State]++
+	}
+	c.Assert(states, DeepEquals, map[backupstore.BackupState]int{
+		backupstore.BackupStateInProgress: 1, backupstore.BackupStatePending: 1})
+
+	// A restore waiting for a slot of the destination can be canceled
+	backupstore.SetConcurrencyLimits(backupstore.ConcurrencyLimits{MaxBackups: 1, MaxJobsPerDestination: 1})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := backupstore.RestoreDeltaBlockBackupWithContext(ctx, &backupstore.DeltaRestoreConfig{
+		BackupURL: s.getDestURL() + "?backup=" + handles[0].Name() + "&volume=" + limitVolumeName,
+		Filename:  filepath.Join(s.BasePath, "limit-restore"),
+	})
+	c.Assert(err, Equals, context.DeadlineExceeded)
+
+	closeGate()
+	for _, h := range handles {
+		_, err := h.Wait()
+		c.Assert(err, IsNil)
+	}
+}
+
+func (s *TestSuite) TestDriverTimeouts(c *C) {
+	unblock := make(chan struct{})
+	defer close(unblock)
+	err := backupstore.RegisterDriver("hang", func(destURL string) (backupstore.BackupStoreDriver, error) {
+		<-unblock
+		return nil, fmt.Errorf("unreachable %v", destURL)
+	})
+	c.Assert(err, IsNil)
+
+	timeouts := backupstore.GetDriverTimeouts()
+	c.Assert(timeouts, Equals, backupstore.DefaultDriverTimeouts)
+	defer backupstore.SetDriverTimeouts(timeouts)
+	backupstore.SetDriverTimeouts(backupstore.DriverTimeouts{Connect: 100 * time.Millisecond})
+
+	_, err = backupstore.GetBackupStoreDriver("hang://server/path")
+	c.Assert(err, FitsTypeOf, &backupstore.DriverTimeoutError{})
+	c.Assert(err, ErrorMatches, "Timed out after 100ms waiting for connection of hang://server/path.*")
+}
+
+func (s *TestSuite) TestBackupStoreClient(c *C) {
+	volume, newConfig := s.newTestVolume(c, clientVolumeName, [][]byte{s.randomData(volumeContentSize)})
+	snapName := volume.Snapshots[0].Name
+
+	client, err := backupstore.NewBackupStoreClient(s.getDestURL())
+	c.Assert(err, IsNil)
+	// The client fills in its destination
+	config := newConfig(0)
+	config.DestURL = ""
+	h, err := client.Backup(context.Background(), config)
+	c.Assert(err, IsNil)
+	result, err := h.Wait()
+	c.Assert(err, IsNil)
+	c.Assert(result.BackupURL, Equals, client.BackupURL(h.Name(), clientVolumeName))
+
+	volumeInfo, err := client.List(clientVolumeName, false)
+	c.Assert(err, IsNil)
+	c.Assert(volumeInfo[clientVolumeName].Backups, HasLen, 1)
+	info, err := client.InspectBackup(result.BackupURL)
+	c.Assert(err, IsNil)
+	c.Assert(info.SnapshotName, Equals, snapName)
+
+	restore := filepath.Join(s.BasePath, "restore-client")
+	err = client.Restore(context.Background(), &backupstore.DeltaRestoreConfig{
+		BackupURL: result.BackupURL,
+		Filename:  restore,
+	})
+	c.Assert(err, IsNil)
+	err = exec.Command("diff", snapName, restore).Run()
+	c.Assert(err, IsNil)
+
+	err = client.DeleteBackup(result.BackupURL)
+	c.Assert(err, IsNil)
+	volumeInfo, err = client.List("", true)
+	c.Assert(err, IsNil)
+	_, exists := volumeInfo[clientVolumeName]
+	c.Assert(exists, Equals, false)
+}
+
+func (s *TestSuite) TestDurabilityOptions(c *C) {
+	volume, newConfig := s.newTestVolume(c, durabilityVolumeName, [][]byte{s.randomData(volumeContentSize)})
+
+	fsops.SetDurabilityOptions(fsops.DurabilityOptions{SyncFiles: true, SyncDirs: true})
+	defer fsops.SetDurabilityOptions(fsops.DurabilityOptions{})
+
+	result, err := backupstore.CreateDeltaBlockBackupAndWait(context.Background(), newConfig(0))
+	c.Assert(err, IsNil)
+
+	restore := filepath.Join(s.BasePath, "restore-durability")
+	err = backupstore.RestoreDeltaBlockBackup(result.BackupURL, restore)
+	c.Assert(err, IsNil)
+	err = exec.Command("diff", volume.Snapshots[0].Name, restore).Run()
+	c.Assert(err, IsNil)
+
+	err = backupstore.DeleteDeltaBlockBackup(result.BackupURL)
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestForEachBackupBlock(c *C) {
+	blockSize := int64(backupstore.DEFAULT_BLOCK_SIZE)
+	data := s.randomData(volumeContentSize)
+	_, newConfig := s.newTestVolume(c, blockIterationVolumeName, [][]byte{data})
+
+	// The block lists saved in both formats are iterated the same way
+	backups := []string{}
+	for _, compact := range []bool{true, false} {
+		backupstore.SetCompactBlockList(compact)
+		result, err := backupstore.CreateDeltaBlockBackupAndWait(context.Background(), newConfig(0))
+		backupstore.SetCompactBlockList(false)
+		c.Assert(err, IsNil)
+		backups = append(backups, result.BackupURL)
+	}
+
+	for _, backup := range backups {
+		offsets := []int64{}
+		err := backupstore.ForEachBackupBlock(backup, func(blk backupstore.BlockMapping) error {
+			c.Assert(blk.BlockChecksum, Equals,
+				util.GetChecksum(data[blk.Offset:blk.Offset+blockSize]))
+			offsets = append(offsets, blk.Offset)
+			return nil
+		})
+		c.Assert(err, IsNil)
+		c.Assert(offsets, HasLen, int(volumeContentSize/blockSize))
+		for i, offset := range offsets {
+			c.Assert(offset, Equals, int64(i)*blockSize)
+		}
+
+		err = backupstore.ForEachBackupBlock(backup, func(blk backupstore.BlockMapping) error {
+			return fmt.Errorf("stopped at %v", blk.Offset)
+		})
+		c.Assert(err, ErrorMatches, "stopped at 0")
+	}
+
+	// Both backups reference the same blocks
+	referencing, err := backupstore.WhoReferencesBlock(blockIterationVolumeName, util.GetChecksum(data[:blockSize]), s.getDestURL())
+	c.Assert(err, IsNil)
+	sort.Strings(referencing)
+	expected := append([]string{}, backups...)
+	sort.Strings(expected)
+	c.Assert(referencing, DeepEquals, expected)
+	referencing, err = backupstore.WhoReferencesBlock(blockIterationVolumeName, util.GetChecksum([]byte("unknown")), s.getDestURL())
+	c.Assert(err, IsNil)
+	c.Assert(referencing, HasLen, 0)
+
+	// The compact block list is verified as well
+	driver, err := backupstore.GetBackupStoreDriver(s.getDestURL())
+	c.Assert(err, IsNil)
+	backupName, err := backupstore.GetBackupFromBackupURL(backups[0])
+	c.Assert(err, IsNil)
+	backupCfg := filepath.Join(getVolumePath(blockIterationVolumeName), "backups", "backup_"+backupName+".cfg")
+	rc, err := driver.Read(backupCfg)
+	c.Assert(err, IsNil)
+	cfg, err := ioutil.ReadAll(rc)
+	rc.Close()
+	c.Assert(err, IsNil)
+	err = driver.Write(backupCfg, bytes.NewReader([]byte(`{"Name":"`+backupName+`","BlocksFormat":1,"CompactBlocks":"AQ=="}`)))
+	c.Assert(err, IsNil)
+	err = backupstore.ForEachBackupBlock(backups[0], func(blk backupstore.BlockMapping) error {
+		return nil
+	})
+	c.Assert(backupstore.IsMetadataCorrupted(err), Equals, true)
+	err = driver.Write(backupCfg, bytes.NewReader(cfg))
+	c.Assert(err, IsNil)
+
+	for _, backup := range backups {
+		err = backupstore.DeleteDeltaBlockBackup(backup)
+		c.Assert(err, IsNil)
+	}
+}
+
+func (s *TestSuite) TestGCOptions(c *C) {
+	blockSize := int64(backupstore.DEFAULT_BLOCK_SIZE)
+	// The snapshots share no block, so all the blocks of the first backup
+	// are removed with it
+	volume, newConfig := s.newTestVolume(c, gcVolumeName, [][]byte{
+		s.randomData(volumeContentSize),
+		s.randomData(volumeContentSize),
+	})
+
+	backups := []string{}
+	for i := range volume.Snapshots {
+		result, err := backupstore.CreateDeltaBlockBackupAndWait(context.Background(), newConfig(i))
+		c.Assert(err, IsNil)
+		backups = append(backups, result.BackupURL)
+	}
+
+	c.Assert(backupstore.GetGCOptions(), DeepEquals, backupstore.DefaultGCOptions)
+	defer backupstore.SetGCOptions(backupstore.DefaultGCOptions)
+	progress := []backupstore.GCProgress{}
+	backupstore.SetGCOptions(backupstore.GCOptions{
+		BatchSize:   2,
+		Concurrency: 2,
+		ProgressFunc: func(p *backupstore.GCProgress) {
+			progress = append(progress, *p)
+		},
+	})
+	c.Assert(backupstore.GetGCOptions().Retries, Equals, 0)
+
+	err := backupstore.DeleteDeltaBlockBackupWithOperationID(backups[0], "gc-op")
+	c.Assert(err, IsNil)
+	blockCount := volumeContentSize / blockSize
+	c.Assert(progress, HasLen, int((blockCount+1)/2))
+	for i, p := range progress {
+		c.Assert(p.OperationID, Equals, "gc-op")
+		c.Assert(p.VolumeName, Equals, gcVolumeName)
+		c.Assert(p.BlocksTotal, Equals, blockCount)
+		if i > 0 {
+			c.Assert(p.BlocksRemoved > progress[i-1].BlocksRemoved, Equals, true)
+		}
+	}
+	c.Assert(progress[len(progress)-1].BlocksRemoved, Equals, blockCount)
+
+	// The blocks of the remaining backup are kept
+	restore := filepath.Join(s.BasePath, "restore-gc")
+	err = backupstore.RestoreDeltaBlockBackup(backups[1], restore)
+	c.Assert(err, IsNil)
+	err = exec.Command("diff", volume.Snapshots[1].Name, restore).Run()
+	c.Assert(err, IsNil)
+
+	err = backupstore.DeleteDeltaBlockBackup(backups[1])
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestStaleBlocks(c *C) {
+	blockSize := int64(backupstore.DEFAULT_BLOCK_SIZE)
+	data := s.randomData(volumeContentSize)
+	_, newConfig := s.newTestVolume(c, staleBlocksVolumeName, [][]byte{data})
+
+	// The empty block left by an interrupted upload is uploaded again
+	driver, err := backupstore.GetBackupStoreDriver(s.getDestURL())
+	c.Assert(err, IsNil)
+	err = driver.Write(getBlockFilePath(staleBlocksVolumeName, data[:blockSize]), bytes.NewReader(nil))
+	c.Assert(err, IsNil)
+
+	result, err := backupstore.CreateDeltaBlockBackupAndWait(context.Background(), newConfig(0))
+	c.Assert(err, IsNil)
+	c.Assert(result.NewBlocks, Equals, volumeContentSize/blockSize)
+	report, err := backupstore.AuditBackupBlocks(result.BackupURL, true)
+	c.Assert(err, IsNil)
+	c.Assert(report.Healthy(), Equals, true)
+
+	stale, err := backupstore.FindStaleBlocks(staleBlocksVolumeName, s.getDestURL())
+	c.Assert(err, IsNil)
+	c.Assert(stale.Empty(), Equals, true)
+
+	// Leave a temporary file, truncate a block of the backup and an unused
+	// block
+	tmpFile := getBlockFilePath(staleBlocksVolumeName, data[blockSize:2*blockSize]) + backupstore.TMP_SUFFIX
+	err = driver.Write(tmpFile, bytes.NewReader([]byte("partial")))
+	c.Assert(err, IsNil)
+	err = driver.Write(getBlockFilePath(staleBlocksVolumeName, data[2*blockSize:3*blockSize]),
+		bytes.NewReader([]byte("short")))
+	c.Assert(err, IsNil)
+	unused := []byte("unused block")
+	err = driver.Write(getBlockFilePath(staleBlocksVolumeName, unused), bytes.NewReader(unused[:6]))
+	c.Assert(err, IsNil)
+
+	// The size of the truncated block doesn't match the one recorded
+	report, err = backupstore.AuditBackupBlocks(result.BackupURL, false)
+	c.Assert(err, IsNil)
+	c.Assert(report.CorruptedBlocks, HasLen, 1)
+	c.Assert(report.CorruptedBlocks[0].Offset, Equals, 2*blockSize)
+
+	expectedShort := []string{util.GetChecksum(data[2*blockSize : 3*blockSize]), util.GetChecksum(unused)}
+	sort.Strings(expectedShort)
+	stale, err = backupstore.FindStaleBlocks(staleBlocksVolumeName, s.getDestURL())
+	c.Assert(err, IsNil)
+	c.Assert(stale.Purged, Equals, false)
+	c.Assert(stale.TempFiles, DeepEquals, []string{tmpFile})
+	sort.Strings(stale.ShortBlocks)
+	c.Assert(stale.ShortBlocks, DeepEquals, expectedShort)
+	c.Assert(driver.FileExists(tmpFile), Equals, true)
+
+	stale, err = backupstore.PurgeStaleBlocks(staleBlocksVolumeName, s.getDestURL())
+	c.Assert(err, IsNil)
+	c.Assert(stale.Purged, Equals, true)
+	c.Assert(stale.TempFiles, HasLen, 1)
+	c.Assert(stale.ShortBlocks, HasLen, 2)
+	c.Assert(driver.FileExists(tmpFile), Equals, false)
+	c.Assert(driver.FileExists(getBlockFilePath(staleBlocksVolumeName, unused)), Equals, false)
+
+	stale, err = backupstore.FindStaleBlocks(staleBlocksVolumeName, s.getDestURL())
+	c.Assert(err, IsNil)
+	c.Assert(stale.Empty(), Equals, true)
+	report, err = backupstore.AuditBackupBlocks(result.BackupURL, false)
+	c.Assert(err, IsNil)
+	c.Assert(report.CorruptedBlocks, HasLen, 0)
+	c.Assert(report.MissingBlocks, HasLen, 1)
+	c.Assert(report.MissingBlocks[0].Offset, Equals, 2*blockSize)
+
+	err = backupstore.DeleteBackupVolume(staleBlocksVolumeName, s.getDestURL())
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestRestoreToBlockDevice(c *C) {
+	blockSize := int64(backupstore.DEFAULT_BLOCK_SIZE)
+	// The second and fourth blocks are empty, so not backed up
+	data := s.randomData(volumeContentSize)
+	for _, offset := range []int64{blockSize, 3 * blockSize} {
+		copy(data[offset:offset+blockSize], make([]byte, blockSize))
+	}
+	// The volume is larger than its content
+	volume, newConfig := s.newTestVolume(c, blockDeviceVolumeName, [][]byte{data})
+	volume.v.Size = volumeSize
+	result, err := backupstore.CreateDeltaBlockBackupAndWait(context.Background(), newConfig(0))
+	c.Assert(err, IsNil)
+	c.Assert(result.TotalBlocks, Equals, volumeContentSize/blockSize-2)
+
+	expected := make([]byte, volumeSize)
+	copy(expected, data)
+	for _, discard := range []bool{false, true} {
+		// The device is full of the content of its previous use
+		image := filepath.Join(s.BasePath, fmt.Sprintf("blockdev-%v.img", discard))
+		err = ioutil.WriteFile(image, bytes.Repeat([]byte("x"), int(volumeSize)), 0600)
+		c.Assert(err, IsNil)
+		out, err := exec.Command("losetup", "-f", "--show", image).Output()
+		if err != nil {
+			c.Skip("Cannot set up a loop device: " + err.Error())
+		}
+		dev := strings.TrimSpace(string(out))
+		defer exec.Command("losetup", "-d", dev).Run()
+
+		// No marker is put along a device in /dev
+		err = backupstore.RestoreDeltaBlockBackupWithConfig(&backupstore.DeltaRestoreConfig{
+			BackupURL:        result.BackupURL,
+			Filename:         dev,
+			DetectLastBackup: true,
+		})
+		c.Assert(err, ErrorMatches, "Cannot detect the last backup restored to .* without a restore state file")
+
+		err = backupstore.RestoreDeltaBlockBackupWithConfig(&backupstore.DeltaRestoreConfig{
+			BackupURL:        result.BackupURL,
+			Filename:         dev,
+			RestoreStateFile: filepath.Join(s.BasePath, "blockdev.restore-state"),
+			DiscardUnmapped:  discard,
+		})
+		c.Assert(err, IsNil)
+		restored, err := ioutil.ReadFile(dev)
+		c.Assert(err, IsNil)
+		c.Assert(bytes.Equal(restored, expected), Equals, true)
+	}
+
+	err = backupstore.DeleteBackupVolume(blockDeviceVolumeName, s.getDestURL())
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestExportCatalog(c *C) {
+	volume, newConfig := s.newTestVolume(c, catalogVolumeName, s.changingData(2))
+	backups := []*backupstore.BackupResult{}
+	for i := range volume.Snapshots {
+		config := newConfig(i)
+		config.Labels = map[string]string{"index": strconv.Itoa(i), "app": "catalog"}
+		result, err := backupstore.CreateDeltaBlockBackupAndWait(context.Background(), config)
+		c.Assert(err, IsNil)
+		backups = append(backups, result)
+	}
+
+	catalog, err := backupstore.ExportCatalog(s.getDestURL())
+	c.Assert(err, IsNil)
+	var volumeInfo *backupstore.VolumeInfo
+	for i, v := range catalog.Volumes {
+		if i > 0 {
+			c.Assert(catalog.Volumes[i-1].Name < v.Name, Equals, true)
+		}
+		if v.Name == catalogVolumeName {
+			volumeInfo = v
+		}
+	}
+	c.Assert(volumeInfo, NotNil)
+	c.Assert(volumeInfo.Backups, HasLen, 2)
+	first := volumeInfo.Backups[backups[0].BackupURL]
+	second := volumeInfo.Backups[backups[1].BackupURL]
+	c.Assert(first, NotNil)
+	c.Assert(second, NotNil)
+	c.Assert(first.ParentBackupName, Equals, "")
+	c.Assert(second.ParentBackupName, Equals, backups[0].BackupName)
+	c.Assert(second.Labels["index"], Equals, "1")
+
+	buf := &bytes.Buffer{}
+	err = catalog.Write(buf, backupstore.CatalogFormatJSON)
+	c.Assert(err, IsNil)
+	exported := &backupstore.Catalog{}
+	err = json.Unmarshal(buf.Bytes(), exported)
+	c.Assert(err, IsNil)
+	c.Assert(exported.Volumes, HasLen, len(catalog.Volumes))
+	c.Assert(exported.ExportedAt, Equals, catalog.ExportedAt)
+	for _, v := range exported.Volumes {
+		if v.Name == catalogVolumeName {
+			c.Assert(v.Backups, DeepEquals, volumeInfo.Backups)
+		}
+	}
+
+	// The parents come first in the rows of a volume
+	buf.Reset()
+	err = catalog.Write(buf, backupstore.CatalogFormatCSV)
+	c.Assert(err, IsNil)
+	records, err := csv.NewReader(buf).ReadAll()
+	c.Assert(err, IsNil)
+	header := records[0]
+	c.Assert(header[0], Equals, "Volume")
+	rows := []map[string]string{}
+	for _, record := range records[1:] {
+		row := make(map[string]string)
+		for i, column := range header {
+			row[column] = record[i]
+		}
+		if row["Volume"] == catalogVolumeName {
+			rows = append(rows, row)
+		}
+	}
+	c.Assert(rows, HasLen, 2)
+	c.Assert(rows[0]["Backup"], Equals, backups[0].BackupName)
+	c.Assert(rows[0]["Labels"], Equals, "app=catalog;index=0")
+	c.Assert(rows[1]["Backup"], Equals, backups[1].BackupName)
+	c.Assert(rows[1]["ParentBackup"], Equals, backups[0].BackupName)
+	c.Assert(rows[1]["URL"], Equals, backups[1].BackupURL)
+	c.Assert(rows[1]["Size"], Equals, strconv.FormatInt(volumeContentSize, 10))
+
+	err = catalog.Write(buf, backupstore.CatalogFormat("xml"))
+	c.Assert(err, ErrorMatches, "Unsupported catalog format.*")
+
+	err = backupstore.DeleteBackupVolume(catalogVolumeName, s.getDestURL())
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestBackupHooks(c *C) {
+	volume, newBackupConfig := s.newTestVolume(c, hooksVolumeName, [][]byte{s.randomData(volumeContentSize)})
+	snapName := volume.Snapshots[0].Name
+
+	var lock sync.Mutex
+	events := []string{}
+	hook := func(event string, hookErr error) backupstore.BackupHook {
+		return func(ctx context.Context, info *backupstore.BackupHookInfo) error {
+			c.Check(info.VolumeName, Equals, hooksVolumeName)
+			c.Check(info.SnapshotName, Equals, snapName)
+			c.Check(info.OperationID, Not(Equals), "")
+			lock.Lock()
+			defer lock.Unlock()
+			if info.Error != nil {
+				event += " error"
+			}
+			events = append(events, event)
+			return hookErr
+		}
+	}
+	getEvents := func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		e := events
+		events = []string{}
+		return e
+	}
+	newConfig := func(pre, post backupstore.BackupHook) *backupstore.DeltaBackupConfig {
+		config := newBackupConfig(0)
+		config.PreBackup = pre
+		config.PostBackup = post
+		return config
+	}
+
+	result, err := backupstore.CreateDeltaBlockBackupAndWait(context.Background(),
+		newConfig(hook("pre", nil), hook("post", nil)))
+	c.Assert(err, IsNil)
+	c.Assert(getEvents(), DeepEquals, []string{"pre", "post"})
+	c.Assert(result.BackupURL, Not(Equals), "")
+
+	// PostBackup isn't called if PreBackup failed
+	_, err = backupstore.CreateDeltaBlockBackupAndWait(context.Background(),
+		newConfig(hook("pre", fmt.Errorf("freeze failed")), hook("post", nil)))
+	c.Assert(err, ErrorMatches, "PreBackup hook .* failed: freeze failed")
+	c.Assert(getEvents(), DeepEquals, []string{"pre"})
+
+	// The backup fails if PostBackup fails
+	_, err = backupstore.CreateDeltaBlockBackupAndWait(context.Background(),
+		newConfig(hook("pre", nil), hook("post", fmt.Errorf("thaw failed"))))
+	c.Assert(err, ErrorMatches, "PostBackup hook .* failed: thaw failed")
+	c.Assert(getEvents(), DeepEquals, []string{"pre", "post"})
+
+	// PostBackup is called with the error of a failed backup
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	h, err := backupstore.StartDeltaBlockBackup(ctx, newConfig(hook("pre", nil), hook("post", nil)))
+	c.Assert(err, IsNil)
+	_, err = h.Wait()
+	c.Assert(err, NotNil)
+	c.Assert(getEvents(), DeepEquals, []string{"pre", "post error"})
+
+	// The commands run by ExecBackupHook get the backup in environment
+	output := filepath.Join(s.BasePath, "hooks-output")
+	h, err = backupstore.StartDeltaBlockBackup(context.Background(), newConfig(nil,
+		backupstore.ExecBackupHook("sh", "-c", "echo $BACKUP_NAME $BACKUP_VOLUME > "+output)))
+	c.Assert(err, IsNil)
+	_, err = h.Wait()
+	c.Assert(err, IsNil)
+	content, err := ioutil.ReadFile(output)
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, h.Name()+" "+hooksVolumeName+"\n")
+
+	_, err = backupstore.CreateDeltaBlockBackupAndWait(context.Background(),
+		newConfig(backupstore.ExecBackupHook("false"), nil))
+	c.Assert(err, ErrorMatches, "PreBackup hook .* failed: Failed to execute: false .*")
+
+	err = backupstore.DeleteBackupVolume(hooksVolumeName, s.getDestURL())
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestGroupBackup(c *C) {
+	groupName := "BackupStoreTestGroup"
+	volumes := []*RawFileVolume{}
+	contents := make(map[string][]byte)
+	for _, volumeName := range []string{groupVolumeName, groupMemberVolumeName} {
+		contents[volumeName] = s.randomData(volumeContentSize)
+		volume, _ := s.newTestVolume(c, volumeName, [][]byte{contents[volumeName]})
+		volumes = append(volumes, volume)
+	}
+	newConfig := func(backupName string) *backupstore.GroupBackupConfig {
+		config := &backupstore.GroupBackupConfig{
+			GroupName:  groupName,
+			DestURL:    s.getDestURL(),
+			BackupName: backupName,
+			Labels:     map[string]string{"app": "db"},
+		}
+		for _, v := range volumes {
+			config.Members = append(config.Members, &backupstore.DeltaBackupConfig{
+				Volume:   &v.v,
+				Snapshot: &v.Snapshots[0],
+				DeltaOps: v,
+			})
+		}
+		return config
+	}
+
+	result, err := backupstore.CreateGroupBackup(context.Background(), newConfig(""))
+	c.Assert(err, IsNil)
+	c.Assert(result.Members, HasLen, 2)
+
+	groupBackup, err := backupstore.InspectGroupBackup(result.GroupBackupURL)
+	c.Assert(err, IsNil)
+	c.Assert(groupBackup.Name, Equals, result.Name)
+	c.Assert(groupBackup.GroupName, Equals, groupName)
+	c.Assert(groupBackup.Labels, DeepEquals, map[string]string{"app": "db"})
+	c.Assert(groupBackup.Members, HasLen, 2)
+	for i, m := range groupBackup.Members {
+		c.Assert(m.VolumeName, Equals, volumes[i].v.Name)
+		c.Assert(m.BackupName, Equals, result.Members[i].BackupName)
+		c.Assert(m.BackupURL, Equals, result.Members[i].BackupURL)
+	}
+
+	urls, err := backupstore.ListGroupBackups(groupName, s.getDestURL())
+	c.Assert(err, IsNil)
+	c.Assert(urls, DeepEquals, []string{result.GroupBackupURL})
+
+	_, err = backupstore.CreateGroupBackup(context.Background(), newConfig(result.Name))
+	c.Assert(err, ErrorMatches, "Group backup .* already exists")
+
+	// All the members are restored
+	filenames := make(map[string]string)
+	for _, v := range volumes {
+		filenames[v.v.Name] = filepath.Join(s.BasePath, "group-restore-"+v.v.Name)
+	}
+	err = backupstore.RestoreGroup(context.Background(), &backupstore.GroupRestoreConfig{
+		GroupBackupURL: result.GroupBackupURL,
+		Filenames:      filenames,
+	})
+	c.Assert(err, IsNil)
+	for volumeName, filename := range filenames {
+		restored, err := ioutil.ReadFile(filename)
+		c.Assert(err, IsNil)
+		c.Assert(bytes.Equal(restored, contents[volumeName]), Equals, true)
+	}
+
+	err = backupstore.RestoreGroup(context.Background(), &backupstore.GroupRestoreConfig{
+		GroupBackupURL: result.GroupBackupURL,
+		Filenames:      map[string]string{groupVolumeName: filenames[groupVolumeName]},
+	})
+	c.Assert(err, ErrorMatches, "Invalid 1 targets for the 2 members of group backup .*")
+
+	// No group backup is saved if a member fails
+	err = os.Remove(volumes[1].Snapshots[0].Name)
+	c.Assert(err, IsNil)
+	_, err = backupstore.CreateGroupBackup(context.Background(), newConfig("failed-group-backup"))
+	c.Assert(err, ErrorMatches, "Failed to back up volume "+groupMemberVolumeName+" of group "+groupName+": .*")
+	urls, err = backupstore.ListGroupBackups(groupName, s.getDestURL())
+	c.Assert(err, IsNil)
+	c.Assert(urls, DeepEquals, []string{result.GroupBackupURL})
+
+	err = backupstore.DeleteGroupBackup(result.GroupBackupURL)
+	c.Assert(err, IsNil)
+	_, err = backupstore.InspectGroupBackup(result.GroupBackupURL)
+	c.Assert(err, NotNil)
+	for _, m := range groupBackup.Members {
+		_, err = backupstore.InspectBackup(m.BackupURL)
+		c.Assert(err, NotNil)
+	}
+
+	// The volumes without backup left are already removed
+	for _, v := range volumes {
+		err = backupstore.DeleteBackupVolume(v.v.Name, s.getDestURL())
+		if err != nil {
+			c.Assert(err, ErrorMatches, "Volume .* doesn't exist in backupstore")
+		}
+	}
+}
+
+func (s *TestSuite) TestInventorySync(c *C) {
+	_, newConfig := s.newTestVolume(c, inventoryVolumeName, [][]byte{s.randomData(volumeContentSize)})
+	backup := func() *backupstore.BackupResult {
+		result, err := backupstore.CreateDeltaBlockBackupAndWait(context.Background(), newConfig(0))
+		c.Assert(err, IsNil)
+		return result
+	}
+
+	syncer, err := backupstore.NewInventorySyncer(s.getDestURL(), nil)
+	c.Assert(err, IsNil)
+	_, err = syncer.Sync()
+	c.Assert(err, IsNil)
+
+	first := backup()
+	delta, err := syncer.Sync()
+	c.Assert(err, IsNil)
+	c.Assert(delta.AddedVolumes, HasLen, 1)
+	c.Assert(delta.AddedVolumes[0].Name, Equals, inventoryVolumeName)
+	c.Assert(delta.AddedBackups, HasLen, 1)
+	c.Assert(delta.AddedBackups[0].URL, Equals, first.BackupURL)
+	c.Assert(delta.AddedBackups[0].VolumeName, Equals, inventoryVolumeName)
+
+	delta, err = syncer.Sync()
+	c.Assert(err, IsNil)
+	c.Assert(delta.Empty(), Equals, true)
+
+	// The syncer resumes from the saved state
+	second := backup()
+	state, err := json.Marshal(syncer.State())
+	c.Assert(err, IsNil)
+	savedState := &backupstore.InventoryState{}
+	err = json.Unmarshal(state, savedState)
+	c.Assert(err, IsNil)
+	syncer, err = backupstore.NewInventorySyncer(s.getDestURL(), savedState)
+	c.Assert(err, IsNil)
+	delta, err = syncer.Sync()
+	c.Assert(err, IsNil)
+	c.Assert(delta.AddedVolumes, HasLen, 0)
+	c.Assert(delta.UpdatedVolumes, HasLen, 1)
+	c.Assert(delta.AddedBackups, HasLen, 1)
+	c.Assert(delta.AddedBackups[0].URL, Equals, second.BackupURL)
+	c.Assert(delta.RemovedBackups, HasLen, 0)
+
+	err = backupstore.DeleteDeltaBlockBackup(first.BackupURL)
+	c.Assert(err, IsNil)
+	delta, err = syncer.Sync()
+	c.Assert(err, IsNil)
+	c.Assert(delta.AddedBackups, HasLen, 0)
+	c.Assert(delta.RemovedBackups, DeepEquals, []string{first.BackupURL})
+
+	err = backupstore.DeleteBackupVolume(inventoryVolumeName, s.getDestURL())
+	c.Assert(err, IsNil)
+	delta, err = syncer.Sync()
+	c.Assert(err, IsNil)
+	c.Assert(delta.RemovedVolumes, DeepEquals, []string{inventoryVolumeName})
+	c.Assert(delta.RemovedBackups, DeepEquals, []string{second.BackupURL})
+
+	_, err = backupstore.NewInventorySyncer(s.getDestURL(), &backupstore.InventoryState{URL: "vfs:///unknown"})
+	c.Assert(err, ErrorMatches, "Inventory state of .* cannot be used for .*")
+}
+
+func (s *TestSuite) TestBackupWithBaseBackup(c *C) {
+	blockSize := int64(backupstore.DEFAULT_BLOCK_SIZE)
+	base := make([]byte, volumeContentSize)
+	s.randomChange(base, 0, volumeContentSize)
+	// The last backup changes the first block, the branch the third one
+	last := append([]byte{}, base...)
+	s.randomChange(last, 0, blockSize)
+	branch := append([]byte{}, base...)
+	s.randomChange(branch, 2*blockSize, blockSize)
+
+	volume, newBackupConfig := s.newTestVolume(c, baseBackupVolumeName, [][]byte{base, last, branch, base})
+	newConfig := func(snapshot int, baseBackupName, baseSnapshotName string) *backupstore.DeltaBackupConfig {
+		config := newBackupConfig(snapshot)
+		config.BaseBackupName = baseBackupName
+		config.BaseSnapshotName = baseSnapshotName
+		return config
+	}
+
+	baseResult, err := backupstore.CreateDeltaBlockBackupAndWait(context.Background(), newConfig(0, "", ""))
+	c.Assert(err, IsNil)
+	_, err = backupstore.CreateDeltaBlockBackupAndWait(context.Background(), newConfig(1, "", ""))
+	c.Assert(err, IsNil)
+
+	// The branch only differs from the base backup by a block
+	result, err := backupstore.CreateDeltaBlockBackupAndWait(context.Background(),
+		newConfig(2, baseResult.BackupName, ""))
+	c.Assert(err, IsNil)
+	c.Assert(result.NewBlocks, Equals, int64(1))
+	c.Assert(result.TotalBlocks, Equals, volumeContentSize/blockSize)
+	info, err := backupstore.InspectBackup(result.BackupURL)
+	c.Assert(err, IsNil)
+	c.Assert(info.ParentBackupName, Equals, baseResult.BackupName)
+
+	restore := filepath.Join(s.BasePath, "base-restore")
+	err = backupstore.RestoreDeltaBlockBackup(result.BackupURL, restore)
+	c.Assert(err, IsNil)
+	restored, err := ioutil.ReadFile(restore)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(restored, branch), Equals, true)
+
+	// The base snapshot can be another snapshot with the same content
+	result, err = backupstore.CreateDeltaBlockBackupAndWait(context.Background(),
+		newConfig(2, baseResult.BackupName, volume.Snapshots[3].Name))
+	c.Assert(err, IsNil)
+	c.Assert(result.NewBlocks, Equals, int64(0))
+
+	_, err = backupstore.CreateDeltaBlockBackupAndWait(context.Background(),
+		newConfig(2, baseResult.BackupName, volume.Snapshots[3].Name+"-unknown"))
+	c.Assert(err, ErrorMatches, "Cannot find base snapshot .*")
+	_, err = backupstore.CreateDeltaBlockBackupAndWait(context.Background(),
+		newConfig(2, "backup-unknown", ""))
+	c.Assert(err, ErrorMatches, "Cannot load base backup backup-unknown of volume "+baseBackupVolumeName+": .*")
+	_, err = backupstore.CreateDeltaBlockBackupAndWait(context.Background(),
+		newConfig(2, "", volume.Snapshots[0].Name))
+	c.Assert(err, ErrorMatches, "Base snapshot .* specified without base backup")
+
+	err = backupstore.DeleteBackupVolume(baseBackupVolumeName, s.getDestURL())
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestBenchmarkBackupStore(c *C) {
+	report, err := backupstore.BenchmarkBackupStore(context.Background(), &backupstore.BenchConfig{
+		DestURL:     s.getDestURL(),
+		Objects:     10,
+		ObjectSize:  4096,
+		Concurrency: 3,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(report.Phases, HasLen, 3)
+	for i, phase := range []backupstore.BenchPhase{
+		backupstore.BenchPhaseWrite, backupstore.BenchPhaseRead, backupstore.BenchPhaseDelete,
+	} {
+		p := report.Phases[i]
+		c.Assert(p.Phase, Equals, phase)
+		c.Assert(p.Operations, Equals, 10)
+		c.Assert(p.Errors, Equals, 0)
+		c.Assert(p.LatencyP50 <= p.LatencyP99, Equals, true)
+		c.Assert(p.LatencyP99 <= p.LatencyMax, Equals, true)
+	}
+	c.Assert(report.Phases[0].Bytes, Equals, int64(10*4096))
+	c.Assert(report.Phases[1].Bytes, Equals, int64(10*4096))
+
+	// The objects are removed once done, the drivers may remove the empty
+	// directories as well
+	driver, err := backupstore.GetBackupStoreDriver(s.getDestURL())
+	c.Assert(err, IsNil)
+	entries, err := driver.List(filepath.Join(backupstore.GetBackupstoreBase(), backupstore.BENCH_DIRECTORY))
+	if err == nil {
+		c.Assert(entries, HasLen, 0)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = backupstore.BenchmarkBackupStore(ctx, &backupstore.BenchConfig{DestURL: s.getDestURL()})
+	c.Assert(err, Equals, context.Canceled)
+}
+
+func (s *TestSuite) TestRestoreWithExpansion(c *C) {
+	blockSize := int64(backupstore.DEFAULT_BLOCK_SIZE)
+	first := make([]byte, volumeContentSize)
+	s.randomChange(first, 0, volumeContentSize)
+	second := append([]byte{}, first...)
+	s.randomChange(second, 0, blockSize)
+
+	volume, newConfig := s.newTestVolume(c, expansionVolumeName, [][]byte{first, second})
+	backups := []string{}
+	for i := range volume.Snapshots {
+		result, err := backupstore.CreateDeltaBlockBackupAndWait(context.Background(), newConfig(i))
+		c.Assert(err, IsNil)
+		backups = append(backups, result.BackupURL)
+	}
+
+	targetSize := volumeContentSize + 3*blockSize
+	checkTarget := func(restore string, data []byte) {
+		restored, err := ioutil.ReadFile(restore)
+		c.Assert(err, IsNil)
+		c.Assert(int64(len(restored)), Equals, targetSize)
+		c.Assert(bytes.Equal(restored[:volumeContentSize], data), Equals, true)
+		c.Assert(bytes.Equal(restored[volumeContentSize:], make([]byte, targetSize-volumeContentSize)), Equals, true)
+	}
+
+	restore := filepath.Join(s.BasePath, "expansion-restore")
+	err := backupstore.RestoreDeltaBlockBackupWithConfig(&backupstore.DeltaRestoreConfig{
+		BackupURL:        backups[0],
+		Filename:         restore,
+		DetectLastBackup: true,
+		TargetSize:       targetSize,
+	})
+	c.Assert(err, IsNil)
+	checkTarget(restore, first)
+	state, err := backupstore.GetRestoreState(restore + backupstore.RESTORE_STATE_SUFFIX)
+	c.Assert(err, IsNil)
+	c.Assert(state.Size, Equals, targetSize)
+
+	// The incremental restore keeps the expansion
+	err = backupstore.RestoreDeltaBlockBackupWithConfig(&backupstore.DeltaRestoreConfig{
+		BackupURL:        backups[1],
+		Filename:         restore,
+		DetectLastBackup: true,
+	})
+	c.Assert(err, IsNil)
+	checkTarget(restore, second)
+
+	err = backupstore.RestoreDeltaBlockBackupWithConfig(&backupstore.DeltaRestoreConfig{
+		BackupURL:        backups[0],
+		Filename:         restore,
+		DetectLastBackup: true,
+		TargetSize:       volumeContentSize,
+	})
+	c.Assert(err, ErrorMatches, "Target .* was expanded to .*, it cannot be shrunk to .*")
+	checkTarget(restore, second)
+
+	err = backupstore.RestoreDeltaBlockBackupWithConfig(&backupstore.DeltaRestoreConfig{
+		BackupURL:  backups[0],
+		Filename:   filepath.Join(s.BasePath, "expansion-restore-small"),
+		TargetSize: volumeContentSize - blockSize,
+	})
+	c.Assert(err, ErrorMatches, "Invalid target size .* smaller than the size .* of volume "+expansionVolumeName)
+
+	err = backupstore.DeleteBackupVolume(expansionVolumeName, s.getDestURL())
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestFaultDriver(c *C) {
+	data := s.randomData(volumeContentSize)
+	_, newConfig := s.newTestVolume(c, faultVolumeName, [][]byte{data})
+
+	blocks := regexp.MustCompile(`\.blk$`)
+	driver, err := fault.Register("test-faults", s.getDestURL(), fault.Faults{
+		PathPattern: blocks,
+		FailWriteAt: 3,
+	})
+	c.Assert(err, IsNil)
+	defer fault.Unregister("test-faults")
+	destURL := driver.GetURL()
+	c.Assert(destURL, Equals, "fault://test-faults")
+
+	config := newConfig(0)
+	config.DestURL = destURL
+	_, err = backupstore.CreateDeltaBlockBackupAndWait(context.Background(), config)
+	c.Assert(err, ErrorMatches, ".*Injected failure of write of .*\\.blk.*")
+	c.Assert(driver.GetStats().FailedWrites, Equals, 1)
+
+	// Only the third write fails
+	result, err := backupstore.CreateDeltaBlockBackupAndWait(context.Background(), config)
+	c.Assert(err, IsNil)
+	c.Assert(strings.HasPrefix(result.BackupURL, destURL+"?"), Equals, true)
+
+	restore := filepath.Join(s.BasePath, "fault-restore")
+	checkRestore := func() {
+		restored, err := ioutil.ReadFile(restore)
+		c.Assert(err, IsNil)
+		c.Assert(bytes.Equal(restored, data), Equals, true)
+	}
+
+	// The partial and slow reads are handled
+	driver.SetFaults(fault.Faults{
+		PathPattern: blocks,
+		ReadDelay:   time.Millisecond,
+		MaxReadSize: 7,
+	})
+	err = backupstore.RestoreDeltaBlockBackup(result.BackupURL, restore)
+	c.Assert(err, IsNil)
+	checkRestore()
+	c.Assert(driver.GetStats().Reads, Equals, int(volumeContentSize/backupstore.DEFAULT_BLOCK_SIZE))
+
+	driver.SetFaults(fault.Faults{
+		PathPattern: blocks,
+		FailReadAt:  2,
+	})
+	err = backupstore.RestoreDeltaBlockBackup(result.BackupURL, restore)
+	c.Assert(err, NotNil)
+	c.Assert(driver.GetStats().FailedReads, Equals, 1)
+
+	// The corrupted blocks are zero-filled by a best-effort restore
+	driver.SetFaults(fault.Faults{
+		PathPattern:  blocks,
+		CorruptReads: true,
+	})
+	err = backupstore.RestoreDeltaBlockBackupWithConfig(&backupstore.DeltaRestoreConfig{
+		BackupURL:  result.BackupURL,
+		Filename:   restore,
+		BestEffort: true,
+	})
+	auditErr, ok := err.(*backupstore.BlockAuditError)
+	c.Assert(ok, Equals, true)
+	c.Assert(auditErr.Report.CorruptedBlocks, HasLen, int(volumeContentSize/backupstore.DEFAULT_BLOCK_SIZE))
+
+	driver.SetFaults(fault.Faults{})
+	err = backupstore.RestoreDeltaBlockBackup(result.BackupURL, restore)
+	c.Assert(err, IsNil)
+	checkRestore()
+
+	_, err = fault.Register("test-faults", s.getDestURL(), fault.Faults{})
+	c.Assert(err, ErrorMatches, "Fault driver test-faults has already been registered")
+	_, err = backupstore.GetBackupStoreDriver("fault://unknown")
+	c.Assert(err, ErrorMatches, "Cannot find fault driver unknown, it must be registered first")
+
+	err = backupstore.DeleteBackupVolume(faultVolumeName, destURL)
+	c.Assert(err, IsNil)
+}
@@ -0,0 +1,41 @@
+package util
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// The ioctls of linux/fs.h taking a range of a block device
+const (
+	BLKDISCARD = 0x1277
+	BLKZEROOUT = 0x127f
+)
+
+// IsBlockDevice returns true if the file info is of a block device
+func IsBlockDevice(info os.FileInfo) bool {
+	mode := info.Mode()
+	return mode&os.ModeDevice != 0 && mode&os.ModeCharDevice == 0
+}
+
+// DiscardRange discards length bytes at offset of the block device file,
+// so a thin-provisioned device or an SSD can release them. The range only
+// reads back as zeroes if the device guarantees it.
+func DiscardRange(file *os.File, offset, length int64) error {
+	return blockRangeIoctl(file, BLKDISCARD, offset, length)
+}
+
+// ZeroOutRange zeroes out length bytes at offset of the block device file,
+// without transferring the zeroes if the device supports it
+func ZeroOutRange(file *os.File, offset, length int64) error {
+	return blockRangeIoctl(file, BLKZEROOUT, offset, length)
+}
+
+func blockRangeIoctl(file *os.File, request uintptr, offset, length int64) error {
+	r := [2]uint64{uint64(offset), uint64(length)}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), request, uintptr(unsafe.Pointer(&r[0])))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
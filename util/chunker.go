@@ -0,0 +1,88 @@
+package util
+
+import (
+	"math/bits"
+)
+
+// gearTable maps the bytes to the random values of the gear hash. It must
+// never change, otherwise the chunks of the existing backups would no
+// longer be found.
+var gearTable [256]uint64
+
+func init() {
+	// splitmix64 with a fixed seed
+	seed := uint64(0x6261636b757073)
+	for i := range gearTable {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gearTable[i] = z ^ (z >> 31)
+	}
+}
+
+// Chunker splits data into content-defined chunks using FastCDC, so the
+// chunk boundaries follow the content when it shifts. The chunk sizes are
+// between a quarter and four times the average size.
+type Chunker struct {
+	minSize    int
+	normalSize int
+	maxSize    int
+
+	// maskS is used before normalSize and has more bits set than maskL,
+	// which makes the chunk sizes gather around normalSize
+	maskS uint64
+	maskL uint64
+}
+
+// NewChunker returns a chunker of the average chunk size avgSize, rounded
+// down to a power of two
+func NewChunker(avgSize int) *Chunker {
+	avgBits := uint(bits.Len(uint(avgSize)) - 1)
+	return &Chunker{
+		minSize:    avgSize / 4,
+		normalSize: avgSize,
+		maxSize:    avgSize * 4,
+		// The highest bits of the hash depend on the most bytes
+		maskS: ^uint64(0) << (64 - (avgBits + 1)),
+		maskL: ^uint64(0) << (64 - (avgBits - 1)),
+	}
+}
+
+// MaxSize returns the maximum size of a chunk
+func (c *Chunker) MaxSize() int {
+	return c.maxSize
+}
+
+// Cut returns the length of the first chunk of data. The data should hold
+// at least MaxSize bytes unless it's the end of the content, which is
+// returned as the last chunk if no boundary is found.
+func (c *Chunker) Cut(data []byte) int {
+	n := len(data)
+	if n <= c.minSize {
+		return n
+	}
+	if n > c.maxSize {
+		n = c.maxSize
+	}
+	normal := c.normalSize
+	if n < normal {
+		normal = n
+	}
+
+	fp := uint64(0)
+	i := c.minSize
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
@@ -0,0 +1,83 @@
+package util
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"sync"
+)
+
+var (
+	bufferPool = sync.Pool{
+		New: func() interface{} {
+			return new(bytes.Buffer)
+		},
+	}
+	bytesPool sync.Pool
+	// gzip writers are pooled per compression level
+	gzipWriterPools = map[int]*sync.Pool{
+		gzip.DefaultCompression: {},
+		gzip.BestSpeed:          {},
+	}
+	gzipReaderPool sync.Pool
+)
+
+// GetBuffer returns an empty buffer from the pool. It should be returned by
+// PutBuffer once no longer used.
+func GetBuffer() *bytes.Buffer {
+	b := bufferPool.Get().(*bytes.Buffer)
+	b.Reset()
+	return b
+}
+
+// PutBuffer returns a buffer got from GetBuffer to the pool
+func PutBuffer(b *bytes.Buffer) {
+	bufferPool.Put(b)
+}
+
+// GetBytes returns a byte slice of size from the pool, its content is not
+// zeroed. It should be returned by PutBytes once no longer used.
+func GetBytes(size int) []byte {
+	if v := bytesPool.Get(); v != nil {
+		b := *(v.(*[]byte))
+		if cap(b) >= size {
+			return b[:size]
+		}
+	}
+	return make([]byte, size)
+}
+
+// PutBytes returns a byte slice got from GetBytes to the pool
+func PutBytes(b []byte) {
+	bytesPool.Put(&b)
+}
+
+// getGzipWriter returns a writer of level, which should be one of the levels
+// in gzipWriterPools
+func getGzipWriter(b *bytes.Buffer, level int) (*gzip.Writer, error) {
+	if v := gzipWriterPools[level].Get(); v != nil {
+		w := v.(*gzip.Writer)
+		w.Reset(b)
+		return w, nil
+	}
+	return gzip.NewWriterLevel(b, level)
+}
+
+func putGzipWriter(w *gzip.Writer, level int) {
+	gzipWriterPools[level].Put(w)
+}
+
+func getGzipReader(src io.Reader) (*gzip.Reader, error) {
+	if v := gzipReaderPool.Get(); v != nil {
+		r := v.(*gzip.Reader)
+		if err := r.Reset(src); err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+	return gzip.NewReader(src)
+}
+
+func putGzipReader(r *gzip.Reader) {
+	gzipReaderPool.Put(r)
+}
@@ -7,7 +7,6 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os/exec"
 	"regexp"
 	"strings"
@@ -19,6 +18,14 @@ import (
 
 const (
 	PreservedChecksumLength = 64
+
+	// CompressionSampleCount and CompressionSampleSize define the windows
+	// taken from a block to estimate whether it's worth compressing
+	CompressionSampleCount = 8
+	CompressionSampleSize  = 8 * 1024
+	// CompressionMaxSampleRatio is the compressed/raw size ratio of the
+	// samples above which a block is treated as incompressible
+	CompressionMaxSampleRatio = 0.95
 )
 
 var (
@@ -51,19 +58,145 @@ func CompressData(data []byte) (io.ReadSeeker, error) {
 	return bytes.NewReader(b.Bytes()), nil
 }
 
-func DecompressAndVerify(src io.Reader, checksum string) (io.Reader, error) {
-	r, err := gzip.NewReader(src)
+// IsGzipData returns true if data starts with the gzip magic number
+func IsGzipData(data []byte) bool {
+	return len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b
+}
+
+// DecompressData decompresses data compressed by CompressData
+func DecompressData(data []byte) ([]byte, error) {
+	r, err := getGzipReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer putGzipReader(r)
+	var b bytes.Buffer
+	if _, err := b.ReadFrom(r); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// IsCompressible estimates whether compressing data would save space, by
+// compressing a few windows spread across it instead of the whole data
+func IsCompressible(data []byte) bool {
+	sample := data
+	if len(data) > CompressionSampleCount*CompressionSampleSize {
+		sample = GetBytes(CompressionSampleCount * CompressionSampleSize)[:0]
+		defer PutBytes(sample)
+		stride := len(data) / CompressionSampleCount
+		for i := 0; i < CompressionSampleCount; i++ {
+			start := i * stride
+			sample = append(sample, data[start:start+CompressionSampleSize]...)
+		}
+	}
+	if len(sample) == 0 {
+		return false
+	}
+
+	b := GetBuffer()
+	defer PutBuffer(b)
+	w, err := getGzipWriter(b, gzip.BestSpeed)
+	if err != nil {
+		return true
+	}
+	defer putGzipWriter(w, gzip.BestSpeed)
+	if _, err := w.Write(sample); err != nil {
+		w.Close()
+		return true
+	}
+	w.Close()
+	return float64(b.Len()) < float64(len(sample))*CompressionMaxSampleRatio
+}
+
+// CompressBlock compresses data unless it turns out to be incompressible, in
+// which case data is returned as is. The bool result tells whether the
+// returned content is compressed.
+func CompressBlock(data []byte) (*bytes.Reader, bool, error) {
+	var b bytes.Buffer
+	compressed, err := CompressBlockTo(&b, data)
+	if err != nil {
+		return nil, false, err
+	}
+	if !compressed {
+		return bytes.NewReader(data), false, nil
+	}
+	return bytes.NewReader(b.Bytes()), true, nil
+}
+
+// CompressBlockTo is CompressBlock writing the compressed content to dst,
+// which would be reset first. dst is left empty if data is incompressible,
+// and data should be used as is.
+func CompressBlockTo(dst *bytes.Buffer, data []byte) (bool, error) {
+	dst.Reset()
+	if !IsCompressible(data) {
+		return false, nil
+	}
+	w, err := getGzipWriter(dst, gzip.DefaultCompression)
 	if err != nil {
+		return false, err
+	}
+	defer putGzipWriter(w, gzip.DefaultCompression)
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return false, err
+	}
+	if err := w.Close(); err != nil {
+		return false, err
+	}
+	if dst.Len() >= len(data) {
+		dst.Reset()
+		return false, nil
+	}
+	return true, nil
+}
+
+func DecompressAndVerify(src io.Reader, checksum string) (io.Reader, error) {
+	var b bytes.Buffer
+	if err := DecompressAndVerifyTo(&b, src, checksum); err != nil {
 		return nil, err
 	}
-	block, err := ioutil.ReadAll(r)
+	return &b, nil
+}
+
+// DecompressAndVerifyTo decompresses src into dst, which would be reset
+// first, and verifies the checksum of the result
+func DecompressAndVerifyTo(dst *bytes.Buffer, src io.Reader, checksum string) error {
+	dst.Reset()
+	r, err := getGzipReader(src)
 	if err != nil {
+		return err
+	}
+	defer putGzipReader(r)
+	if _, err := dst.ReadFrom(r); err != nil {
+		return err
+	}
+	if GetChecksum(dst.Bytes()) != checksum {
+		return fmt.Errorf("checksum verification failed for block")
+	}
+	return nil
+}
+
+// ReadAndVerify reads uncompressed data from src and verifies its checksum
+func ReadAndVerify(src io.Reader, checksum string) (io.Reader, error) {
+	var b bytes.Buffer
+	if err := ReadAndVerifyTo(&b, src, checksum); err != nil {
 		return nil, err
 	}
-	if GetChecksum(block) != checksum {
-		return nil, fmt.Errorf("checksum verification failed for block")
+	return &b, nil
+}
+
+// ReadAndVerifyTo reads uncompressed data from src into dst, which would be
+// reset first, and verifies its checksum
+func ReadAndVerifyTo(dst *bytes.Buffer, src io.Reader, checksum string) error {
+	dst.Reset()
+	if _, err := dst.ReadFrom(src); err != nil {
+		return err
+	}
+	if GetChecksum(dst.Bytes()) != checksum {
+		return fmt.Errorf("checksum verification failed for block")
 	}
-	return bytes.NewReader(block), nil
+	return nil
 }
 
 func Now() string {
@@ -1,6 +1,9 @@
 package util
 
 import (
+	"bytes"
+	crand "crypto/rand"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"os/exec"
@@ -71,6 +74,179 @@ func (s *TestSuite) TestCompress(c *C) {
 	c.Assert(err, IsNil)
 
 	c.Assert(result, DeepEquals, data)
+
+	compressed.Seek(0, io.SeekStart)
+	raw, err := ioutil.ReadAll(compressed)
+	c.Assert(err, IsNil)
+	c.Assert(IsGzipData(raw), Equals, true)
+	c.Assert(IsGzipData(data), Equals, false)
+	result, err = DecompressData(raw)
+	c.Assert(err, IsNil)
+	c.Assert(result, DeepEquals, data)
+}
+
+func (s *TestSuite) TestCompressBlock(c *C) {
+	compressible := bytes.Repeat([]byte("Some random string"), 1<<16)
+	rs, compressed, err := CompressBlock(compressible)
+	c.Assert(err, IsNil)
+	c.Assert(compressed, Equals, true)
+
+	decompressed, err := DecompressAndVerify(rs, GetChecksum(compressible))
+	c.Assert(err, IsNil)
+	result, err := ioutil.ReadAll(decompressed)
+	c.Assert(err, IsNil)
+	c.Assert(result, DeepEquals, compressible)
+
+	incompressible := make([]byte, 1<<20)
+	_, err = crand.Read(incompressible)
+	c.Assert(err, IsNil)
+	rs, compressed, err = CompressBlock(incompressible)
+	c.Assert(err, IsNil)
+	c.Assert(compressed, Equals, false)
+
+	raw, err := ReadAndVerify(rs, GetChecksum(incompressible))
+	c.Assert(err, IsNil)
+	result, err = ioutil.ReadAll(raw)
+	c.Assert(err, IsNil)
+	c.Assert(result, DeepEquals, incompressible)
+
+	_, err = ReadAndVerify(bytes.NewReader(incompressible), GetChecksum(compressible))
+	c.Assert(err, ErrorMatches, "checksum verification failed.*")
+}
+
+type recordingWriter struct {
+	writes []int64
+	data   []byte
+}
+
+func (w *recordingWriter) WriteAt(p []byte, off int64) (int, error) {
+	w.writes = append(w.writes, off)
+	if end := int(off) + len(p); end > len(w.data) {
+		w.data = append(w.data, make([]byte, end-len(w.data))...)
+	}
+	copy(w.data[off:], p)
+	return len(p), nil
+}
+
+func (s *TestSuite) TestCoalescingWriter(c *C) {
+	w := &recordingWriter{}
+	cw := NewCoalescingWriter(w, 8)
+
+	// Contiguous writes are merged until the buffer is full
+	for _, off := range []int64{0, 2, 4, 6, 8} {
+		_, err := cw.WriteAt([]byte{byte(off), byte(off + 1)}, off)
+		c.Assert(err, IsNil)
+	}
+	// A gap flushes the pending data, a too large write passes through
+	_, err := cw.WriteAt([]byte{12, 13}, 12)
+	c.Assert(err, IsNil)
+	_, err = cw.WriteAt([]byte{14, 15, 16, 17, 18, 19, 20, 21, 22}, 14)
+	c.Assert(err, IsNil)
+	c.Assert(cw.Close(), IsNil)
+	c.Assert(cw.Close(), IsNil)
+
+	c.Assert(w.writes, DeepEquals, []int64{0, 8, 12, 14})
+	c.Assert(w.data[:10], DeepEquals, []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9})
+	c.Assert(w.data[12:], DeepEquals, []byte{12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22})
+}
+
+func chunkAll(chunker *Chunker, data []byte) []string {
+	checksums := []string{}
+	for len(data) != 0 {
+		n := chunker.Cut(data)
+		checksums = append(checksums, GetChecksum(data[:n]))
+		data = data[n:]
+	}
+	return checksums
+}
+
+func (s *TestSuite) TestChunker(c *C) {
+	avgSize := 4096
+	chunker := NewChunker(avgSize)
+	data := make([]byte, 256*avgSize)
+	_, err := crand.Read(data)
+	c.Assert(err, IsNil)
+
+	for rest := data; len(rest) > chunker.MaxSize(); {
+		n := chunker.Cut(rest)
+		c.Assert(n >= avgSize/4, Equals, true)
+		c.Assert(n <= chunker.MaxSize(), Equals, true)
+		rest = rest[n:]
+	}
+	chunks := chunkAll(chunker, data)
+	c.Assert(chunkAll(chunker, data), DeepEquals, chunks)
+
+	// Inserting data at the beginning only changes the first chunks
+	shifted := append([]byte("inserted"), data...)
+	existing := make(map[string]bool)
+	for _, checksum := range chunks {
+		existing[checksum] = true
+	}
+	changed := 0
+	for _, checksum := range chunkAll(chunker, shifted) {
+		if !existing[checksum] {
+			changed++
+		}
+	}
+	c.Assert(changed <= 2, Equals, true)
+}
+
+func benchmarkBlock() []byte {
+	chunk := make([]byte, 4096)
+	for i := range chunk {
+		chunk[i] = byte(firstLetters[rand.Intn(len(firstLetters))])
+	}
+	return bytes.Repeat(chunk, 512)
+}
+
+// Compare with BenchmarkCompressBlockPooled by running
+// go test -check.b -check.bmem
+func (s *TestSuite) BenchmarkCompressBlock(c *C) {
+	block := benchmarkBlock()
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		_, _, err := CompressBlock(block)
+		c.Assert(err, IsNil)
+	}
+}
+
+func (s *TestSuite) BenchmarkCompressBlockPooled(c *C) {
+	block := benchmarkBlock()
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		buf := GetBuffer()
+		_, err := CompressBlockTo(buf, block)
+		c.Assert(err, IsNil)
+		PutBuffer(buf)
+	}
+}
+
+func (s *TestSuite) BenchmarkDecompressAndVerify(c *C) {
+	block := benchmarkBlock()
+	checksum := GetChecksum(block)
+	compressed, _, err := CompressBlock(block)
+	c.Assert(err, IsNil)
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		compressed.Seek(0, io.SeekStart)
+		_, err := DecompressAndVerify(compressed, checksum)
+		c.Assert(err, IsNil)
+	}
+}
+
+func (s *TestSuite) BenchmarkDecompressAndVerifyPooled(c *C) {
+	block := benchmarkBlock()
+	checksum := GetChecksum(block)
+	compressed, _, err := CompressBlock(block)
+	c.Assert(err, IsNil)
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		compressed.Seek(0, io.SeekStart)
+		buf := GetBuffer()
+		err := DecompressAndVerifyTo(buf, compressed, checksum)
+		c.Assert(err, IsNil)
+		PutBuffer(buf)
+	}
 }
 
 func GenerateRandString() string {
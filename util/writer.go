@@ -0,0 +1,63 @@
+package util
+
+import (
+	"io"
+)
+
+// CoalescingWriter buffers the data written at contiguous offsets and writes
+// it to the underlying writer at once, turning many small writes into large
+// sequential ones. Flush must be called once done. It's not safe for
+// concurrent use.
+type CoalescingWriter struct {
+	w     io.WriterAt
+	buf   []byte
+	start int64
+}
+
+// NewCoalescingWriter returns a writer buffering up to maxSize bytes
+func NewCoalescingWriter(w io.WriterAt, maxSize int) *CoalescingWriter {
+	return &CoalescingWriter{
+		w:   w,
+		buf: GetBytes(maxSize)[:0],
+	}
+}
+
+func (c *CoalescingWriter) WriteAt(p []byte, off int64) (int, error) {
+	if len(c.buf) > 0 && (off != c.start+int64(len(c.buf)) || len(c.buf)+len(p) > cap(c.buf)) {
+		if err := c.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	if len(p) > cap(c.buf) {
+		return c.w.WriteAt(p, off)
+	}
+	if len(c.buf) == 0 {
+		c.start = off
+	}
+	c.buf = append(c.buf, p...)
+	return len(p), nil
+}
+
+// Flush writes the buffered data to the underlying writer
+func (c *CoalescingWriter) Flush() error {
+	if len(c.buf) == 0 {
+		return nil
+	}
+	if _, err := c.w.WriteAt(c.buf, c.start); err != nil {
+		return err
+	}
+	c.buf = c.buf[:0]
+	return nil
+}
+
+// Close flushes the buffered data and releases the buffer. The writer
+// cannot be used after that.
+func (c *CoalescingWriter) Close() error {
+	if c.buf == nil {
+		return nil
+	}
+	err := c.Flush()
+	PutBytes(c.buf)
+	c.buf = nil
+	return err
+}
@@ -0,0 +1,212 @@
+package backupstore
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"time"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+const (
+	PROBE_DIRECTORY = "probe"
+	PROBE_PREFIX    = "probe"
+)
+
+type ValidationCheck string
+
+const (
+	ValidationCheckURL = ValidationCheck("url")
+	// ValidationCheckAccess covers both the reachability and the
+	// credentials, since the drivers list the target when initialized
+	ValidationCheckAccess   = ValidationCheck("access")
+	ValidationCheckWrite    = ValidationCheck("write")
+	ValidationCheckRead     = ValidationCheck("read")
+	ValidationCheckDelete   = ValidationCheck("delete")
+	ValidationCheckCapacity = ValidationCheck("capacity")
+)
+
+type ValidationResult struct {
+	Check   ValidationCheck
+	Passed  bool
+	Skipped bool   `json:",omitempty"`
+	Message string `json:",omitempty"`
+	// Latency is the time taken by the operation of the check, if any
+	Latency time.Duration `json:",omitempty"`
+}
+
+// BackupTargetValidation is the diagnostics of ValidateBackupTarget
+type BackupTargetValidation struct {
+	URL     string
+	Kind    string `json:",omitempty"`
+	Results []ValidationResult
+	// AvailableBytes is -1 if the driver cannot determine the capacity
+	AvailableBytes int64 `json:",string"`
+}
+
+// Passed returns true if none of the checks failed
+func (v *BackupTargetValidation) Passed() bool {
+	for _, r := range v.Results {
+		if !r.Passed && !r.Skipped {
+			return false
+		}
+	}
+	return true
+}
+
+func (v *BackupTargetValidation) pass(check ValidationCheck, format string, a ...interface{}) {
+	v.Results = append(v.Results, ValidationResult{
+		Check:   check,
+		Passed:  true,
+		Message: fmt.Sprintf(format, a...),
+	})
+}
+
+func (v *BackupTargetValidation) fail(check ValidationCheck, err error) {
+	v.Results = append(v.Results, ValidationResult{
+		Check:   check,
+		Message: err.Error(),
+	})
+}
+
+// timed records the latency of the last check, started at start
+func (v *BackupTargetValidation) timed(start time.Time) {
+	v.Results[len(v.Results)-1].Latency = time.Since(start)
+}
+
+func (v *BackupTargetValidation) skip(check ValidationCheck, reason string) {
+	v.Results = append(v.Results, ValidationResult{
+		Check:   check,
+		Skipped: true,
+		Message: reason,
+	})
+}
+
+// CapacityReporter can optionally be implemented by the drivers able to
+// tell the space available in the backupstore
+type CapacityReporter interface {
+	AvailableCapacity() (int64, error)
+}
+
+// ValidateBackupTarget checks that destURL can be used as a backupstore,
+// by writing, reading back and removing a probe object. The failures are
+// reported in the result, the checks depending on a failed one are skipped.
+func ValidateBackupTarget(destURL string) *BackupTargetValidation {
+	v := &BackupTargetValidation{
+		URL:            destURL,
+		AvailableBytes: -1,
+	}
+	checks := []ValidationCheck{
+		ValidationCheckAccess,
+		ValidationCheckWrite,
+		ValidationCheckRead,
+		ValidationCheckDelete,
+		ValidationCheckCapacity,
+	}
+
+	u, err := url.Parse(destURL)
+	if err == nil && u.Scheme == "" {
+		err = fmt.Errorf("Missing scheme in destination URL %v", destURL)
+	}
+	if err != nil {
+		v.fail(ValidationCheckURL, err)
+		skipChecks(v, checks, "invalid URL")
+		return v
+	}
+	v.Kind = u.Scheme
+	if _, exists := initializers[u.Scheme]; !exists {
+		v.fail(ValidationCheckURL, fmt.Errorf("Driver %v is not supported", u.Scheme))
+		skipChecks(v, checks, "invalid URL")
+		return v
+	}
+	v.pass(ValidationCheckURL, "driver %v", u.Scheme)
+
+	start := time.Now()
+	driver, err := GetBackupStoreDriver(destURL)
+	if err != nil {
+		v.fail(ValidationCheckAccess, err)
+		v.timed(start)
+		skipChecks(v, checks[1:], "backupstore is not accessible")
+		return v
+	}
+	v.pass(ValidationCheckAccess, "connected to %v", driver.GetURL())
+	v.timed(start)
+
+	validateProbe(v, driver)
+	validateCapacity(v, driver)
+	return v
+}
+
+func skipChecks(v *BackupTargetValidation, checks []ValidationCheck, reason string) {
+	for _, check := range checks {
+		v.skip(check, reason)
+	}
+}
+
+func validateProbe(v *BackupTargetValidation, driver BackupStoreDriver) {
+	name := util.GenerateName(PROBE_PREFIX)
+	probeFile := filepath.Join(backupstoreBase, PROBE_DIRECTORY, name)
+	content := []byte(name)
+
+	start := time.Now()
+	if err := driver.Write(probeFile, bytes.NewReader(content)); err != nil {
+		v.fail(ValidationCheckWrite, err)
+		v.timed(start)
+		skipChecks(v, []ValidationCheck{ValidationCheckRead, ValidationCheckDelete}, "probe object cannot be written")
+		return
+	}
+	v.pass(ValidationCheckWrite, "wrote %v", probeFile)
+	v.timed(start)
+
+	start = time.Now()
+	if err := readProbe(driver, probeFile, content); err != nil {
+		v.fail(ValidationCheckRead, err)
+	} else {
+		v.pass(ValidationCheckRead, "read %v", probeFile)
+	}
+	v.timed(start)
+
+	start = time.Now()
+	if err := driver.Remove(probeFile); err != nil {
+		v.fail(ValidationCheckDelete, err)
+	} else if driver.FileExists(probeFile) {
+		v.fail(ValidationCheckDelete, fmt.Errorf("Probe object %v still exists after removal", probeFile))
+	} else {
+		v.pass(ValidationCheckDelete, "removed %v", probeFile)
+	}
+	v.timed(start)
+}
+
+func readProbe(driver BackupStoreDriver, probeFile string, content []byte) error {
+	rc, err := driver.Read(probeFile)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(data, content) {
+		return fmt.Errorf("Content of probe object %v doesn't match what was written", probeFile)
+	}
+	return nil
+}
+
+func validateCapacity(v *BackupTargetValidation, driver BackupStoreDriver) {
+	reporter, ok := unwrapDriver(driver).(CapacityReporter)
+	if !ok {
+		v.skip(ValidationCheckCapacity, fmt.Sprintf("capacity cannot be determined for %v", driver.Kind()))
+		return
+	}
+	available, err := reporter.AvailableCapacity()
+	if err != nil {
+		v.fail(ValidationCheckCapacity, err)
+		return
+	}
+	v.AvailableBytes = available
+	v.pass(ValidationCheckCapacity, "%v bytes available", available)
+}
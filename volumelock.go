@@ -0,0 +1,45 @@
+package backupstore
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ErrOperationInProgress is returned when an operation modifying a backup
+// volume is started while another one is running on the same volume in this
+// process
+var ErrOperationInProgress = fmt.Errorf("Another operation is in progress on the backup volume")
+
+var (
+	volumeLocksLock sync.Mutex
+	// volumeLocks maps the locked volumes to the operation holding them
+	volumeLocks = make(map[string]string)
+)
+
+func getVolumeLockKey(driver BackupStoreDriver, volumeName string) string {
+	return driver.GetURL() + "|" + volumeName
+}
+
+// lockVolume marks volumeName of the backupstore as being modified by
+// operation, and returns the function to unlock it. It doesn't wait if the
+// volume is already locked, but fails with ErrOperationInProgress.
+func lockVolume(driver BackupStoreDriver, volumeName, operation string) (func(), error) {
+	key := getVolumeLockKey(driver, volumeName)
+
+	volumeLocksLock.Lock()
+	defer volumeLocksLock.Unlock()
+	if holder, exists := volumeLocks[key]; exists {
+		log.Debugf("Cannot %v on volume %v while %v is in progress", operation, volumeName, holder)
+		return nil, ErrOperationInProgress
+	}
+	volumeLocks[key] = operation
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			volumeLocksLock.Lock()
+			delete(volumeLocks, key)
+			volumeLocksLock.Unlock()
+		})
+	}, nil
+}